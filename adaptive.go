@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A levelController adjusts compressionLevel during the conversion.
+type levelController interface {
+	// update is called before reading each blob with the number of
+	// input bytes, that have been processed so far.
+	update(done int64)
+}
+
+// levelCheckInterval is the minimum time between two adjustments of the
+// compression level, so that the throughput at a level can be measured.
+const levelCheckInterval = 10 * time.Second
+
+// deadlineController adjusts compressionLevel, so that the conversion
+// finishes before the deadline. The level is lowered, if the throughput
+// since the last adjustment is too low to finish in time, and raised,
+// if there is plenty of time left.
+type deadlineController struct {
+	end   time.Time
+	total int64 // The size of the input.
+
+	lastCheck time.Time
+	lastDone  int64
+}
+
+func newDeadlineController(deadline time.Duration, total int64) *deadlineController {
+	now := time.Now()
+	return &deadlineController{end: now.Add(deadline), total: total, lastCheck: now}
+}
+
+func (c *deadlineController) update(done int64) {
+	now := time.Now()
+	elapsed := now.Sub(c.lastCheck)
+	if elapsed < levelCheckInterval || done <= c.lastDone {
+		return
+	}
+	rate := float64(done-c.lastDone) / elapsed.Seconds()
+	needed := time.Duration(float64(c.total-done) / rate * float64(time.Second))
+	left := c.end.Sub(now)
+	c.lastCheck, c.lastDone = now, done
+	switch {
+	case needed > left*9/10 && compressionLevel > zstd.SpeedFastest:
+		compressionLevel--
+		slog.Info("Lowering the compression level to meet the deadline", "level", compressionLevel)
+	case needed < left*2/5 && compressionLevel < zstd.SpeedBestCompression:
+		compressionLevel++
+		slog.Info("Raising the compression level, since the deadline leaves time", "level", compressionLevel)
+	}
+}
+
+// sizeController adjusts compressionLevel, so that the output ends up
+// close to, but not larger than, the target size. The level is raised,
+// if the output written since the last adjustment is projected to
+// exceed the target, and lowered, if it would leave plenty of room.
+type sizeController struct {
+	target int64
+	total  int64 // The size of the input.
+
+	lastDone, lastWritten int64
+}
+
+func newSizeController(target, total int64) *sizeController {
+	return &sizeController{target: target, total: total}
+}
+
+func (c *sizeController) update(done int64) {
+	// Adjust at most once per percent of the input, so that the ratio
+	// at a level can be measured.
+	if done-c.lastDone < c.total/100 || done <= c.lastDone {
+		return
+	}
+	ratio := float64(bytesWritten-c.lastWritten) / float64(done-c.lastDone)
+	projected := bytesWritten + int64(ratio*float64(c.total-done))
+	c.lastDone, c.lastWritten = done, bytesWritten
+	switch {
+	case projected > c.target && compressionLevel < zstd.SpeedBestCompression:
+		compressionLevel++
+		slog.Info("Raising the compression level to meet the target size", "level", compressionLevel)
+	case projected < c.target*97/100 && compressionLevel > zstd.SpeedFastest:
+		compressionLevel--
+		slog.Info("Lowering the compression level, since the target size leaves room", "level", compressionLevel)
+	}
+}
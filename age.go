@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// ageCommand is the age binary, see https://age-encryption.org, that
+// encrypts the output and decrypts inputs.
+const ageCommand = "age"
+
+// encryptRecipients are the age recipients, that the output is
+// encrypted to, if there are any.
+var encryptRecipients []string
+
+// identityFile is the age identity, that decrypts encrypted inputs.
+var identityFile string
+
+// ageEncrypter pipes the output through age, which writes it to the
+// output file.
+type ageEncrypter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// startEncryption starts age, which encrypts the data written to the
+// returned ageEncrypter for encryptRecipients and writes it to out.
+func startEncryption(out *os.File) (*ageEncrypter, error) {
+	args := []string{"--encrypt"}
+	for _, recipient := range encryptRecipients {
+		args = append(args, "--recipient", recipient)
+	}
+	cmd := exec.Command(ageCommand, args...)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &ageEncrypter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (e *ageEncrypter) Write(p []byte) (int, error) {
+	n, err := e.stdin.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("age failed: %v", err)
+	}
+	return n, nil
+}
+
+// close ends the input of age and waits until it has written the
+// encrypted output.
+func (e *ageEncrypter) close() error {
+	if err := e.stdin.Close(); err != nil {
+		return err
+	}
+	if err := e.cmd.Wait(); err != nil {
+		return fmt.Errorf("age failed: %v", err)
+	}
+	return nil
+}
+
+// ageDecrypter reads the output of age decrypting f with identityFile.
+type ageDecrypter struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+}
+
+func startDecryption(f *os.File) (*ageDecrypter, error) {
+	if identityFile == "" {
+		return nil, fmt.Errorf("the input is encrypted with age; give an identity file with -identity")
+	}
+	cmd := exec.Command(ageCommand, "--decrypt", "--identity", identityFile)
+	cmd.Stdin = f
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &ageDecrypter{cmd: cmd, stdout: stdout}, nil
+}
+
+// Read reads the decrypted data. Once age exits, the error tells whether
+// it succeeded, since a failed decryption must not look like the end of
+// the file.
+func (d *ageDecrypter) Read(p []byte) (int, error) {
+	n, err := d.stdout.Read(p)
+	if err == io.EOF {
+		if waitErr := d.cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("age failed: %v", waitErr)
+		}
+	}
+	return n, err
+}
+
+// Close stops age, if it is still running.
+func (d *ageDecrypter) Close() error {
+	if d.cmd.ProcessState == nil {
+		d.cmd.Process.Kill()
+		d.cmd.Wait()
+	}
+	return nil
+}
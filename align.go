@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxAlignment is the largest -align. The padding is stored in the
+// BlobHeader, which must stay below 64KiB, and can be up to twice the
+// alignment.
+const maxAlignment = 16 * 1024
+
+// alignment makes every blob start at a multiple of this many bytes, if
+// it is not zero.
+var alignment byteSize
+
+// padHeader sets the indexdata of header to padding, so that a frame
+// with header and a blob of blobSize bytes, starting at offset, ends at
+// a multiple of alignment. The specification allows arbitrary indexdata,
+// so readers skip the padding along with the rest of the header.
+func padHeader(header *pbfproto.BlobHeader, blobSize int, offset int64) {
+	header.Indexdata = nil
+	end := offset + 4 + int64(proto.Size(header)) + int64(blobSize)
+	gap := (int64(alignment) - end%int64(alignment)) % int64(alignment)
+	if gap == 0 {
+		return
+	}
+	for ; ; gap += int64(alignment) {
+		// The padding takes a byte for the field tag, the varint length
+		// and the data itself. Not every gap can be filled exactly,
+		// because the length of the varint grows with the data.
+		for n := gap - 2; n >= 0 && n >= gap-1-binary.MaxVarintLen32; n-- {
+			if 1+int64(uvarintSize(uint64(n)))+n == gap {
+				header.Indexdata = make([]byte, n)
+				return
+			}
+		}
+	}
+}
+
+func uvarintSize(x uint64) int {
+	return len(binary.AppendUvarint(nil, x))
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A .zpbf archive holds the uncompressed data of the blobs of a PBF file
+// in the seekable zstd format: independent zstd frames of several blobs
+// each, followed by a seek table in a skippable frame, which lists the
+// sizes of the frames. So zstd decompresses an archive to the
+// concatenated data of its blobs, while zstd-pbf can still start
+// reading at any frame.
+//
+// Between the last frame and the seek table is another skippable frame
+// with the index of the blobs. It starts with zpbfVersion and then has
+// for each blob the length of its type as a uvarint, the type, the length
+// of its indexdata as a uvarint, the indexdata and the length of its
+// uncompressed data as a uvarint.
+const (
+	skippableMagic       = 0x184D2A50
+	zpbfIndexMagic       = skippableMagic + 0xA
+	seekTableMagic       = skippableMagic + 0xE
+	seekTableFooterMagic = 0x8F92EAB1
+	seekTableFooterSize  = 9
+	zpbfVersion          = 1
+)
+
+// defaultArchiveFrameSize is the default amount of uncompressed data per
+// frame of an archive. Larger frames compress better, but must be read
+// as a whole to get to a blob within them.
+const defaultArchiveFrameSize = 8 << 20
+
+// archiveEntry is a blob of an archive.
+type archiveEntry struct {
+	blobType  string
+	indexdata []byte
+	rawSize   int
+}
+
+// seekTableEntry is a frame of an archive.
+type seekTableEntry struct {
+	compressedSize, rawSize uint32
+}
+
+func runArchive(args []string) {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	frameSize := byteSize(defaultArchiveFrameSize)
+	flags.Var(&frameSize, "frame-size", "start a new zstd frame after this `size` of uncompressed data, e.g. 64M")
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf archive [-frame-size SIZE] [-yes] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Write the uncompressed data of the blobs of IN_FILE to the .zpbf\n"+
+			"archive OUT_FILE, which compresses better than a PBF file, since zstd\n"+
+			"frames span many blobs. The PBF file can be restored with unarchive.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 2 {
+		fatalCode(exitUsage, "Give exactly two arguments: The input PBF file and the output archive")
+	}
+	if frameSize <= 0 || frameSize > zstd.MaxWindowSize {
+		fatalCode(exitUsage, "The frame size must be positive and must not exceed 512MiB")
+	}
+	convertFile(flags.Arg(0), flags.Arg(1), func(in io.ReadSeeker, out io.Writer) error {
+		blobs, frames, err := writeArchive(in, out, int(frameSize))
+		if err == nil {
+			slog.Info("Wrote archive", "blobs", blobs, "frames", frames)
+		}
+		return err
+	})
+}
+
+func runUnarchive(args []string) {
+	flags := flag.NewFlagSet("unarchive", flag.ExitOnError)
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf unarchive [-yes] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Restore the PBF file of the .zpbf archive IN_FILE, that was written by\n"+
+			"archive. Every blob is compressed with zstd again.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 2 {
+		fatalCode(exitUsage, "Give exactly two arguments: The input archive and the output PBF file")
+	}
+	convertFile(flags.Arg(0), flags.Arg(1), func(in io.ReadSeeker, out io.Writer) error {
+		blobs, err := readArchive(in, out)
+		if err == nil {
+			slog.Info("Restored blobs", "blobs", blobs)
+		}
+		return err
+	})
+}
+
+// writeArchive writes the blobs of in to out as an archive, whose frames
+// hold at least frameSize bytes of uncompressed data, unless they are the
+// last. A footer is dropped, since it would not match the restored file.
+func writeArchive(in io.Reader, out io.Writer, frameSize int) (blobs, frames int, err error) {
+	window := zstd.MinWindowSize
+	for window < frameSize {
+		window <<= 1
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderCRC(zstdChecksum), zstd.WithWindowSize(window))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer enc.Close()
+	var frame, compressed []byte
+	var seekTable []seekTableEntry
+	flush := func() error {
+		if len(frame) == 0 {
+			return nil
+		}
+		compressed = enc.EncodeAll(frame, compressed[:0])
+		if _, err := out.Write(compressed); err != nil {
+			return err
+		}
+		seekTable = append(seekTable, seekTableEntry{uint32(len(compressed)), uint32(len(frame))})
+		frame = frame[:0]
+		return nil
+	}
+	index := []byte{zpbfVersion}
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return blobs, len(seekTable), fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		blob, err := readBlob(header, in)
+		if err != nil {
+			return blobs, len(seekTable), fmt.Errorf("could not read Blob: %v", err)
+		}
+		if header.GetType() == footerBlobType {
+			continue
+		}
+		n := len(frame)
+		if frame, err = pbf.AppendDecompressed(frame, blob); err != nil {
+			return blobs, len(seekTable), err
+		}
+		blob.ReturnToVTPool()
+		index = binary.AppendUvarint(index, uint64(len(header.GetType())))
+		index = append(index, header.GetType()...)
+		index = binary.AppendUvarint(index, uint64(len(header.GetIndexdata())))
+		index = append(index, header.GetIndexdata()...)
+		index = binary.AppendUvarint(index, uint64(len(frame)-n))
+		blobs++
+		if len(frame) >= frameSize {
+			if err = flush(); err != nil {
+				return blobs, len(seekTable), err
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return blobs, len(seekTable), err
+	}
+	if err = writeSkippableFrame(out, zpbfIndexMagic, index); err != nil {
+		return blobs, len(seekTable), err
+	}
+	var table []byte
+	for _, e := range seekTable {
+		table = binary.LittleEndian.AppendUint32(table, e.compressedSize)
+		table = binary.LittleEndian.AppendUint32(table, e.rawSize)
+	}
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(seekTable)))
+	table = append(table, 0) // The descriptor: no checksums in the table.
+	table = binary.LittleEndian.AppendUint32(table, seekTableFooterMagic)
+	return blobs, len(seekTable), writeSkippableFrame(out, seekTableMagic, table)
+}
+
+func writeSkippableFrame(out io.Writer, magic uint32, data []byte) error {
+	frame := binary.LittleEndian.AppendUint32(nil, magic)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(data)))
+	_, err := out.Write(append(frame, data...))
+	return err
+}
+
+// readSkippableFrame reads the data of the skippable frame with magic at
+// offset of in.
+func readSkippableFrame(in io.ReadSeeker, offset int64, magic uint32) ([]byte, error) {
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header) != magic {
+		return nil, fmt.Errorf("missing skippable frame at offset %d", offset)
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+	_, err := io.ReadFull(in, data)
+	return data, err
+}
+
+// readSeekTable returns the frames listed in the seek table of in.
+func readSeekTable(in io.ReadSeeker) ([]seekTableEntry, error) {
+	size, err := in.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	footer := make([]byte, seekTableFooterSize)
+	if size < 8+seekTableFooterSize {
+		return nil, fmt.Errorf("not an archive")
+	}
+	if _, err = in.Seek(size-seekTableFooterSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(in, footer); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekTableFooterMagic {
+		return nil, fmt.Errorf("not an archive")
+	}
+	entrySize := int64(8)
+	if footer[4]&0x80 != 0 {
+		entrySize += 4 // A checksum, which is not needed here.
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer))
+	offset := size - 8 - frames*entrySize - seekTableFooterSize
+	if offset < 0 {
+		return nil, fmt.Errorf("seek table exceeds the file")
+	}
+	table, err := readSkippableFrame(in, offset, seekTableMagic)
+	if err != nil {
+		return nil, fmt.Errorf("could not read seek table: %v", err)
+	}
+	if int64(len(table)) != frames*entrySize+seekTableFooterSize {
+		return nil, fmt.Errorf("invalid seek table")
+	}
+	var entries []seekTableEntry
+	for i := int64(0); i < frames; i++ {
+		e := table[i*entrySize:]
+		entries = append(entries, seekTableEntry{binary.LittleEndian.Uint32(e), binary.LittleEndian.Uint32(e[4:])})
+	}
+	return entries, nil
+}
+
+// parseArchiveIndex parses the index of an archive.
+func parseArchiveIndex(index []byte) ([]archiveEntry, error) {
+	if len(index) == 0 || index[0] != zpbfVersion {
+		return nil, fmt.Errorf("unsupported archive version")
+	}
+	r := bytes.NewReader(index[1:])
+	readField := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return nil, fmt.Errorf("invalid index")
+		}
+		data := make([]byte, n)
+		r.Read(data)
+		return data, nil
+	}
+	var entries []archiveEntry
+	for r.Len() > 0 {
+		blobType, err := readField()
+		if err != nil {
+			return nil, err
+		}
+		indexdata, err := readField()
+		if err != nil {
+			return nil, err
+		}
+		rawSize, err := binary.ReadUvarint(r)
+		if err != nil || rawSize > pbf.MaxOversizedBlockSize {
+			return nil, fmt.Errorf("invalid index")
+		}
+		if len(indexdata) == 0 {
+			indexdata = nil
+		}
+		entries = append(entries, archiveEntry{string(blobType), indexdata, int(rawSize)})
+	}
+	return entries, nil
+}
+
+// readArchive restores the PBF file of the archive in to out.
+func readArchive(in io.ReadSeeker, out io.Writer) (blobs int, err error) {
+	seekTable, err := readSeekTable(in)
+	if err != nil {
+		return 0, err
+	}
+	var offset int64
+	for _, e := range seekTable {
+		offset += int64(e.compressedSize)
+	}
+	index, err := readSkippableFrame(in, offset, zpbfIndexMagic)
+	if err != nil {
+		return 0, fmt.Errorf("could not read index: %v", err)
+	}
+	entries, err := parseArchiveIndex(index)
+	if err != nil {
+		return 0, err
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstd.MaxWindowSize))
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	// data holds the uncompressed data of the frames, that has not been
+	// written yet. Blobs may span frames.
+	var data []byte
+	for i, e := range seekTable {
+		compressed := make([]byte, e.compressedSize)
+		if _, err = io.ReadFull(in, compressed); err != nil {
+			return blobs, fmt.Errorf("could not read frame %d: %v", i, err)
+		}
+		n := len(data)
+		if data, err = dec.DecodeAll(compressed, data); err != nil {
+			return blobs, fmt.Errorf("could not decompress frame %d: %v", i, err)
+		}
+		if len(data)-n != int(e.rawSize) {
+			return blobs, fmt.Errorf("frame %d has %d instead of %d bytes", i, len(data)-n, e.rawSize)
+		}
+		for len(entries) > 0 && entries[0].rawSize <= len(data) {
+			entry := entries[0]
+			blob, err := compressData(data[:entry.rawSize], codecZstd)
+			if err != nil {
+				return blobs, fmt.Errorf("could not compress Blob: %v", err)
+			}
+			if err = writeBlobFrame(entry.blobType, entry.indexdata, blob, out); err != nil {
+				return blobs, err
+			}
+			data = data[entry.rawSize:]
+			entries = entries[1:]
+			blobs++
+		}
+		data = append([]byte(nil), data...)
+	}
+	if len(entries) > 0 || len(data) > 0 {
+		return blobs, fmt.Errorf("the index does not match the frames")
+	}
+	return blobs, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+)
+
+// autoLevel makes the conversion choose compressionLevel by compressing
+// the first data blobs at every level before it starts.
+var autoLevel bool
+
+// autoLevelBlobs is the number of data blobs, that are compressed at
+// every level to choose one.
+const autoLevelBlobs = 5
+
+// tuneLevel sets compressionLevel to the zstd level, that gives the best
+// ratio per second of compression time on this machine for the first
+// data blobs of input, and rewinds input afterwards.
+func tuneLevel(input io.ReadSeeker) error {
+	var samples [][]byte
+	for len(samples) < autoLevelBlobs {
+		header, err := readBlobHeader(input)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		blob, err := readBlob(header, input)
+		if err != nil {
+			return err
+		}
+		if header.GetType() != "OSMData" {
+			continue
+		}
+		rawData, err := pbf.Decompress(blob)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, rawData)
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		slog.Info("Found no data blobs to choose the compression level with", "level", compressionLevel)
+		return nil
+	}
+	bestScore := 0.0
+	for _, level := range explainLevels {
+		raw, compressed := 0, 0
+		began := time.Now()
+		for _, rawData := range samples {
+			data, err := compressTrial(rawData, zstdTrial{level: level})
+			if err != nil {
+				return err
+			}
+			raw += len(rawData)
+			compressed += len(data)
+		}
+		duration := time.Since(began)
+		ratio := float64(raw) / float64(max(compressed, 1))
+		score := ratio / max(duration.Seconds(), 1e-9)
+		slog.Debug("Benchmarked compression level", "level", level, "ratio", ratio, "duration", duration)
+		if score > bestScore {
+			bestScore = score
+			compressionLevel = level
+		}
+	}
+	slog.Info("Chose the compression level", "level", compressionLevel, "blobs", len(samples))
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// blobExtent is the position of a blob, including its size prefix and
+// BlobHeader, in a file.
+type blobExtent struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Type   string `json:"type"`
+}
+
+func runServeBlobs(args []string) {
+	flags := flag.NewFlagSet("serve-blobs", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8080", "listen on this `address`")
+	metricsAddr := addMetricsFlag(flags)
+	indexFile := flags.String("index", "", "read the blob offsets from this `file`, written by list -format json,\ninstead of scanning IN_FILE at startup")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf serve-blobs [-listen ADDRESS] [-index FILE] [-metrics ADDRESS] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Serve the blobs of IN_FILE over HTTP, as they are stored, including\n"+
+			"their size prefix and BlobHeader. Range requests are supported.\n"+
+			"  /header    the OSMHeader blob\n"+
+			"  /blob/N    the blob with index N, counting from 0\n"+
+			"  /index     the offset, length and type of every blob as JSON")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		fatalCode(exitInput, "Could not stat file", "file", flags.Arg(0), "err", err)
+	}
+	var extents []blobExtent
+	if *indexFile != "" {
+		extents, err = readBlobIndex(*indexFile, stat.Size())
+	} else {
+		extents, err = scanBlobs(in)
+	}
+	if err != nil {
+		fatalCode(inputCode(err), "Could not index", "file", flags.Arg(0), "err", err)
+	}
+	s := &blobServer{in: in, modTime: stat.ModTime(), extents: extents}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /header", s.serveHeader)
+	mux.HandleFunc("GET /blob/{n}", s.serveBlob)
+	mux.HandleFunc("GET /index", s.serveIndex)
+	serveMetrics(*metricsAddr)
+	slog.Info("Serving blobs", "blobs", len(extents), "address", *listen)
+	if err = http.ListenAndServe(*listen, mux); err != nil {
+		fatal("Could not serve", "err", err)
+	}
+}
+
+// scanBlobs finds the blobs of in by reading only their headers.
+func scanBlobs(in io.ReadSeeker) ([]blobExtent, error) {
+	var extents []blobExtent
+	var offset int64
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			return extents, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		end, err := in.Seek(int64(header.GetDatasize()), io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, blobExtent{Offset: offset, Length: end - offset, Type: header.GetType()})
+		offset = end
+	}
+}
+
+// readBlobIndex reads the output of list -format json for a file of the
+// given size.
+func readBlobIndex(path string, size int64) ([]blobExtent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var infos []blobInfo
+	if err = json.Unmarshal(data, &infos); err != nil {
+		return nil, err
+	}
+	extents := make([]blobExtent, len(infos))
+	for i, info := range infos {
+		end := size
+		if i+1 < len(infos) {
+			end = infos[i+1].Offset
+		}
+		if info.Offset < 0 || end < info.Offset || end > size {
+			return nil, fmt.Errorf("the index does not match the file")
+		}
+		extents[i] = blobExtent{Offset: info.Offset, Length: end - info.Offset, Type: info.Type}
+	}
+	return extents, nil
+}
+
+type blobServer struct {
+	in      *os.File
+	modTime time.Time
+	extents []blobExtent
+}
+
+func (s *blobServer) serveHeader(w http.ResponseWriter, r *http.Request) {
+	for i, extent := range s.extents {
+		if extent.Type == "OSMHeader" {
+			s.serveExtent(w, r, i)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *blobServer) serveBlob(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 || n >= len(s.extents) {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveExtent(w, r, n)
+}
+
+func (s *blobServer) serveExtent(w http.ResponseWriter, r *http.Request, n int) {
+	metricQueueDepth.Inc()
+	defer metricQueueDepth.Dec()
+	extent := s.extents[n]
+	recordBlob(int(extent.Length), int(extent.Length))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Blob-Type", extent.Type)
+	http.ServeContent(w, r, "", s.modTime, io.NewSectionReader(s.in, extent.Offset, extent.Length))
+}
+
+func (s *blobServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.extents)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// blobCache stores compressed blobs in a directory, so that a later
+// conversion of a similar file can reuse them instead of compressing the
+// same data again. Blobs are stored under a hash of their uncompressed
+// data and all options, that affect the compressed output.
+type blobCache struct {
+	dir          string
+	hits, misses int
+}
+
+func newBlobCache(dir string) (*blobCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &blobCache{dir: dir}, nil
+}
+
+// key returns the cache key for compressing rawData with codec.
+func (c *blobCache) key(rawData []byte, codec string) string {
+	hasher := sha256.New()
+	// The output of concurrent zstd encoders may differ, so the
+	// concurrency, that the encoder actually uses, is part of the key.
+	concurrency := encoderConcurrency
+	if concurrency == 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	fmt.Fprintf(hasher, "%s\x00%d\x00%d\x00%t\x00%t\x00%t\x00%d\x00", codec, compressionLevel, windowLog,
+		longWindow, zstdChecksum, optimize, concurrency)
+	hasher.Write(binary.AppendUvarint(nil, uint64(len(rawData))))
+	hasher.Write(rawData)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// get returns the serialized blob stored under key or nil, if there is
+// none. Unreadable entries are treated as missing.
+func (c *blobCache) get(key string) ([]byte, *pbfproto.Blob) {
+	rawBlob, err := os.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		c.misses++
+		return nil, nil
+	}
+	blob := &pbfproto.Blob{}
+	if err = blob.UnmarshalVTUnsafe(rawBlob); err != nil {
+		c.misses++
+		return nil, nil
+	}
+	c.hits++
+	return rawBlob, blob
+}
+
+// put stores rawBlob under key. The entry is written to a temporary file
+// first, so that concurrent or interrupted runs never leave a partial
+// entry behind.
+func (c *blobCache) put(key string, rawBlob []byte) error {
+	tmp, err := os.CreateTemp(c.dir, key+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(rawBlob)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.dir, key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
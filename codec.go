@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	codecZstd   = "zstd"
+	codecZlib   = "zlib"
+	codecRaw    = "raw"
+	codecBrotli = "brotli"
+)
+
+// experimentalBrotli allows codecBrotli, which only zstd-pbf can read.
+var experimentalBrotli bool
+
+// checkCodec returns an error, if codec is unknown. Whether brotli may
+// be used is checked after parsing by checkBrotli, since the flags can
+// come in any order.
+func checkCodec(codec string) error {
+	switch codec {
+	case codecZstd, codecZlib, codecRaw, codecBrotli:
+		return nil
+	}
+	return fmt.Errorf("unknown codec '%s'", codec)
+}
+
+// checkBrotli returns an error, if brotli has been requested for any
+// output, but experimentalBrotli is not set.
+func checkBrotli() error {
+	requested := append([]string{alsoCodec}, bestOf...)
+	for _, codec := range codecs {
+		requested = append(requested, codec)
+	}
+	for _, codec := range requested {
+		if codec == codecBrotli && !experimentalBrotli {
+			return fmt.Errorf("brotli is nonstandard and must be enabled with -experimental-brotli")
+		}
+	}
+	return nil
+}
+
+// defaultCodec compresses the blobs, which have no other codec.
+var defaultCodec = codecZstd
+
+// codecPolicy is a flag.Value mapping blob types to the codec used for
+// them. Blob types without a codec are compressed with bestOf, if it is
+// given, or defaultCodec.
+type codecPolicy map[string]string
+
+func (p codecPolicy) get(blobType string) string {
+	if codec, ok := p[blobType]; ok {
+		return codec
+	}
+	if len(bestOf) > 0 {
+		return bestOf.String()
+	}
+	return defaultCodec
+}
+
+func (p codecPolicy) String() string {
+	var rules []string
+	for blobType, codec := range p {
+		rules = append(rules, blobType+"="+codec)
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ",")
+}
+
+func (p codecPolicy) Set(value string) error {
+	blobType, codec, ok := strings.Cut(value, "=")
+	if !ok || blobType == "" {
+		return fmt.Errorf("expected TYPE=CODEC")
+	}
+	if err := checkCodec(codec); err != nil {
+		return err
+	}
+	p[blobType] = codec
+	return nil
+}
+
+// bestOf are the codecs, that blobs are compressed with to keep the
+// smallest result, if it is not empty.
+var bestOf codecList
+
+// codecList is a flag.Value holding a comma-separated list of codecs.
+type codecList []string
+
+func (l codecList) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *codecList) Set(value string) error {
+	var codecs codecList
+	for _, codec := range strings.Split(value, ",") {
+		if err := checkCodec(codec); err != nil {
+			return err
+		}
+		codecs = append(codecs, codec)
+	}
+	*l = codecs
+	return nil
+}
+
+// sampleSize is the number of bytes taken from each of the start, middle
+// and end of a blob to check whether it is compressible.
+const sampleSize = 16 * 1024
+
+// incompressibleRatio is the compressed to uncompressed size ratio of
+// the samples, above which a blob is considered incompressible.
+const incompressibleRatio = 0.97
+
+var sampleEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest),
+	zstd.WithEncoderConcurrency(1))
+
+// sampleRatio compresses samples of rawData with the fastest zstd level
+// and returns the ratio of compressed to uncompressed sample size. It
+// is a cheap estimate of how well rawData can be compressed.
+func sampleRatio(rawData []byte) float64 {
+	sample := rawData
+	if len(rawData) > 3*sampleSize {
+		middle := len(rawData)/2 - sampleSize/2
+		sample = make([]byte, 0, 3*sampleSize)
+		sample = append(sample, rawData[:sampleSize]...)
+		sample = append(sample, rawData[middle:middle+sampleSize]...)
+		sample = append(sample, rawData[len(rawData)-sampleSize:]...)
+	}
+	if len(sample) == 0 {
+		return 1
+	}
+	compressed := sampleEncoder.EncodeAll(sample, nil)
+	return float64(len(compressed)) / float64(len(sample))
+}
+
+// maxWindowLog is the largest useful window log, since a window of
+// maxBlockSize covers every blob. Larger windows are also rejected by
+// some decoders, e.g. libzstd by default rejects more than 1<<27.
+const maxWindowLog = 25
+
+// zstdOptions returns the options for compressing size bytes with zstd.
+func zstdOptions(size int) []zstd.EOption {
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(compressionLevel),
+		zstd.WithEncoderCRC(zstdChecksum),
+	}
+	if encoderConcurrency > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(encoderConcurrency))
+	}
+	if maxMemory > 0 {
+		opts = append(opts, zstd.WithLowerEncoderMem(true))
+	}
+	if windowLog > 0 {
+		opts = append(opts, zstd.WithWindowSize(1<<windowLog))
+	} else if longWindow {
+		// klauspost/compress has no long distance matching, so the
+		// next best thing is a window, that covers the whole blob.
+		window := zstd.MinWindowSize
+		for window < size && window < maxBlockSize {
+			window <<= 1
+		}
+		opts = append(opts, zstd.WithWindowSize(window))
+	}
+	return opts
+}
+
+// compressData creates a Blob containing rawData, compressed with codec.
+// If codec is a comma-separated list, rawData is compressed with each of
+// them and the smallest Blob is returned.
+func compressData(rawData []byte, codec string) (*pbfproto.Blob, error) {
+	if strings.Contains(codec, ",") {
+		var smallest *pbfproto.Blob
+		for _, c := range strings.Split(codec, ",") {
+			blob, err := compressData(rawData, c)
+			if err != nil {
+				return nil, err
+			}
+			if smallest == nil || blob.SizeVT() < smallest.SizeVT() {
+				smallest = blob
+			}
+		}
+		return smallest, nil
+	}
+	if codec == codecRaw {
+		return &pbfproto.Blob{Data: &pbfproto.Blob_Raw{Raw: rawData}}, nil
+	}
+	out := new(bytes.Buffer)
+	var enc io.WriteCloser
+	var err error
+	switch codec {
+	case codecZstd:
+		enc, err = zstd.NewWriter(out, zstdOptions(len(rawData))...)
+	case codecZlib:
+		enc, err = zlib.NewWriterLevel(out, zlib.BestCompression)
+	case codecBrotli:
+		enc = brotli.NewWriterOptions(out, brotli.WriterOptions{Quality: brotliQuality(), LGWin: 24})
+	default:
+		err = fmt.Errorf("unknown codec '%s'", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(enc, bytes.NewReader(rawData)); err != nil {
+		enc.Close()
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+	rawSize := int32(len(rawData))
+	blob := &pbfproto.Blob{RawSize: &rawSize}
+	switch codec {
+	case codecZstd:
+		blob.Data = &pbfproto.Blob_ZstdData{ZstdData: out.Bytes()}
+	case codecZlib:
+		blob.Data = &pbfproto.Blob_ZlibData{ZlibData: out.Bytes()}
+	case codecBrotli:
+		blob.Data = &pbfproto.Blob_BrotliData{BrotliData: out.Bytes()}
+	}
+	return blob, nil
+}
+
+// brotliQuality returns the brotli quality, that corresponds to
+// compressionLevel. The largest window of brotli is used, which still
+// only covers half of the largest blobs.
+func brotliQuality() int {
+	switch compressionLevel {
+	case zstd.SpeedFastest:
+		return 3
+	case zstd.SpeedBetterCompression:
+		return 9
+	case zstd.SpeedBestCompression:
+		return brotli.BestCompression
+	}
+	return brotli.DefaultCompression
+}
+
+// inputCode returns the exit code for err, which occurred while reading
+// an input: exitCodec for blobs in an unsupported format and exitInput
+// otherwise.
+func inputCode(err error) exitCode {
+	if errors.Is(err, pbf.ErrUnsupportedFormat) {
+		return exitCodec
+	}
+	return exitInput
+}
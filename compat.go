@@ -0,0 +1,328 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// specBlobHeaderSize is the limit of the PBF specification for
+// BlobHeaders, which readers enforce. zstd-pbf itself is more lenient.
+const specBlobHeaderSize = 64 * 1024
+
+// support is how well a reader handles a codec or feature.
+type support struct {
+	ok   bool
+	note string // Why the support is limited, if it is.
+}
+
+var (
+	supported   = support{ok: true}
+	unsupported = support{}
+)
+
+// knownReader describes, which codecs and required features of the
+// OSMHeader a common consumer of PBF files can read. Those, that are not
+// listed, are unsupported.
+type knownReader struct {
+	name     string
+	codecs   map[string]support
+	features map[string]support
+}
+
+// The support of osmium and osm2pgsql depends on the libosmium they are
+// built with.
+var (
+	libosmiumCodecs = map[string]support{
+		"raw":  supported,
+		"zlib": supported,
+		"lz4":  {ok: true, note: "needs libosmium 2.17 or later, built with lz4"},
+		"zstd": {ok: true, note: "needs a recent libosmium, built with zstd"},
+	}
+	basicFeatures = map[string]support{
+		"OsmSchema-V0.6": supported,
+		"DenseNodes":     supported,
+	}
+)
+
+// knownReaders is what zstd-pbf knows about common readers. It must be
+// updated, as they gain support for codecs or features.
+var knownReaders = []knownReader{
+	{
+		name:   "osmium",
+		codecs: libosmiumCodecs,
+		features: map[string]support{
+			"OsmSchema-V0.6":        supported,
+			"DenseNodes":            supported,
+			"HistoricalInformation": supported,
+			"LocationsOnWays":       supported,
+		},
+	},
+	{
+		name:   "osm2pgsql",
+		codecs: libosmiumCodecs,
+		features: map[string]support{
+			"OsmSchema-V0.6":  supported,
+			"DenseNodes":      supported,
+			"LocationsOnWays": supported,
+		},
+	},
+	{
+		name:     "planetiler",
+		codecs:   map[string]support{"raw": supported, "zlib": supported},
+		features: basicFeatures,
+	},
+	{
+		name:     "imposm",
+		codecs:   map[string]support{"raw": supported, "zlib": supported},
+		features: basicFeatures,
+	},
+}
+
+func lookupReader(name string) (knownReader, bool) {
+	for _, r := range knownReaders {
+		if r.name == name {
+			return r, true
+		}
+	}
+	return knownReader{}, false
+}
+
+func readerNames() []string {
+	names := make([]string, len(knownReaders))
+	for i, r := range knownReaders {
+		names[i] = r.name
+	}
+	return names
+}
+
+// fileFeatures are the properties of a PBF file, that decide whether a
+// reader can read it.
+type fileFeatures struct {
+	codecs         map[string]int // The number of blobs per codec.
+	features       []string       // Required features of the OSMHeader.
+	oversizedBlobs int
+}
+
+// inspectFile collects the fileFeatures of the PBF file in. Only the
+// OSMHeader is decompressed.
+func inspectFile(in io.Reader) (*fileFeatures, error) {
+	ff := &fileFeatures{codecs: make(map[string]int)}
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			return ff, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		blob, err := readBlob(header, in)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Blob: %v", err)
+		}
+		if err = ff.addBlob(header, blob); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// addBlob adds the features of a blob with the given header to ff.
+func (ff *fileFeatures) addBlob(header *pbfproto.BlobHeader, blob *pbfproto.Blob) error {
+	if header.GetType() == footerBlobType {
+		return nil // Readers skip it, like any unknown blob type.
+	}
+	ff.codecs[pbf.Codec(blob)]++
+	rawSize := int(blob.GetRawSize())
+	if raw := blob.GetRaw(); raw != nil {
+		rawSize = len(raw)
+	}
+	if rawSize > maxBlockSize || header.SizeVT() > specBlobHeaderSize {
+		ff.oversizedBlobs++
+	}
+	if header.GetType() != "OSMHeader" {
+		return nil
+	}
+	rawData, err := pbf.Decompress(blob)
+	if err != nil {
+		return err
+	}
+	headerBlock := &pbfproto.HeaderBlock{}
+	if err = proto.Unmarshal(rawData, headerBlock); err != nil {
+		return fmt.Errorf("could not parse HeaderBlock: %v", err)
+	}
+	for _, feature := range headerBlock.RequiredFeatures {
+		if !slices.Contains(ff.features, feature) {
+			ff.features = append(ff.features, feature)
+		}
+	}
+	return nil
+}
+
+// check returns the problems r has with a file with the features ff.
+// readable is false, if r can't read it at all.
+func (r knownReader) check(ff *fileFeatures) (readable bool, problems []string) {
+	readable = true
+	add := func(subject string, s support) {
+		switch {
+		case !s.ok:
+			readable = false
+			problems = append(problems, subject+": unsupported")
+		case s.note != "":
+			problems = append(problems, subject+": "+s.note)
+		}
+	}
+	for _, codec := range sortedKeys(ff.codecs) {
+		add(fmt.Sprintf("%d %s blobs", ff.codecs[codec], codec), r.codecs[codec])
+	}
+	for _, feature := range ff.features {
+		add("required feature "+feature, r.features[feature])
+	}
+	if ff.oversizedBlobs > 0 {
+		add(fmt.Sprintf("%d blobs above the size limits", ff.oversizedBlobs), unsupported)
+	}
+	return readable, problems
+}
+
+func runCompatCheck(args []string) {
+	flags := flag.NewFlagSet("compat-check", flag.ExitOnError)
+	require := flags.String("require", "", "fail, if one of these comma-separated `readers` can't read the file")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf compat-check [-require READERS] <IN_FILE>")
+		fmt.Fprintf(os.Stderr, "Report, whether common readers are known to support the blob codecs,\n"+
+			"required features and blob sizes of the file, before it is shipped to\n"+
+			"them. The known readers are %s.\n", strings.Join(readerNames(), ", "))
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	var required []string
+	if *require != "" {
+		required = strings.Split(*require, ",")
+		for _, name := range required {
+			if _, ok := lookupReader(name); !ok {
+				fatalCode(exitUsage, "Unknown reader", "reader", name, "known", strings.Join(readerNames(), ","))
+			}
+		}
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	ff, err := inspectFile(in)
+	if err != nil {
+		fatalCode(inputCode(err), "Could not read file", "file", flags.Arg(0), "err", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "READER\tSTATUS\tPROBLEMS")
+	var unreadable []string
+	for _, r := range knownReaders {
+		readable, problems := r.check(ff)
+		status := "ok"
+		switch {
+		case !readable:
+			status = "unreadable"
+			if slices.Contains(required, r.name) {
+				unreadable = append(unreadable, r.name)
+			}
+		case len(problems) > 0:
+			status = "maybe"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.name, status, strings.Join(problems, "; "))
+	}
+	tw.Flush()
+	if len(unreadable) > 0 {
+		fatalCode(exitMismatch, "Required readers can't read the file", "readers", strings.Join(unreadable, ","))
+	}
+}
+
+// compatMax is the -compat preset for all known readers.
+const compatMax = "max"
+
+// compat is the name of a known reader or compatMax. If it is given, the
+// output is restricted to codecs, block sizes and required features,
+// that are guaranteed to work with these readers.
+var compat string
+
+// compatReaders returns the readers of compat.
+func compatReaders() ([]knownReader, error) {
+	if compat == compatMax {
+		return knownReaders, nil
+	}
+	r, ok := lookupReader(compat)
+	if !ok {
+		return nil, fmt.Errorf("unknown reader '%s'; known are %s and %s", compat, strings.Join(readerNames(), ", "), compatMax)
+	}
+	return []knownReader{r}, nil
+}
+
+// setupCompat picks the most compact codec, that all readers of compat
+// support without restrictions, as defaultCodec, lets oversized blocks be
+// split and checks, that the requested codecs and block size work with
+// the readers.
+func setupCompat() error {
+	readers, err := compatReaders()
+	if err != nil {
+		return err
+	}
+	guaranteed := func(codec string) error {
+		for _, r := range readers {
+			if s := r.codecs[codec]; !s.ok || s.note != "" {
+				return fmt.Errorf("%s is not guaranteed to read the codec %s", r.name, codec)
+			}
+		}
+		return nil
+	}
+	for _, codec := range []string{codecZstd, codecZlib} {
+		if guaranteed(codec) == nil {
+			defaultCodec = codec
+			break
+		}
+	}
+	requested := append([]string{}, bestOf...)
+	for _, codec := range codecs {
+		requested = append(requested, codec)
+	}
+	for _, codec := range requested {
+		if err := guaranteed(codec); err != nil {
+			return err
+		}
+	}
+	if targetBlobSize > recommendedBlockSize {
+		return fmt.Errorf("the target blob size must not exceed 16MiB")
+	}
+	splitOversized = true
+	return nil
+}
+
+// checkCompatHeader returns an error, if the serialized HeaderBlock
+// rawData has a required feature, that a reader of compat doesn't
+// support.
+func checkCompatHeader(rawData []byte) error {
+	readers, err := compatReaders()
+	if err != nil {
+		return err
+	}
+	header := &pbfproto.HeaderBlock{}
+	if err := proto.Unmarshal(rawData, header); err != nil {
+		return fmt.Errorf("could not parse HeaderBlock: %v", err)
+	}
+	for _, feature := range header.RequiredFeatures {
+		for _, r := range readers {
+			if !r.features[feature].ok {
+				return fmt.Errorf("%s does not support the required feature %s", r.name, feature)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// flagCollector receives the flags of a command instead of parsing its
+// arguments, if it is set. The command is stopped afterwards.
+var flagCollector func(flags *flag.FlagSet)
+
+func init() {
+	// Registered here, since runCompletion refers to commands.
+	commands["completion"] = runCompletion
+}
+
+// commandFlags returns the flags, that run defines, by running it until
+// it parses its arguments.
+func commandFlags(run func(args []string)) []*flag.Flag {
+	var flags []*flag.Flag
+	done := make(chan struct{})
+	flagCollector = func(fs *flag.FlagSet) {
+		fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	}
+	go func() {
+		defer close(done)
+		run(nil)
+	}()
+	<-done
+	flagCollector = nil
+	return flags
+}
+
+// collectFlags stops the current command, if flagCollector is set, after
+// passing flags to it.
+func collectFlags(flags *flag.FlagSet) {
+	if flagCollector != nil {
+		flagCollector(flags)
+		runtime.Goexit()
+	}
+}
+
+// takesValue reports whether f needs a value, unlike boolean flags.
+func takesValue(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return !ok || !b.IsBoolFlag()
+}
+
+// flagDescription returns the first line of the usage of f.
+func flagDescription(f *flag.Flag) string {
+	_, usage := flag.UnquoteUsage(f)
+	usage, _, _ = strings.Cut(usage, "\n")
+	return usage
+}
+
+// completionCommand is a command, whose arguments are completed.
+type completionCommand struct {
+	name  string // Empty for the conversion.
+	flags []*flag.Flag
+}
+
+func completionCommands() []completionCommand {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cmds := []completionCommand{{flags: commandFlags(func([]string) { parseFlags() })}}
+	for _, name := range names {
+		cmds = append(cmds, completionCommand{name: name, flags: commandFlags(commands[name])})
+	}
+	return cmds
+}
+
+func flagNames(flags []*flag.Flag) string {
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = "-" + f.Name
+	}
+	return strings.Join(names, " ")
+}
+
+func writeBashCompletion(w io.Writer, cmds []completionCommand) {
+	fmt.Fprintln(w, "# bash completion for zstd-pbf, generated by 'zstd-pbf completion bash'.")
+	fmt.Fprintln(w, "_zstd_pbf() {")
+	fmt.Fprintln(w, "  local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} flags valued")
+	fmt.Fprintln(w, "  case ${COMP_WORDS[1]} in")
+	for _, cmd := range cmds[1:] {
+		writeBashCase(w, cmd.name, cmd.flags)
+	}
+	writeBashCase(w, "*", cmds[0].flags)
+	fmt.Fprintln(w, "  esac")
+	fmt.Fprintln(w, "  if [[ \" $valued \" == *\" $prev \"* ]]; then")
+	fmt.Fprintln(w, "    COMPREPLY=($(compgen -f -- \"$cur\"))")
+	fmt.Fprintln(w, "  elif [[ $cur == -* ]]; then")
+	fmt.Fprintln(w, "    COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))")
+	fmt.Fprintln(w, "  elif ((COMP_CWORD == 1)); then")
+	names := make([]string, 0, len(cmds)-1)
+	for _, cmd := range cmds[1:] {
+		names = append(names, cmd.name)
+	}
+	fmt.Fprintf(w, "    COMPREPLY=($(compgen -W %q -- \"$cur\") $(compgen -f -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "  else")
+	fmt.Fprintln(w, "    COMPREPLY=($(compgen -f -- \"$cur\"))")
+	fmt.Fprintln(w, "  fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o filenames -F _zstd_pbf zstd-pbf")
+}
+
+func writeBashCase(w io.Writer, pattern string, flags []*flag.Flag) {
+	var valued []*flag.Flag
+	for _, f := range flags {
+		if takesValue(f) {
+			valued = append(valued, f)
+		}
+	}
+	fmt.Fprintf(w, "    %s)\n", pattern)
+	fmt.Fprintf(w, "      flags=%q\n", flagNames(flags))
+	fmt.Fprintf(w, "      valued=%q;;\n", flagNames(valued))
+}
+
+func writeZshCompletion(w io.Writer, cmds []completionCommand) {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	spec := func(f *flag.Flag) string {
+		description := strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(flagDescription(f))
+		if takesValue(f) {
+			return quote(fmt.Sprintf("-%s[%s]:value:_files", f.Name, description))
+		}
+		return quote(fmt.Sprintf("-%s[%s]", f.Name, description))
+	}
+	fmt.Fprintln(w, "#compdef zstd-pbf")
+	fmt.Fprintln(w, "# zsh completion for zstd-pbf, generated by 'zstd-pbf completion zsh'.")
+	fmt.Fprintln(w, "_zstd_pbf() {")
+	fmt.Fprintln(w, "  local -a commands")
+	fmt.Fprint(w, "  commands=(")
+	for _, cmd := range cmds[1:] {
+		fmt.Fprintf(w, " %s", cmd.name)
+	}
+	fmt.Fprintln(w, " )")
+	fmt.Fprintln(w, "  if ((CURRENT == 2)) && [[ $PREFIX != -* ]]; then")
+	fmt.Fprintln(w, "    compadd -a commands")
+	fmt.Fprintln(w, "    _files")
+	fmt.Fprintln(w, "    return")
+	fmt.Fprintln(w, "  fi")
+	fmt.Fprintln(w, "  case $words[2] in")
+	caseArguments := func(pattern, prefix string, flags []*flag.Flag) {
+		fmt.Fprintf(w, "    %s)\n%s      _arguments", pattern, prefix)
+		for _, f := range flags {
+			fmt.Fprintf(w, " \\\n        %s", spec(f))
+		}
+		fmt.Fprintln(w, " \\\n        '*:file:_files';;")
+	}
+	for _, cmd := range cmds[1:] {
+		caseArguments(cmd.name, "      shift words; ((CURRENT--))\n", cmd.flags)
+	}
+	// The conversion comes last, since it matches everything.
+	caseArguments("*", "", cmds[0].flags)
+	fmt.Fprintln(w, "  esac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "compdef _zstd_pbf zstd-pbf")
+}
+
+func writeFishCompletion(w io.Writer, cmds []completionCommand) {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	}
+	names := make([]string, 0, len(cmds)-1)
+	for _, cmd := range cmds[1:] {
+		names = append(names, cmd.name)
+	}
+	fmt.Fprintln(w, "# fish completion for zstd-pbf, generated by 'zstd-pbf completion fish'.")
+	fmt.Fprintf(w, "complete -c zstd-pbf -n '__fish_use_subcommand' -a %s\n", quote(strings.Join(names, " ")))
+	for i, cmd := range cmds {
+		condition := "__fish_seen_subcommand_from " + cmd.name
+		if i == 0 {
+			condition = "not __fish_seen_subcommand_from " + strings.Join(names, " ")
+		}
+		for _, f := range cmd.flags {
+			line := fmt.Sprintf("complete -c zstd-pbf -n %s -o %s -d %s", quote(condition), f.Name, quote(flagDescription(f)))
+			if takesValue(f) {
+				line += " -r"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func runCompletion(args []string) {
+	flags := flag.NewFlagSet("completion", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf completion bash|zsh|fish")
+		fmt.Fprintln(os.Stderr, "Write a script, that completes the commands and flags of zstd-pbf, for\n"+
+			"the given shell, e.g. for bash:\n"+
+			"  source <(zstd-pbf completion bash)")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The shell")
+	}
+	switch shell := flags.Arg(0); shell {
+	case "bash":
+		writeBashCompletion(os.Stdout, completionCommands())
+	case "zsh":
+		writeZshCompletion(os.Stdout, completionCommands())
+	case "fish":
+		writeFishCompletion(os.Stdout, completionCommands())
+	default:
+		fatalCode(exitUsage, "Unknown shell", "shell", shell, "known", "bash,zsh,fish")
+	}
+}
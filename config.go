@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is the prefix of the environment variables, that set flags.
+// The flag -target-size, for example, is set by ZSTD_PBF_TARGET_SIZE.
+const envPrefix = "ZSTD_PBF_"
+
+// config contains the flag values from the configuration file, by
+// subcommand, where the conversion is "". It is loaded by loadConfig.
+var config map[string]map[string][]string
+
+// configFile is the path config has been loaded from.
+var configFile string
+
+// parseArgs parses args into flags, after setting the flags from the
+// configuration file and the environment. Flags on the command line take
+// precedence over environment variables, which take precedence over the
+// configuration file, also over the other flags of their group in
+// exclusiveFlags. Flags, which can be given multiple times, accumulate
+// the values from all sources instead. The logging flags, which all
+// commands share, are added to flags.
+func parseArgs(flags *flag.FlagSet, args []string) {
+	flags.StringVar(&logFormat, "log-format", "text", "write log messages as `text` or json")
+	flags.StringVar(&errorFormat, "error-format", "text", "write the error, with which a command fails, as a log message (`text`) or as a\nsingle line of json")
+	flags.BoolVar(&quiet, "q", false, "log only errors")
+	flags.BoolVar(&verbose, "v", false, "log debug messages")
+	flags.BoolVar(&veryVerbose, "vv", false, "log debug messages and a line for every written blob")
+	flags.IntVar(&cpus, "cpus", 0, "use up to `N` CPUs; defaults to the CPU quota of the cgroup or the number of CPUs")
+	collectFlags(flags)
+	if err := applyConfig(flags, args); err != nil {
+		fatalCode(exitUsage, "Could not apply configuration", "err", err)
+	}
+	flags.Parse(args)
+	if err := setupLogging(); err != nil {
+		fatalCode(exitUsage, "Could not set up logging", "err", err)
+	}
+	if err := setupCPUs(); err != nil {
+		fatal("Could not limit the CPUs", "err", err)
+	}
+}
+
+// configPath returns the path of the configuration file, which can be
+// changed with ZSTD_PBF_CONFIG.
+func configPath() (string, error) {
+	if path := os.Getenv(envPrefix + "CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "zstd-pbf", "config.toml"), nil
+}
+
+// loadConfig reads the configuration file into config. The top level
+// keys of the file are the flags of the conversion; the flags of
+// subcommands are given in a table named after the subcommand, e.g.
+//
+//	best = true
+//	codec = ["OSMHeader=raw"]
+//
+//	[serve-grpc]
+//	listen = "0.0.0.0:50051"
+//
+// A missing file is no error.
+func loadConfig() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	var file map[string]any
+	if _, err = toml.DecodeFile(path, &file); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read '%s': %v", path, err)
+	}
+	configFile = path
+	config = map[string]map[string][]string{"": {}}
+	for key, value := range file {
+		table, isTable := value.(map[string]any)
+		if !isTable {
+			config[""][key] = configValues(value)
+			continue
+		}
+		if _, ok := commands[key]; !ok {
+			return fmt.Errorf("'%s' contains a table for the unknown subcommand '%s'", path, key)
+		}
+		config[key] = make(map[string][]string)
+		for name, value := range table {
+			config[key][name] = configValues(value)
+		}
+	}
+	return nil
+}
+
+// exclusiveFlags are groups of flags, of which only one can be used. A
+// flag of a group, that is set by a source, overrides all flags of the
+// group from sources with lower precedence, so that e.g. -fastest on the
+// command line can be combined with best = true in the configuration.
+var exclusiveFlags = [][]string{
+	{"fastest", "better", "best", "optimize", "auto-level"},
+	{"deadline", "target-size", "target-ratio"},
+	{"window-log", "long"},
+	{"q", "v", "vv"},
+}
+
+// applyConfig sets flags from config and the environment, except those
+// overridden by args or, for config, by the environment.
+func applyConfig(flags *flag.FlagSet, args []string) error {
+	section := ""
+	if flags != flag.CommandLine {
+		section = flags.Name()
+	}
+	cli := commandLineFlags(flags, args)
+	env := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envVariable(f.Name)); ok {
+			env[f.Name] = v
+		}
+	})
+	for name, values := range config[section] {
+		f := flags.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("'%s' contains the unknown option '%s'", configFile, name)
+		}
+		if overridden(f, cli) || overridden(f, env) {
+			continue
+		}
+		for _, v := range values {
+			if err := flags.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value '%s' for '%s' in '%s': %v", v, name, configFile, err)
+			}
+		}
+	}
+	for name, v := range env {
+		if overridden(flags.Lookup(name), cli) {
+			continue
+		}
+		if err := flags.Set(name, v); err != nil {
+			return fmt.Errorf("invalid value '%s' for %s: %v", v, envVariable(name), err)
+		}
+	}
+	return nil
+}
+
+// envVariable returns the environment variable, that sets the flag with
+// the given name.
+func envVariable(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// overridden reports whether f or another flag of its group in
+// exclusiveFlags is among the set flags, unless f can be given multiple
+// times.
+func overridden[V any](f *flag.Flag, set map[string]V) bool {
+	if strings.Contains(f.Usage, "can be given multiple times") {
+		return false
+	}
+	if _, ok := set[f.Name]; ok {
+		return true
+	}
+	for _, group := range exclusiveFlags {
+		if !slices.Contains(group, f.Name) {
+			continue
+		}
+		for _, name := range group {
+			if _, ok := set[name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commandLineFlags returns the names of the flags, that args set. Errors
+// are ignored, since they are reported when flags parses args.
+func commandLineFlags(flags *flag.FlagSet, args []string) map[string]bool {
+	scratch := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	scratch.SetOutput(io.Discard)
+	flags.VisitAll(func(f *flag.Flag) {
+		scratch.Var(ignoredValue{takesValue(f)}, f.Name, "")
+	})
+	scratch.Parse(args)
+	set := make(map[string]bool)
+	scratch.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// ignoredValue is a flag.Value, that discards what it is set to.
+type ignoredValue struct {
+	takesValue bool
+}
+
+func (ignoredValue) String() string     { return "" }
+func (ignoredValue) Set(string) error   { return nil }
+func (v ignoredValue) IsBoolFlag() bool { return !v.takesValue }
+
+// configValues formats a TOML value as flag values. Arrays give the
+// values of a flag, that can be given multiple times.
+func configValues(value any) []string {
+	switch v := value.(type) {
+	case []any:
+		var values []string
+		for _, element := range v {
+			values = append(values, configValues(element)...)
+		}
+		return values
+	case time.Time:
+		return []string{v.Format(time.RFC3339)}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// maxWorkerFailures is the number of consecutive failures, after which
+// a worker is given up.
+const maxWorkerFailures = 3
+
+// workerRetryDelay is the time to wait before reconnecting to a worker,
+// that failed.
+const workerRetryDelay = 2 * time.Second
+
+func runCoordinate(args []string) {
+	flags := flag.NewFlagSet("coordinate", flag.ExitOnError)
+	workers := flags.String("workers", "", "send blobs to the serve-grpc workers at these comma separated `addresses`")
+	inFlight := flags.Int("in-flight", 4, "send up to `N` blobs to a worker before waiting for the first result")
+	maxBuffered := byteSize(0)
+	flags.Var(&maxBuffered, "max-memory", "buffer at most this `size` of blobs, that wait for a worker or to be written,\ne.g. 512M; 0 means no limit")
+	withFooter := flags.Bool("footer", false, "append a blob with the hash of the file, that can be checked with verify -quick")
+	metricsAddr := addMetricsFlag(flags)
+	addRateLimitFlags(flags)
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf coordinate -workers ADDRESSES [-in-flight N] [-max-memory SIZE] [-footer]\n"+
+			"                      [-metrics ADDRESS] [-max-read-mbps RATE] [-max-write-mbps RATE]\n"+
+			"                      [-yes] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Recompress IN_FILE into OUT_FILE by distributing its blobs across workers,\n"+
+			"started with serve-grpc, which determine the compression options. Blobs\n"+
+			"of a failed worker are given to the others.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 2 {
+		fatalCode(exitUsage, "Give exactly two arguments: The input and output PBF files")
+	}
+	if *workers == "" {
+		fatalCode(exitUsage, "Give at least one worker with -workers")
+	}
+	if *inFlight < 1 {
+		fatalCode(exitUsage, "The number of blobs in flight must be positive")
+	}
+	if err := setupRateLimits(); err != nil {
+		fatalCode(exitUsage, "Could not limit the I/O rate", "err", err)
+	}
+	inPath, outPath := flags.Arg(0), flags.Arg(1)
+	checkOutput(outPath, inPath)
+	in, err := os.Open(inPath)
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", inPath, "err", err)
+	}
+	defer in.Close()
+	out, err := createOutput(outPath)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", outPath, "err", err)
+	}
+	defer out.Close()
+	serveMetrics(*metricsAddr)
+	addrs := strings.Split(*workers, ",")
+	c := newCoordinator(len(addrs), *inFlight)
+	if maxBuffered > 0 {
+		debug.SetMemoryLimit(int64(maxBuffered))
+		// A blob and its result are buffered at once.
+		c.memory = newMemoryBudget(int64(maxBuffered) / 2)
+	}
+	var r io.Reader = in
+	if readLimit != nil {
+		r = &rateLimitedReader{r: in, limit: readLimit}
+	}
+	go c.read(r)
+	for _, addr := range addrs {
+		c.workers.Add(1)
+		go c.work(strings.TrimSpace(addr))
+	}
+	blobs, err := c.write(out)
+	if err == nil {
+		c.wait()
+	}
+	if err == nil && *withFooter {
+		err = writeFooter(out, blobs)
+	}
+	if err == nil {
+		err = commitOutput(out, outPath)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		fatal("Could not recompress", "file", inPath, "err", err)
+	}
+	slog.Info("Recompressed blobs", "blobs", blobs)
+}
+
+// coordinatorTask is a blob, that is to be recompressed by a worker.
+type coordinatorTask struct {
+	index  int
+	header *pbfproto.BlobHeader
+	blob   *pbfproto.Blob
+	read   int // The size of the blob before recompression.
+}
+
+// coordinator hands out the blobs of a file to workers and collects the
+// results. The number of blobs, that have been read but not yet
+// written, is limited by slots, so that a slow worker does not make the
+// coordinator buffer the whole file. Their size is limited by memory, if
+// it is not nil.
+type coordinator struct {
+	slots    chan struct{}
+	memory   *memoryBudget
+	queue    chan *coordinatorTask
+	results  chan *coordinatorTask
+	total    chan int
+	errs     chan error
+	done     chan struct{}
+	inFlight int
+	alive    atomic.Int32
+	workers  sync.WaitGroup
+}
+
+func newCoordinator(workers, inFlight int) *coordinator {
+	window := workers * inFlight
+	c := &coordinator{
+		slots:    make(chan struct{}, window),
+		queue:    make(chan *coordinatorTask, window),
+		results:  make(chan *coordinatorTask, window),
+		total:    make(chan int, 1),
+		errs:     make(chan error, workers+1),
+		done:     make(chan struct{}),
+		inFlight: inFlight,
+	}
+	c.alive.Store(int32(workers))
+	return c
+}
+
+// read queues the blobs of in and finally sends their number to
+// c.total.
+func (c *coordinator) read(in io.Reader) {
+	n := 0
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			c.total <- n
+			return
+		} else if err != nil {
+			c.errs <- fmt.Errorf("could not read BlobHeader: %v", err)
+			return
+		}
+		blob, err := readBlob(header, in)
+		if err != nil {
+			c.errs <- fmt.Errorf("could not read Blob: %v", err)
+			return
+		}
+		if header.GetType() == footerBlobType {
+			continue // The footer of the input does not match the output.
+		}
+		select {
+		case c.slots <- struct{}{}:
+		case <-c.done:
+			return
+		}
+		if c.memory != nil && !c.memory.acquire(int64(header.GetDatasize())) {
+			return
+		}
+		c.queue <- &coordinatorTask{index: n, header: header, blob: blob, read: int(header.GetDatasize())}
+		n++
+	}
+}
+
+// write writes the results to out in the order of the input and returns
+// the number of written blobs.
+func (c *coordinator) write(out io.Writer) (int, error) {
+	defer close(c.done)
+	if c.memory != nil {
+		defer c.memory.close()
+	}
+	pending := make(map[int]*coordinatorTask)
+	next, total := 0, -1
+	for total < 0 || next < total {
+		select {
+		case t := <-c.results:
+			pending[t.index] = t
+		case total = <-c.total:
+		case err := <-c.errs:
+			return next, err
+		}
+		for t := pending[next]; t != nil; t = pending[next] {
+			if err := writeRecompressed(t, out); err != nil {
+				return next, err
+			}
+			delete(pending, next)
+			next++
+			<-c.slots
+			if c.memory != nil {
+				c.memory.release(int64(t.read))
+			}
+		}
+		metricQueueDepth.Set(float64(len(c.slots)))
+	}
+	return next, nil
+}
+
+func writeRecompressed(t *coordinatorTask, out io.Writer) error {
+	n, err := pbf.WriteBlob(out, t.header, t.blob)
+	if err != nil {
+		return err
+	}
+	writeLimit.wait(n)
+	recordBlob(t.read, int(t.header.GetDatasize()))
+	return nil
+}
+
+// wait waits a moment for the workers to end their streams, after all
+// blobs have been written, so that they don't see them canceled.
+func (c *coordinator) wait() {
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(workerRetryDelay):
+	}
+}
+
+// work sends blobs to the worker at addr until all blobs are written.
+// After a failure, the worker is retried, unless it failed too often in
+// a row or rejected a blob as invalid.
+func (c *coordinator) work(addr string) {
+	defer c.workers.Done()
+	failures := 0
+	for {
+		done, err := c.stream(addr)
+		if err == nil {
+			return
+		}
+		if done > 0 {
+			failures = 0
+		}
+		failures++
+		metricErrors.Inc()
+		if status.Code(err) == codes.InvalidArgument {
+			c.errs <- fmt.Errorf("worker %s rejected a blob: %v", addr, err)
+			return
+		}
+		if failures >= maxWorkerFailures {
+			slog.Warn("Giving up worker", "worker", addr, "err", err)
+			if c.alive.Add(-1) == 0 {
+				c.errs <- fmt.Errorf("all workers failed")
+			}
+			return
+		}
+		slog.Warn("Worker failed, retrying", "worker", addr, "err", err)
+		select {
+		case <-time.After(workerRetryDelay):
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// stream sends blobs to the worker at addr over a single stream and
+// returns the number of received results. Blobs without a result are
+// queued again, if an error occurs.
+func (c *coordinator) stream(addr string) (int, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(2*maxBlockSize), grpc.MaxCallSendMsgSize(2*maxBlockSize)))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := pbfproto.NewRecompressorClient(conn).Recompress(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The results arrive in the order of sent.
+	sent := make(chan *coordinatorTask, c.inFlight)
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		for {
+			var t *coordinatorTask
+			select {
+			case t = <-c.queue:
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				stream.CloseSend()
+				return
+			}
+			select {
+			case sent <- t:
+			case <-ctx.Done():
+				c.queue <- t
+				return
+			}
+			req := &pbfproto.RecompressRequest{Type: t.header.Type, Blob: t.blob}
+			if stream.Send(req) != nil {
+				return // Recv reports the error.
+			}
+		}
+	}()
+	received := 0
+	for {
+		var t *coordinatorTask
+		select {
+		case t = <-sent:
+		case <-senderDone:
+			select {
+			case t = <-sent:
+			default:
+				stream.Recv() // Wait for the worker to end the stream.
+				return received, nil
+			}
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			cancel()
+			<-senderDone
+			c.queue <- t
+			for len(sent) > 0 {
+				c.queue <- <-sent
+			}
+			return received, err
+		}
+		t.blob = resp.Blob
+		c.results <- t
+		received++
+	}
+}
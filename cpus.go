@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cpus is the number of CPUs given with -cpus, or zero to detect it.
+var cpus int
+
+// setupCPUs limits the goroutines running at once, which also bound the
+// default encoder concurrency, to -cpus or to the CPU quota of the
+// cgroup of the process. Without a limit, containers would use as many
+// goroutines as the host has CPUs and get throttled.
+func setupCPUs() error {
+	if cpus < 0 {
+		return fmt.Errorf("the number of CPUs must not be negative")
+	} else if cpus > 0 {
+		runtime.GOMAXPROCS(cpus)
+		return nil
+	}
+	quota, ok := cgroupCPUQuota()
+	if !ok {
+		return nil
+	}
+	n := max(1, int(math.Ceil(quota)))
+	if n < runtime.GOMAXPROCS(0) {
+		slog.Debug("Limiting the CPUs to the cgroup quota", "cpus", n)
+		runtime.GOMAXPROCS(n)
+	}
+	return nil
+}
+
+// cgroupCPUQuota returns the number of CPUs, that the cgroup of the
+// process may use. ok is false, if there is no quota or it can't be
+// determined.
+func cgroupCPUQuota() (quota float64, ok bool) {
+	if dir, ok := cgroupDir(""); ok {
+		// cgroup v2: cpu.max holds the quota and period in µs.
+		if fields, ok := readCgroupFields(filepath.Join("/sys/fs/cgroup", dir, "cpu.max")); ok && len(fields) == 2 {
+			return parseCPUQuota(fields[0], fields[1])
+		}
+	}
+	if dir, ok := cgroupDir("cpu"); ok {
+		// cgroup v1 keeps the quota and period in separate files.
+		base := filepath.Join("/sys/fs/cgroup/cpu", dir)
+		q, ok1 := readCgroupFields(filepath.Join(base, "cpu.cfs_quota_us"))
+		p, ok2 := readCgroupFields(filepath.Join(base, "cpu.cfs_period_us"))
+		if !ok1 || !ok2 || len(q) != 1 || len(p) != 1 {
+			// Inside a container, the cgroup is often mounted as root.
+			q, ok1 = readCgroupFields("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+			p, ok2 = readCgroupFields("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+		}
+		if ok1 && ok2 && len(q) == 1 && len(p) == 1 {
+			return parseCPUQuota(q[0], p[0])
+		}
+	}
+	return 0, false
+}
+
+// cgroupDir returns the path of the cgroup of the process for the given
+// v1 controller, or for cgroup v2 if controller is empty.
+func cgroupDir(controller string) (string, bool) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines look like "ID:CONTROLLERS:PATH".
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if controller == "" && parts[0] == "0" && parts[1] == "" {
+			return parts[2], true
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			if controller != "" && c == controller {
+				return parts[2], true
+			}
+		}
+	}
+	return "", false
+}
+
+func readCgroupFields(path string) ([]string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return strings.Fields(string(data)), true
+}
+
+// parseCPUQuota divides quota by period. A quota of "max" or -1 means
+// no limit.
+func parseCPUQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+)
+
+// A delta file starts with deltaMagic, followed by the SHA-256 hashes of
+// the old and the new file. Then follow records, which reconstruct the
+// new file in order:
+//
+//	'C' <uvarint offset> <uvarint length>  copy bytes from the old file
+//	'D' <uvarint length> <bytes>           insert the given bytes
+//	'E'                                    end of the delta
+const deltaMagic = "ZSTD-PBF-DELTA-1\n"
+
+const (
+	deltaCopy = 'C'
+	deltaData = 'D'
+	deltaEnd  = 'E'
+)
+
+func runDelta(args []string) {
+	flags := flag.NewFlagSet("delta", flag.ExitOnError)
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf delta [-yes] <OLD_FILE> <NEW_FILE> <DELTA_FILE>")
+		fmt.Fprintln(os.Stderr, "Write the blobs of NEW_FILE, which are not also in OLD_FILE, to\n"+
+			"DELTA_FILE. Blobs are matched by the hash of their stored bytes, so\n"+
+			"both files should be written with the same options. NEW_FILE can be\n"+
+			"reconstructed with the patch command.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 3 {
+		fatalCode(exitUsage, "Give exactly three arguments: The old, new and delta files")
+	}
+	oldFile, newFile, deltaFile := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	checkOutput(deltaFile, oldFile, newFile)
+	old, err := os.Open(oldFile)
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", oldFile, "err", err)
+	}
+	defer old.Close()
+	cur, err := os.Open(newFile)
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", newFile, "err", err)
+	}
+	defer cur.Close()
+	out, err := createOutput(deltaFile)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", deltaFile, "err", err)
+	}
+	defer out.Close()
+	copied, inserted, err := writeDelta(old, cur, out)
+	if err == nil {
+		err = commitOutput(out, deltaFile)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		fatalCode(exitOutput, "Could not write delta", "err", err)
+	}
+	slog.Info("Wrote delta", "reused_bytes", copied, "stored_bytes", inserted)
+}
+
+func runPatch(args []string) {
+	flags := flag.NewFlagSet("patch", flag.ExitOnError)
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf patch [-yes] <OLD_FILE> <DELTA_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Reconstruct the new file of a delta, that was written by the delta\n"+
+			"command, from OLD_FILE and DELTA_FILE.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 3 {
+		fatalCode(exitUsage, "Give exactly three arguments: The old, delta and output files")
+	}
+	oldFile, deltaFile, outFile := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	checkOutput(outFile, oldFile, deltaFile)
+	old, err := os.Open(oldFile)
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", oldFile, "err", err)
+	}
+	defer old.Close()
+	delta, err := os.Open(deltaFile)
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", deltaFile, "err", err)
+	}
+	defer delta.Close()
+	out, err := createOutput(outFile)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", outFile, "err", err)
+	}
+	defer out.Close()
+	err = applyDelta(old, delta, out)
+	if err == nil {
+		err = commitOutput(out, outFile)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		fatal("Could not apply delta", "err", err)
+	}
+}
+
+// writeDelta writes a delta from old to cur to out and returns the
+// number of bytes copied from old and stored in the delta.
+func writeDelta(old, cur io.ReadSeeker, out io.Writer) (copied, inserted int64, err error) {
+	oldHash, err := hashFile(old)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read old file: %v", err)
+	}
+	newHash, err := hashFile(cur)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read new file: %v", err)
+	}
+
+	type extent struct{ offset, length int64 }
+	oldFrames := make(map[[sha256.Size]byte]extent)
+	var offset int64
+	for {
+		frame, err := readFrame(old)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("could not read old file: %v", err)
+		}
+		hash := sha256.Sum256(frame)
+		if _, ok := oldFrames[hash]; !ok {
+			oldFrames[hash] = extent{offset, int64(len(frame))}
+		}
+		offset += int64(len(frame))
+	}
+
+	w := bufio.NewWriter(out)
+	w.WriteString(deltaMagic)
+	w.Write(oldHash)
+	w.Write(newHash)
+	var pending extent // A copy, that may be extended by the next frame.
+	flushCopy := func() {
+		if pending.length > 0 {
+			w.WriteByte(deltaCopy)
+			w.Write(binary.AppendUvarint(nil, uint64(pending.offset)))
+			w.Write(binary.AppendUvarint(nil, uint64(pending.length)))
+			pending = extent{}
+		}
+	}
+	for {
+		frame, err := readFrame(cur)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("could not read new file: %v", err)
+		}
+		if e, ok := oldFrames[sha256.Sum256(frame)]; ok {
+			if pending.length > 0 && pending.offset+pending.length == e.offset {
+				pending.length += e.length
+			} else {
+				flushCopy()
+				pending = e
+			}
+			copied += e.length
+			continue
+		}
+		flushCopy()
+		w.WriteByte(deltaData)
+		w.Write(binary.AppendUvarint(nil, uint64(len(frame))))
+		w.Write(frame)
+		inserted += int64(len(frame))
+	}
+	flushCopy()
+	w.WriteByte(deltaEnd)
+	return copied, inserted, w.Flush()
+}
+
+// applyDelta reconstructs the new file of delta from old into out.
+func applyDelta(old io.ReadSeeker, delta io.Reader, out io.Writer) error {
+	r := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return fmt.Errorf("not a delta file")
+	}
+	oldHash := make([]byte, sha256.Size)
+	newHash := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, oldHash); err != nil {
+		return fmt.Errorf("could not read delta: %v", err)
+	}
+	if _, err := io.ReadFull(r, newHash); err != nil {
+		return fmt.Errorf("could not read delta: %v", err)
+	}
+	if hash, err := hashFile(old); err != nil {
+		return fmt.Errorf("could not read old file: %v", err)
+	} else if !bytes.Equal(hash, oldHash) {
+		return fmt.Errorf("the delta was made for another old file")
+	}
+
+	hasher := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(out, hasher))
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("could not read delta: %v", err)
+		}
+		switch op {
+		case deltaCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("could not read delta: %v", err)
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("could not read delta: %v", err)
+			}
+			if _, err := old.Seek(int64(offset), io.SeekStart); err != nil {
+				return err
+			}
+			if n, err := io.CopyN(w, old, int64(length)); err != nil && err != io.EOF {
+				return err
+			} else if n != int64(length) {
+				return fmt.Errorf("copy beyond the end of the old file")
+			}
+		case deltaData:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("could not read delta: %v", err)
+			}
+			if n, err := io.CopyN(w, r, int64(length)); err != nil {
+				return fmt.Errorf("could not read delta: %v", err)
+			} else if n != int64(length) {
+				return fmt.Errorf("delta is truncated")
+			}
+		case deltaEnd:
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			if !bytes.Equal(hasher.Sum(nil), newHash) {
+				return fmt.Errorf("the result does not match the hash of the new file")
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown delta record '%c'", op)
+		}
+	}
+}
+
+// hashFile returns the SHA-256 hash of f and rewinds it afterwards.
+func hashFile(f io.ReadSeeker) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return hasher.Sum(nil), err
+}
+
+// readFrame reads the next blob from in as it is stored, including the
+// size prefix and BlobHeader.
+func readFrame(in io.Reader) ([]byte, error) {
+	var frame bytes.Buffer
+	tee := io.TeeReader(in, &frame)
+	header, err := pbf.ReadBlobHeader(tee)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = pbf.ReadRawBlob(tee, header); err != nil {
+		return nil, err
+	}
+	return frame.Bytes(), nil
+}
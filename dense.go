@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// denseNode is a single node of a DenseNodes group with all delta
+// coding resolved. String IDs refer to the string table of the
+// containing PrimitiveBlock.
+type denseNode struct {
+	id       int64
+	lat, lon int64
+	keysVals []int32 // Alternating key and value string IDs.
+
+	// Only set if the group contains DenseInfo.
+	version   int32
+	timestamp int64
+	changeset int64
+	uid       int32
+	userSid   int32
+	visible   bool // Only meaningful if the group contains visible flags.
+}
+
+// decodeDenseNodes resolves the delta coding of dense.
+func decodeDenseNodes(dense *pbfproto.DenseNodes) ([]denseNode, error) {
+	n := len(dense.Id)
+	if len(dense.Lat) != n || len(dense.Lon) != n {
+		return nil, fmt.Errorf("DenseNodes with %d IDs, %d lats and %d lons",
+			n, len(dense.Lat), len(dense.Lon))
+	}
+	info := dense.Denseinfo
+	hasInfo := info != nil && len(info.Version) > 0
+	if hasInfo && (len(info.Version) != n || len(info.Timestamp) != n ||
+		len(info.Changeset) != n || len(info.Uid) != n || len(info.UserSid) != n) {
+		return nil, fmt.Errorf("DenseInfo does not match the %d nodes", n)
+	}
+	hasVisible := info != nil && len(info.Visible) > 0
+	if hasVisible && len(info.Visible) != n {
+		return nil, fmt.Errorf("DenseInfo has %d visible flags for %d nodes", len(info.Visible), n)
+	}
+	nodes := make([]denseNode, n)
+	var node denseNode
+	kv := 0
+	for i := range nodes {
+		node.id += dense.Id[i]
+		node.lat += dense.Lat[i]
+		node.lon += dense.Lon[i]
+		if hasInfo {
+			node.version = info.Version[i]
+			node.timestamp += info.Timestamp[i]
+			node.changeset += info.Changeset[i]
+			node.uid += info.Uid[i]
+			node.userSid += info.UserSid[i]
+		}
+		if hasVisible {
+			node.visible = info.Visible[i]
+		}
+		node.keysVals = nil
+		if len(dense.KeysVals) > 0 {
+			start := kv
+			for kv < len(dense.KeysVals) && dense.KeysVals[kv] != 0 {
+				kv += 2
+			}
+			if kv >= len(dense.KeysVals) {
+				return nil, fmt.Errorf("unterminated keys_vals in DenseNodes")
+			}
+			node.keysVals = dense.KeysVals[start:kv]
+			kv++
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// encodeDenseNodes delta codes nodes into a DenseNodes group. DenseInfo
+// is only written if withInfo is true and visible flags only if
+// withVisible is true.
+func encodeDenseNodes(nodes []denseNode, withInfo, withVisible bool) *pbfproto.DenseNodes {
+	dense := &pbfproto.DenseNodes{
+		Id:  make([]int64, len(nodes)),
+		Lat: make([]int64, len(nodes)),
+		Lon: make([]int64, len(nodes)),
+	}
+	hasTags := false
+	for _, node := range nodes {
+		if len(node.keysVals) > 0 {
+			hasTags = true
+			break
+		}
+	}
+	var info *pbfproto.DenseInfo
+	if withInfo {
+		info = &pbfproto.DenseInfo{
+			Version:   make([]int32, len(nodes)),
+			Timestamp: make([]int64, len(nodes)),
+			Changeset: make([]int64, len(nodes)),
+			Uid:       make([]int32, len(nodes)),
+			UserSid:   make([]int32, len(nodes)),
+		}
+		if withVisible {
+			info.Visible = make([]bool, len(nodes))
+		}
+		dense.Denseinfo = info
+	}
+	var prev denseNode
+	for i, node := range nodes {
+		dense.Id[i] = node.id - prev.id
+		dense.Lat[i] = node.lat - prev.lat
+		dense.Lon[i] = node.lon - prev.lon
+		if withInfo {
+			info.Version[i] = node.version
+			info.Timestamp[i] = node.timestamp - prev.timestamp
+			info.Changeset[i] = node.changeset - prev.changeset
+			info.Uid[i] = node.uid - prev.uid
+			info.UserSid[i] = node.userSid - prev.userSid
+			if withVisible {
+				info.Visible[i] = node.visible
+			}
+		}
+		if hasTags {
+			dense.KeysVals = append(dense.KeysVals, node.keysVals...)
+			dense.KeysVals = append(dense.KeysVals, 0)
+		}
+		prev = node
+	}
+	return dense
+}
+
+// denseHasInfo reports whether dense contains DenseInfo and visible
+// flags.
+func denseHasInfo(dense *pbfproto.DenseNodes) (hasInfo, hasVisible bool) {
+	info := dense.Denseinfo
+	return info != nil && len(info.Version) > 0, info != nil && len(info.Visible) > 0
+}
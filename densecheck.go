@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxStructureExamples is the number of structural problems, that are
+// printed; the others are only counted.
+const maxStructureExamples = 10
+
+// structureCheck checks the DenseNodes groups of data blocks for
+// problems, which readers may tolerate, misread or only report without
+// saying, where they are.
+type structureCheck struct {
+	// Whether the OSMHeader claims Sort.Type_then_ID and whether it is a
+	// history file, in which an ID repeats for each version.
+	sorted, history bool
+
+	last        denseNode // The last node of the previous group.
+	haveLast    bool
+	problems    int
+	examples    []string
+	blob, group int // The position, that is checked.
+}
+
+// header records the claims of the OSMHeader rawData.
+func (c *structureCheck) header(rawData []byte) error {
+	header := &pbfproto.HeaderBlock{}
+	if err := proto.Unmarshal(rawData, header); err != nil {
+		return fmt.Errorf("could not parse OSMHeader: %v", err)
+	}
+	c.sorted = slices.Contains(header.OptionalFeatures, sortedFeature)
+	c.history = slices.Contains(header.RequiredFeatures, "HistoricalInformation")
+	return nil
+}
+
+// check checks the DenseNodes of the data block rawData, which is the
+// blob with index blob.
+func (c *structureCheck) check(blob int, rawData []byte) error {
+	block := &pbfproto.PrimitiveBlock{}
+	if err := proto.Unmarshal(rawData, block); err != nil {
+		return fmt.Errorf("could not parse PrimitiveBlock of blob %d: %v", blob, err)
+	}
+	numStrings := 0
+	if block.Stringtable != nil {
+		numStrings = len(block.Stringtable.S)
+	}
+	c.blob = blob
+	for i, group := range block.Primitivegroup {
+		if group.Dense != nil {
+			c.group = i
+			c.checkDense(group.Dense, numStrings)
+		}
+	}
+	return nil
+}
+
+// report records a problem of the node with index node within the
+// group, or of the whole group, if node is negative.
+func (c *structureCheck) report(node int, format string, args ...any) {
+	c.problems++
+	if len(c.examples) == maxStructureExamples {
+		return
+	}
+	position := fmt.Sprintf("Blob %d, group %d", c.blob, c.group)
+	if node >= 0 {
+		position += fmt.Sprintf(", node %d", node)
+	}
+	c.examples = append(c.examples, position+": "+fmt.Sprintf(format, args...)+".")
+}
+
+func (c *structureCheck) checkDense(dense *pbfproto.DenseNodes, numStrings int) {
+	ids := len(dense.Id)
+	if len(dense.Lat) != ids || len(dense.Lon) != ids {
+		c.report(-1, "DenseNodes has %d IDs, %d lats and %d lons", ids, len(dense.Lat), len(dense.Lon))
+	}
+	// The nodes, of which all properties are there, are checked further.
+	n := min(ids, len(dense.Lat), len(dense.Lon))
+	info := dense.Denseinfo
+	hasInfo := info != nil
+	if info != nil {
+		for _, field := range []struct {
+			name   string
+			length int
+		}{
+			{"versions", len(info.Version)},
+			{"timestamps", len(info.Timestamp)},
+			{"changesets", len(info.Changeset)},
+			{"uids", len(info.Uid)},
+			{"user_sids", len(info.UserSid)},
+		} {
+			if field.length != ids {
+				c.report(-1, "DenseInfo has %d %s for %d nodes", field.length, field.name, ids)
+				hasInfo = false
+			}
+		}
+		if len(info.Visible) > 0 && len(info.Visible) != ids {
+			c.report(-1, "DenseInfo has %d visible flags for %d nodes", len(info.Visible), ids)
+		}
+	}
+	var node denseNode
+	kv := 0
+	for i := 0; i < n; i++ {
+		node.id += dense.Id[i]
+		if hasInfo {
+			node.version = info.Version[i]
+			node.timestamp += info.Timestamp[i]
+			node.changeset += info.Changeset[i]
+			node.userSid += info.UserSid[i]
+			if node.version < 0 {
+				c.report(i, "negative version %d", node.version)
+			}
+			if node.timestamp < 0 || node.changeset < 0 {
+				c.report(i, "negative timestamp %d or changeset %d", node.timestamp, node.changeset)
+			}
+			if node.userSid < 0 || int(node.userSid) >= numStrings {
+				c.report(i, "user_sid %d is not in the string table of %d strings", node.userSid, numStrings)
+			}
+		}
+		if c.sorted && c.haveLast && (node.id < c.last.id ||
+			node.id == c.last.id && !(c.history && hasInfo && node.version > c.last.version)) {
+			c.report(i, "ID %d does not follow ID %d, although the OSMHeader claims %s", node.id, c.last.id, sortedFeature)
+		}
+		c.last, c.haveLast = node, true
+		if len(dense.KeysVals) == 0 || kv > len(dense.KeysVals) {
+			continue
+		}
+		for kv < len(dense.KeysVals) && dense.KeysVals[kv] != 0 {
+			if kv+1 == len(dense.KeysVals) {
+				break
+			}
+			for _, sid := range dense.KeysVals[kv : kv+2] {
+				if sid < 0 || int(sid) >= numStrings {
+					c.report(i, "keys_vals refers to string %d, but the string table has %d strings", sid, numStrings)
+				}
+			}
+			kv += 2
+		}
+		if kv >= len(dense.KeysVals) || dense.KeysVals[kv] != 0 {
+			c.report(i, "keys_vals ends without the 0, that terminates the tags of the node")
+			kv = len(dense.KeysVals) + 1 // The following nodes are not checked.
+			continue
+		}
+		kv++
+	}
+	if len(dense.KeysVals) > 0 && kv < len(dense.KeysVals) {
+		c.report(-1, "keys_vals has %d entries after the tags of the last node", len(dense.KeysVals)-kv)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	ignoreMetadata := flags.Bool("ignore-metadata", false, "do not compare versions, timestamps, changesets and users")
+	limit := flags.Int("limit", 100, "print at most `N` differences; 0 means no limit")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf diff [-ignore-metadata] [-limit N] <FILE_A> <FILE_B>")
+		fmt.Fprintln(os.Stderr, "Report whether two files contain the same objects, regardless of blob\n"+
+			"boundaries and compression. Objects only in FILE_A are prefixed with\n"+
+			"'-', objects only in FILE_B with '+' and differing objects with '~'.\n"+
+			"Both files must be sorted by type and ID. The exit status is 1, if the\n"+
+			"files differ.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 2 {
+		fatalCode(exitUsage, "Give exactly two arguments: The PBF files to compare")
+	}
+	var readers [2]*elementReader
+	for i := range readers {
+		in, err := os.Open(flags.Arg(i))
+		if err != nil {
+			fatalCode(exitInput, "Could not open file", "file", flags.Arg(i), "err", err)
+		}
+		defer in.Close()
+		readers[i] = newElementReader(in)
+	}
+	d := differ{a: readers[0], b: readers[1], ignoreMetadata: *ignoreMetadata}
+	differences := 0
+	err := d.run(func(prefix string, e *osmElement, parts []string) {
+		differences++
+		if *limit > 0 && differences > *limit {
+			return
+		}
+		line := prefix + " " + e.name()
+		if e.info != nil && !*ignoreMetadata {
+			line += fmt.Sprintf(" v%d", e.info.version)
+		}
+		if len(parts) > 0 {
+			line += " (" + strings.Join(parts, ", ") + ")"
+		}
+		fmt.Println(line)
+	})
+	if err != nil {
+		fatalCode(inputCode(err), "Could not compare files", "err", err)
+	}
+	if differences == 0 {
+		fmt.Println("The files contain the same objects.")
+		return
+	}
+	if *limit > 0 && differences > *limit {
+		fmt.Printf("... and %d more differences.\n", differences-*limit)
+	}
+	// Like diff(1), differing files are reported with status 1.
+	os.Exit(1)
+}
+
+// differ compares the elements of two files, which are sorted by type,
+// ID and version.
+type differ struct {
+	a, b           *elementReader
+	ignoreMetadata bool
+}
+
+// run calls report for every element, that is only in a ("-"), only in
+// b ("+") or differs between them ("~"). For differing elements, the
+// differing parts are given.
+func (d *differ) run(report func(prefix string, e *osmElement, parts []string)) error {
+	var last [2]*osmElement
+	next := func(i int, r *elementReader) (*osmElement, error) {
+		e, err := r.next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if last[i] != nil && d.compareKeys(last[i], e) > 0 {
+			return nil, fmt.Errorf("file %c is not sorted by type and ID at %s", 'A'+i, e.name())
+		}
+		last[i] = e
+		return e, nil
+	}
+	a, err := next(0, d.a)
+	if err != nil {
+		return err
+	}
+	b, err := next(1, d.b)
+	if err != nil {
+		return err
+	}
+	for a != nil || b != nil {
+		cmp := 0
+		switch {
+		case a == nil:
+			cmp = 1
+		case b == nil:
+			cmp = -1
+		default:
+			cmp = d.compareKeys(a, b)
+		}
+		if cmp < 0 {
+			report("-", a, nil)
+		} else if cmp > 0 {
+			report("+", b, nil)
+		} else if parts := d.compare(a, b); len(parts) > 0 {
+			report("~", a, parts)
+		}
+		if cmp <= 0 {
+			if a, err = next(0, d.a); err != nil {
+				return err
+			}
+		}
+		if cmp >= 0 {
+			if b, err = next(1, d.b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compareKeys orders elements by type, ID and, unless metadata is
+// ignored, version.
+func (d *differ) compareKeys(a, b *osmElement) int {
+	if a.kind != b.kind {
+		return int(a.kind) - int(b.kind)
+	}
+	if a.id != b.id {
+		if a.id < b.id {
+			return -1
+		}
+		return 1
+	}
+	if d.ignoreMetadata || a.info == nil || b.info == nil {
+		return 0
+	}
+	return int(a.info.version) - int(b.info.version)
+}
+
+// compare returns the names of the parts, in which a and b differ. The
+// order of tags is not significant.
+func (d *differ) compare(a, b *osmElement) []string {
+	var parts []string
+	if a.lat != b.lat || a.lon != b.lon {
+		parts = append(parts, "location")
+	}
+	if !sameTags(a.tags, b.tags) {
+		parts = append(parts, "tags")
+	}
+	if !slices.Equal(a.refs, b.refs) {
+		parts = append(parts, "nodes")
+	}
+	if !slices.Equal(a.members, b.members) {
+		parts = append(parts, "members")
+	}
+	if !d.ignoreMetadata {
+		if (a.info == nil) != (b.info == nil) || a.info != nil && *a.info != *b.info {
+			parts = append(parts, "metadata")
+		}
+	}
+	return parts
+}
+
+func sameTags(a, b []tag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	cmp := func(x, y tag) int {
+		if c := strings.Compare(x.key, y.key); c != 0 {
+			return c
+		}
+		return strings.Compare(x.value, y.value)
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.SortFunc(a, cmp)
+	slices.SortFunc(b, cmp)
+	return slices.Equal(a, b)
+}
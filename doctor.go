@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// knownFeatures are the required features, that the specification and
+// libosmium define.
+var knownFeatures = []string{"OsmSchema-V0.6", "DenseNodes", "HistoricalInformation", "LocationsOnWays"}
+
+// finding is a problem, that doctor found, with advice on fixing it.
+type finding struct {
+	severity string // "error", "warning" or "info".
+	message  string
+	advice   string
+}
+
+// doctor collects the findings about a PBF file.
+type doctor struct {
+	in       io.ReadSeeker
+	size     int64
+	findings []finding
+
+	offsets []int64 // Of every blob, but the footer.
+	types   []string
+	header  *pbfproto.HeaderBlock
+	ff      *fileFeatures
+
+	// Found in the decoded sample:
+	dense, invisible bool
+	unsorted         int // The index of the first unsorted blob or -1.
+}
+
+func (d *doctor) add(severity, message, advice string) {
+	d.findings = append(d.findings, finding{severity: severity, message: message, advice: advice})
+}
+
+// checkFraming reads the BlobHeader and Blob of every blob. It stops at
+// the first one, that is broken, since the following offsets are
+// unknown then.
+func (d *doctor) checkFraming() {
+	d.ff = &fileFeatures{codecs: make(map[string]int)}
+	for {
+		offset, err := d.in.Seek(0, io.SeekCurrent)
+		if err != nil {
+			d.add("error", fmt.Sprintf("Could not read the file: %v.", err), "")
+			return
+		}
+		header, err := readBlobHeader(d.in)
+		if err == io.EOF {
+			return
+		}
+		var blob *pbfproto.Blob
+		if err == nil {
+			// readBlob does not notice a truncated Blob, if the part
+			// that is there can be parsed.
+			var pos int64
+			if pos, err = d.in.Seek(0, io.SeekCurrent); err == nil && pos+int64(header.GetDatasize()) > d.size {
+				err = io.ErrUnexpectedEOF
+			} else if err == nil {
+				blob, err = readBlob(header, d.in)
+			}
+		}
+		if err != nil {
+			// A truncated BlobHeader is only noticed, when it is parsed.
+			if pos, seekErr := d.in.Seek(0, io.SeekCurrent); seekErr == nil && pos >= d.size {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			d.add("error", fmt.Sprintf("The file is truncated in blob %d at offset %d.", len(d.offsets), offset),
+				"It has probably not been downloaded or written completely; download or convert it again.")
+			return
+		} else if err != nil {
+			d.add("error", fmt.Sprintf("The framing of blob %d at offset %d is broken: %v.", len(d.offsets), offset, err),
+				"The file is damaged or no PBF file; download or convert it again.")
+			return
+		}
+		if err = d.ff.addBlob(header, blob); err != nil {
+			d.add("error", fmt.Sprintf("The OSMHeader at offset %d can't be read: %v.", offset, err),
+				"The file is damaged; download or convert it again.")
+		}
+		if header.GetType() == footerBlobType {
+			continue
+		}
+		d.offsets = append(d.offsets, offset)
+		d.types = append(d.types, header.GetType())
+	}
+}
+
+// checkOrder checks, that the file starts with its only OSMHeader,
+// which is followed by data.
+func (d *doctor) checkOrder() {
+	if len(d.types) == 0 {
+		d.add("error", "The file contains no blobs.", "")
+		return
+	}
+	if d.types[0] != "OSMHeader" {
+		d.add("error", fmt.Sprintf("The first blob is of type %s instead of OSMHeader.", d.types[0]),
+			"Readers expect the OSMHeader first; the file may have been assembled from the wrong parts.")
+	}
+	headers, data := 0, 0
+	unknown := make(map[string]int)
+	for _, blobType := range d.types {
+		switch blobType {
+		case "OSMHeader":
+			headers++
+		case "OSMData":
+			data++
+		default:
+			unknown[blobType]++
+		}
+	}
+	if headers > 1 {
+		d.add("warning", fmt.Sprintf("The file contains %d OSMHeaders, e.g. because files have been concatenated.", headers),
+			"Readers may reject it or ignore the data after the second header; merge the files with a tool, that writes a single header.")
+	}
+	if data == 0 {
+		d.add("warning", "The file contains no OSMData blobs.", "")
+	}
+	for _, blobType := range sortedKeys(unknown) {
+		d.add("info", fmt.Sprintf("Readers skip %d blobs of the unknown type %s.", unknown[blobType], blobType), "")
+	}
+}
+
+// checkFeatures checks the required features of the OSMHeader and
+// whether the readers known to zstd-pbf can read the file.
+func (d *doctor) checkFeatures() {
+	if d.header == nil {
+		return
+	}
+	for _, feature := range d.header.RequiredFeatures {
+		if !slices.Contains(knownFeatures, feature) {
+			d.add("error", fmt.Sprintf("The OSMHeader requires the unknown feature %s.", feature),
+				"Most readers refuse files with required features they don't know.")
+		}
+	}
+	if !slices.Contains(d.header.RequiredFeatures, "OsmSchema-V0.6") {
+		d.add("warning", "The OSMHeader does not require OsmSchema-V0.6.", "Strict readers may refuse the file.")
+	}
+	if d.dense && !slices.Contains(d.header.RequiredFeatures, "DenseNodes") {
+		d.add("warning", "The file contains dense nodes, but the OSMHeader does not require DenseNodes.",
+			"Readers without support for dense nodes will silently miss them.")
+	}
+	if d.invisible && !slices.Contains(d.header.RequiredFeatures, "HistoricalInformation") {
+		d.add("warning", "The file contains deleted objects, but the OSMHeader does not require HistoricalInformation.",
+			"Readers will treat it as a snapshot; reconvert it with -snapshot to keep only the current versions.")
+	}
+	if d.unsorted >= 0 && slices.Contains(d.header.OptionalFeatures, sortedFeature) {
+		d.add("error", fmt.Sprintf("The OSMHeader claims Sort.Type_then_ID, but blob %d is not sorted.", d.unsorted),
+			"Readers, that rely on the order, e.g. to merge files, will produce wrong results.")
+	}
+	if d.ff.oversizedBlobs > 0 {
+		d.add("error", fmt.Sprintf("%d blobs exceed the size limits of the specification.", d.ff.oversizedBlobs),
+			"Reconvert the file with -split-oversized.")
+	}
+	for _, r := range knownReaders {
+		if readable, _ := r.check(d.ff); !readable {
+			d.add("warning", fmt.Sprintf("%s can't read the file.", r.name),
+				fmt.Sprintf("Run compat-check for details or reconvert the file with -compat %s.", r.name))
+		}
+	}
+}
+
+// decodeSample decodes n blobs, that are spread evenly over the file,
+// or all of them, if n is 0. The OSMHeader is always decoded.
+func (d *doctor) decodeSample(n int) {
+	d.unsorted = -1
+	indexes := []int{}
+	if n == 0 || n >= len(d.offsets) {
+		for i := range d.offsets {
+			indexes = append(indexes, i)
+		}
+	} else {
+		for i := 0; i < n; i++ {
+			indexes = append(indexes, i*(len(d.offsets)-1)/max(n-1, 1))
+		}
+	}
+	if len(d.offsets) > 0 && indexes[0] != 0 {
+		indexes = append([]int{0}, indexes...)
+	}
+	for _, i := range slices.Compact(indexes) {
+		if err := d.decodeBlob(i); err != nil {
+			d.add("error", fmt.Sprintf("Blob %d at offset %d can't be decoded: %v.", i, d.offsets[i], err),
+				"The file is damaged; download or convert it again.")
+		}
+	}
+}
+
+func (d *doctor) decodeBlob(i int) error {
+	if _, err := d.in.Seek(d.offsets[i], io.SeekStart); err != nil {
+		return err
+	}
+	header, err := readBlobHeader(d.in)
+	if err != nil {
+		return err
+	}
+	blob, err := readBlob(header, d.in)
+	if err != nil {
+		return err
+	}
+	rawData, err := pbf.Decompress(blob)
+	if err != nil {
+		return err
+	}
+	switch header.GetType() {
+	case "OSMHeader":
+		headerBlock := &pbfproto.HeaderBlock{}
+		if err = proto.Unmarshal(rawData, headerBlock); err != nil {
+			return fmt.Errorf("could not parse HeaderBlock: %v", err)
+		}
+		if d.header == nil {
+			d.header = headerBlock
+		}
+		return nil
+	case "OSMData":
+		block := &pbfproto.PrimitiveBlock{}
+		if err = proto.Unmarshal(rawData, block); err != nil {
+			return fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+		}
+		for _, group := range block.Primitivegroup {
+			d.dense = d.dense || groupKind(group) == kindDense
+		}
+		var last element
+		sorted := true
+		err = visitElements(block, func(e *element) {
+			if last.kind != 0 && (e.kind < last.kind || e.kind == last.kind && e.id < last.id) {
+				sorted = false
+			}
+			last = *e
+			d.invisible = d.invisible || !e.visible
+		})
+		if !sorted && d.unsorted < 0 {
+			d.unsorted = i
+		}
+		return err
+	}
+	return nil
+}
+
+func runDoctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	sample := flags.Int("sample", 20, "decode this `number` of blobs, spread over the file, or all, if 0")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf doctor [-sample N] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Diagnose, why a file can't be read: Check the framing of all blobs, the\n"+
+			"order of the blob types, the footer and the features of the OSMHeader,\n"+
+			"decode a sample of the blobs and print what is wrong and how to fix it.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	if *sample < 0 {
+		fatalCode(exitUsage, "The sample size must not be negative")
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		fatalCode(exitInput, "Could not stat file", "file", flags.Arg(0), "err", err)
+	}
+	d := &doctor{in: in, size: stat.Size()}
+	d.checkFraming()
+	d.checkOrder()
+	d.decodeSample(*sample)
+	d.checkFeatures()
+	if found, _, err := checkFooter(in); found && err != nil {
+		d.add("error", fmt.Sprintf("The footer check failed: %v.", err),
+			"The file has been modified or damaged since it was written.")
+	}
+	errorCount := 0
+	for _, f := range d.findings {
+		fmt.Printf("%s: %s\n", f.severity, f.message)
+		if f.advice != "" {
+			fmt.Printf("  %s\n", f.advice)
+		}
+		if f.severity == "error" {
+			errorCount++
+		}
+	}
+	if len(d.findings) == 0 {
+		fmt.Printf("No problems found in %d blobs.\n", len(d.offsets))
+	}
+	if errorCount > 0 {
+		fatalCode(exitMismatch, "Found errors", "errors", errorCount)
+	}
+}
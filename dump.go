@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// xmlBounds is the bounding box of an OSMHeader in the OSM XML format.
+type xmlBounds struct {
+	XMLName xml.Name `xml:"bounds"`
+	MinLat  string   `xml:"minlat,attr"`
+	MinLon  string   `xml:"minlon,attr"`
+	MaxLat  string   `xml:"maxlat,attr"`
+	MaxLon  string   `xml:"maxlon,attr"`
+}
+
+// xmlDumper writes decoded blocks as a single OSM XML document.
+type xmlDumper struct {
+	w   io.Writer
+	enc *xml.Encoder
+}
+
+func newXMLDumper(w io.Writer) (*xmlDumper, error) {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return nil, err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	root := xml.StartElement{Name: xml.Name{Local: "osm"}, Attr: []xml.Attr{
+		{Name: xml.Name{Local: "version"}, Value: "0.6"},
+		{Name: xml.Name{Local: "generator"}, Value: "zstd-pbf"},
+	}}
+	return &xmlDumper{w: w, enc: enc}, enc.EncodeToken(root)
+}
+
+// header writes the bounding box of header, if it has one.
+func (d *xmlDumper) header(header *pbfproto.HeaderBlock) error {
+	b := header.Bbox
+	if b == nil {
+		return nil
+	}
+	return d.enc.Encode(xmlBounds{
+		MinLat: formatCoordinate(b.GetBottom()),
+		MinLon: formatCoordinate(b.GetLeft()),
+		MaxLat: formatCoordinate(b.GetTop()),
+		MaxLon: formatCoordinate(b.GetRight()),
+	})
+}
+
+// block writes the elements of block.
+func (d *xmlDumper) block(block *pbfproto.PrimitiveBlock) error {
+	elements, err := decodeElements(block)
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+		start := xml.StartElement{Name: xml.Name{Local: xmlKindName(e.kind)}}
+		if err = d.enc.EncodeElement(newXMLElement(e), start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *xmlDumper) close() error {
+	if err := d.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: "osm"}}); err != nil {
+		return err
+	}
+	if err := d.enc.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(d.w, "\n")
+	return err
+}
+
+func runDump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	var blobs []int
+	flags.Func("blob", "dump the blob with this `index`, as printed by list; can be given multiple\ntimes", func(value string) error {
+		index, err := strconv.Atoi(value)
+		if err != nil || index < 0 {
+			return fmt.Errorf("expected a blob index")
+		}
+		blobs = append(blobs, index)
+		return nil
+	})
+	format := flags.String("format", "xml", "the output `format`: xml")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf dump -blob N [-format xml] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Write the decoded content of blobs to stdout as an OSM XML document,\n"+
+			"so that it can be inspected or compared with standard OSM tools. The\n"+
+			"OSMHeader is written as its bounding box.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	if len(blobs) == 0 {
+		fatalCode(exitUsage, "Select the blobs to dump with -blob")
+	}
+	if *format != "xml" {
+		fatalCode(exitUsage, "Unknown format", "format", *format)
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	d, err := newXMLDumper(os.Stdout)
+	if err != nil {
+		fatalCode(exitOutput, "Could not write XML", "err", err)
+	}
+	last := slices.Max(blobs)
+	for i := 0; i <= last; i++ {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			fatalCode(exitInput, "The file has fewer blobs", "blobs", i, "blob", last)
+		} else if err != nil {
+			fatalCode(inputCode(err), "Could not read blob", "blob", i, "err", err)
+		}
+		blob, err := readBlob(header, in)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read blob", "blob", i, "err", err)
+		}
+		if !slices.Contains(blobs, i) {
+			continue
+		}
+		rawData, err := pbf.Decompress(blob)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not decompress blob", "blob", i, "err", err)
+		}
+		switch header.GetType() {
+		case "OSMHeader":
+			headerBlock := &pbfproto.HeaderBlock{}
+			if err = proto.Unmarshal(rawData, headerBlock); err != nil {
+				fatalCode(inputCode(err), "Could not parse OSMHeader", "blob", i, "err", err)
+			}
+			err = d.header(headerBlock)
+		case "OSMData":
+			block := &pbfproto.PrimitiveBlock{}
+			if err = proto.Unmarshal(rawData, block); err != nil {
+				fatalCode(inputCode(err), "Could not parse PrimitiveBlock", "blob", i, "err", err)
+			}
+			err = d.block(block)
+		default:
+			fatalCode(exitInput, "The blob is neither an OSMHeader nor OSMData", "blob", i, "type", header.GetType())
+		}
+		if err != nil {
+			fatalCode(exitOutput, "Could not write XML", "blob", i, "err", err)
+		}
+	}
+	if err = d.close(); err != nil {
+		fatalCode(exitOutput, "Could not write XML", "err", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// dedupe drops objects, whose type, ID and version have already been
+// written. The input must be sorted by type, ID and version, apart from
+// the copies.
+var dedupe bool
+
+// maxDuplicateExamples is the number of duplicates, that are printed; the
+// others are only counted.
+const maxDuplicateExamples = 10
+
+// duplicateFilter is a blockStage, that drops the copies of object
+// versions, that have already been passed on. Since the input is sorted,
+// a copy is either equal to the last object version, that has been
+// passed on, or comes before it, e.g. in a block, that has been written
+// twice.
+type duplicateFilter struct {
+	last    objectVersionKey
+	seen    map[groupKindType]*idSet
+	dropped int
+	err     error // Of the first object version, that is out of order.
+}
+
+func newDuplicateFilter() *duplicateFilter {
+	return &duplicateFilter{seen: map[groupKindType]*idSet{kindNodes: {}, kindWays: {}, kindRelations: {}}}
+}
+
+// keep reports whether key is new.
+func (d *duplicateFilter) keep(key objectVersionKey) bool {
+	switch c := compareVersionKeys(key, d.last); {
+	case c > 0:
+		d.last = key
+		d.seen[key.kind].add(key.id)
+		return true
+	case c < 0 && !d.seen[key.kind].has(key.id) && d.err == nil:
+		d.err = fmt.Errorf("input is not sorted by type, ID and version at %s%d", kindLetter(key.kind), key.id)
+	}
+	d.dropped++
+	return false
+}
+
+func (d *duplicateFilter) add(block *pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error) {
+	var groups []*pbfproto.PrimitiveGroup
+	for _, group := range block.Primitivegroup {
+		group.Nodes = filter(group.Nodes, func(node *pbfproto.Node) bool {
+			return d.keep(objectVersionKey{objectKey{kindNodes, node.GetId()}, node.GetInfo().GetVersion()})
+		})
+		if group.Dense != nil {
+			hasInfo, hasVisible := denseHasInfo(group.Dense)
+			nodes, err := decodeDenseNodes(group.Dense)
+			if err != nil {
+				return nil, err
+			}
+			nodes = filter(nodes, func(node denseNode) bool {
+				// Dense and regular nodes share the same ID space.
+				return d.keep(objectVersionKey{objectKey{kindNodes, node.id}, node.version})
+			})
+			group.Dense = encodeDenseNodes(nodes, hasInfo, hasVisible)
+		}
+		group.Ways = filter(group.Ways, func(way *pbfproto.Way) bool {
+			return d.keep(objectVersionKey{objectKey{kindWays, way.GetId()}, way.GetInfo().GetVersion()})
+		})
+		group.Relations = filter(group.Relations, func(r *pbfproto.Relation) bool {
+			return d.keep(objectVersionKey{objectKey{kindRelations, r.GetId()}, r.GetInfo().GetVersion()})
+		})
+		if groupKind(group) != kindEmpty {
+			groups = append(groups, group)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	block.Primitivegroup = groups
+	return []*pbfproto.PrimitiveBlock{block}, nil
+}
+
+func (d *duplicateFilter) flush() ([]*pbfproto.PrimitiveBlock, error) {
+	if d.dropped > 0 {
+		slog.Info("Dropped duplicate objects", "objects", d.dropped)
+	}
+	return nil, nil
+}
+
+// objectVersionKey identifies a version of an object.
+type objectVersionKey struct {
+	objectKey
+	version int32
+}
+
+// compareVersionKeys orders object versions by type, ID and version.
+func compareVersionKeys(a, b objectVersionKey) int {
+	if a.objectKey != b.objectKey {
+		return compareObjects(&osmElement{kind: a.kind, id: a.id}, &osmElement{kind: b.kind, id: b.id})
+	}
+	return cmp.Compare(a.version, b.version)
+}
+
+// duplicateCheck finds object versions, that appear more than once, in
+// any order.
+type duplicateCheck struct {
+	seen, repeated map[groupKindType]*idSet
+
+	// The blobs, in which the versions of repeated IDs appear.
+	blobs map[objectVersionKey][]int
+
+	duplicates int // Versions, that appear more than once.
+	examples   []string
+}
+
+// collect finds the IDs, that appear more than once in block or in
+// earlier blocks.
+func (c *duplicateCheck) collect(_ int, block *pbfproto.PrimitiveBlock) error {
+	return visitElements(block, func(e *element) {
+		if c.seen[e.kind].has(e.id) {
+			c.repeated[e.kind].add(e.id)
+		} else {
+			c.seen[e.kind].add(e.id)
+		}
+	})
+}
+
+// locate records the blob of the versions of the repeated IDs in block.
+func (c *duplicateCheck) locate(index int, block *pbfproto.PrimitiveBlock) error {
+	return visitElements(block, func(e *element) {
+		if c.repeated[e.kind].has(e.id) {
+			key := objectVersionKey{objectKey{e.kind, e.id}, e.version}
+			c.blobs[key] = append(c.blobs[key], index)
+		}
+	})
+}
+
+// report counts the versions, that appear more than once, and describes
+// the first of them.
+func (c *duplicateCheck) report() {
+	keys := make([]objectVersionKey, 0, len(c.blobs))
+	for key, blobs := range c.blobs {
+		if len(blobs) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, compareVersionKeys)
+	c.duplicates = len(keys)
+	for _, key := range keys[:min(len(keys), maxDuplicateExamples)] {
+		blobs := make([]string, len(c.blobs[key]))
+		for i, blob := range c.blobs[key] {
+			blobs[i] = fmt.Sprint(blob)
+		}
+		c.examples = append(c.examples, fmt.Sprintf("%s%d version %d appears %d times, in blobs %s.",
+			kindLetter(key.kind), key.id, key.version, len(blobs), strings.Join(blobs, ", ")))
+	}
+}
+
+// checkDuplicates reads in twice: first to find the IDs, that appear
+// more than once, and then to find their versions, so that only the
+// versions of repeated IDs are kept in memory.
+func checkDuplicates(in io.ReadSeeker) (*duplicateCheck, error) {
+	c := &duplicateCheck{
+		seen:     map[groupKindType]*idSet{kindNodes: {}, kindWays: {}, kindRelations: {}},
+		repeated: map[groupKindType]*idSet{kindNodes: {}, kindWays: {}, kindRelations: {}},
+		blobs:    make(map[objectVersionKey][]int),
+	}
+	for _, step := range []func(int, *pbfproto.PrimitiveBlock) error{c.collect, c.locate} {
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		index := 0
+		err := readBlobs(in, func(header *pbfproto.BlobHeader, rawData []byte) error {
+			if header.GetType() == footerBlobType {
+				return nil
+			}
+			index++
+			if header.GetType() != "OSMData" {
+				return nil
+			}
+			block := &pbfproto.PrimitiveBlock{}
+			if err := proto.Unmarshal(rawData, block); err != nil {
+				return fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+			}
+			return step(index-1, block)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.report()
+	return c, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "github.com/codesoap/zstd-pbf/pbfproto"
+
+// element contains the properties, that nodes, ways and relations have
+// in common.
+type element struct {
+	kind groupKindType // One of kindNodes, kindWays and kindRelations.
+	id   int64
+
+	hasInfo   bool
+	version   int32
+	timestamp int64 // In milliseconds since the epoch.
+	changeset int64
+	uid       int32
+	visible   bool
+}
+
+// visitElements calls f for every node, way and relation in block. e is
+// reused between calls.
+func visitElements(block *pbfproto.PrimitiveBlock, f func(e *element)) error {
+	dateGranularity := int64(block.GetDateGranularity())
+	var e element
+	visit := func(kind groupKindType, id int64, info *pbfproto.Info) {
+		e = element{kind: kind, id: id, hasInfo: info != nil, visible: true}
+		if info != nil {
+			e.version = info.GetVersion()
+			e.timestamp = info.GetTimestamp() * dateGranularity
+			e.changeset = info.GetChangeset()
+			e.uid = info.GetUid()
+			e.visible = info.Visible == nil || *info.Visible
+		}
+		f(&e)
+	}
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			visit(kindNodes, node.GetId(), node.Info)
+		}
+		if group.Dense != nil {
+			nodes, err := decodeDenseNodes(group.Dense)
+			if err != nil {
+				return err
+			}
+			hasInfo, hasVisible := denseHasInfo(group.Dense)
+			for _, node := range nodes {
+				e = element{kind: kindNodes, id: node.id, hasInfo: hasInfo, visible: true}
+				if hasInfo {
+					e.version = node.version
+					e.timestamp = node.timestamp * dateGranularity
+					e.changeset = node.changeset
+					e.uid = node.uid
+				}
+				if hasVisible {
+					e.visible = node.visible
+				}
+				f(&e)
+			}
+		}
+		for _, way := range group.Ways {
+			visit(kindWays, way.GetId(), way.Info)
+		}
+		for _, relation := range group.Relations {
+			visit(kindRelations, relation.GetId(), relation.Info)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// execFilter is a command, that the data of every blob is piped through.
+var execFilter string
+
+// commandTransform returns a Transform, that runs command for every
+// blob with its uncompressed data on stdin and uses its stdout as the
+// new data. Empty output drops the blob. The command is split at spaces;
+// the type and index of the blob are passed in ZSTD_PBF_BLOB_TYPE and
+// ZSTD_PBF_BLOB_INDEX.
+func commandTransform(command string) (pbf.Transform, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("the command is empty")
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+	index := 0
+	return func(header *pbfproto.BlobHeader, data []byte) ([]byte, error) {
+		cmd := exec.Command(path, args[1:]...)
+		cmd.Env = append(os.Environ(),
+			"ZSTD_PBF_BLOB_TYPE="+header.GetType(),
+			"ZSTD_PBF_BLOB_INDEX="+strconv.Itoa(index))
+		index++
+		cmd.Stdin = bytes.NewReader(data)
+		out := bytes.NewBuffer(make([]byte, 0, len(data)))
+		cmd.Stdout = out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("filter failed for blob %d: %v", index-1, err)
+		}
+		if out.Len() == 0 {
+			return nil, nil
+		} else if out.Len() > maxBlockSize {
+			return nil, fmt.Errorf("filter output of %d bytes for blob %d exceeds 32MiB", out.Len(), index-1)
+		}
+		return out.Bytes(), nil
+	}, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// explainLevels are the zstd levels, that explain tries.
+var explainLevels = []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedDefault, zstd.SpeedBetterCompression, zstd.SpeedBestCompression}
+
+// blobExplanation describes, how well a blob compresses and why.
+type blobExplanation struct {
+	Index      int     `json:"index"`
+	Type       string  `json:"type"`
+	Codec      string  `json:"codec"`
+	Datasize   int     `json:"datasize"`
+	RawSize    int     `json:"raw_size"`
+	Ratio      float64 `json:"ratio"`   // Of the raw size to the datasize.
+	Entropy    float64 `json:"entropy"` // In bits per byte.
+	EntropyCap float64 `json:"entropy_ratio"`
+
+	// The shares of the uncompressed data, that are taken up by the parts
+	// of a PrimitiveBlock.
+	Shares []contentShare `json:"shares,omitempty"`
+
+	Levels []levelTrial `json:"levels"`
+}
+
+type contentShare struct {
+	Content string  `json:"content"`
+	Size    int     `json:"size"`
+	Share   float64 `json:"share"`
+}
+
+// levelTrial is the result of compressing a blob at a zstd level.
+type levelTrial struct {
+	Level    string        `json:"level"`
+	Size     int           `json:"size"`
+	Ratio    float64       `json:"ratio"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// byteEntropy returns the Shannon entropy of the bytes of data in bits
+// per byte. 8 bits per byte means, that compressing the bytes one at a
+// time can't shrink data.
+func byteEntropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(data))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// blockShares returns the sizes of the string table and the kinds of
+// groups of block relative to rawSize.
+func blockShares(block *pbfproto.PrimitiveBlock, rawSize int) []contentShare {
+	sizes := map[string]int{"string table": proto.Size(block.Stringtable)}
+	for _, group := range block.Primitivegroup {
+		if group.Dense != nil {
+			sizes["dense nodes"] += proto.Size(group.Dense)
+		}
+		for _, node := range group.Nodes {
+			sizes["nodes"] += proto.Size(node)
+		}
+		for _, way := range group.Ways {
+			sizes["ways"] += proto.Size(way)
+		}
+		for _, r := range group.Relations {
+			sizes["relations"] += proto.Size(r)
+		}
+	}
+	var shares []contentShare
+	other := rawSize
+	for _, content := range []string{"string table", "dense nodes", "nodes", "ways", "relations"} {
+		if size := sizes[content]; size > 0 || content == "string table" {
+			shares = append(shares, contentShare{content, size, float64(size) / float64(max(rawSize, 1))})
+			other -= size
+		}
+	}
+	// The remainder are the tags, lengths and fields of the messages
+	// themselves, like the granularity.
+	return append(shares, contentShare{"other", other, float64(other) / float64(max(rawSize, 1))})
+}
+
+func explainBlob(index int, header *pbfproto.BlobHeader, blob *pbfproto.Blob) (*blobExplanation, error) {
+	rawData, err := pbf.Decompress(blob)
+	if err != nil {
+		return nil, err
+	}
+	e := &blobExplanation{
+		Index:    index,
+		Type:     header.GetType(),
+		Codec:    pbf.Codec(blob),
+		Datasize: int(header.GetDatasize()),
+		RawSize:  len(rawData),
+		Entropy:  byteEntropy(rawData),
+	}
+	e.Ratio = float64(e.RawSize) / float64(max(e.Datasize, 1))
+	e.EntropyCap = 8 / max(e.Entropy, 1e-9)
+	if header.GetType() == "OSMData" {
+		block := &pbfproto.PrimitiveBlock{}
+		if err = proto.Unmarshal(rawData, block); err != nil {
+			return nil, fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+		}
+		e.Shares = blockShares(block, len(rawData))
+	}
+	for _, level := range explainLevels {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		began := time.Now()
+		size := len(enc.EncodeAll(rawData, nil))
+		e.Levels = append(e.Levels, levelTrial{level.String(), size, float64(len(rawData)) / float64(max(size, 1)), time.Since(began)})
+		enc.Close()
+	}
+	return e, nil
+}
+
+func (e *blobExplanation) print(w io.Writer) {
+	fmt.Fprintf(w, "Blob %d: %s, %s, %d bytes, %d uncompressed, ratio %.2f\n", e.Index, e.Type, e.Codec, e.Datasize, e.RawSize, e.Ratio)
+	fmt.Fprintf(w, "Entropy: %.2f bits per byte, which limits compressing single bytes to ratio %.2f\n", e.Entropy, e.EntropyCap)
+	fmt.Fprintln(w)
+	if e.Shares != nil {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "CONTENT\tUNCOMPRESSED\tSHARE")
+		for _, s := range e.Shares {
+			fmt.Fprintf(tw, "%s\t%d\t%.1f%%\n", s.Content, s.Size, 100*s.Share)
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ZSTD LEVEL\tCOMPRESSED\tRATIO\tDURATION")
+	for _, l := range e.Levels {
+		fmt.Fprintf(tw, "%s\t%d\t%.2f\t%s\n", l.Level, l.Size, l.Ratio, l.Duration.Round(time.Microsecond))
+	}
+	tw.Flush()
+}
+
+func runExplain(args []string) {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	index := flags.Int("blob", -1, "explain the blob with this `index`, as printed by list")
+	format := flags.String("format", "text", "the output `format`: text or json")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf explain -blob N [-format text|json] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Explain how well a blob compresses: its ratio, the entropy of its bytes,\n"+
+			"the shares of the string table and the kinds of elements in its data and\n"+
+			"the ratio, it achieves at each zstd level.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	if *index < 0 {
+		fatalCode(exitUsage, "Select the blob to explain with -blob")
+	}
+	if *format != "text" && *format != "json" {
+		fatalCode(exitUsage, "Unknown format", "format", *format)
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	for i := 0; ; i++ {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			fatalCode(exitInput, "The file has fewer blobs", "blobs", i, "blob", *index)
+		} else if err != nil {
+			fatalCode(inputCode(err), "Could not read blob", "blob", i, "err", err)
+		}
+		blob, err := readBlob(header, in)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read blob", "blob", i, "err", err)
+		}
+		if i < *index {
+			continue
+		}
+		e, err := explainBlob(i, header, blob)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not decompress blob", "blob", i, "err", err)
+		}
+		if *format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err = enc.Encode(e); err != nil {
+				fatalCode(exitOutput, "Could not write explanation", "err", err)
+			}
+		} else {
+			e.print(os.Stdout)
+		}
+		return
+	}
+}
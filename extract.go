@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// extractRelations are the IDs of the relations, that are extracted
+// instead of converting the whole input, if there are any.
+var extractRelations []int64
+
+// completeRelations includes all members of extractRelations in the
+// output: member nodes, member ways with their nodes and member
+// relations with their members.
+var completeRelations bool
+
+// parseRelationID is the flag.Func of -relation.
+func parseRelationID(value string) error {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected a relation ID")
+	}
+	extractRelations = append(extractRelations, id)
+	return nil
+}
+
+// extractSet is a set of IDs, that remembers, which of them have been
+// found in the input.
+type extractSet map[int64]bool
+
+func (s extractSet) add(id int64) bool {
+	if _, ok := s[id]; ok {
+		return false
+	}
+	s[id] = false
+	return true
+}
+
+func (s extractSet) found() int {
+	found := 0
+	for _, ok := range s {
+		if ok {
+			found++
+		}
+	}
+	return found
+}
+
+// relationExtractor selects the elements of extractRelations in multiple
+// passes over the input, since members may come before or after the
+// relations, that reference them.
+type relationExtractor struct {
+	input                  io.ReadSeeker
+	nodes, ways, relations extractSet
+	buf                    []byte
+}
+
+// pass reads the whole input and calls f with the type and data of each
+// blob. If dataKinds is not nil, only OSMData blocks, that contain a
+// group of one of these kinds, are passed to f.
+func (x *relationExtractor) pass(dataKinds []groupKindType, f func(blobType string, rawData []byte, block *pbfproto.PrimitiveBlock) error) error {
+	if _, err := x.input.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	for {
+		stageBegan := time.Now()
+		header, err := readBlobHeader(x.input)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		blob, err := readBlob(header, x.input)
+		if err != nil {
+			return fmt.Errorf("could not read Blob: %v", err)
+		}
+		times.read += since(&stageBegan)
+		if x.buf, err = pbf.AppendDecompressed(x.buf[:0], blob); err != nil {
+			return fmt.Errorf("could not decompress Blob: %v", err)
+		}
+		blob.ReturnToVTPool()
+		times.decompress += since(&stageBegan)
+		var block *pbfproto.PrimitiveBlock
+		if header.GetType() == "OSMData" {
+			block = &pbfproto.PrimitiveBlock{}
+			if err = proto.Unmarshal(x.buf, block); err != nil {
+				return fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+			}
+			if dataKinds != nil && !slices.ContainsFunc(block.Primitivegroup, func(group *pbfproto.PrimitiveGroup) bool {
+				kind := groupKind(group)
+				return kind == kindMixed || slices.Contains(dataKinds, kind)
+			}) {
+				continue
+			}
+		}
+		if err = f(header.GetType(), x.buf, block); err != nil {
+			return err
+		}
+	}
+}
+
+// collectRelations finds the members of the selected relations. With
+// completeRelations, member relations are selected as well, until no new
+// ones are found.
+func (x *relationExtractor) collectRelations() error {
+	for {
+		added := false
+		err := x.pass([]groupKindType{kindRelations}, func(_ string, _ []byte, block *pbfproto.PrimitiveBlock) error {
+			if block == nil {
+				return nil
+			}
+			elements, err := decodeElements(block)
+			if err != nil {
+				return err
+			}
+			for _, e := range elements {
+				if _, ok := x.relations[e.id]; e.kind != kindRelations || !ok {
+					continue
+				}
+				x.relations[e.id] = true
+				if !completeRelations {
+					continue
+				}
+				for _, m := range e.members {
+					switch m.kind {
+					case kindNodes:
+						x.nodes.add(m.id)
+					case kindWays:
+						x.ways.add(m.id)
+					case kindRelations:
+						added = x.relations.add(m.id) || added
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil || !added {
+			return err
+		}
+	}
+}
+
+// collectWayNodes selects the nodes of the selected ways.
+func (x *relationExtractor) collectWayNodes() error {
+	return x.pass([]groupKindType{kindWays}, func(_ string, _ []byte, block *pbfproto.PrimitiveBlock) error {
+		if block == nil {
+			return nil
+		}
+		elements, err := decodeElements(block)
+		if err != nil {
+			return err
+		}
+		for _, e := range elements {
+			if _, ok := x.ways[e.id]; e.kind != kindWays || !ok {
+				continue
+			}
+			x.ways[e.id] = true
+			for _, ref := range e.refs {
+				x.nodes.add(ref)
+			}
+		}
+		return nil
+	})
+}
+
+// write writes the OSMHeader and the selected elements to out. The
+// bounding box is removed from the OSMHeader, since it is the one of the
+// whole input.
+func (x *relationExtractor) write(out *elementOutput) error {
+	return x.pass(nil, func(blobType string, rawData []byte, block *pbfproto.PrimitiveBlock) error {
+		switch blobType {
+		case "OSMHeader":
+			header := &pbfproto.HeaderBlock{}
+			if err := proto.Unmarshal(rawData, header); err != nil {
+				return fmt.Errorf("could not parse OSMHeader: %v", err)
+			}
+			header.Bbox = nil
+			rawData, err := marshalOptions.Marshal(header)
+			if err != nil {
+				return err
+			}
+			return out.writeData("OSMHeader", rawData)
+		case "OSMData":
+			elements, err := decodeElements(block)
+			if err != nil {
+				return err
+			}
+			sets := map[groupKindType]extractSet{kindNodes: x.nodes, kindWays: x.ways, kindRelations: x.relations}
+			for _, e := range elements {
+				set := sets[e.kind]
+				if _, ok := set[e.id]; !ok {
+					continue
+				}
+				set[e.id] = true
+				if err = out.add(e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// convertRelations writes extractRelations, and with completeRelations
+// their members, from inFile to outFile.
+func convertRelations() {
+	began := time.Now()
+	_, input, closeInput := openInput()
+	defer closeInput()
+	x := &relationExtractor{
+		input:     input,
+		nodes:     make(extractSet),
+		ways:      make(extractSet),
+		relations: make(extractSet),
+	}
+	for _, id := range extractRelations {
+		x.relations.add(id)
+	}
+	if err := x.collectRelations(); err != nil {
+		fatalCode(inputCode(err), "Could not read file", "file", inFile, "err", err)
+	}
+	for _, id := range extractRelations {
+		if !x.relations[id] {
+			fatal("The relation is not in the input", "relation", id)
+		}
+	}
+	if completeRelations && len(x.ways) > 0 {
+		if err := x.collectWayNodes(); err != nil {
+			fatalCode(inputCode(err), "Could not read file", "file", inFile, "err", err)
+		}
+	}
+	f, err := createOutput(outFile)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", outFile, "err", err)
+	}
+	onFatal(func() { os.Remove(f.Name()) })
+	out := &elementOutput{teeWriter: teeWriter{f: f}, path: outFile}
+	if err = x.write(out); err != nil {
+		fatalCode(inputCode(err), "Could not extract the relations", "err", err)
+	}
+	if err = out.flush(); err != nil {
+		fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+	}
+	if err = fsync.syncEnd(f); err != nil {
+		fatalCode(exitOutput, "Could not sync file", "file", outFile, "err", err)
+	}
+	if err = commitOutput(f, outFile); err != nil {
+		fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+	}
+	nodes, ways, relations := x.nodes.found(), x.ways.found(), x.relations.found()
+	if missing := len(x.nodes) + len(x.ways) + len(x.relations) - nodes - ways - relations; missing > 0 {
+		slog.Warn("Some members are not in the input", "members", missing)
+	}
+	slog.Info("Extracted the relations", "nodes", nodes, "ways", ways, "relations", relations, "duration", time.Since(began))
+	times.log(time.Since(began))
+	keepResults()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// followInterval is how often a followReader checks for new data.
+const followInterval = 200 * time.Millisecond
+
+// followReader reads from a file, that is still being written, e.g.
+// downloaded. At the end of the file, it waits for more data and only
+// reports the end, once no data has arrived for timeout.
+type followReader struct {
+	ctx     context.Context // Ends the waiting, once it is done.
+	f       *os.File
+	timeout time.Duration
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	var waited time.Duration
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || err != io.EOF || waited >= r.timeout {
+			return n, err
+		}
+		select {
+		case <-time.After(followInterval):
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+		waited += followInterval
+	}
+}
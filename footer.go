@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// footerBlobType is the type of the optional last blob of a file, which
+// allows checking the integrity of the whole file without decompressing
+// it. Readers ignore blob types they don't know, as the specification
+// demands.
+//
+// The footer is an uncompressed blob, whose data is the number of
+// preceding blobs as a big-endian uint64, followed by the SHA-256 hash
+// of all bytes before the footer.
+const footerBlobType = "ZstdPbfFooter"
+
+const footerSize = 8 + sha256.Size
+
+// readBackWriter is an output, that can be read back.
+type readBackWriter interface {
+	io.WriteSeeker
+	io.ReaderAt
+}
+
+// writeFooter appends a footer to out, which already contains blobs
+// blobs. The written data is read back to compute the hash.
+func writeFooter(out readBackWriter, blobs int) error {
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, io.NewSectionReader(out, 0, size)); err != nil {
+		return err
+	}
+	data := binary.BigEndian.AppendUint64(nil, uint64(blobs))
+	data = hasher.Sum(data)
+	rawBlob, err := marshalFraming(&pbfproto.Blob{Data: &pbfproto.Blob_Raw{Raw: data}})
+	if err != nil {
+		return err
+	}
+	blobType, datasize := footerBlobType, int32(len(rawBlob))
+	header := &pbfproto.BlobHeader{Type: &blobType, Datasize: &datasize}
+	if err = writeBlobHeader(header, out); err != nil {
+		return err
+	}
+	_, err = out.Write(rawBlob)
+	return err
+}
+
+// checkFooter checks the footer of in, if there is one, by hashing the
+// preceding bytes and counting the blobs. found is false, if the file
+// has no footer.
+func checkFooter(in io.ReadSeeker) (found bool, blobs int, err error) {
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		return false, 0, err
+	}
+	var offset int64
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			return false, blobs, nil
+		} else if err != nil {
+			return false, blobs, fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		if header.GetType() != footerBlobType {
+			if offset, err = in.Seek(int64(header.GetDatasize()), io.SeekCurrent); err != nil {
+				return false, blobs, err
+			}
+			blobs++
+			continue
+		}
+		blob, err := readBlob(header, in)
+		if err != nil {
+			return true, blobs, fmt.Errorf("could not read footer: %v", err)
+		}
+		data := blob.GetRaw()
+		if len(data) != footerSize {
+			return true, blobs, fmt.Errorf("footer has %d instead of %d bytes", len(data), footerSize)
+		}
+		if _, err = readBlobHeader(in); err != io.EOF {
+			return true, blobs, fmt.Errorf("footer is not the last blob")
+		}
+		if n := binary.BigEndian.Uint64(data); n != uint64(blobs) {
+			return true, blobs, fmt.Errorf("footer counts %d blobs, but the file has %d", n, blobs)
+		}
+		hasher := sha256.New()
+		if _, err = in.Seek(0, io.SeekStart); err != nil {
+			return true, blobs, err
+		}
+		if _, err = io.CopyN(hasher, in, offset); err != nil {
+			return true, blobs, err
+		}
+		if !bytes.Equal(hasher.Sum(nil), data[8:]) {
+			return true, blobs, fmt.Errorf("hash does not match the footer")
+		}
+		return true, blobs, nil
+	}
+}
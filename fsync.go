@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// syncPolicy is a flag.Value for when the output is synced to disk:
+// never, at the end, or additionally every that many blobs.
+type syncPolicy struct {
+	atEnd bool
+	every int // Zero means never during the conversion.
+}
+
+var fsync syncPolicy
+
+func (p *syncPolicy) String() string {
+	switch {
+	case p.every > 0:
+		return strconv.Itoa(p.every)
+	case p.atEnd:
+		return "end"
+	}
+	return "none"
+}
+
+func (p *syncPolicy) Set(value string) error {
+	switch value {
+	case "none":
+		*p = syncPolicy{}
+		return nil
+	case "end":
+		*p = syncPolicy{atEnd: true}
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("expected none, end or a positive number of blobs")
+	}
+	*p = syncPolicy{atEnd: true, every: n}
+	return nil
+}
+
+// syncBlob syncs out, if the policy asks for it after the given number
+// of written blobs and out can be synced.
+func (p *syncPolicy) syncBlob(out io.Writer, blobs int) error {
+	s, ok := out.(interface{ Sync() error })
+	if !ok || p.every == 0 || blobs%p.every != 0 {
+		return nil
+	}
+	return s.Sync()
+}
+
+// syncEnd syncs out and the directory containing it, so that the file
+// survives a crash after the conversion.
+func (p *syncPolicy) syncEnd(out *os.File) error {
+	if !p.atEnd {
+		return nil
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(out.Name()))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
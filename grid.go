@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// grid splits the conversion into one output per cell, if it is set.
+var grid gridSpec
+
+// maxGridCells limits the number of outputs, that are open at once.
+const maxGridCells = 1024
+
+// gridSpec is a flag.Value for a grid of the form "COLUMNSxROWS", which
+// divides the bounding box of the OSMHeader, or "zN", which divides the
+// world into the web mercator tiles of zoom level N.
+type gridSpec struct {
+	columns, rows int
+	zoom          int // Only used, if columns is 0.
+	set           bool
+}
+
+func (g *gridSpec) String() string {
+	switch {
+	case g == nil || !g.set:
+		return ""
+	case g.columns == 0:
+		return "z" + strconv.Itoa(g.zoom)
+	}
+	return fmt.Sprintf("%dx%d", g.columns, g.rows)
+}
+
+func (g *gridSpec) Set(value string) error {
+	if zoom, ok := strings.CutPrefix(value, "z"); ok {
+		z, err := strconv.Atoi(zoom)
+		if err != nil || z < 0 || z > 10 {
+			return fmt.Errorf("the zoom level must be between 0 and 10")
+		}
+		*g = gridSpec{zoom: z, set: true}
+		return nil
+	}
+	columns, rows, ok := strings.Cut(value, "x")
+	c, err := strconv.Atoi(columns)
+	if !ok || err != nil || c <= 0 {
+		return fmt.Errorf("expected COLUMNSxROWS or zN")
+	}
+	r, err := strconv.Atoi(rows)
+	if err != nil || r <= 0 {
+		return fmt.Errorf("expected COLUMNSxROWS or zN")
+	}
+	if c*r > maxGridCells {
+		return fmt.Errorf("the grid must not have more than %d cells", maxGridCells)
+	}
+	*g = gridSpec{columns: c, rows: r, set: true}
+	return nil
+}
+
+// cellKey is the column and row of a cell, counted from the north-west,
+// or the x and y of a tile.
+type cellKey struct {
+	x, y int
+}
+
+// bounds are the edges of a bounding box in nanodegrees.
+type bounds struct {
+	left, right, top, bottom int64
+}
+
+var worldBounds = bounds{left: -180e9, right: 180e9, top: 90e9, bottom: -90e9}
+
+// maxMercatorLat is the latitude, where web mercator tiles end.
+const maxMercatorLat = 85.0511287798
+
+// cell returns the cell of the node at lat and lon, which are given in
+// nanodegrees. area is the bounding box of the input.
+func (g *gridSpec) cell(area bounds, lat, lon int64) cellKey {
+	clamp := func(v, n int) int {
+		return max(0, min(v, n-1))
+	}
+	if g.columns == 0 {
+		n := 1 << g.zoom
+		latRad := math.Max(-maxMercatorLat, math.Min(maxMercatorLat, float64(lat)/1e9)) * math.Pi / 180
+		x := int((float64(lon)/1e9 + 180) / 360 * float64(n))
+		y := int((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * float64(n))
+		return cellKey{x: clamp(x, n), y: clamp(y, n)}
+	}
+	width := max(area.right-area.left, 1)
+	height := max(area.top-area.bottom, 1)
+	x := int((lon - area.left) * int64(g.columns) / width)
+	y := int((area.top - lat) * int64(g.rows) / height)
+	return cellKey{x: clamp(x, g.columns), y: clamp(y, g.rows)}
+}
+
+// cellBounds returns the bounding box of the cell key.
+func (g *gridSpec) cellBounds(area bounds, key cellKey) bounds {
+	if g.columns == 0 {
+		n := float64(int(1) << g.zoom)
+		lon := func(x int) int64 { return int64((float64(x)/n*360 - 180) * 1e9) }
+		lat := func(y int) int64 {
+			return int64(math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi * 1e9)
+		}
+		return bounds{left: lon(key.x), right: lon(key.x + 1), top: lat(key.y), bottom: lat(key.y + 1)}
+	}
+	width, height := area.right-area.left, area.top-area.bottom
+	return bounds{
+		left:   area.left + width*int64(key.x)/int64(g.columns),
+		right:  area.left + width*int64(key.x+1)/int64(g.columns),
+		top:    area.top - height*int64(key.y)/int64(g.rows),
+		bottom: area.top - height*int64(key.y+1)/int64(g.rows),
+	}
+}
+
+// cellPath returns the output path of the cell key, which is outFile
+// with the cell inserted before the extension, e.g. "out-1-0.osm.pbf"
+// or "out-5-17-10.osm.pbf" for tiles.
+func (g *gridSpec) cellPath(key cellKey) string {
+	base, ext := outFile, ""
+	for _, suffix := range []string{".osm.pbf", ".pbf"} {
+		if strings.HasSuffix(outFile, suffix) {
+			base, ext = strings.TrimSuffix(outFile, suffix), suffix
+			break
+		}
+	}
+	if g.columns == 0 {
+		return fmt.Sprintf("%s-%d-%d-%d%s", base, g.zoom, key.x, key.y, ext)
+	}
+	return fmt.Sprintf("%s-%d-%d%s", base, key.x, key.y, ext)
+}
+
+// cellIndex maps element IDs to the 1-based index of their cell, or 0,
+// if it is unknown. The IDs are stored in pages, so that the dense IDs of
+// OSM take two bytes each.
+type cellIndex map[int64]*[cellPageSize]uint16
+
+const cellPageSize = 1 << 16
+
+func (c cellIndex) set(id int64, cell uint16) {
+	page := c[id>>16]
+	if page == nil {
+		page = new([cellPageSize]uint16)
+		c[id>>16] = page
+	}
+	page[id&(cellPageSize-1)] = cell
+}
+
+func (c cellIndex) get(id int64) uint16 {
+	if page := c[id>>16]; page != nil {
+		return page[id&(cellPageSize-1)]
+	}
+	return 0
+}
+
+// elementOutput is an output, to which decoded elements are written in
+// blocks, e.g. the output of a grid cell.
+type elementOutput struct {
+	teeWriter
+	path    string
+	pending []*osmElement
+}
+
+func (c *elementOutput) writeData(blobType string, rawData []byte) error {
+	began := time.Now()
+	blob, err := compressData(rawData, codecs.get(blobType))
+	if err != nil {
+		return fmt.Errorf("could not compress Blob: %v", err)
+	}
+	times.compress += time.Since(began)
+	rawBlob, err := marshalFraming(blob)
+	if err != nil {
+		return fmt.Errorf("could not serialize Blob: %v", err)
+	}
+	return c.writeRaw(blobType, rawBlob)
+}
+
+// add adds e to the pending elements of c, which are written, once there
+// are maxBlockElements of them or e is of another kind, so that each block
+// contains only one kind of elements.
+func (c *elementOutput) add(e *osmElement) error {
+	if len(c.pending) > 0 && c.pending[len(c.pending)-1].kind != e.kind {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	c.pending = append(c.pending, e)
+	if len(c.pending) < maxBlockElements {
+		return nil
+	}
+	return c.flush()
+}
+
+// flush writes the pending elements of c as a data block.
+func (c *elementOutput) flush() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	began := time.Now()
+	rawData, err := marshalOptions.Marshal(encodeElements(c.pending))
+	times.marshal += since(&began)
+	if err != nil {
+		return err
+	}
+	c.pending = c.pending[:0]
+	return c.writeData("OSMData", rawData)
+}
+
+// gridSplitter routes the elements of the input to the cells of grid.
+// Nodes go to the cell they are in, ways to the cell of their first
+// known node and relations to the cell of their first known member, so
+// that each element is written once.
+type gridSplitter struct {
+	area   bounds
+	header *pbfproto.HeaderBlock
+
+	keys      map[cellKey]uint16
+	cells     []*elementOutput // At the index of their key minus one.
+	nodes     cellIndex
+	ways      cellIndex
+	relations cellIndex
+	unlocated int // Elements, of which no member is in the input.
+}
+
+// cell returns the output of key, which is created, when it is first
+// used.
+func (s *gridSplitter) cell(key cellKey) (uint16, error) {
+	if index, ok := s.keys[key]; ok {
+		return index, nil
+	}
+	if len(s.cells) == maxGridCells {
+		return 0, fmt.Errorf("the grid has more than %d used cells", maxGridCells)
+	}
+	path := grid.cellPath(key)
+	f, err := createOutput(path)
+	if err != nil {
+		return 0, err
+	}
+	onFatal(func() { os.Remove(f.Name()) })
+	c := &elementOutput{teeWriter: teeWriter{f: f}, path: path}
+	s.cells = append(s.cells, c)
+	index := uint16(len(s.cells))
+	s.keys[key] = index
+
+	header := proto.Clone(s.header).(*pbfproto.HeaderBlock)
+	b := grid.cellBounds(s.area, key)
+	header.Bbox = &pbfproto.HeaderBBox{Left: &b.left, Right: &b.right, Top: &b.top, Bottom: &b.bottom}
+	rawData, err := marshalOptions.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+	return index, c.writeData("OSMHeader", rawData)
+}
+
+// add routes the elements of block.
+func (s *gridSplitter) add(block *pbfproto.PrimitiveBlock) error {
+	if s.header == nil {
+		return fmt.Errorf("the input has no OSMHeader before its data")
+	}
+	elements, err := decodeElements(block)
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+		var index uint16
+		switch e.kind {
+		case kindNodes:
+			if index, err = s.cell(grid.cell(s.area, e.lat, e.lon)); err != nil {
+				return err
+			}
+			s.nodes.set(e.id, index)
+		case kindWays:
+			for _, ref := range e.refs {
+				if index = s.nodes.get(ref); index != 0 {
+					break
+				}
+			}
+			s.ways.set(e.id, index)
+		case kindRelations:
+			for _, m := range e.members {
+				switch m.kind {
+				case kindNodes:
+					index = s.nodes.get(m.id)
+				case kindWays:
+					index = s.ways.get(m.id)
+				case kindRelations:
+					index = s.relations.get(m.id)
+				}
+				if index != 0 {
+					break
+				}
+			}
+			s.relations.set(e.id, index)
+		}
+		if index == 0 {
+			s.unlocated++
+			continue
+		}
+		c := s.cells[index-1]
+		if err = c.add(e); err != nil {
+			return fmt.Errorf("could not write %s: %v", c.path, err)
+		}
+	}
+	return nil
+}
+
+// convertGrid converts inFile into one output per cell of grid.
+func convertGrid() {
+	began := time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	_, input, closeInput := openInput()
+	defer closeInput()
+	s := &gridSplitter{
+		area:      worldBounds,
+		keys:      make(map[cellKey]uint16),
+		nodes:     make(cellIndex),
+		ways:      make(cellIndex),
+		relations: make(cellIndex),
+	}
+	var buf []byte
+	for {
+		if ctx.Err() != nil {
+			fatal("The conversion has been canceled")
+		}
+		stageBegan := time.Now()
+		blobHeader, err := readBlobHeader(input)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalCode(inputCode(err), "Could not read BlobHeader", "err", err)
+		}
+		blob, err := readBlob(blobHeader, input)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read Blob", "err", err)
+		}
+		times.read += since(&stageBegan)
+		if buf, err = pbf.AppendDecompressed(buf[:0], blob); err != nil {
+			fatalCode(inputCode(err), "Could not decompress Blob", "err", err)
+		}
+		blob.ReturnToVTPool()
+		times.decompress += since(&stageBegan)
+		switch blobHeader.GetType() {
+		case "OSMHeader":
+			s.header = &pbfproto.HeaderBlock{}
+			if err = proto.Unmarshal(buf, s.header); err != nil {
+				fatalCode(inputCode(err), "Could not parse OSMHeader", "err", err)
+			}
+			if b := s.header.Bbox; b != nil && grid.columns > 0 {
+				s.area = bounds{left: b.GetLeft(), right: b.GetRight(), top: b.GetTop(), bottom: b.GetBottom()}
+			}
+		case "OSMData":
+			block := &pbfproto.PrimitiveBlock{}
+			if err = proto.Unmarshal(buf, block); err != nil {
+				fatalCode(inputCode(err), "Could not parse PrimitiveBlock", "err", err)
+			}
+			if err = s.add(block); err != nil {
+				fatal("Could not split data block", "err", err)
+			}
+		}
+	}
+	for _, c := range s.cells {
+		if err := c.flush(); err != nil {
+			fatalCode(exitOutput, "Could not write file", "file", c.path, "err", err)
+		}
+		if err := fsync.syncEnd(c.f); err != nil {
+			fatalCode(exitOutput, "Could not sync file", "file", c.path, "err", err)
+		}
+		if err := commitOutput(c.f, c.path); err != nil {
+			fatalCode(exitOutput, "Could not write file", "file", c.path, "err", err)
+		}
+	}
+	if s.unlocated > 0 {
+		slog.Warn("Dropped elements, whose members are not in the input", "elements", s.unlocated)
+	}
+	slog.Info("Split the input", "cells", len(s.cells), "duration", time.Since(began))
+	times.log(time.Since(began))
+	keepResults()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// hilbertZoom makes the conversion order the elements of each kind along
+// a Hilbert curve over the web mercator tiles of this zoom level, if it
+// is not 0.
+var hilbertZoom int
+
+// maxHilbertZoom keeps the positions on the curve within 31 bits.
+const maxHilbertZoom = 15
+
+// hilbertIndex maps element IDs to their position on the curve plus one,
+// or 0, if it is unknown, in pages like cellIndex.
+type hilbertIndex map[int64]*[cellPageSize]uint32
+
+func (h hilbertIndex) set(id int64, d uint32) {
+	page := h[id>>16]
+	if page == nil {
+		page = new([cellPageSize]uint32)
+		h[id>>16] = page
+	}
+	page[id&(cellPageSize-1)] = d
+}
+
+func (h hilbertIndex) get(id int64) uint32 {
+	if page := h[id>>16]; page != nil {
+		return page[id&(cellPageSize-1)]
+	}
+	return 0
+}
+
+// hilbertPosition returns the position of the tile x, y on the Hilbert
+// curve, that fills a square of n times n tiles, where n is a power of
+// two.
+func hilbertPosition(n, x, y int) uint32 {
+	var d uint32
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry int
+		if x&s != 0 {
+			rx = 1
+		}
+		if y&s != 0 {
+			ry = 1
+		}
+		d += uint32(s) * uint32(s) * uint32((3*rx)^ry)
+		// Rotate the quadrant, so that the curve continues in it.
+		if ry == 0 {
+			if rx == 1 {
+				x, y = s-1-x, s-1-y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+// tilePosition returns the position of the tile of the node at lat and
+// lon, which are given in nanodegrees, plus one.
+func tilePosition(lat, lon int64) uint32 {
+	n := 1 << hilbertZoom
+	clamp := func(v int) int {
+		return max(0, min(v, n-1))
+	}
+	latRad := math.Max(-maxMercatorLat, math.Min(maxMercatorLat, float64(lat)/1e9)) * math.Pi / 180
+	x := int((float64(lon)/1e9 + 180) / 360 * float64(n))
+	y := int((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * float64(n))
+	return hilbertPosition(n, clamp(x), clamp(y)) + 1
+}
+
+// hilbertSorter collects the elements of the input with their position
+// on the curve. Nodes are positioned by their tile, ways by their first
+// known node and relations by their first known member. Elements without
+// a known position are placed after all others.
+type hilbertSorter struct {
+	header    *pbfproto.HeaderBlock
+	elements  [3][]positionedElement // Nodes, ways and relations.
+	nodes     hilbertIndex
+	ways      hilbertIndex
+	relations hilbertIndex
+	unlocated int
+}
+
+type positionedElement struct {
+	position uint32
+	e        *osmElement
+}
+
+func (s *hilbertSorter) add(block *pbfproto.PrimitiveBlock) error {
+	elements, err := decodeElements(block)
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+		var position uint32
+		var kind int
+		switch e.kind {
+		case kindNodes:
+			position = tilePosition(e.lat, e.lon)
+			s.nodes.set(e.id, position)
+		case kindWays:
+			kind = 1
+			for _, ref := range e.refs {
+				if position = s.nodes.get(ref); position != 0 {
+					break
+				}
+			}
+			s.ways.set(e.id, position)
+		case kindRelations:
+			kind = 2
+			for _, m := range e.members {
+				switch m.kind {
+				case kindNodes:
+					position = s.nodes.get(m.id)
+				case kindWays:
+					position = s.ways.get(m.id)
+				case kindRelations:
+					position = s.relations.get(m.id)
+				}
+				if position != 0 {
+					break
+				}
+			}
+			s.relations.set(e.id, position)
+		}
+		if position == 0 {
+			s.unlocated++
+			position = math.MaxUint32
+		}
+		s.elements[kind] = append(s.elements[kind], positionedElement{position, e})
+	}
+	return nil
+}
+
+// write writes the OSMHeader and the elements ordered by position to out.
+// Elements at the same position keep their order.
+func (s *hilbertSorter) write(out *elementOutput) error {
+	header := proto.Clone(s.header).(*pbfproto.HeaderBlock)
+	// The elements are no longer sorted by ID.
+	header.OptionalFeatures = slices.DeleteFunc(header.OptionalFeatures, func(f string) bool {
+		return f == sortedFeature
+	})
+	rawData, err := marshalOptions.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err = out.writeData("OSMHeader", rawData); err != nil {
+		return err
+	}
+	for _, elements := range s.elements {
+		slices.SortStableFunc(elements, func(a, b positionedElement) int {
+			return cmp.Compare(a.position, b.position)
+		})
+		for _, p := range elements {
+			if err = out.add(p.e); err != nil {
+				return err
+			}
+		}
+	}
+	return out.flush()
+}
+
+// convertHilbert converts inFile into outFile with the elements ordered
+// along the Hilbert curve. All elements are held in memory.
+func convertHilbert() {
+	began := time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	_, input, closeInput := openInput()
+	defer closeInput()
+	s := &hilbertSorter{
+		nodes:     make(hilbertIndex),
+		ways:      make(hilbertIndex),
+		relations: make(hilbertIndex),
+	}
+	var buf []byte
+	for {
+		if ctx.Err() != nil {
+			fatal("The conversion has been canceled")
+		}
+		stageBegan := time.Now()
+		blobHeader, err := readBlobHeader(input)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalCode(inputCode(err), "Could not read BlobHeader", "err", err)
+		}
+		blob, err := readBlob(blobHeader, input)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read Blob", "err", err)
+		}
+		times.read += since(&stageBegan)
+		if buf, err = pbf.AppendDecompressed(buf[:0], blob); err != nil {
+			fatalCode(inputCode(err), "Could not decompress Blob", "err", err)
+		}
+		blob.ReturnToVTPool()
+		times.decompress += since(&stageBegan)
+		switch blobHeader.GetType() {
+		case "OSMHeader":
+			s.header = &pbfproto.HeaderBlock{}
+			if err = proto.Unmarshal(buf, s.header); err != nil {
+				fatalCode(inputCode(err), "Could not parse OSMHeader", "err", err)
+			}
+		case "OSMData":
+			if s.header == nil {
+				fatalCode(exitInput, "The input has no OSMHeader before its data")
+			}
+			block := &pbfproto.PrimitiveBlock{}
+			if err = proto.Unmarshal(buf, block); err != nil {
+				fatalCode(inputCode(err), "Could not parse PrimitiveBlock", "err", err)
+			}
+			if err = s.add(block); err != nil {
+				fatalCode(inputCode(err), "Could not decode data block", "err", err)
+			}
+			times.transform += since(&stageBegan)
+		}
+	}
+	if s.header == nil {
+		fatalCode(exitInput, "The input has no OSMHeader")
+	}
+	f, err := createOutput(outFile)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", outFile, "err", err)
+	}
+	onFatal(func() { os.Remove(f.Name()) })
+	out := &elementOutput{teeWriter: teeWriter{f: f}, path: outFile}
+	if err = s.write(out); err != nil {
+		fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+	}
+	if err = fsync.syncEnd(f); err != nil {
+		fatalCode(exitOutput, "Could not sync file", "file", outFile, "err", err)
+	}
+	if err = commitOutput(f, outFile); err != nil {
+		fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+	}
+	if s.unlocated > 0 {
+		slog.Warn("Placed elements, whose members are not in the input, at the end", "elements", s.unlocated)
+	}
+	slog.Info("Ordered the elements along the Hilbert curve", "zoom", hilbertZoom,
+		"blobs", out.blobs, "duration", time.Since(began))
+	times.log(time.Since(began))
+	keepResults()
+}
@@ -0,0 +1,244 @@
+package main
+
+import "github.com/codesoap/zstd-pbf/pbfproto"
+
+// historyFilter selects versions of the objects in a history file. The
+// versions of an object can be spread over consecutive blocks, so blocks
+// are held back until all of their objects are complete. The input must
+// be sorted by type, ID and version, as history files are.
+type historyFilter struct {
+	// decide is called with all versions of an object in order and
+	// clears the keep flag of the versions that shall be dropped.
+	decide func(versions []*objectVersion)
+
+	// stripVisible removes the visible flags from the output.
+	stripVisible bool
+
+	pending  []*historyBlock
+	current  objectKey
+	versions []*objectVersion
+	first    *historyBlock // Contains the first of versions.
+}
+
+type objectKey struct {
+	kind groupKindType
+	id   int64
+}
+
+// objectVersion is the part of an element, which is relevant to decide
+// whether a version is kept.
+type objectVersion struct {
+	timestamp int64 // In milliseconds since the epoch.
+	visible   bool
+	keep      bool
+}
+
+type historyBlock struct {
+	block    *pbfproto.PrimitiveBlock
+	versions [][]*objectVersion // For each group.
+	dense    [][]denseNode      // For each group; nil unless dense.
+}
+
+// add adds block to the filter and returns the blocks, whose objects
+// have all been decided.
+func (h *historyFilter) add(block *pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error) {
+	hb := &historyBlock{
+		block:    block,
+		versions: make([][]*objectVersion, len(block.Primitivegroup)),
+		dense:    make([][]denseNode, len(block.Primitivegroup)),
+	}
+	h.pending = append(h.pending, hb)
+	dateGranularity := int64(block.GetDateGranularity())
+	for i, group := range block.Primitivegroup {
+		add := func(kind groupKindType, id int64, info *pbfproto.Info) {
+			v := &objectVersion{visible: true, keep: true}
+			if info != nil {
+				v.timestamp = info.GetTimestamp() * dateGranularity
+				v.visible = info.Visible == nil || *info.Visible
+			}
+			h.addVersion(hb, objectKey{kind, id}, v)
+			hb.versions[i] = append(hb.versions[i], v)
+		}
+		for _, node := range group.Nodes {
+			add(kindNodes, node.GetId(), node.Info)
+		}
+		if group.Dense != nil {
+			nodes, err := decodeDenseNodes(group.Dense)
+			if err != nil {
+				return nil, err
+			}
+			hasInfo, hasVisible := denseHasInfo(group.Dense)
+			for _, node := range nodes {
+				v := &objectVersion{visible: true, keep: true}
+				if hasInfo {
+					v.timestamp = node.timestamp * dateGranularity
+				}
+				if hasVisible {
+					v.visible = node.visible
+				}
+				// Dense and regular nodes share the same ID space.
+				h.addVersion(hb, objectKey{kindNodes, node.id}, v)
+				hb.versions[i] = append(hb.versions[i], v)
+			}
+			hb.dense[i] = nodes
+		}
+		for _, way := range group.Ways {
+			add(kindWays, way.GetId(), way.Info)
+		}
+		for _, relation := range group.Relations {
+			add(kindRelations, relation.GetId(), relation.Info)
+		}
+	}
+
+	// All blocks before the one containing the first version of the
+	// current object are complete.
+	var done []*pbfproto.PrimitiveBlock
+	for len(h.pending) > 0 && h.pending[0] != h.first {
+		block, err := h.finish(h.pending[0])
+		if err != nil {
+			return nil, err
+		}
+		if block != nil {
+			done = append(done, block)
+		}
+		h.pending = h.pending[1:]
+	}
+	return done, nil
+}
+
+// flush decides the last object and returns all remaining blocks.
+func (h *historyFilter) flush() ([]*pbfproto.PrimitiveBlock, error) {
+	if len(h.versions) > 0 {
+		h.decide(h.versions)
+		h.versions = nil
+	}
+	var done []*pbfproto.PrimitiveBlock
+	for _, hb := range h.pending {
+		block, err := h.finish(hb)
+		if err != nil {
+			return nil, err
+		}
+		if block != nil {
+			done = append(done, block)
+		}
+	}
+	h.pending = nil
+	return done, nil
+}
+
+func (h *historyFilter) addVersion(hb *historyBlock, key objectKey, v *objectVersion) {
+	if len(h.versions) > 0 && key != h.current {
+		h.decide(h.versions)
+		h.versions = nil
+	}
+	if len(h.versions) == 0 {
+		h.current, h.first = key, hb
+	}
+	h.versions = append(h.versions, v)
+}
+
+// finish drops the versions, which shall not be kept, from hb. Nil is
+// returned, if no elements remain.
+func (h *historyFilter) finish(hb *historyBlock) (*pbfproto.PrimitiveBlock, error) {
+	var groups []*pbfproto.PrimitiveGroup
+	for i, group := range hb.block.Primitivegroup {
+		versions := hb.versions[i]
+		j := 0
+		next := func() bool {
+			keep := versions[j].keep
+			j++
+			return keep
+		}
+		group.Nodes = filter(group.Nodes, func(node *pbfproto.Node) bool { return next() })
+		if group.Dense != nil {
+			hasInfo, hasVisible := denseHasInfo(group.Dense)
+			nodes := filter(hb.dense[i], func(denseNode) bool { return next() })
+			group.Dense = encodeDenseNodes(nodes, hasInfo, hasVisible && !h.stripVisible)
+		}
+		group.Ways = filter(group.Ways, func(way *pbfproto.Way) bool { return next() })
+		group.Relations = filter(group.Relations, func(r *pbfproto.Relation) bool { return next() })
+		if h.stripVisible {
+			for _, node := range group.Nodes {
+				stripVisible(node.Info)
+			}
+			for _, way := range group.Ways {
+				stripVisible(way.Info)
+			}
+			for _, relation := range group.Relations {
+				stripVisible(relation.Info)
+			}
+		}
+		if groupKind(group) != kindEmpty {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	hb.block.Primitivegroup = groups
+	return hb.block, nil
+}
+
+func stripVisible(info *pbfproto.Info) {
+	if info != nil {
+		info.Visible = nil
+	}
+}
+
+// filter returns the elements of s for which keep returns true. keep is
+// called for every element in order.
+func filter[T any](s []T, keep func(T) bool) []T {
+	var kept []T
+	for _, e := range s {
+		if keep(e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// snapshotDecider keeps only the version of an object, that was current
+// at timestamp, which is given in milliseconds since the epoch.
+// Objects that did not exist or were deleted at that time are dropped.
+func snapshotDecider(timestamp int64) func([]*objectVersion) {
+	return func(versions []*objectVersion) {
+		current := -1
+		for i, v := range versions {
+			if v.timestamp <= timestamp {
+				current = i
+			}
+		}
+		for i, v := range versions {
+			v.keep = v.keep && i == current && v.visible
+		}
+	}
+}
+
+// dropDeletedDecider drops all versions of objects, whose latest version
+// is a deletion.
+func dropDeletedDecider(versions []*objectVersion) {
+	if versions[len(versions)-1].visible {
+		return
+	}
+	for _, v := range versions {
+		v.keep = false
+	}
+}
+
+// chainDeciders combines deciders, so that a version is only kept if
+// no decider drops it.
+func chainDeciders(deciders []func([]*objectVersion)) func([]*objectVersion) {
+	return func(versions []*objectVersion) {
+		for _, decide := range deciders {
+			decide(versions)
+		}
+	}
+}
+
+// stripHistoricalInformation removes the HistoricalInformation feature
+// from header.
+func stripHistoricalInformation(header *pbfproto.HeaderBlock) {
+	header.RequiredFeatures = filter(header.RequiredFeatures, func(f string) bool {
+		return f != "HistoricalInformation"
+	})
+}
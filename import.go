@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Input formats other than PBF, that are converted into PBF.
+const (
+	importXML = "OSM XML"
+	importO5M = "o5m"
+)
+
+// o5mMagic starts every o5m file: a reset and the header dataset.
+var o5mMagic = []byte{0xff, 0xe0, 0x04, 'o', '5', 'm', '2'}
+
+// sniffImportFormat returns the format of input, if it is OSM XML or
+// o5m, or "" otherwise. input is rewound afterwards.
+func sniffImportFormat(input io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(input, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err = input.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	start := bytes.TrimLeft(bytes.TrimPrefix(buf[:n], []byte("\xef\xbb\xbf")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(start, o5mMagic):
+		return importO5M, nil
+	case bytes.HasPrefix(start, []byte("<?xml")) || bytes.HasPrefix(start, []byte("<osm")):
+		return importXML, nil
+	}
+	return "", nil
+}
+
+// importer packs the elements of an input in another format into data
+// blocks. The OSMHeader is written before the first element, since
+// whether the input is a history file is only known then.
+type importer struct {
+	out           *elementOutput
+	header        *pbfproto.HeaderBlock
+	headerWritten bool
+	elements      int
+	deleted       int // Written in a file without HistoricalInformation.
+}
+
+func newImporter(out *elementOutput) *importer {
+	return &importer{out: out, header: &pbfproto.HeaderBlock{
+		RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"},
+		Writingprogram:   proto.String("zstd-pbf"),
+	}}
+}
+
+func (im *importer) setBounds(b bounds) {
+	im.header.Bbox = &pbfproto.HeaderBBox{Left: &b.left, Right: &b.right, Top: &b.top, Bottom: &b.bottom}
+}
+
+func (im *importer) writeHeader() error {
+	im.headerWritten = true
+	rawData, err := marshalOptions.Marshal(im.header)
+	if err != nil {
+		return err
+	}
+	return im.out.writeData("OSMHeader", rawData)
+}
+
+// add writes e. history tells, whether the input contains the visible
+// flags of a history file, which is decided by the first element of an
+// OSM XML file; o5m files are never considered history files.
+func (im *importer) add(e *osmElement, history bool) error {
+	if !im.headerWritten {
+		if history {
+			im.header.RequiredFeatures = append(im.header.RequiredFeatures, "HistoricalInformation")
+		}
+		if err := im.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if e.info != nil && !e.info.visible && !history {
+		im.deleted++
+	}
+	im.elements++
+	return im.out.add(e)
+}
+
+func (im *importer) finish() error {
+	if !im.headerWritten {
+		if err := im.writeHeader(); err != nil {
+			return err
+		}
+	}
+	return im.out.flush()
+}
+
+// importXMLFile reads the OSM XML file r.
+func (im *importer) importXMLFile(r io.Reader) error {
+	decoder := xml.NewDecoder(r)
+	history := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch name := start.Name.Local; name {
+		case "osmChange":
+			return fmt.Errorf("OsmChange files can only be applied to a PBF file with -apply-diff")
+		case "bounds":
+			var x struct {
+				MinLat string `xml:"minlat,attr"`
+				MinLon string `xml:"minlon,attr"`
+				MaxLat string `xml:"maxlat,attr"`
+				MaxLon string `xml:"maxlon,attr"`
+			}
+			if err = decoder.DecodeElement(&x, &start); err != nil {
+				return err
+			}
+			var b bounds
+			for _, c := range []struct {
+				v *int64
+				s string
+			}{{&b.bottom, x.MinLat}, {&b.left, x.MinLon}, {&b.top, x.MaxLat}, {&b.right, x.MaxLon}} {
+				if *c.v, err = parseCoordinate(c.s); err != nil {
+					return fmt.Errorf("invalid bounds: %v", err)
+				}
+			}
+			im.setBounds(b)
+		case "node", "way", "relation":
+			var x xmlElement
+			if err = decoder.DecodeElement(&x, &start); err != nil {
+				return err
+			}
+			e, err := x.toElement(xmlKinds[name])
+			if err != nil {
+				return err
+			}
+			if im.elements == 0 {
+				history = x.Visible != ""
+			}
+			if err = im.add(e, history); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// o5mStringTableSize is the number of strings and string pairs, that
+// o5m references can point back to.
+const o5mStringTableSize = 15000
+
+// o5mMaxStoredString is the maximum length of a string or string pair,
+// including the terminating zeros, that is stored in the string table.
+const o5mMaxStoredString = 252
+
+// o5mReader decodes the datasets of an o5m file, see
+// https://wiki.openstreetmap.org/wiki/O5m.
+type o5mReader struct {
+	r     *bufio.Reader
+	table [o5mStringTableSize][]string
+	next  int // The index of the next entry of table.
+
+	// The string table and the delta coded values are reset by a reset
+	// dataset.
+	id, timestamp, changeset, lon, lat int64
+	wayRef                             int64
+	memberRefs                         [3]int64 // For nodes, ways and relations.
+
+	data []byte // The rest of the current dataset.
+}
+
+func (o *o5mReader) reset() {
+	o.id, o.timestamp, o.changeset, o.lon, o.lat, o.wayRef = 0, 0, 0, 0, 0, 0
+	o.memberRefs = [3]int64{}
+	o.table, o.next = [o5mStringTableSize][]string{}, 0
+}
+
+var errO5MDataset = errors.New("truncated o5m dataset")
+
+func (o *o5mReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(o.data)
+	if n <= 0 {
+		return 0, errO5MDataset
+	}
+	o.data = o.data[n:]
+	return v, nil
+}
+
+// varint reads a signed number, which o5m stores with the sign in the
+// lowest bit, like protobuf's sint64.
+func (o *o5mReader) varint() (int64, error) {
+	v, err := o.uvarint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+// delta adds the next signed number to *v and returns the new value.
+func (o *o5mReader) delta(v *int64) (int64, error) {
+	d, err := o.varint()
+	*v += d
+	return *v, err
+}
+
+// strings reads n strings, that are either given inline or reference
+// an earlier entry of the string table.
+func (o *o5mReader) strings(n int) ([]string, error) {
+	if len(o.data) == 0 {
+		return nil, errO5MDataset
+	}
+	if o.data[0] != 0 {
+		ref, err := o.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if ref == 0 || ref > o5mStringTableSize {
+			return nil, fmt.Errorf("invalid o5m string reference %d", ref)
+		}
+		s := o.table[(o.next-int(ref)+o5mStringTableSize)%o5mStringTableSize]
+		if len(s) != n {
+			return nil, fmt.Errorf("invalid o5m string reference %d", ref)
+		}
+		return s, nil
+	}
+	o.data = o.data[1:]
+	s := make([]string, n)
+	size := 0
+	for i := range s {
+		end := bytes.IndexByte(o.data, 0)
+		if end < 0 {
+			return nil, errO5MDataset
+		}
+		s[i] = string(o.data[:end])
+		o.data = o.data[end+1:]
+		size += end + 1
+	}
+	if size <= o5mMaxStoredString {
+		o.table[o.next] = s
+		o.next = (o.next + 1) % o5mStringTableSize
+	}
+	return s, nil
+}
+
+// info reads the version and author section. It returns nil, if there
+// is none.
+func (o *o5mReader) info() (*osmInfo, error) {
+	version, err := o.uvarint()
+	if err != nil || version == 0 {
+		return nil, err
+	}
+	info := &osmInfo{version: int32(version), visible: true}
+	timestamp, err := o.delta(&o.timestamp)
+	if err != nil || timestamp == 0 {
+		return info, err
+	}
+	info.timestamp = timestamp * 1000
+	if info.changeset, err = o.delta(&o.changeset); err != nil {
+		return nil, err
+	}
+	author, err := o.strings(2)
+	if err != nil {
+		return nil, err
+	}
+	uid, _ := binary.Uvarint([]byte(author[0]))
+	info.uid, info.user = int32(uid), author[1]
+	return info, nil
+}
+
+// tags reads the tags at the end of a dataset.
+func (o *o5mReader) tags() ([]tag, error) {
+	var tags []tag
+	for len(o.data) > 0 {
+		pair, err := o.strings(2)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag{pair[0], pair[1]})
+	}
+	return tags, nil
+}
+
+// element decodes a node, way or relation dataset. A dataset, that ends
+// after the author section, is a deleted object.
+func (o *o5mReader) element(kind groupKindType) (*osmElement, error) {
+	id, err := o.delta(&o.id)
+	if err != nil {
+		return nil, err
+	}
+	e := &osmElement{kind: kind, id: id}
+	if e.info, err = o.info(); err != nil {
+		return nil, err
+	}
+	if len(o.data) == 0 {
+		if e.info == nil {
+			e.info = &osmInfo{}
+		}
+		e.info.visible = false
+		return e, nil
+	}
+	switch kind {
+	case kindNodes:
+		lon, err := o.delta(&o.lon)
+		if err != nil {
+			return nil, err
+		}
+		lat, err := o.delta(&o.lat)
+		if err != nil {
+			return nil, err
+		}
+		e.lon, e.lat = lon*100, lat*100
+	case kindWays, kindRelations:
+		size, err := o.uvarint()
+		if err != nil || size > uint64(len(o.data)) {
+			return nil, errO5MDataset
+		}
+		tail := o.data[size:]
+		o.data = o.data[:size]
+		for len(o.data) > 0 {
+			if kind == kindWays {
+				ref, err := o.delta(&o.wayRef)
+				if err != nil {
+					return nil, err
+				}
+				e.refs = append(e.refs, ref)
+				continue
+			}
+			d, err := o.varint()
+			if err != nil {
+				return nil, err
+			}
+			typeRole, err := o.strings(1)
+			if err != nil {
+				return nil, err
+			}
+			if typeRole[0] == "" || typeRole[0][0] < '0' || typeRole[0][0] > '2' {
+				return nil, fmt.Errorf("invalid o5m member type in r%d", id)
+			}
+			t := typeRole[0][0] - '0'
+			o.memberRefs[t] += d
+			memberKind := []groupKindType{kindNodes, kindWays, kindRelations}[t]
+			e.members = append(e.members, member{memberKind, o.memberRefs[t], typeRole[0][1:]})
+		}
+		o.data = tail
+	}
+	e.tags, err = o.tags()
+	return e, err
+}
+
+// importO5MFile reads the o5m file r.
+func (im *importer) importO5MFile(r io.Reader) error {
+	o := &o5mReader{r: bufio.NewReaderSize(r, 1<<20)}
+	for {
+		datasetType, err := o.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case datasetType == 0xff:
+			o.reset()
+			continue
+		case datasetType == 0xfe:
+			return nil // The end of the file.
+		case datasetType >= 0xf0:
+			continue // Datasets without content.
+		}
+		size, err := binary.ReadUvarint(o.r)
+		if err != nil {
+			return errO5MDataset
+		}
+		if size > maxBlockSize {
+			return fmt.Errorf("o5m dataset of %d bytes is too large", size)
+		}
+		if uint64(cap(o.data)) < size {
+			o.data = make([]byte, size)
+		}
+		o.data = o.data[:size]
+		if _, err = io.ReadFull(o.r, o.data); err != nil {
+			return errO5MDataset
+		}
+		var e *osmElement
+		switch datasetType {
+		case 0x10:
+			e, err = o.element(kindNodes)
+		case 0x11:
+			e, err = o.element(kindWays)
+		case 0x12:
+			e, err = o.element(kindRelations)
+		case 0xdb:
+			var b bounds
+			for _, v := range []*int64{&b.left, &b.bottom, &b.right, &b.top} {
+				if *v, err = o.varint(); err != nil {
+					return err
+				}
+				*v *= 100
+			}
+			im.setBounds(b)
+		case 0xdc:
+			timestamp, err := o.varint()
+			if err != nil {
+				return err
+			}
+			im.header.OsmosisReplicationTimestamp = &timestamp
+		}
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			if err = im.add(e, false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// convertImport converts input, which is in the given format, to
+// outFile.
+func convertImport(input io.Reader, format string) {
+	began := time.Now()
+	if !onlyCompressionOptions() {
+		fatalCode(exitUsage, "Inputs in other formats than PBF can only be converted with options, that choose the compression", "format", format)
+	}
+	f, err := createOutput(outFile)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", outFile, "err", err)
+	}
+	onFatal(func() { os.Remove(f.Name()) })
+	im := newImporter(&elementOutput{teeWriter: teeWriter{f: f}, path: outFile})
+	if format == importO5M {
+		err = im.importO5MFile(input)
+	} else {
+		err = im.importXMLFile(input)
+	}
+	if err != nil {
+		fatalCode(inputCode(err), "Could not import file", "file", inFile, "format", format, "err", err)
+	}
+	if err = im.finish(); err != nil {
+		fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+	}
+	if err = fsync.syncEnd(f); err != nil {
+		fatalCode(exitOutput, "Could not sync file", "file", outFile, "err", err)
+	}
+	if err = commitOutput(f, outFile); err != nil {
+		fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+	}
+	if im.deleted > 0 {
+		slog.Warn("The input contains deleted objects, but is no history file", "objects", im.deleted)
+	}
+	slog.Info("Imported the input", "format", format, "elements", im.elements, "duration", time.Since(began))
+	times.log(time.Since(began))
+	keepResults()
+}
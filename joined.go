@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// joinedBlobType is the type of the nonstandard blobs, that join-blobs
+// writes. Their data is a single zstd frame of the uncompressed data of
+// consecutive OSMData blobs, so that zstd can exploit the redundancy
+// between them. Other readers skip such blobs, as the specification
+// demands, and thereby miss their elements.
+//
+// The indexdata of the BlobHeader is the index of the joined blobs: for
+// each of them the length of its type as a uvarint, the type, the length
+// of its uncompressed data as a uvarint, the length of its indexdata as a
+// uvarint and the indexdata.
+const joinedBlobType = "ZstdPbfJoined"
+
+// defaultJoinedBlobs is the default number of blobs, that are joined.
+const defaultJoinedBlobs = 8
+
+// joinedEntry is a blob within a joined blob.
+type joinedEntry struct {
+	blobType  string
+	rawSize   int
+	indexdata []byte
+}
+
+func appendJoinedEntry(index []byte, e joinedEntry) []byte {
+	index = binary.AppendUvarint(index, uint64(len(e.blobType)))
+	index = append(index, e.blobType...)
+	index = binary.AppendUvarint(index, uint64(e.rawSize))
+	index = binary.AppendUvarint(index, uint64(len(e.indexdata)))
+	return append(index, e.indexdata...)
+}
+
+// maxJoinedIndexSize is the largest index of a joined blob. It leaves
+// room for the rest of the BlobHeader below pbf.MaxBlobHeaderSize.
+const maxJoinedIndexSize = pbf.MaxBlobHeaderSize - 1024
+
+// parseJoinedIndex parses the index of a joined blob, that holds rawSize
+// bytes of uncompressed data.
+func parseJoinedIndex(index []byte, rawSize int) ([]joinedEntry, error) {
+	var entries []joinedEntry
+	total := 0
+	for len(index) > 0 {
+		n, l := binary.Uvarint(index)
+		if l <= 0 || n > uint64(len(index)-l) {
+			return nil, fmt.Errorf("invalid index")
+		}
+		blobType := string(index[l : l+int(n)])
+		index = index[l+int(n):]
+		size, l := binary.Uvarint(index)
+		if l <= 0 || size > uint64(rawSize-total) {
+			return nil, fmt.Errorf("invalid index")
+		}
+		index = index[l:]
+		n, l = binary.Uvarint(index)
+		if l <= 0 || n > uint64(len(index)-l) {
+			return nil, fmt.Errorf("invalid index")
+		}
+		var indexdata []byte
+		if n > 0 {
+			indexdata = index[l : l+int(n)]
+		}
+		index = index[l+int(n):]
+		entries = append(entries, joinedEntry{blobType, int(size), indexdata})
+		total += int(size)
+	}
+	if total != rawSize {
+		return nil, fmt.Errorf("index covers %d of %d bytes", total, rawSize)
+	}
+	return entries, nil
+}
+
+func runJoinBlobs(args []string) {
+	flags := flag.NewFlagSet("join-blobs", flag.ExitOnError)
+	maxBlobs := flags.Int("blobs", defaultJoinedBlobs, "join up to `N` consecutive data blobs")
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf join-blobs [-blobs N] [-yes] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Compress runs of consecutive data blobs of IN_FILE into a single zstd\n"+
+			"frame each. This is experimental: OUT_FILE can only be read after\n"+
+			"converting it back with split-blobs, since other readers skip the\n"+
+			"joined blobs.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 2 {
+		fatalCode(exitUsage, "Give exactly two arguments: The input and output PBF files")
+	}
+	if *maxBlobs < 1 {
+		fatalCode(exitUsage, "The number of joined blobs must be positive")
+	}
+	convertFile(flags.Arg(0), flags.Arg(1), func(in io.ReadSeeker, out io.Writer) error {
+		blobs, runs, err := joinBlobs(in, out, *maxBlobs)
+		if err == nil {
+			slog.Info("Joined blobs", "blobs", blobs, "joined_blobs", runs)
+		}
+		return err
+	})
+}
+
+func runSplitBlobs(args []string) {
+	flags := flag.NewFlagSet("split-blobs", flag.ExitOnError)
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf split-blobs [-yes] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Convert a file written by join-blobs back to the standard layout of\n"+
+			"one zstd frame per blob.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 2 {
+		fatalCode(exitUsage, "Give exactly two arguments: The input and output PBF files")
+	}
+	convertFile(flags.Arg(0), flags.Arg(1), func(in io.ReadSeeker, out io.Writer) error {
+		blobs, err := splitBlobs(in, out)
+		if err == nil {
+			slog.Info("Split blobs", "blobs", blobs)
+		}
+		return err
+	})
+}
+
+// convertFile writes outFile with f from inFile. An existing outFile is
+// only replaced, if f succeeds.
+func convertFile(inFile, outFile string, f func(in io.ReadSeeker, out io.Writer) error) {
+	checkOutput(outFile, inFile)
+	in, err := os.Open(inFile)
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", inFile, "err", err)
+	}
+	defer in.Close()
+	out, err := createOutput(outFile)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", outFile, "err", err)
+	}
+	defer out.Close()
+	err = f(in, out)
+	if err == nil {
+		err = commitOutput(out, outFile)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		fatal("Could not convert file", "err", err)
+	}
+}
+
+// joinBlobs copies the blobs of in to out, but joins up to maxBlobs
+// consecutive OSMData blobs into one joinedBlobType blob. The
+// uncompressed data of a joined blob does not exceed maxBlockSize, unless
+// a single blob does. A footer is dropped, since it would not match out.
+func joinBlobs(in io.Reader, out io.Writer, maxBlobs int) (blobs, runs int, err error) {
+	var run, index []byte
+	members := 0
+	flush := func() error {
+		if members == 0 {
+			return nil
+		}
+		blob, err := compressData(run, codecZstd)
+		if err != nil {
+			return fmt.Errorf("could not compress Blob: %v", err)
+		}
+		if err = writeBlobFrame(joinedBlobType, index, blob, out); err != nil {
+			return err
+		}
+		run, index, members = run[:0], nil, 0
+		runs++
+		return nil
+	}
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return blobs, runs, fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		rawBlob, blob, err := readRawBlob(header, in)
+		if err != nil {
+			return blobs, runs, fmt.Errorf("could not read Blob: %v", err)
+		}
+		switch header.GetType() {
+		case footerBlobType:
+		case "OSMData":
+			rawData, err := pbf.Decompress(blob)
+			if err != nil {
+				return blobs, runs, err
+			}
+			entry := appendJoinedEntry(nil, joinedEntry{header.GetType(), len(rawData), header.GetIndexdata()})
+			if members == maxBlobs || members > 0 && (len(run)+len(rawData) > maxBlockSize ||
+				len(index)+len(entry) > maxJoinedIndexSize) {
+				if err = flush(); err != nil {
+					return blobs, runs, err
+				}
+			}
+			run = append(run, rawData...)
+			index = append(index, entry...)
+			members++
+			blobs++
+		default:
+			if err = flush(); err != nil {
+				return blobs, runs, err
+			}
+			if err = writeBlobHeader(header, out); err != nil {
+				return blobs, runs, fmt.Errorf("could not write BlobHeader: %v", err)
+			}
+			if _, err = out.Write(rawBlob); err != nil {
+				return blobs, runs, fmt.Errorf("could not write Blob: %v", err)
+			}
+		}
+		blob.ReturnToVTPool()
+	}
+	return blobs, runs, flush()
+}
+
+// splitBlobs copies the blobs of in to out, but compresses the blobs
+// within joinedBlobType blobs separately again.
+func splitBlobs(in io.Reader, out io.Writer) (blobs int, err error) {
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			return blobs, nil
+		} else if err != nil {
+			return blobs, fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		rawBlob, blob, err := readRawBlob(header, in)
+		if err != nil {
+			return blobs, fmt.Errorf("could not read Blob: %v", err)
+		}
+		switch header.GetType() {
+		case footerBlobType:
+		case joinedBlobType:
+			rawData, err := pbf.Decompress(blob)
+			if err != nil {
+				return blobs, err
+			}
+			entries, err := parseJoinedIndex(header.GetIndexdata(), len(rawData))
+			if err != nil {
+				return blobs, fmt.Errorf("could not read joined blob: %v", err)
+			}
+			for _, e := range entries {
+				member, err := compressData(rawData[:e.rawSize], codecZstd)
+				if err != nil {
+					return blobs, fmt.Errorf("could not compress Blob: %v", err)
+				}
+				if err = writeBlobFrame(e.blobType, e.indexdata, member, out); err != nil {
+					return blobs, err
+				}
+				rawData = rawData[e.rawSize:]
+				blobs++
+			}
+		default:
+			if err = writeBlobHeader(header, out); err != nil {
+				return blobs, fmt.Errorf("could not write BlobHeader: %v", err)
+			}
+			if _, err = out.Write(rawBlob); err != nil {
+				return blobs, fmt.Errorf("could not write Blob: %v", err)
+			}
+		}
+		blob.ReturnToVTPool()
+	}
+}
+
+// writeBlobFrame writes blob with a BlobHeader of blobType and
+// indexdata to out.
+func writeBlobFrame(blobType string, indexdata []byte, blob *pbfproto.Blob, out io.Writer) error {
+	rawBlob, err := marshalFraming(blob)
+	if err != nil {
+		return fmt.Errorf("could not serialize Blob: %v", err)
+	}
+	datasize := int32(len(rawBlob))
+	header := &pbfproto.BlobHeader{Type: &blobType, Indexdata: indexdata, Datasize: &datasize}
+	if err = writeBlobHeader(header, out); err != nil {
+		return fmt.Errorf("could not write BlobHeader: %v", err)
+	}
+	if _, err = out.Write(rawBlob); err != nil {
+		return fmt.Errorf("could not write Blob: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// blobInfo describes a single blob of a PBF file.
+type blobInfo struct {
+	Index     int    `json:"index"`
+	Offset    int64  `json:"offset"` // Of the BlobHeader's size prefix.
+	Type      string `json:"type"`
+	Codec     string `json:"codec"`
+	Checksum  *bool  `json:"checksum,omitempty"` // Only set for zstd.
+	Datasize  int    `json:"datasize"`
+	RawSize   int    `json:"raw_size"`
+	Nodes     int64  `json:"nodes"`
+	Ways      int64  `json:"ways"`
+	Relations int64  `json:"relations"`
+	BBox      *bbox  `json:"bbox,omitempty"`
+}
+
+// bbox is a bounding box in degrees.
+type bbox struct {
+	MinLon float64 `json:"min_lon"`
+	MinLat float64 `json:"min_lat"`
+	MaxLon float64 `json:"max_lon"`
+	MaxLat float64 `json:"max_lat"`
+}
+
+func (b *bbox) extend(lon, lat float64) {
+	b.MinLon, b.MaxLon = min(b.MinLon, lon), max(b.MaxLon, lon)
+	b.MinLat, b.MaxLat = min(b.MinLat, lat), max(b.MaxLat, lat)
+}
+
+func runList(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	format := flags.String("format", "text", "the output `format`: text, csv, json or geojson")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf list [-format text|csv|json|geojson] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Print the offset, codec, zstd checksum status, size, element counts and\n"+
+			"bounding box of every blob. geojson writes the bounding boxes as a\n"+
+			"FeatureCollection of polygons, to show how the blocks are laid out on a map.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	var w blobInfoWriter
+	switch *format {
+	case "text":
+		w = newTextBlobInfoWriter(os.Stdout)
+	case "csv":
+		w = newCSVBlobInfoWriter(os.Stdout)
+	case "json":
+		w = newJSONBlobInfoWriter(os.Stdout)
+	case "geojson":
+		w = newGeoJSONBlobInfoWriter(os.Stdout)
+	default:
+		fatalCode(exitUsage, "Unknown format", "format", *format)
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	for i := 0; ; i++ {
+		info, err := readBlobInfo(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalCode(inputCode(err), "Could not read blob", "blob", i, "err", err)
+		}
+		info.Index = i
+		if err = w.write(info); err != nil {
+			fatalCode(exitOutput, "Could not write output", "err", err)
+		}
+	}
+	if err = w.close(); err != nil {
+		fatalCode(exitOutput, "Could not write output", "err", err)
+	}
+}
+
+// readBlobInfo reads the next blob from in and describes it.
+func readBlobInfo(in io.ReadSeeker) (*blobInfo, error) {
+	offset, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	header, err := readBlobHeader(in)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := readBlob(header, in)
+	if err != nil {
+		return nil, fmt.Errorf("could not read Blob: %v", err)
+	}
+	info := &blobInfo{
+		Offset:   offset,
+		Type:     header.GetType(),
+		Codec:    pbf.Codec(blob),
+		Datasize: int(header.GetDatasize()),
+	}
+	if data, ok := blob.Data.(*pbfproto.Blob_ZstdData); ok {
+		var frame zstd.Header
+		if err = frame.Decode(data.ZstdData); err != nil {
+			return nil, fmt.Errorf("could not decode zstd frame header: %v", err)
+		}
+		info.Checksum = &frame.HasCheckSum
+	}
+	rawData, err := pbf.Decompress(blob)
+	if err != nil {
+		return nil, err
+	}
+	info.RawSize = len(rawData)
+	if info.Type != "OSMData" {
+		return info, nil
+	}
+	block := &pbfproto.PrimitiveBlock{}
+	if err = proto.Unmarshal(rawData, block); err != nil {
+		return nil, fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+	}
+	err = visitElements(block, func(e *element) {
+		switch e.kind {
+		case kindNodes:
+			info.Nodes++
+		case kindWays:
+			info.Ways++
+		case kindRelations:
+			info.Relations++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	info.BBox, err = blockBBox(block)
+	return info, err
+}
+
+// blockBBox returns the bounding box of the nodes in block or nil, if
+// there are none.
+func blockBBox(block *pbfproto.PrimitiveBlock) (*bbox, error) {
+	var b *bbox
+	extend := func(lat, lon int64) {
+		latDeg, lonDeg := pbf.Degrees(block, lat, lon)
+		if b == nil {
+			b = &bbox{MinLon: lonDeg, MinLat: latDeg, MaxLon: lonDeg, MaxLat: latDeg}
+		}
+		b.extend(lonDeg, latDeg)
+	}
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			extend(node.GetLat(), node.GetLon())
+		}
+		if group.Dense != nil {
+			nodes, err := decodeDenseNodes(group.Dense)
+			if err != nil {
+				return nil, err
+			}
+			for _, node := range nodes {
+				extend(node.lat, node.lon)
+			}
+		}
+	}
+	return b, nil
+}
+
+type blobInfoWriter interface {
+	write(info *blobInfo) error
+	close() error
+}
+
+type textBlobInfoWriter struct {
+	w *tabwriter.Writer
+}
+
+func newTextBlobInfoWriter(w io.Writer) *textBlobInfoWriter {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "INDEX\tOFFSET\tTYPE\tCODEC\tCHECKSUM\tSIZE\tRAW_SIZE\tNODES\tWAYS\tRELATIONS\tBBOX\t")
+	return &textBlobInfoWriter{w: tw}
+}
+
+func (t *textBlobInfoWriter) write(info *blobInfo) error {
+	bbox := "-"
+	if b := info.BBox; b != nil {
+		bbox = fmt.Sprintf("%.7f,%.7f,%.7f,%.7f", b.MinLon, b.MinLat, b.MaxLon, b.MaxLat)
+	}
+	checksum := "-"
+	if info.Checksum != nil {
+		checksum = map[bool]string{true: "yes", false: "no"}[*info.Checksum]
+	}
+	_, err := fmt.Fprintf(t.w, "%d\t%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t\n",
+		info.Index, info.Offset, info.Type, info.Codec, checksum, info.Datasize,
+		info.RawSize, info.Nodes, info.Ways, info.Relations, bbox)
+	return err
+}
+
+func (t *textBlobInfoWriter) close() error {
+	return t.w.Flush()
+}
+
+type csvBlobInfoWriter struct {
+	w *csv.Writer
+}
+
+func newCSVBlobInfoWriter(w io.Writer) *csvBlobInfoWriter {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"index", "offset", "type", "codec", "checksum", "datasize", "raw_size",
+		"nodes", "ways", "relations", "min_lon", "min_lat", "max_lon", "max_lat"})
+	return &csvBlobInfoWriter{w: cw}
+}
+
+func (c *csvBlobInfoWriter) write(info *blobInfo) error {
+	record := []string{
+		strconv.Itoa(info.Index),
+		strconv.FormatInt(info.Offset, 10),
+		info.Type,
+		info.Codec,
+		"",
+		strconv.Itoa(info.Datasize),
+		strconv.Itoa(info.RawSize),
+		strconv.FormatInt(info.Nodes, 10),
+		strconv.FormatInt(info.Ways, 10),
+		strconv.FormatInt(info.Relations, 10),
+		"", "", "", "",
+	}
+	if info.Checksum != nil {
+		record[4] = strconv.FormatBool(*info.Checksum)
+	}
+	if b := info.BBox; b != nil {
+		for i, f := range []float64{b.MinLon, b.MinLat, b.MaxLon, b.MaxLat} {
+			record[10+i] = strconv.FormatFloat(f, 'f', 7, 64)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvBlobInfoWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonBlobInfoWriter writes a JSON array with one object per blob.
+type jsonBlobInfoWriter struct {
+	w     io.Writer
+	first bool
+}
+
+func newJSONBlobInfoWriter(w io.Writer) *jsonBlobInfoWriter {
+	return &jsonBlobInfoWriter{w: w, first: true}
+}
+
+func (j *jsonBlobInfoWriter) write(info *blobInfo) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if j.first {
+		sep, j.first = "[\n", false
+	}
+	_, err = fmt.Fprintf(j.w, "%s%s", sep, raw)
+	return err
+}
+
+func (j *jsonBlobInfoWriter) close() error {
+	end := "\n]\n"
+	if j.first {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+// geoJSONBlobInfoWriter writes a GeoJSON FeatureCollection with the
+// bounding box of every blob as a polygon. Blobs without nodes have no
+// bounding box and are left out.
+type geoJSONBlobInfoWriter struct {
+	w     io.Writer
+	first bool
+}
+
+// geoJSONFeature is a blob in the output of a geoJSONBlobInfoWriter.
+type geoJSONFeature struct {
+	Type       string     `json:"type"`
+	BBox       []float64  `json:"bbox"`
+	Geometry   geoJSONBox `json:"geometry"`
+	Properties *blobInfo  `json:"properties"`
+}
+
+type geoJSONBox struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+func newGeoJSONBlobInfoWriter(w io.Writer) *geoJSONBlobInfoWriter {
+	return &geoJSONBlobInfoWriter{w: w, first: true}
+}
+
+func (g *geoJSONBlobInfoWriter) write(info *blobInfo) error {
+	b := info.BBox
+	if b == nil {
+		return nil
+	}
+	properties := *info
+	properties.BBox = nil // It is given by the feature itself.
+	raw, err := json.Marshal(geoJSONFeature{
+		Type: "Feature",
+		BBox: []float64{b.MinLon, b.MinLat, b.MaxLon, b.MaxLat},
+		Geometry: geoJSONBox{
+			Type: "Polygon",
+			Coordinates: [][][2]float64{{
+				{b.MinLon, b.MinLat}, {b.MaxLon, b.MinLat}, {b.MaxLon, b.MaxLat},
+				{b.MinLon, b.MaxLat}, {b.MinLon, b.MinLat},
+			}},
+		},
+		Properties: &properties,
+	})
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if g.first {
+		sep, g.first = `{"type":"FeatureCollection","features":[`+"\n", false
+	}
+	_, err = fmt.Fprintf(g.w, "%s%s", sep, raw)
+	return err
+}
+
+func (g *geoJSONBlobInfoWriter) close() error {
+	end := "\n]}\n"
+	if g.first {
+		end = `{"type":"FeatureCollection","features":[]}` + "\n"
+	}
+	_, err := io.WriteString(g.w, end)
+	return err
+}
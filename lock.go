@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overwrite makes checkOutput replace existing outputs without asking.
+var overwrite bool
+
+// addOverwriteFlag adds -yes to the flags of a command, that writes
+// files.
+func addOverwriteFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&overwrite, "yes", false, "overwrite existing output files without asking")
+}
+
+// checkedOutputs are the outputs, that checkOutput has accepted.
+var checkedOutputs = make(map[string]bool)
+
+// checkOutput exits, if the output file at path is one of the inputs,
+// if it is being written, naming the process writing it, or if it exists
+// and neither -yes is given nor the user agrees to overwrite it, when
+// asked on a terminal. An existing file is only replaced, once the
+// output has been written completely.
+func checkOutput(path string, inputs ...string) {
+	if stat, err := os.Stat(path); err == nil {
+		for _, input := range inputs {
+			if inStat, err := os.Stat(input); err == nil && os.SameFile(stat, inStat) {
+				fatalCode(exitUsage, "The output file is an input", "file", path)
+			}
+		}
+	}
+	if pid, ok := lockHolder(tempOutputPath(path)); ok {
+		fatalCode(exitOutput, "The output file is already being written", "file", path, "pid", pid)
+	}
+	if checkedOutputs[path] {
+		return
+	}
+	if _, err := os.Stat(path); err == nil &&
+		!overwrite && !confirm(fmt.Sprintf("%s exists; overwrite? [y/N] ", path)) {
+		fatalCode(exitOutput, "The output file already exists", "file", path)
+	}
+	checkedOutputs[path] = true
+}
+
+// tempOutputPath returns the path of the file next to path, to which the
+// output at path is written, until it is complete.
+func tempOutputPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+}
+
+// confirm asks question on stderr and reports whether the answer is yes.
+// It doesn't ask and returns false, unless stdin and stdout are
+// terminals, so that scripts fail instead of waiting for an answer.
+func confirm(question string) bool {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return false
+	}
+	fmt.Fprint(os.Stderr, question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// createOutput creates the temporary file of the output at path and
+// locks it, so that other invocations can tell who writes it. The lock
+// is released, when the file is closed. commitOutput moves the file to
+// path; if the command fails instead, the caller removes it by its Name.
+func createOutput(path string) (*os.File, error) {
+	// Outputs like the cells of -grid are only checked here.
+	checkOutput(path)
+	tempPath := tempOutputPath(path)
+	f, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if errors.Is(err, fs.ErrExist) {
+		if pid, ok := lockHolder(tempPath); ok {
+			fatalCode(exitOutput, "The output file is already being written", "file", path, "pid", pid)
+		}
+		// It is left over from an invocation, that has been killed.
+		if err = os.Remove(tempPath); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return nil, err
+	}
+	return f, nil
+}
+
+// commitOutput closes the output f, which createOutput has created for
+// path, and moves it to path, replacing an existing file.
+func commitOutput(f *os.File, path string) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
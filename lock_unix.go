@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an advisory write lock on f. Record locks are used
+// instead of flock, since they tell who holds them.
+func lockFile(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+	if errors.Is(err, syscall.ENOLCK) || errors.Is(err, syscall.ENOTSUP) {
+		return nil // The file system does not support locks.
+	}
+	return err
+}
+
+// lockHolder returns the ID of the process holding a lock on the file
+// at path.
+func lockHolder(path string) (int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	if err = syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lock); err != nil || lock.Type == syscall.F_UNLCK {
+		return 0, false
+	}
+	return int(lock.Pid), true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// levelTrace is the level of the messages written for every blob with
+// -vv.
+const levelTrace = slog.LevelDebug - 4
+
+// logFormat is the format of the log messages written to stderr, text
+// or json.
+var logFormat = "text"
+
+// errorFormat is the format of the error, with which fatal exits, text
+// or json.
+var errorFormat = "text"
+
+var quiet bool
+var verbose bool
+var veryVerbose bool
+
+// setupLogging makes the default logger write in logFormat, at the level
+// requested with -q, -v or -vv.
+func setupLogging() error {
+	level := slog.LevelInfo
+	switch {
+	case quiet && (verbose || veryVerbose) || verbose && veryVerbose:
+		return fmt.Errorf("only one of -q, -v and -vv can be used")
+	case quiet:
+		level = slog.LevelError
+	case verbose:
+		level = slog.LevelDebug
+	case veryVerbose:
+		level = levelTrace
+	}
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}
+	var handler slog.Handler
+	switch logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("unknown log format '%s'", logFormat)
+	}
+	if errorFormat != "text" && errorFormat != "json" {
+		return fmt.Errorf("unknown error format '%s'", errorFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// replaceLevel names levelTrace, which slog would call DEBUG-4.
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == levelTrace {
+		a.Value = slog.StringValue("TRACE")
+	}
+	return a
+}
+
+// compressionRatio returns size/rawSize, or 1 for empty data.
+func compressionRatio(size, rawSize int) float64 {
+	if rawSize == 0 {
+		return 1
+	}
+	return float64(size) / float64(rawSize)
+}
+
+// cleanups undo the effects of a command, that has not completed, like
+// partially written files. fatal runs them before exiting.
+var cleanups []func()
+
+// onFatal makes fatal run f, until the cleanups are discarded with
+// keepResults.
+func onFatal(f func()) {
+	cleanups = append(cleanups, f)
+}
+
+// keepResults discards the cleanups, once a command has completed.
+func keepResults() {
+	cleanups = nil
+}
+
+// exitCode is the status, with which a command fails, so that scripts
+// can tell the causes of failures apart.
+type exitCode int
+
+const (
+	exitError    exitCode = 1 // Any failure without a more specific code.
+	exitUsage    exitCode = 2 // Invalid flags or arguments, like package flag uses.
+	exitInput    exitCode = 3 // An input can't be read or is corrupt.
+	exitOutput   exitCode = 4 // An output can't be written.
+	exitCodec    exitCode = 5 // A codec is not supported or not enabled.
+	exitMismatch exitCode = 6 // A check, like verify, found problems in the file.
+)
+
+// exitCauses name the exit codes in errors written as JSON.
+var exitCauses = map[exitCode]string{
+	exitError:    "error",
+	exitUsage:    "usage",
+	exitInput:    "input",
+	exitOutput:   "output",
+	exitCodec:    "codec",
+	exitMismatch: "mismatch",
+}
+
+// fatal logs an error, runs the cleanups and exits with exitError.
+func fatal(msg string, args ...any) {
+	fatalCode(exitError, msg, args...)
+}
+
+// fatalCode logs an error, or writes it as JSON to stderr with
+// -error-format json, runs the cleanups and exits with code.
+func fatalCode(code exitCode, msg string, args ...any) {
+	clearProgress()
+	if errorFormat == "json" {
+		writeJSONError(code, msg, args)
+	} else {
+		slog.Error(msg, args...)
+	}
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	os.Exit(int(code))
+}
+
+// writeJSONError writes a single line like
+//
+//	{"error":"Could not open file","cause":"input","exit_code":3,"details":{"file":"a.pbf","err":"..."}}
+//
+// where details holds the key-value pairs of args.
+func writeJSONError(code exitCode, msg string, args []any) {
+	details := make(map[string]string)
+	for _, attr := range slog.Group("", args...).Value.Group() {
+		details[attr.Key] = attr.Value.String()
+	}
+	json.NewEncoder(os.Stderr).Encode(struct {
+		Error    string            `json:"error"`
+		Cause    string            `json:"cause"`
+		ExitCode exitCode          `json:"exit_code"`
+		Details  map[string]string `json:"details,omitempty"`
+	}{msg, exitCauses[code], code, details})
+}
@@ -1,226 +1,1157 @@
 package main
 
-//go:generate protoc fileformat.proto --go_out=.
+//go:generate protoc fileformat.proto osmformat.proto recompress.proto --go_out=. --go-grpc_out=.
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/codesoap/zstd-pbf/pbf"
 	"github.com/codesoap/zstd-pbf/pbfproto"
-	"github.com/klauspost/compress/zlib"
 	"github.com/klauspost/compress/zstd"
 	"google.golang.org/protobuf/proto"
 )
 
 // See https://wiki.openstreetmap.org/wiki/PBF_Format#File_format
-const maxBlobHeaderSize = 64 * 1024 * 1024
-
 var compressionLevel = zstd.SpeedDefault
 var speedFastest bool
 var speedBetterCompression bool
 var speedBestCompression bool
+var canonicalStrings bool
+var targetBlobSize byteSize
+var snapshot time.Time
+var dropDeleted bool
+var codecs = codecPolicy{}
+var skipIncompressible bool
+var zlibOnly bool
+var deadline time.Duration
+var targetSize byteSize
+var targetRatio float64
+var windowLog int
+var longWindow bool
+
+// zstdChecksum is true by default, also for the commands, that don't
+// have -checksum.
+var zstdChecksum = true
+var encoderConcurrency int
+var reproducible bool
+var selfCheck bool
+var cacheDir string
+var cache *blobCache
+var manifestFile string
+var manifest *manifestWriter
+var footer bool
+var diffFiles []string
+var changes []*osmChange
+var catchUpReplication bool
+var follow bool
+var followTimeout time.Duration
 var inFile = ""
+var inMember = ""
 var outFile = ""
 
-func init() {
+// commands contains the subcommands, which can be given as the first
+// argument. They receive the remaining arguments.
+var commands = map[string]func(args []string){
+	"archive":      runArchive,
+	"assemble":     runAssemble,
+	"compat-check": runCompatCheck,
+	"coordinate":   runCoordinate,
+	"doctor":       runDoctor,
+	"dump":         runDump,
+	"explain":      runExplain,
+	"join-blobs":   runJoinBlobs,
+	"delta":        runDelta,
+	"diff":         runDiff,
+	"list":         runList,
+	"patch":        runPatch,
+	"serve-blobs":  runServeBlobs,
+	"split-blobs":  runSplitBlobs,
+	"serve-grpc":   runServeGRPC,
+	"serve-http":   runServeHTTP,
+	"stats":        runStats,
+	"unarchive":    runUnarchive,
+	"verify":       runVerify,
+	"version":      runVersion,
+}
+
+func main() {
+	if err := setupLogging(); err != nil {
+		fatalCode(exitUsage, "Could not set up logging", "err", err)
+	}
+	if err := loadConfig(); err != nil {
+		fatalCode(exitUsage, "Could not load configuration", "err", err)
+	}
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	parseFlags()
+	stopProfiling := startProfiling()
+	if grid.set {
+		convertGrid()
+	} else if len(extractRelations) > 0 {
+		convertRelations()
+	} else if hilbertZoom > 0 {
+		convertHilbert()
+	} else {
+		convert()
+	}
+	stopProfiling()
+}
+
+func parseFlags() {
 	flag.Usage = func() {
-		fmt.Fprintln(os.Stderr,
-			"Usage:\n  zstd-pbf [-fastest|-better|-best] <IN_FILE> <OUT_FILE>")
+		fmt.Fprintln(os.Stderr, "Usage:\n"+
+			"  zstd-pbf [-fastest|-better|-best] [OPTIONS] <IN_FILE>[::MEMBER] <OUT_FILE>\n"+
+			"  zstd-pbf list [-format text|csv|json|geojson] <IN_FILE>\n"+
+			"  zstd-pbf diff [-ignore-metadata] [-limit N] <FILE_A> <FILE_B>\n"+
+			"  zstd-pbf assemble [-footer] [-yes] <OUT_FILE> <SHARD_FILE>...\n"+
+			"  zstd-pbf coordinate -workers ADDRESSES [-in-flight N] [-max-memory SIZE] [-footer]\n"+
+			"                      [-metrics ADDRESS] [-max-read-mbps RATE] [-max-write-mbps RATE]\n"+
+			"                      [-yes] <IN_FILE> <OUT_FILE>\n"+
+			"  zstd-pbf delta [-yes] <OLD_FILE> <NEW_FILE> <DELTA_FILE>\n"+
+			"  zstd-pbf patch [-yes] <OLD_FILE> <DELTA_FILE> <OUT_FILE>\n"+
+			"  zstd-pbf join-blobs [-blobs N] [-yes] <IN_FILE> <OUT_FILE>\n"+
+			"  zstd-pbf split-blobs [-yes] <IN_FILE> <OUT_FILE>\n"+
+			"  zstd-pbf archive [-frame-size SIZE] [-yes] <IN_FILE> <OUT_FILE>\n"+
+			"  zstd-pbf unarchive [-yes] <IN_FILE> <OUT_FILE>\n"+
+			"  zstd-pbf serve-blobs [-listen ADDRESS] [-index FILE] [-metrics ADDRESS] <IN_FILE>\n"+
+			"  zstd-pbf serve-grpc [-listen ADDRESS] [-metrics ADDRESS] [COMPRESSION_OPTIONS]\n"+
+			"  zstd-pbf serve-http [-listen ADDRESS] [-max-requests N] [-max-request-size SIZE]\n"+
+			"                      [-metrics ADDRESS] [COMPRESSION_OPTIONS]\n"+
+			"  zstd-pbf compat-check [-require READERS] <IN_FILE>\n"+
+			"  zstd-pbf completion bash|zsh|fish\n"+
+			"  zstd-pbf doctor [-sample N] <IN_FILE>\n"+
+			"  zstd-pbf dump -blob N [-format xml] <IN_FILE>\n"+
+			"  zstd-pbf explain -blob N [-format text|json] <IN_FILE>\n"+
+			"  zstd-pbf stats [-format text|json] <IN_FILE>\n"+
+			"  zstd-pbf verify [-quick] [-manifest FILE] [-references] [-duplicates] [-deep] <IN_FILE>\n"+
+			"  zstd-pbf version")
 		fmt.Fprintln(os.Stderr, "Options:")
 		flag.PrintDefaults()
 	}
+	flag.StringVar(&alsoWrite, "also-write", "", "write a second output to this `file`, whose blobs are compressed with the\ncodec of -also-codec, while reading the input only once")
+	flag.Func("also-codec", "compress the blobs of -also-write with this `codec`: zstd, zlib, raw or\nbrotli (default zlib)", func(value string) error {
+		if err := checkCodec(value); err != nil {
+			return err
+		}
+		alsoCodec = value
+		return nil
+	})
+	flag.Var(&alignment, "align", "pad the BlobHeaders, so that every blob starts at a multiple of this `size`,\ne.g. 4K, which helps readers doing range requests; at most 16K")
+	flag.Func("apply-diff", "apply the changes of this OsmChange `file`, which may be gzip compressed; can\nbe given multiple times; the input must be sorted and not be a history file", func(value string) error {
+		diffFiles = append(diffFiles, value)
+		return nil
+	})
+	flag.StringVar(&compat, "compat", "", "restrict the output to codecs, block sizes and required features, that are\nguaranteed to work with this `reader`: osmium, osm2pgsql, planetiler, imposm\nor max for all of them")
+	flag.BoolVar(&catchUpReplication, "catch-up", false, "download and apply the diffs from the replication server named in the\nOSMHeader, that are needed to bring the file up to date")
+	flag.BoolVar(&splitOversized, "split-oversized", false, "split data blocks, that exceed the 32MiB limit of the specification, into\nblocks of about 16MiB, instead of copying them with a warning")
 	flag.BoolVar(&speedFastest, "fastest", false, "use the fastest compression level")
 	flag.BoolVar(&speedBetterCompression, "better", false, "use a compression level with better compression than default")
 	flag.BoolVar(&speedBestCompression, "best", false, "use the compression level with the best compression")
-	flag.Parse()
+	flag.IntVar(&encoderConcurrency, "encoder-concurrency", 0, "compress each blob with up to `N` goroutines; defaults to the number of usable\nCPUs, see -cpus")
+	flag.StringVar(&cpuProfile, "cpu-profile", "", "write a CPU profile to this `file`")
+	flag.StringVar(&cacheDir, "cache", "", "reuse compressed blobs from and store them in this `directory`, to speed up\nthe conversion of files, that share much of their data")
+	flag.BoolVar(&zstdChecksum, "checksum", true, "store a content checksum in every zstd frame; -checksum=false saves 4 bytes per blob")
+	flag.Var(&bestOf, "best-of", "compress blobs with each of these comma-separated `codecs`, e.g. zlib,zstd,\nand keep the smallest result; blob types given with -codec are left alone")
+	flag.Var(&codecs, "codec", "compress blobs of a type with another codec, given as `TYPE=CODEC`, where\nCODEC is zstd, zlib, raw or brotli, e.g. OSMHeader=raw; can be given multiple times")
+	flag.BoolVar(&canonicalStrings, "canonicalize-strings", false, "deduplicate and sort the string tables of data blocks by frequency")
+	flag.DurationVar(&deadline, "deadline", 0, "adapt the compression level to finish within this `duration`, e.g. 30m")
+	flag.BoolVar(&dedupe, "dedupe", false, "drop objects, whose type, ID and version have already been written; the\ninput must be sorted by type, ID and version apart from the copies")
+	flag.BoolVar(&dropDeleted, "drop-deleted", false, "drop all versions of objects of a history file, whose latest version is a deletion")
+	flag.Func("encrypt", "encrypt the output with the age CLI for this `recipient`, e.g. an age1... public\nkey; can be given multiple times", func(value string) error {
+		encryptRecipients = append(encryptRecipients, value)
+		return nil
+	})
+	flag.StringVar(&identityFile, "identity", "", "decrypt an input, that is encrypted with age, with the identity in this `file`")
+	flag.Var(&grid, "grid", "split the output into one file per cell of this `grid`: COLUMNSxROWS over the\nbounding box of the input or zN for the web mercator tiles of zoom level N;\nOUT_FILE gets the cell appended, e.g. out-1-0.osm.pbf or out-5-17-10.osm.pbf")
+	flag.IntVar(&hilbertZoom, "hilbert", 0, "order the nodes, ways and relations along a Hilbert curve over the web\nmercator tiles of this `zoom` level, so that nearby elements share blobs; the\nwhole input is held in memory")
+	flag.Func("relation", "write only the relation with this `ID` instead of the whole input; can be\ngiven multiple times", parseRelationID)
+	flag.BoolVar(&completeRelations, "complete", false, "write the members of the -relation as well: nodes, ways with their nodes and,\nrecursively, relations")
+	flag.Var(&maxMemory, "max-memory", "keep the memory used for buffers and encoders below this `size`, e.g. 512M,\nby lowering the encoder concurrency and reading fewer blobs ahead")
+	flag.BoolVar(&useMmap, "mmap", false, "map the input into memory instead of reading it, which saves copies on fast\nlocal storage")
+	flag.BoolVar(&autoLevel, "auto-level", false, "compress the first data blobs at every zstd level before converting and use\nthe level with the best ratio per second on this machine")
+	flag.BoolVar(&optimize, "optimize", false, "try several zstd levels and windows for every blob and keep the smallest\nresult; similar blobs reuse the choice for the first of them")
+	flag.StringVar(&memProfile, "mem-profile", "", "write an allocation profile to this `file` at the end of the conversion")
+	flag.StringVar(&manifestFile, "manifest", "", "write the SHA-256 hash of the uncompressed data of every blob to this `file`")
+	flag.IntVar(&readAhead, "read-ahead", 0, "read up to `N` blobs ahead in the background, to hide the latency of slow\nor network storage")
+	flag.BoolVar(&preallocateOutput, "preallocate", true, "reserve disk space for the estimated output size up front, to fail early\nif it is missing")
+	flag.BoolVar(&preserveMetadata, "preserve-times", false, "give the output the modification time of the input, as well as its\npermissions and, if allowed, its owner")
+	flag.Func("plugin", "load this Go plugin `file`, which may register transforms for -transform; can\nbe given multiple times", func(value string) error {
+		pluginFiles = append(pluginFiles, value)
+		return nil
+	})
+	flag.BoolVar(&keepOriginal, "keep-original", false, "copy blobs, that already use the codec they would be written with, unchanged\nfrom the input, instead of recompressing them")
+	flag.BoolVar(&reproducible, "reproducible", false, "guarantee identical output for identical input and options, which rules out\n-deadline, -auto-level and -encoder-concurrency above 1")
+	flag.BoolVar(&selfCheck, "self-check", false, "decompress every written blob and compare it to the original data")
+	flag.BoolVar(&skipIncompressible, "skip-incompressible", false, "store blobs raw, if a sample of them barely compresses")
+	flag.BoolVar(&longWindow, "long", false, "use a zstd window, that covers the whole blob, to find matches far apart")
+	flag.Var(&fsync, "fsync", "sync the output to disk according to this `policy`: none, end, or a number N\nto sync at the end and after every N blobs")
+	flag.StringVar(&execFilter, "exec-filter", "", "pipe the uncompressed data of every blob through this `command` and use its\noutput, or drop the blob, if it is empty; the blob type and index are passed\nin ZSTD_PBF_BLOB_TYPE and ZSTD_PBF_BLOB_INDEX")
+	flag.BoolVar(&experimentalBrotli, "experimental-brotli", false, "allow the codec brotli, which is not part of the PBF specification and can\nonly be read by zstd-pbf")
+	flag.BoolVar(&follow, "follow", false, "wait for more data at the end of the input, e.g. while it is being downloaded")
+	flag.DurationVar(&followTimeout, "follow-timeout", time.Minute, "with -follow, end the conversion, once no data has arrived for this `duration`")
+	flag.BoolVar(&footer, "footer", false, "append a blob with the hash of the file, that can be checked with verify -quick")
+	flag.IntVar(&sampleBlobs, "sample", 0, "convert only the OSMHeader and the first `N` data blobs, to try the options\non a small but valid output before converting the whole input")
+	flag.Var(&shard, "shard", "convert only every n-th blob, starting with blob i, given as `i/n`, and\nwrite an assembly manifest to OUT_FILE.shard; combine the shards with assemble")
+	flag.Func("changeset", "keep only the objects, that were last edited in the changeset with this `ID`;\ncan be given multiple times", parseChangesetID)
+	flag.Func("user", "keep only the objects, that were last edited by the user with this `name` or\nUID; can be given multiple times", func(value string) error {
+		filterUsers = append(filterUsers, value)
+		return nil
+	})
+	flag.Func("since", "keep only the objects, that were edited at or after this RFC 3339 `time`", func(value string) (err error) {
+		filterSince, err = time.Parse(time.RFC3339, value)
+		return err
+	})
+	flag.Func("until", "keep only the objects, that were edited before this RFC 3339 `time`", func(value string) (err error) {
+		filterUntil, err = time.Parse(time.RFC3339, value)
+		return err
+	})
+	flag.Func("snapshot", "keep only the object versions of a history file, that were current at this RFC 3339 `time`", func(value string) (err error) {
+		snapshot, err = time.Parse(time.RFC3339, value)
+		return err
+	})
+	flag.Float64Var(&targetRatio, "target-ratio", 0, "adapt the compression level to make the output about this `ratio` of the input size")
+	flag.Var(&targetSize, "target-size", "adapt the compression level to make the output about this `size`, e.g. 40G")
+	flag.BoolVar(&zlibOnly, "zlib", false, "recompress blobs with zlib at level 9 instead of zstd, which shrinks files\nfor readers without zstd support")
+	flag.IntVar(&windowLog, "window-log", 0, "use a zstd window of 2^`N` bytes, with N from 10 to 25")
+	flag.StringVar(&progressMode, "progress", "auto", "show the progress as a bar, as log lines every 10s or not at all with none;\n`auto` draws a bar, if stderr is a terminal, and logs lines otherwise")
+	flag.Var(&progressEvery, "progress-every", "show the progress after this `duration`, like 1m, or after every N blobs,\nlike 1000, instead of every 10s or, for the bar, continuously")
+	flag.StringVar(&statsFile, "stats-file", "", "write a report of the conversion with its sizes, ratio, times, flags and the\nSHA-256 hashes of the outputs as JSON to this `file`")
+	flag.StringVar(&tmpDir, "tmpdir", "", "put temporary files, like the diffs of -catch-up, into this `directory`;\ndefaults to TMPDIR or the temporary directory of the system")
+	flag.StringVar(&traceFile, "trace", "", "write an execution trace to this `file`")
+	flag.Func("transform", "apply the registered transform with this `name` to the data of every blob, e.g.\nstrip-metadata; can be given multiple times to apply several in order", func(value string) error {
+		transformNames = append(transformNames, value)
+		return nil
+	})
+	flag.Var(&targetBlobSize, "target-blob-size", "merge and split data blocks to approximately this uncompressed `size`, e.g. 8M")
+	flag.BoolVar(&showVersion, "version", false, "print the version, like the version command, and exit")
+	addRateLimitFlags(flag.CommandLine)
+	addOverwriteFlag(flag.CommandLine)
+	parseArgs(flag.CommandLine, os.Args[1:])
+	if showVersion {
+		writeVersion(os.Stdout)
+		os.Exit(0)
+	}
+	setCompressionLevel()
+	if err := checkBrotli(); err != nil {
+		fatalCode(exitCodec, "Could not use codec", "err", err)
+	}
+	if zlibOnly {
+		if len(bestOf) > 0 {
+			fatalCode(exitUsage, "Only one of -zlib and -best-of can be used")
+		}
+		defaultCodec = codecZlib
+	}
+	if compat != "" {
+		if err := setupCompat(); err != nil {
+			fatalCode(exitUsage, "Could not apply -compat", "err", err)
+		}
+	}
+	if (deadline > 0 && (targetSize > 0 || targetRatio > 0)) || (targetSize > 0 && targetRatio > 0) {
+		fatalCode(exitUsage, "Only one of -deadline, -target-size and -target-ratio can be used")
+	}
+	if reproducible {
+		// The output of concurrent encoders is not guaranteed to be
+		// stable and -deadline and -auto-level make the level depend on
+		// timing.
+		if encoderConcurrency > 1 || deadline > 0 || autoLevel {
+			fatalCode(exitUsage, "-reproducible can't be used with -deadline, -auto-level or with -encoder-concurrency above 1")
+		}
+		encoderConcurrency = 1
+	}
+	if encoderConcurrency < 0 {
+		fatalCode(exitUsage, "The encoder concurrency must not be negative")
+	}
+	if windowLog != 0 && (windowLog < 10 || windowLog > maxWindowLog) {
+		fatalCode(exitUsage, fmt.Sprintf("The window log must be between 10 and %d", maxWindowLog))
+	}
+	if windowLog != 0 && longWindow {
+		fatalCode(exitUsage, "Only one of -window-log and -long can be used")
+	}
+	if optimize && (speedFastest || speedBetterCompression || speedBestCompression || windowLog != 0 || longWindow ||
+		deadline > 0 || targetSize > 0 || targetRatio > 0) {
+		fatalCode(exitUsage, "-optimize chooses the level and window itself and can't be used with options, that set them")
+	}
+	if autoLevel && (speedFastest || speedBetterCompression || speedBestCompression || optimize ||
+		deadline > 0 || targetSize > 0 || targetRatio > 0) {
+		fatalCode(exitUsage, "-auto-level chooses the level itself and can't be used with options, that set it")
+	}
+	if targetBlobSize > maxBlockSize {
+		fatalCode(exitUsage, "The target blob size must not exceed 32MiB")
+	}
+	if sampleBlobs < 0 {
+		fatalCode(exitUsage, "The number of sampled blobs must not be negative")
+	}
+	if alignment > maxAlignment {
+		fatalCode(exitUsage, "The alignment must not exceed 16KiB")
+	}
+	if err := setupRateLimits(); err != nil {
+		fatalCode(exitUsage, "Could not limit the I/O rate", "err", err)
+	}
+	if useMmap && follow {
+		fatalCode(exitUsage, "-mmap can't be used with -follow, since the input grows")
+	}
+	if readAhead < 0 {
+		fatalCode(exitUsage, "The number of blobs to read ahead must not be negative")
+	}
+	if err := applyMemoryLimit(blobMemory); err != nil {
+		fatalCode(exitUsage, "The memory limit is too low", "err", err)
+	}
+	if err := setupTransforms(); err != nil {
+		fatalCode(exitUsage, "Could not set up the transforms", "err", err)
+	}
+	if shard.count > 0 && (len(diffFiles) > 0 || len(transformNames) > 0 || execFilter != "" || alsoWrite != "" || catchUpReplication || dropDeleted ||
+		!snapshot.IsZero() || filteringMetadata() || dedupe || targetBlobSize > 0 || alignment > 0 || footer || follow || len(encryptRecipients) > 0 ||
+		sampleBlobs > 0) {
+		fatalCode(exitUsage, "-shard can't be used with options, that change the number or offsets of blobs, "+
+			"or with -follow or -encrypt; footers can be added by assemble")
+	}
+	if grid.set && !onlyCompressionOptions() {
+		fatalCode(exitUsage, "-grid can only be used with options, that choose the compression")
+	}
+	if hilbertZoom < 0 || hilbertZoom > maxHilbertZoom {
+		fatalCode(exitUsage, fmt.Sprintf("The zoom level of -hilbert must be between 1 and %d", maxHilbertZoom))
+	}
+	if hilbertZoom > 0 && (grid.set || !onlyCompressionOptions()) {
+		fatalCode(exitUsage, "-hilbert can only be used with options, that choose the compression")
+	}
+	if len(extractRelations) > 0 && (grid.set || hilbertZoom > 0 || !onlyCompressionOptions()) {
+		fatalCode(exitUsage, "-relation can only be used with options, that choose the compression")
+	}
+	if completeRelations && len(extractRelations) == 0 {
+		fatalCode(exitUsage, "-complete can only be used with -relation")
+	}
+	if len(encryptRecipients) > 0 && (footer || alsoWrite != "") {
+		fatalCode(exitUsage, "-footer and -also-write can't be used with -encrypt")
+	}
+	if flag.NArg() != 2 {
+		fatalCode(exitUsage, "Give exactly two arguments: The input and output PBF files")
+	}
+	inFile, inMember, _ = strings.Cut(flag.Arg(0), memberSeparator)
+	outFile = flag.Arg(1)
+	inputs := append([]string{inFile}, diffFiles...)
+	if !grid.set {
+		// The outputs of the cells are checked, when they are created.
+		checkOutput(outFile, inputs...)
+	}
+	if alsoWrite != "" {
+		checkOutput(alsoWrite, inputs...)
+	}
+	if shard.count > 0 {
+		checkOutput(outFile+shardSuffix, inputs...)
+	}
+	if statsFile != "" {
+		checkOutput(statsFile, inputs...)
+	}
+	if manifestFile != "" {
+		checkOutput(manifestFile, inputs...)
+	}
+}
+
+// setCompressionLevel sets compressionLevel according to the level
+// flags.
+func setCompressionLevel() {
 	if speedFastest {
 		if speedBetterCompression || speedBestCompression {
-			fmt.Fprintln(os.Stderr, "Multiple compression levels have been requested.")
-			os.Exit(1)
+			fatalCode(exitUsage, "Multiple compression levels have been requested")
 		}
 		compressionLevel = zstd.SpeedFastest
 	}
 	if speedBetterCompression {
 		if speedFastest || speedBestCompression {
-			fmt.Fprintln(os.Stderr, "Multiple compression levels have been requested.")
-			os.Exit(1)
+			fatalCode(exitUsage, "Multiple compression levels have been requested")
 		}
 		compressionLevel = zstd.SpeedBetterCompression
 	}
 	if speedBestCompression {
 		if speedFastest || speedBetterCompression {
-			fmt.Fprintln(os.Stderr, "Multiple compression levels have been requested.")
-			os.Exit(1)
+			fatalCode(exitUsage, "Multiple compression levels have been requested")
 		}
 		compressionLevel = zstd.SpeedBestCompression
 	}
-	if flag.NArg() != 2 {
-		fmt.Fprintln(os.Stderr,
-			"Give exactly two arguments: The input and output PBF files.")
-		os.Exit(1)
-	}
-	inFile = flag.Arg(0)
-	outFile = flag.Arg(1)
-	if _, err := os.Stat(outFile); !errors.Is(err, os.ErrNotExist) {
-		fmt.Fprintf(os.Stderr, "The file '%s' already exists.\n", outFile)
-		os.Exit(1)
-	}
 }
 
-func main() {
-	in, err := os.Open(inFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not open file '%s': %v", inFile, err)
-		os.Exit(1)
+// convert re-compresses inFile into outFile. An interrupt or SIGTERM
+// cancels it after the current blob and removes the incomplete output.
+func convert() {
+	began := time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	in, input, closeInput := openInput()
+	defer closeInput()
+	if input != io.ReadSeeker(in) && (useMmap || follow) {
+		fatalCode(exitUsage, "-mmap and -follow can't be used with a compressed input or an archive", "file", inFile)
+	}
+	if format, err := sniffImportFormat(input); err != nil {
+		fatalCode(inputCode(err), "Could not read file", "file", inFile, "err", err)
+	} else if format != "" {
+		convertImport(input, format)
+		return
 	}
-	defer in.Close()
-	out, err := os.Create(outFile)
+	if autoLevel {
+		if err := tuneLevel(input); err != nil {
+			fatalCode(inputCode(err), "Could not benchmark the compression levels", "file", inFile, "err", err)
+		}
+	}
+	out, err := createOutput(outFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not open file '%s': %v", outFile, err)
-		os.Exit(1)
+		fatalCode(exitOutput, "Could not open file", "file", outFile, "err", err)
 	}
 	defer out.Close()
-	success := false
-	defer func() {
-		if !success {
-			os.Remove(outFile)
+	onFatal(func() { os.Remove(out.Name()) })
+	if alsoWrite != "" {
+		f, err := createOutput(alsoWrite)
+		if err != nil {
+			fatalCode(exitOutput, "Could not open file", "file", alsoWrite, "err", err)
+		}
+		defer f.Close()
+		onFatal(func() { os.Remove(f.Name()) })
+		tee = &teeWriter{f: f, codec: alsoCodec}
+	}
+	stat, err := in.Stat()
+	if err != nil {
+		fatalCode(exitInput, "Could not stat file", "file", inFile, "err", err)
+	}
+	// w receives the output, which age encrypts on the way to out, if
+	// requested.
+	var w io.Writer = out
+	var encrypter *ageEncrypter
+	if len(encryptRecipients) > 0 {
+		if encrypter, err = startEncryption(out); err != nil {
+			fatal("Could not start age", "err", err)
+		}
+		w = encrypter
+	}
+	if preallocateOutput && !follow && encrypter == nil {
+		if err = preallocate(out, estimateOutputSize(stat.Size())); err != nil {
+			// fatal removes the file, which frees what has been allocated
+			// already.
+			fatalCode(exitOutput, "Could not preallocate file", "file", outFile, "err", err)
+		}
+	}
+	var controller levelController
+	if deadline > 0 || targetSize > 0 || targetRatio > 0 {
+		switch {
+		case deadline > 0:
+			controller = newDeadlineController(deadline, stat.Size())
+		case targetSize > 0:
+			controller = newSizeController(int64(targetSize), stat.Size())
+		default:
+			target := int64(targetRatio * float64(stat.Size()))
+			controller = newSizeController(target, stat.Size())
+		}
+	}
+	if cacheDir != "" {
+		if cache, err = newBlobCache(cacheDir); err != nil {
+			fatal("Could not open cache", "dir", cacheDir, "err", err)
+		}
+	}
+	if manifestFile != "" {
+		if manifest, err = newManifestWriter(manifestFile); err != nil {
+			fatalCode(exitOutput, "Could not open file", "file", manifestFile, "err", err)
 		}
-	}()
+		onFatal(func() { os.Remove(manifest.f.Name()) })
+	}
+	if shard.count > 0 {
+		if shardWriter, err = newShardManifestWriter(outFile + shardSuffix); err != nil {
+			fatalCode(exitOutput, "Could not open file", "file", outFile+shardSuffix, "err", err)
+		}
+		onFatal(func() { os.Remove(shardWriter.f.Name()) })
+	}
+	if catchUpReplication {
+		header, err := readHeaderBlock(input)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read OSMHeader", "err", err)
+		}
+		dir, err := makeTempDir("zstd-pbf-diffs-", minTempSpace)
+		if err != nil {
+			fatalCode(exitOutput, "Could not create temporary directory", "err", err)
+		}
+		defer os.RemoveAll(dir)
+		onFatal(func() { os.RemoveAll(dir) })
+		var paths []string
+		if paths, caughtUp, err = catchUp(ctx, header, dir); err != nil {
+			fatal("Could not download diffs", "err", err)
+		}
+		diffFiles = append(diffFiles, paths...)
+	}
+	if len(diffFiles) > 0 {
+		if changes, err = readOSC(diffFiles); err != nil {
+			fatalCode(inputCode(err), "Could not read changes", "err", err)
+		}
+	}
+	stages := blockStages()
+	var r io.Reader = input
+	position := func() (int64, error) { return input.Seek(0, io.SeekCurrent) }
+	if follow {
+		r = &followReader{ctx: ctx, f: in, timeout: followTimeout}
+	} else if useMmap {
+		mapped, unmap, err := mapFile(in)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not map file", "file", inFile, "err", err)
+		}
+		defer unmap()
+		r = mapped
+		position = func() (int64, error) { return mapped.pos, nil }
+	}
+	if readLimit != nil {
+		r = &rateLimitedReader{r: r, limit: readLimit}
+	}
+	if readAhead > 0 {
+		r = newPrefetchReader(r, readAhead, readAheadMemory)
+	}
+	total := stat.Size()
+	if follow || sampleBlobs > 0 {
+		// The input grows or won't be read to its end.
+		total = 0
+	}
+	prog, err := newProgress(total)
+	if err != nil {
+		fatalCode(exitUsage, "Could not show the progress", "err", err)
+	}
+	inputBlobs, sampledBlobs := 0, 0
+	var buf []byte // Reused for the uncompressed data of every blob.
 	for {
+		if ctx.Err() != nil {
+			fatal("The conversion has been canceled")
+		}
+		if controller != nil || prog != nil {
+			if done, err := position(); err == nil {
+				if controller != nil {
+					controller.update(done)
+				}
+				if prog != nil {
+					prog.update(done, inputBlobs)
+				}
+			}
+		}
+
 		// 1. Read data:
-		blobHeader, err := readBlobHeader(in)
+		stageBegan := time.Now()
+		blobHeader, err := readBlobHeader(r)
 		if err == io.EOF {
-			success = true
 			break
 		} else if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not read BlobHeader: %v", err)
-			os.Exit(1)
+			fatalCode(inputCode(err), "Could not read BlobHeader", "err", err)
+		}
+		if sampleBlobs > 0 && blobHeader.GetType() == "OSMData" {
+			if sampledBlobs == sampleBlobs {
+				slog.Info("Wrote a sample of the input", "data_blobs", sampledBlobs)
+				break
+			}
+			sampledBlobs++
+		}
+		if blobHeader.GetType() != footerBlobType {
+			inputBlobs++
+			if shard.count > 0 && (inputBlobs-1)%shard.count != shard.index {
+				// The blob belongs to another shard.
+				if _, err = io.CopyN(io.Discard, r, int64(blobHeader.GetDatasize())); err != nil {
+					fatalCode(inputCode(err), "Could not read Blob", "err", err)
+				}
+				continue
+			}
 		}
-		blob, err := readBlob(blobHeader, in)
+		rawBlob, blob, err := readRawBlob(blobHeader, r)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not read Blob: %v", err)
-			os.Exit(1)
+			fatalCode(inputCode(err), "Could not read Blob", "err", err)
 		}
+		times.read += since(&stageBegan)
+		if keepsOriginal(blobHeader, blob, stages) {
+			if err = writeOriginal(blobHeader, rawBlob, blob, w); err != nil {
+				fatalCode(exitOutput, "Could not write data", "err", err)
+			}
+			if tee != nil {
+				if err = tee.writeOriginal(blobHeader.GetType(), rawBlob, blob); err != nil {
+					fatalCode(exitOutput, "Could not write data", "file", alsoWrite, "err", err)
+				}
+			}
+			blob.ReturnToVTPool()
+			continue
+		}
+		if buf, err = pbf.AppendDecompressed(buf[:0], blob); err != nil {
+			fatalCode(inputCode(err), "Could not decompress Blob", "err", err)
+		}
+		rawData := buf
+		blob.ReturnToVTPool()
+		times.decompress += since(&stageBegan)
 
-		// 2. Change compression:
-		if err = recompressData(blob); err != nil {
-			fmt.Fprintf(os.Stderr, "Could not re-compress Blob: %v", err)
-			os.Exit(1)
+		// 2. Transform data:
+		if blobHeader.GetType() == footerBlobType {
+			continue // The footer of the input does not match the output.
 		}
-		rawBlob, err := proto.Marshal(blob)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not serialize Blob: %v", err)
-			os.Exit(1)
+		if blobHeader.GetType() == "OSMHeader" && transformHeader() {
+			if rawData, err = rewriteHeader(rawData); err != nil {
+				fatalCode(exitOutput, "Could not rewrite OSMHeader", "err", err)
+			}
+		}
+		if transform != nil {
+			if rawData, err = transform(blobHeader, rawData); err != nil {
+				fatal("Could not transform blob", "err", err)
+			}
+			times.transform += since(&stageBegan)
+			if rawData == nil {
+				continue // The transform dropped the blob.
+			}
 		}
-		datasize := int32(len(rawBlob))
-		blobHeader.Datasize = &datasize
+		if blobHeader.GetType() == "OSMHeader" && compat != "" {
+			if err = checkCompatHeader(rawData); err != nil {
+				fatalCode(exitMismatch, "The output would not work with the readers of -compat", "err", err)
+			}
+		}
+		if blobHeader.GetType() == "OSMData" && len(rawData) > maxBlockSize && len(stages) == 0 {
+			slog.Warn("A data block exceeds the 32MiB limit of the specification, so readers may reject "+
+				"the output; split it with -split-oversized", "blob", inputBlobs-1, "size", len(rawData))
+		}
+		if blobHeader.GetType() != "OSMData" || (len(stages) == 0 && !canonicalStrings) {
+			// Blocks held back by the stages precede this blob. There are
+			// none before the OSMHeader, but flushing would make the diff
+			// applier emit its created objects there.
+			if blobHeader.GetType() != "OSMHeader" {
+				blocks, err := flushStages(stages)
+				times.transform += since(&stageBegan)
+				if err != nil {
+					fatal("Could not transform data blocks", "err", err)
+				}
+				if err = writeBlocks(blocks, w); err != nil {
+					fatalCode(exitOutput, "Could not write data block", "err", err)
+				}
+			}
 
-		// 3. Write data:
-		if err = writeBlobHeader(blobHeader, out); err != nil {
-			fmt.Fprintf(os.Stderr, "Could not write BlobHeader: %v", err)
-			os.Exit(1)
+			// 3. Write data:
+			if err = writeData(blobHeader, rawData, w); err != nil {
+				fatalCode(exitOutput, "Could not write data", "err", err)
+			}
+			continue
 		}
-		if _, err = out.Write(rawBlob); err != nil {
-			fmt.Fprintf(os.Stderr, "Could not write Blob: %v", err)
-			os.Exit(1)
+		block := &pbfproto.PrimitiveBlock{}
+		if err = proto.Unmarshal(rawData, block); err != nil {
+			fatalCode(inputCode(err), "Could not parse PrimitiveBlock", "err", err)
 		}
+		times.transform += since(&stageBegan)
+		if len(stages) == 0 {
+			err = writeBlock(blobHeader, block, w)
+		} else {
+			blocks, err := runStages(stages, []*pbfproto.PrimitiveBlock{block})
+			times.transform += since(&stageBegan)
+			if err != nil {
+				fatal("Could not transform data blocks", "err", err)
+			}
+			err = writeBlocks(blocks, w)
+		}
+		if err != nil {
+			fatalCode(exitOutput, "Could not write data block", "err", err)
+		}
+	}
+	if prog != nil {
+		prog.finish()
+	}
+	stageBegan := time.Now()
+	blocks, err := flushStages(stages)
+	times.transform += since(&stageBegan)
+	if err != nil {
+		fatal("Could not transform data blocks", "err", err)
+	}
+	if err = writeBlocks(blocks, w); err != nil {
+		fatalCode(exitOutput, "Could not write data block", "err", err)
+	}
+	if footer {
+		if err = writeFooter(out, blobsWritten); err != nil {
+			fatalCode(exitOutput, "Could not write footer", "err", err)
+		}
+		if tee != nil {
+			if err = writeFooter(tee.f, tee.blobs); err != nil {
+				fatalCode(exitOutput, "Could not write footer", "file", alsoWrite, "err", err)
+			}
+		}
+	}
+	if manifest != nil {
+		if err = manifest.close(); err != nil {
+			fatalCode(exitOutput, "Could not write manifest", "err", err)
+		}
+	}
+	if encrypter != nil {
+		if err = encrypter.close(); err != nil {
+			fatalCode(exitOutput, "Could not encrypt file", "file", outFile, "err", err)
+		}
+	}
+	if preallocateOutput && !follow && encrypter == nil {
+		// Frees the space, that was preallocated beyond the end.
+		if size, err := out.Seek(0, io.SeekCurrent); err != nil {
+			fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+		} else if err = out.Truncate(size); err != nil {
+			fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+		}
+	}
+	if err = fsync.syncEnd(out); err != nil {
+		fatalCode(exitOutput, "Could not sync file", "file", outFile, "err", err)
 	}
+	if tee != nil {
+		if err = fsync.syncEnd(tee.f); err != nil {
+			fatalCode(exitOutput, "Could not sync file", "file", alsoWrite, "err", err)
+		}
+	}
+	if preserveMetadata {
+		// The input is stat again, since it may have grown with -follow.
+		if stat, err = in.Stat(); err != nil {
+			fatalCode(exitInput, "Could not stat file", "file", inFile, "err", err)
+		}
+		if err = copyMetadata(out.Name(), stat); err != nil {
+			fatalCode(exitOutput, "Could not copy the metadata of the input", "file", outFile, "err", err)
+		}
+		if tee != nil {
+			if err = copyMetadata(tee.f.Name(), stat); err != nil {
+				fatalCode(exitOutput, "Could not copy the metadata of the input", "file", alsoWrite, "err", err)
+			}
+		}
+	}
+	if shardWriter != nil {
+		if err = shardWriter.close(inputBlobs); err != nil {
+			fatalCode(exitOutput, "Could not write assembly manifest", "err", err)
+		}
+	}
+	optimizer.log()
+	if cache != nil {
+		slog.Info("Reused blobs from the cache", "hits", cache.hits, "blobs", cache.hits+cache.misses)
+	}
+	slog.Debug("Converted file", "blobs", blobsWritten, "size", bytesWritten, "duration", time.Since(began))
+	times.log(time.Since(began))
+	if statsFile != "" {
+		if stat, err = in.Stat(); err != nil {
+			fatalCode(exitInput, "Could not stat file", "file", inFile, "err", err)
+		}
+		if err = writeRunReport(began, stat.Size(), inputBlobs, out); err != nil {
+			fatalCode(exitOutput, "Could not write statistics", "file", statsFile, "err", err)
+		}
+	}
+	if err = commitOutput(out, outFile); err != nil {
+		fatalCode(exitOutput, "Could not write file", "file", outFile, "err", err)
+	}
+	if tee != nil {
+		if err = commitOutput(tee.f, alsoWrite); err != nil {
+			fatalCode(exitOutput, "Could not write file", "file", alsoWrite, "err", err)
+		}
+	}
+	keepResults()
 }
 
-func readBlobHeader(in *os.File) (*pbfproto.BlobHeader, error) {
-	size, err := getBlobHeaderSize(in)
+// openInput opens inFile and returns it and the PBF file input, which
+// may be wrapped or archived in it. closeInput closes both.
+func openInput() (in *os.File, input io.ReadSeeker, closeInput func()) {
+	in, err := os.Open(inFile)
 	if err != nil {
-		return nil, err
+		fatalCode(exitInput, "Could not open file", "file", inFile, "err", err)
 	}
-	rawBlobHeader, err := io.ReadAll(io.LimitReader(in, int64(size)))
+	input = in
+	closeInput = func() { in.Close() }
+	wrapper, err := sniffWrapper(in)
 	if err != nil {
-		return nil, fmt.Errorf("could not read BlobHeader: %v", err)
+		fatalCode(inputCode(err), "Could not read file", "file", inFile, "err", err)
+	}
+	if wrapper != "" {
+		wrapped, err := newWrappedFile(in, wrapper)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not decompress file", "file", inFile, "err", err)
+		}
+		closeInput = func() {
+			wrapped.Close()
+			in.Close()
+		}
+		slog.Debug("Decompressing the input", "wrapper", wrapper)
+		input = wrapped
+	}
+	archived := inMember != ""
+	if !archived {
+		if archived, err = isTar(input); err != nil {
+			fatalCode(inputCode(err), "Could not read file", "file", inFile, "err", err)
+		}
 	}
-	header := &pbfproto.BlobHeader{}
-	return header, proto.Unmarshal(rawBlobHeader, header)
+	if archived {
+		member, err := openTarMember(input, inMember)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read archive", "file", inFile, "err", err)
+		}
+		slog.Debug("Reading from archive", "member", member.name)
+		input = member
+	}
+	return in, input, closeInput
 }
 
-func readBlob(header *pbfproto.BlobHeader, in *os.File) (*pbfproto.Blob, error) {
-	rawBlob, err := io.ReadAll(io.LimitReader(in, int64(*header.Datasize)))
-	if err != nil {
-		return nil, err
+// onlyCompressionOptions reports whether no options are given, that
+// change the content or layout of the output, which -grid, -relation and
+// the import of other formats don't support.
+func onlyCompressionOptions() bool {
+	return len(diffFiles) == 0 && len(transformNames) == 0 && execFilter == "" && alsoWrite == "" && !catchUpReplication &&
+		!dropDeleted && snapshot.IsZero() && !filteringMetadata() && !dedupe && targetBlobSize == 0 && alignment == 0 &&
+		!footer && !follow && shard.count == 0 && len(encryptRecipients) == 0 && manifestFile == "" && cacheDir == "" &&
+		!keepOriginal && !canonicalStrings && statsFile == "" && sampleBlobs == 0
+}
+
+// blockStages returns the stages, that data blocks must pass through
+// for the requested options.
+func blockStages() []blockStage {
+	var stages []blockStage
+	if len(changes) > 0 {
+		stages = append(stages, &diffApplier{changes: changes})
+	}
+	if dedupe {
+		stages = append(stages, newDuplicateFilter())
 	}
-	blob := &pbfproto.Blob{}
-	return blob, proto.Unmarshal(rawBlob, blob)
+	var deciders []func([]*objectVersion)
+	if dropDeleted {
+		deciders = append(deciders, dropDeletedDecider)
+	}
+	if !snapshot.IsZero() {
+		deciders = append(deciders, snapshotDecider(snapshot.UnixMilli()))
+	}
+	if len(deciders) > 0 {
+		stages = append(stages, &historyFilter{
+			decide:       chainDeciders(deciders),
+			stripVisible: !snapshot.IsZero(),
+		})
+	}
+	if filteringMetadata() {
+		stages = append(stages, newMetadataFilter())
+	}
+	if targetBlobSize > 0 {
+		// The reblocker splits oversized blocks anyway.
+		stages = append(stages, newReblocker(int(targetBlobSize)))
+	} else if splitOversized {
+		stages = append(stages, oversizeSplitter{})
+	}
+	return stages
 }
 
-func recompressData(blob *pbfproto.Blob) error {
-	rawData, err := toRawData(blob)
-	if err != nil {
-		return err
+// transformHeader reports whether the OSMHeader must be modified for
+// the requested options.
+func transformHeader() bool {
+	return !snapshot.IsZero() || caughtUp != nil || checksSortOrder() || transform != nil
+}
+
+// sortedFeature is the optional feature of an OSMHeader, which promises,
+// that the elements are sorted by type and then ID.
+const sortedFeature = "Sort.Type_then_ID"
+
+// checksSortOrder reports whether a stage fails the conversion, if the
+// elements are not sorted by type and ID, so that the output is known to
+// be sorted.
+func checksSortOrder() bool {
+	return len(changes) > 0 || dedupe
+}
+
+// rewriteHeader applies the requested modifications to the serialized
+// HeaderBlock rawData.
+func rewriteHeader(rawData []byte) ([]byte, error) {
+	header := &pbfproto.HeaderBlock{}
+	if err := proto.Unmarshal(rawData, header); err != nil {
+		return nil, err
 	}
-	in := bytes.NewReader(rawData)
-	out := new(bytes.Buffer)
-	enc, err := zstd.NewWriter(out, zstd.WithEncoderLevel(compressionLevel))
-	if err != nil {
-		return err
+	if !snapshot.IsZero() {
+		stripHistoricalInformation(header)
 	}
-	if _, err = io.Copy(enc, in); err != nil {
-		enc.Close()
-		return err
+	if caughtUp != nil {
+		header.OsmosisReplicationSequenceNumber = &caughtUp.sequence
+		header.OsmosisReplicationTimestamp = proto.Int64(caughtUp.timestamp.Unix())
 	}
-	err = enc.Close()
-	blob.Data = &pbfproto.Blob_ZstdData{ZstdData: out.Bytes()}
-	return err
+	// Transforms may reorder the elements of a block, so their output is
+	// only known to be sorted, if a stage checks it afterwards.
+	sorted := slices.Contains(header.OptionalFeatures, sortedFeature)
+	if checksSortOrder() && !sorted {
+		header.OptionalFeatures = append(header.OptionalFeatures, sortedFeature)
+	} else if !checksSortOrder() && transform != nil && sorted {
+		header.OptionalFeatures = slices.DeleteFunc(header.OptionalFeatures, func(f string) bool {
+			return f == sortedFeature
+		})
+	}
+	return marshalOptions.Marshal(header)
+}
+
+// writeBlocks writes blocks with new BlobHeaders.
+func writeBlocks(blocks []*pbfproto.PrimitiveBlock, out io.Writer) error {
+	for _, block := range blocks {
+		if err := writeBlock(nil, block, out); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func writeBlobHeader(header *pbfproto.BlobHeader, out *os.File) error {
-	rawHeader, err := proto.Marshal(header)
+// writeBlock applies the requested transformations to block and writes
+// it. If header is nil, a new BlobHeader is created.
+func writeBlock(header *pbfproto.BlobHeader, block *pbfproto.PrimitiveBlock, out io.Writer) error {
+	began := time.Now()
+	if canonicalStrings {
+		if err := canonicalizeStringTable(block); err != nil {
+			return err
+		}
+		times.transform += since(&began)
+	}
+	rawData, err := marshalOptions.Marshal(block)
+	times.marshal += since(&began)
 	if err != nil {
 		return err
 	}
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(len(rawHeader)))
-	if _, err := out.Write(buf); err != nil {
-		return err
+	if len(rawData) > maxBlockSize {
+		return fmt.Errorf("data block of %d bytes exceeds 32MiB; split it with -split-oversized", len(rawData))
 	}
-	_, err = out.Write(rawHeader)
-	return err
+	if header == nil {
+		blobType := "OSMData"
+		header = &pbfproto.BlobHeader{Type: &blobType}
+	}
+	return writeData(header, rawData, out)
 }
 
-func getBlobHeaderSize(file *os.File) (uint32, error) {
-	buf := make([]byte, 4)
-	if _, err := io.ReadFull(file, buf); err != nil {
-		return 0, err
+// blobsWritten and bytesWritten count the blobs and bytes written to
+// the output, rawBytesWritten the uncompressed bytes of their data.
+var blobsWritten int
+var bytesWritten int64
+var rawBytesWritten int64
+
+// sampleBlobs makes the conversion stop after that many data blobs, if
+// it is positive.
+var sampleBlobs int
+
+// keepOriginal makes the conversion copy blobs, that already use their
+// target codec, instead of recompressing them.
+var keepOriginal bool
+
+// keepsOriginal reports whether blob can be copied unchanged from the
+// input, because keepOriginal is set, blob already uses the codec, that
+// it would be written with, and no requested option needs its data.
+func keepsOriginal(header *pbfproto.BlobHeader, blob *pbfproto.Blob, stages []blockStage) bool {
+	if !keepOriginal || transform != nil || manifest != nil || len(stages) > 0 || canonicalStrings {
+		return false
+	}
+	switch header.GetType() {
+	case footerBlobType:
+		return false
+	case "OSMHeader":
+		if transformHeader() || compat != "" {
+			return false
+		}
 	}
-	size := binary.BigEndian.Uint32(buf)
-	if size >= maxBlobHeaderSize {
-		return 0, fmt.Errorf("blobHeader size %d >= 64KiB", size)
+	return pbf.Codec(blob) == codecs.get(header.GetType())
+}
+
+// writeOriginal writes rawBlob, the serialized blob as read from the
+// input, with the given header. Its unknown fields are kept.
+func writeOriginal(header *pbfproto.BlobHeader, rawBlob []byte, blob *pbfproto.Blob, out io.Writer) error {
+	index := blobsWritten
+	blobsWritten++
+	rawSize := int(blob.GetRawSize())
+	if data, ok := blob.Data.(*pbfproto.Blob_Raw); ok {
+		rawSize = len(data.Raw)
 	}
-	return size, nil
+	return writeFrame(index, header, rawBlob, rawSize, time.Now(), out)
 }
 
-// toRawData extracts the uncompressed data from blob. It only supports
-// uncompressed and zlib compressed blobs.
-func toRawData(blob *pbfproto.Blob) ([]byte, error) {
+// writeData compresses rawData and writes it with the given header.
+func writeData(header *pbfproto.BlobHeader, rawData []byte, out io.Writer) error {
+	began := time.Now()
+	index := blobsWritten
+	blobsWritten++
+	codec := codecs.get(header.GetType())
+	if skipIncompressible && codec != codecRaw {
+		ratio := sampleRatio(rawData)
+		if ratio > incompressibleRatio {
+			codec = codecRaw
+		}
+		slog.Log(context.Background(), levelTrace, "Sampled blob", "blob", index, "ratio", ratio, "codec", codec)
+	}
+	if manifest != nil {
+		if err := manifest.add(header.GetType(), rawData); err != nil {
+			return fmt.Errorf("could not write manifest: %v", err)
+		}
+	}
+	if tee != nil {
+		if err := tee.write(header.GetType(), rawData); err != nil {
+			return fmt.Errorf("could not write %s: %v", alsoWrite, err)
+		}
+	}
+	var key string
+	var rawBlob []byte
+	var blob *pbfproto.Blob
+	if cache != nil {
+		key = cache.key(rawData, codec)
+		rawBlob, blob = cache.get(key)
+	}
+	var err error
 	if blob == nil {
-		return nil, fmt.Errorf("blob is nil")
-	}
-	var data []byte
-	switch blobData := blob.Data.(type) {
-	case *pbfproto.Blob_Raw:
-		data = blobData.Raw
-	case *pbfproto.Blob_ZlibData:
-		reader, err := zlib.NewReader(bytes.NewReader(blobData.ZlibData))
+		compressBegan := time.Now()
+		if optimize && codec == codecZstd {
+			blob, err = optimizer.compress(header.GetType(), rawData)
+		} else {
+			blob, err = compressData(rawData, codec)
+		}
+		if err != nil {
+			return fmt.Errorf("could not compress Blob: %v", err)
+		}
+		times.compress += time.Since(compressBegan)
+	}
+	if selfCheck {
+		if err = checkBlob(blob, rawData); err != nil {
+			return fmt.Errorf("self-check failed for blob %d: %v", index, err)
+		}
+	}
+	if rawBlob == nil {
+		marshalBegan := time.Now()
+		if rawBlob, err = marshalFraming(blob); err != nil {
+			return fmt.Errorf("could not serialize Blob: %v", err)
+		}
+		times.marshal += time.Since(marshalBegan)
+		if cache != nil {
+			if err = cache.put(key, rawBlob); err != nil {
+				return fmt.Errorf("could not write to the cache: %v", err)
+			}
+		}
+	}
+	return writeFrame(index, header, rawBlob, len(rawData), began, out)
+}
+
+// writeFrame writes rawBlob, the serialized blob with index, that holds
+// rawSize bytes of uncompressed data, with the given header. It is
+// logged with the time since began.
+func writeFrame(index int, header *pbfproto.BlobHeader, rawBlob []byte, rawSize int, began time.Time, out io.Writer) error {
+	datasize := int32(len(rawBlob))
+	header.Datasize = &datasize
+	if alignment > 0 {
+		padHeader(header, len(rawBlob), bytesWritten)
+	}
+	writeBegan := time.Now()
+	err := writeBlobHeader(header, out)
+	if err != nil {
+		return fmt.Errorf("could not write BlobHeader: %v", err)
+	}
+	if _, err = out.Write(rawBlob); err != nil {
+		return fmt.Errorf("could not write Blob: %v", err)
+	}
+	times.write += time.Since(writeBegan)
+	start := bytesWritten
+	bytesWritten += 4 + int64(proto.Size(header)) + int64(len(rawBlob))
+	rawBytesWritten += int64(rawSize)
+	writeLimit.wait(int(bytesWritten - start))
+	if err = fsync.syncBlob(out, blobsWritten); err != nil {
+		return fmt.Errorf("could not sync: %v", err)
+	}
+	if shardWriter != nil {
+		if err = shardWriter.add(start, bytesWritten-start); err != nil {
+			return fmt.Errorf("could not write assembly manifest: %v", err)
+		}
+	}
+	slog.Log(context.Background(), levelTrace, "Wrote blob", "blob", index, "type", header.GetType(),
+		"raw_size", rawSize, "size", len(rawBlob), "ratio", compressionRatio(len(rawBlob), rawSize),
+		"duration", time.Since(began))
+	return nil
+}
+
+// readBlobs calls f with the header and uncompressed data of every blob
+// in in, until the end of the file is reached or f returns an error.
+func readBlobs(in io.Reader, f func(header *pbfproto.BlobHeader, rawData []byte) error) error {
+	return forEachBlob(in, func(header *pbfproto.BlobHeader, _ *pbfproto.Blob, rawData []byte) error {
+		return f(header, rawData)
+	})
+}
+
+// forEachBlob is like readBlobs, but also passes the blob to f.
+func forEachBlob(in io.Reader, f func(header *pbfproto.BlobHeader, blob *pbfproto.Blob, rawData []byte) error) error {
+	for {
+		header, err := readBlobHeader(in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		blob, err := readBlob(header, in)
+		if err != nil {
+			return fmt.Errorf("could not read Blob: %v", err)
+		}
+		rawData, err := pbf.Decompress(blob)
 		if err != nil {
-			return data, fmt.Errorf("could not decompress zlib blob: %v", err)
+			return err
 		}
-		data = make([]byte, *blob.RawSize)
-		if _, err = io.ReadFull(reader, data); err != nil {
-			return data, fmt.Errorf("could not decompress zlib blob: %v", err)
+		if err = f(header, blob, rawData); err != nil {
+			return err
 		}
-	default:
-		return data, fmt.Errorf("found unsupported blob format: %T", blob.Data)
 	}
-	return data, nil
+}
+
+func readBlobHeader(in io.Reader) (*pbfproto.BlobHeader, error) {
+	return pbf.ReadBlobHeader(in)
+}
+
+func readBlob(header *pbfproto.BlobHeader, in io.Reader) (*pbfproto.Blob, error) {
+	_, blob, err := readRawBlob(header, in)
+	return blob, err
+}
+
+// readRawBlob is like readBlob, but also returns the serialized blob. It
+// is only valid as long as the input is mapped, since mapped files are
+// sliced instead of copied.
+func readRawBlob(header *pbfproto.BlobHeader, in io.Reader) ([]byte, *pbfproto.Blob, error) {
+	var rawBlob []byte
+	var err error
+	m, mapped := in.(*mappedReader)
+	if mapped {
+		rawBlob, err = m.nextBlob(header)
+	} else {
+		rawBlob, err = pbf.ReadRawBlob(in, header)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	blob := pbfproto.BlobFromVTPool()
+	if mapped {
+		return rawBlob, blob, blob.UnmarshalVT(rawBlob)
+	}
+	// rawBlob has been read into a new buffer, that the blob can keep.
+	return rawBlob, blob, blob.UnmarshalVTUnsafe(rawBlob)
+}
+
+// checkBlob verifies that blob decompresses to rawData.
+func checkBlob(blob *pbfproto.Blob, rawData []byte) error {
+	data, err := pbf.Decompress(blob)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, rawData) {
+		return fmt.Errorf("decompressed data differs from the original")
+	}
+	return nil
+}
+
+// marshalOptions serialize messages deterministically, so that reruns
+// produce identical output, regardless of how the protobuf library
+// orders fields by default.
+var marshalOptions = proto.MarshalOptions{Deterministic: true}
+
+// framingMessage is a Blob or BlobHeader.
+type framingMessage interface {
+	proto.Message
+	MarshalVT() ([]byte, error)
+}
+
+// marshalFraming serializes a Blob or BlobHeader canonically. Unknown
+// fields are dropped, since they may describe the original encoding of
+// the data, which has been replaced.
+func marshalFraming(m framingMessage) ([]byte, error) {
+	m.ProtoReflect().SetUnknown(nil)
+	return m.MarshalVT()
+}
+
+func writeBlobHeader(header *pbfproto.BlobHeader, out io.Writer) error {
+	_, err := pbf.WriteBlobHeader(out, header)
+	return err
 }
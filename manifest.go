@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A manifest lists the SHA-256 hash of the uncompressed data of every
+// blob of a file, one line per blob in the format
+//
+//	<hex hash>  <blob index> <blob type>
+//
+// It describes the content of a file independently of its compression,
+// so that it can be checked after the file has been transferred or
+// recompressed.
+type manifestEntry struct {
+	hash     string
+	blobType string
+}
+
+type manifestWriter struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	n    int
+}
+
+func newManifestWriter(path string) (*manifestWriter, error) {
+	f, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestWriter{path: path, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// add adds the next blob to the manifest.
+func (m *manifestWriter) add(blobType string, rawData []byte) error {
+	_, err := fmt.Fprintf(m.w, "%x  %d %s\n", sha256.Sum256(rawData), m.n, blobType)
+	m.n++
+	return err
+}
+
+func (m *manifestWriter) close() error {
+	if err := m.w.Flush(); err != nil {
+		return err
+	}
+	return commitOutput(m.f, m.path)
+}
+
+// readManifest reads the entries of the manifest at path.
+func readManifest(path string) ([]manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var index int
+		if len(fields) != 3 || len(fields[0]) != 2*sha256.Size {
+			return nil, fmt.Errorf("malformed line %d", line)
+		} else if _, err := fmt.Sscan(fields[1], &index); err != nil || index != len(entries) {
+			return nil, fmt.Errorf("line %d does not describe blob %d", line, len(entries))
+		}
+		entries = append(entries, manifestEntry{hash: strings.ToLower(fields[0]), blobType: fields[2]})
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// maxMemory limits the memory used for buffers, if it is not zero.
+var maxMemory byteSize
+
+// blobMemory is the memory needed for a blob, that is being converted,
+// outside of the encoder: the compressed input, the uncompressed data
+// and the recompressed output.
+const blobMemory = 3 * maxBlockSize
+
+// encoderMemory estimates the memory, that each goroutine of a zstd
+// encoder needs with the current options: its history, which is twice
+// the window, and its match tables.
+func encoderMemory() int64 {
+	window := int64(8 << 20) // The default of klauspost/compress.
+	if windowLog > 0 {
+		window = 1 << windowLog
+	} else if longWindow {
+		window = maxBlockSize
+	}
+	return 2*window + 4<<20
+}
+
+// readAheadMemory is the memory, that the blobs read ahead with
+// -read-ahead may take, or zero for no limit. It is set by
+// applyMemoryLimit.
+var readAheadMemory int64
+
+// applyMemoryLimit makes the garbage collector keep the heap below
+// maxMemory and lowers the encoder concurrency, so that the encoders fit
+// into what is left after reserving the given number of bytes for blobs.
+// With -read-ahead, a blob read ahead is reserved, too, and the memory
+// left after the encoders is given to further blobs read ahead.
+func applyMemoryLimit(reserved int64) error {
+	if maxMemory == 0 {
+		return nil
+	}
+	debug.SetMemoryLimit(int64(maxMemory))
+	if readAhead > 0 {
+		reserved += maxBlockSize
+	}
+	left := int64(maxMemory) - reserved
+	encoders := int(left / encoderMemory())
+	if encoders < 1 {
+		needed := byteSize(reserved + encoderMemory())
+		return fmt.Errorf("at least %s are needed with these options", &needed)
+	}
+	requested := encoderConcurrency
+	if requested == 0 {
+		requested = runtime.GOMAXPROCS(0)
+	}
+	if requested > encoders {
+		slog.Debug("Lowering the encoder concurrency to fit the memory limit", "encoder_concurrency", encoders)
+		encoderConcurrency = encoders
+		requested = encoders
+	}
+	if readAhead > 0 {
+		readAheadMemory = maxBlockSize + left - int64(requested)*encoderMemory()
+		slog.Debug("Limiting the blobs read ahead to fit the memory limit", "read_ahead_memory", readAheadMemory)
+	}
+	return nil
+}
+
+// memoryBudget blocks the acquisition of bytes, while others hold more
+// than its size.
+type memoryBudget struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	free   int64
+	closed bool
+}
+
+func newMemoryBudget(size int64) *memoryBudget {
+	b := &memoryBudget{size: size, free: size}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes are free and takes them. Requests larger
+// than the budget take all of it, so that they can still make progress.
+// It returns false, if the budget has been closed.
+func (b *memoryBudget) acquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n = min(n, b.size)
+	for b.free < n && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	b.free -= n
+	return true
+}
+
+// release returns n bytes, that have been taken with acquire.
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.free += min(n, b.size)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// close makes all pending and future calls of acquire fail.
+func (b *memoryBudget) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// The metadata filters keep only the elements, that match all of the
+// given ones. Elements without metadata never match.
+var (
+	filterChangesets []int64
+	filterUsers      []string // Names or UIDs.
+	filterSince      time.Time
+	filterUntil      time.Time
+)
+
+// parseChangesetID is the flag.Func of -changeset.
+func parseChangesetID(value string) error {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected a changeset ID")
+	}
+	filterChangesets = append(filterChangesets, id)
+	return nil
+}
+
+// filteringMetadata reports whether a metadata filter is given.
+func filteringMetadata() bool {
+	return len(filterChangesets) > 0 || len(filterUsers) > 0 || !filterSince.IsZero() || !filterUntil.IsZero()
+}
+
+// metadataFilter is a blockStage, that drops the elements, which don't
+// match the metadata filters.
+type metadataFilter struct {
+	changesets   map[int64]bool // Nil, if all match.
+	uids         map[int32]bool
+	names        map[string]bool
+	since, until int64 // In milliseconds since the epoch; until is exclusive.
+}
+
+func newMetadataFilter() *metadataFilter {
+	f := &metadataFilter{since: math.MinInt64, until: math.MaxInt64}
+	if len(filterChangesets) > 0 {
+		f.changesets = make(map[int64]bool)
+		for _, changeset := range filterChangesets {
+			f.changesets[changeset] = true
+		}
+	}
+	if len(filterUsers) > 0 {
+		f.uids, f.names = make(map[int32]bool), make(map[string]bool)
+		for _, user := range filterUsers {
+			if uid, err := strconv.ParseInt(user, 10, 32); err == nil {
+				f.uids[int32(uid)] = true
+			} else {
+				f.names[user] = true
+			}
+		}
+	}
+	if !filterSince.IsZero() {
+		f.since = filterSince.UnixMilli()
+	}
+	if !filterUntil.IsZero() {
+		f.until = filterUntil.UnixMilli()
+	}
+	return f
+}
+
+// match reports whether an element with the given metadata matches.
+// timestamp is in milliseconds since the epoch.
+func (f *metadataFilter) match(timestamp, changeset int64, uid int32, user string) bool {
+	if f.changesets != nil && !f.changesets[changeset] {
+		return false
+	}
+	if f.uids != nil && !f.uids[uid] && !f.names[user] {
+		return false
+	}
+	return timestamp >= f.since && timestamp < f.until
+}
+
+func (f *metadataFilter) add(block *pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error) {
+	dateGranularity := int64(block.GetDateGranularity())
+	user := func(sid int32) string {
+		if len(f.names) == 0 || sid < 0 || block.Stringtable == nil || int(sid) >= len(block.Stringtable.S) {
+			return ""
+		}
+		return string(block.Stringtable.S[sid])
+	}
+	matchInfo := func(info *pbfproto.Info) bool {
+		return info != nil && f.match(info.GetTimestamp()*dateGranularity, info.GetChangeset(), info.GetUid(), user(int32(info.GetUserSid())))
+	}
+	var groups []*pbfproto.PrimitiveGroup
+	for _, group := range block.Primitivegroup {
+		group.Nodes = filter(group.Nodes, func(node *pbfproto.Node) bool { return matchInfo(node.Info) })
+		if group.Dense != nil {
+			hasInfo, hasVisible := denseHasInfo(group.Dense)
+			nodes, err := decodeDenseNodes(group.Dense)
+			if err != nil {
+				return nil, err
+			}
+			nodes = filter(nodes, func(node denseNode) bool {
+				return hasInfo && f.match(node.timestamp*dateGranularity, node.changeset, node.uid, user(node.userSid))
+			})
+			group.Dense = encodeDenseNodes(nodes, hasInfo, hasVisible)
+		}
+		group.Ways = filter(group.Ways, func(way *pbfproto.Way) bool { return matchInfo(way.Info) })
+		group.Relations = filter(group.Relations, func(r *pbfproto.Relation) bool { return matchInfo(r.Info) })
+		if groupKind(group) != kindEmpty {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	block.Primitivegroup = groups
+	return []*pbfproto.PrimitiveBlock{block}, nil
+}
+
+func (f *metadataFilter) flush() ([]*pbfproto.PrimitiveBlock, error) {
+	return nil, nil
+}
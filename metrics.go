@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricBlobs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zstdpbf_blobs_total",
+		Help: "The number of processed blobs.",
+	})
+	metricBytesRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zstdpbf_read_bytes_total",
+		Help: "The size of the processed blobs before recompression.",
+	})
+	metricBytesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zstdpbf_written_bytes_total",
+		Help: "The size of the processed blobs after recompression.",
+	})
+	metricQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "zstdpbf_queue_depth",
+		Help: "The number of requests or blobs, that are being processed.",
+	})
+	metricErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zstdpbf_errors_total",
+		Help: "The number of requests or blobs, that could not be processed.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "zstdpbf_compression_ratio",
+		Help: "The written bytes divided by the read bytes of all processed blobs.",
+	}, func() float64 {
+		return compressionRatio(int(totalWritten.Load()), int(totalRead.Load()))
+	})
+)
+
+// totalRead and totalWritten repeat the byte counters for the ratio,
+// since counters can't be read.
+var totalRead, totalWritten atomic.Int64
+
+// recordBlob counts a processed blob, that had read bytes and was
+// written with written bytes.
+func recordBlob(read, written int) {
+	metricBlobs.Inc()
+	metricBytesRead.Add(float64(read))
+	metricBytesWritten.Add(float64(written))
+	totalRead.Add(int64(read))
+	totalWritten.Add(int64(written))
+}
+
+// addMetricsFlag adds the flag for the address of the metrics endpoint
+// to the flags of a long-running command.
+func addMetricsFlag(flags *flag.FlagSet) *string {
+	return flags.String("metrics", "", "serve Prometheus metrics at http://`ADDRESS`/metrics")
+}
+
+// serveMetrics serves the metrics in the background, if addr is not
+// empty.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	go func() {
+		slog.Info("Serving metrics", "address", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fatal("Could not serve metrics", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// useMmap makes the conversion map the input into memory, instead of
+// reading it through buffers.
+var useMmap bool
+
+// mappedReader reads a file, that has been mapped into memory.
+type mappedReader struct {
+	data []byte
+	pos  int64
+}
+
+func (m *mappedReader) Read(p []byte) (int, error) {
+	if m.pos >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.pos:])
+	m.pos += int64(n)
+	return n, nil
+}
+
+// next returns the next n bytes or, like io.ReadAll with an
+// io.LimitReader, less at the end of the file. The bytes are not copied
+// and become invalid, once the file is unmapped.
+func (m *mappedReader) next(n int64) []byte {
+	end := min(m.pos+n, int64(len(m.data)))
+	b := m.data[m.pos:end:end]
+	m.pos = end
+	return b
+}
+
+// nextBlob returns the serialized blob, that follows header, like
+// pbf.ReadRawBlob, but without copying it. The bytes must not be
+// retained beyond proto.Unmarshal, which copies them.
+func (m *mappedReader) nextBlob(header *pbfproto.BlobHeader) ([]byte, error) {
+	if err := pbf.CheckDatasize(header); err != nil {
+		return nil, err
+	}
+	rawBlob := m.next(int64(header.GetDatasize()))
+	if len(rawBlob) < int(header.GetDatasize()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return rawBlob, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// mapFile maps f into memory. The returned function unmaps it.
+func mapFile(f *os.File) (*mappedReader, func() error, error) {
+	return nil, nil, fmt.Errorf("memory mapping is not supported on this system")
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps f into memory. The returned function unmaps it.
+func mapFile(f *os.File) (*mappedReader, func() error, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat.Size() == 0 {
+		// Empty mappings are rejected.
+		return &mappedReader{}, func() error { return nil }, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &mappedReader{data: data}, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"math/bits"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/zstd"
+)
+
+// optimize makes the conversion search the zstd level and window, that
+// compress a blob best, instead of using the same for all blobs.
+var optimize bool
+
+// zstdTrial is a combination of a zstd level and window, that -optimize
+// tries. A windowLog of 0 uses the window of the level.
+type zstdTrial struct {
+	level     zstd.EncoderLevel
+	windowLog int
+}
+
+// optimizeKey describes the blobs, that are expected to compress best
+// with the same options: blobs of the same type, similar size and
+// similar entropy.
+type optimizeKey struct {
+	blobType     string
+	sizeClass    int // The bit length of the size.
+	entropyClass int // In quarters of a bit per byte.
+}
+
+// blobOptimizer remembers the best options for every optimizeKey, so
+// that only the first of similar blobs is compressed with all of them.
+type blobOptimizer struct {
+	choices          map[optimizeKey]zstdTrial
+	searches, reused int
+}
+
+var optimizer = &blobOptimizer{choices: make(map[optimizeKey]zstdTrial)}
+
+// zstdTrials returns the options, that are tried for size bytes of data.
+func zstdTrials(size int) []zstdTrial {
+	// A window, that covers the whole blob, like -long.
+	wholeBlob := max(bits.Len(uint(max(size-1, 1))), 10)
+	wholeBlob = min(wholeBlob, maxWindowLog)
+	var trials []zstdTrial
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedDefault, zstd.SpeedBetterCompression, zstd.SpeedBestCompression} {
+		trials = append(trials, zstdTrial{level, 0}, zstdTrial{level, wholeBlob})
+	}
+	return trials
+}
+
+func compressTrial(rawData []byte, trial zstdTrial) ([]byte, error) {
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(trial.level),
+		zstd.WithEncoderCRC(zstdChecksum),
+		zstd.WithEncoderConcurrency(1),
+	}
+	if maxMemory > 0 {
+		opts = append(opts, zstd.WithLowerEncoderMem(true))
+	}
+	if trial.windowLog > 0 {
+		opts = append(opts, zstd.WithWindowSize(1<<trial.windowLog))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(rawData, nil), nil
+}
+
+// compress compresses rawData, the data of a blob of blobType, with the
+// options, that were best for similar blobs, or, for the first of them,
+// with the smallest result of all options.
+func (o *blobOptimizer) compress(blobType string, rawData []byte) (*pbfproto.Blob, error) {
+	key := optimizeKey{
+		blobType:     blobType,
+		sizeClass:    bits.Len(uint(len(rawData))),
+		entropyClass: int(math.Round(4 * byteEntropy(rawData))),
+	}
+	var data []byte
+	var err error
+	if trial, ok := o.choices[key]; ok {
+		o.reused++
+		if data, err = compressTrial(rawData, trial); err != nil {
+			return nil, err
+		}
+	} else {
+		o.searches++
+		var best zstdTrial
+		for _, trial := range zstdTrials(len(rawData)) {
+			compressed, err := compressTrial(rawData, trial)
+			if err != nil {
+				return nil, err
+			}
+			if data == nil || len(compressed) < len(data) {
+				data, best = compressed, trial
+			}
+		}
+		o.choices[key] = best
+		slog.Debug("Chose zstd options", "type", blobType, "size_class", key.sizeClass,
+			"entropy_class", key.entropyClass, "level", best.level, "window_log", best.windowLog)
+	}
+	rawSize := int32(len(rawData))
+	return &pbfproto.Blob{RawSize: &rawSize, Data: &pbfproto.Blob_ZstdData{ZstdData: data}}, nil
+}
+
+func (o *blobOptimizer) log() {
+	if o.searches > 0 {
+		slog.Info("Optimized the zstd options", "searches", o.searches, "reused", o.reused)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/gzip"
+)
+
+// maxBlockElements is the number of elements, after which blocks built
+// from decoded elements are split. Osmium uses the same limit.
+const maxBlockElements = 8000
+
+// osmChange is a single change of an OsmChange file.
+type osmChange struct {
+	element *osmElement
+	delete  bool
+}
+
+// readOSC reads the OsmChange files at paths in order, which may be
+// gzip compressed. The changes are returned sorted by type and ID. If an
+// object is changed multiple times, only the change with the highest
+// version, or the last one for equal versions, is kept.
+func readOSC(paths []string) ([]*osmChange, error) {
+	changes := make(map[objectKey]*osmChange)
+	for _, path := range paths {
+		if err := readOSCFile(path, changes); err != nil {
+			return nil, fmt.Errorf("could not read '%s': %v", path, err)
+		}
+	}
+	sorted := make([]*osmChange, 0, len(changes))
+	for _, change := range changes {
+		sorted = append(sorted, change)
+	}
+	slices.SortFunc(sorted, func(a, b *osmChange) int {
+		return compareObjects(a.element, b.element)
+	})
+	return sorted, nil
+}
+
+func readOSCFile(path string, changes map[objectKey]*osmChange) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	decoder := xml.NewDecoder(r)
+	action := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch name := start.Name.Local; name {
+		case "create", "modify", "delete":
+			action = name
+		case "node", "way", "relation":
+			if action == "" {
+				return fmt.Errorf("%s outside of create, modify or delete", name)
+			}
+			var x xmlElement
+			if err = decoder.DecodeElement(&x, &start); err != nil {
+				return err
+			}
+			e, err := x.toElement(xmlKinds[name])
+			if err != nil {
+				return err
+			}
+			if action == "delete" && e.info != nil {
+				e.info.visible = false
+			}
+			key := objectKey{e.kind, e.id}
+			if old, ok := changes[key]; ok && old.element.info != nil && e.info != nil &&
+				old.element.info.version > e.info.version {
+				continue
+			}
+			changes[key] = &osmChange{element: e, delete: action == "delete"}
+		}
+	}
+}
+
+// compareObjects orders elements by type and ID.
+func compareObjects(a, b *osmElement) int {
+	if a.kind != b.kind {
+		return cmp.Compare(a.kind, b.kind)
+	}
+	return cmp.Compare(a.id, b.id)
+}
+
+// diffApplier merges changes into a stream of data blocks, which must be
+// sorted by type and ID. Blocks, that are not affected by any change,
+// are passed through unchanged; affected blocks are rebuilt from their
+// decoded elements.
+type diffApplier struct {
+	changes []*osmChange
+	last    *osmElement
+}
+
+func (d *diffApplier) add(block *pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error) {
+	elements, err := decodeElements(block)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range elements {
+		if d.last != nil && compareObjects(d.last, e) >= 0 {
+			return nil, fmt.Errorf("input is not sorted by type and ID at %s", e.name())
+		}
+		d.last = e
+	}
+	if len(elements) == 0 {
+		return []*pbfproto.PrimitiveBlock{block}, nil
+	}
+
+	// Changes up to the last element of the block are applied to it.
+	n := 0
+	for n < len(d.changes) && compareObjects(d.changes[n].element, d.last) <= 0 {
+		n++
+	}
+	if n == 0 {
+		return []*pbfproto.PrimitiveBlock{block}, nil
+	}
+	changes := d.changes[:n]
+	d.changes = d.changes[n:]
+	var merged []*osmElement
+	for len(elements) > 0 || len(changes) > 0 {
+		c := 1
+		if len(elements) == 0 {
+			c = -1
+		} else if len(changes) > 0 {
+			c = compareObjects(changes[0].element, elements[0])
+		}
+		if c > 0 {
+			merged = append(merged, elements[0])
+			elements = elements[1:]
+			continue
+		}
+		if c == 0 {
+			elements = elements[1:]
+		}
+		if !changes[0].delete {
+			merged = append(merged, changes[0].element)
+		}
+		changes = changes[1:]
+	}
+	return encodeElementBlocks(merged), nil
+}
+
+// flush returns blocks with the objects created after the last object
+// of the input.
+func (d *diffApplier) flush() ([]*pbfproto.PrimitiveBlock, error) {
+	var created []*osmElement
+	for _, change := range d.changes {
+		if !change.delete {
+			created = append(created, change.element)
+		}
+	}
+	d.changes = nil
+	return encodeElementBlocks(created), nil
+}
+
+// encodeElementBlocks encodes elements into blocks of at most
+// maxBlockElements elements.
+func encodeElementBlocks(elements []*osmElement) []*pbfproto.PrimitiveBlock {
+	var blocks []*pbfproto.PrimitiveBlock
+	for len(elements) > 0 {
+		n := min(len(elements), maxBlockElements)
+		blocks = append(blocks, encodeElements(elements[:n]))
+		elements = elements[n:]
+	}
+	return blocks
+}
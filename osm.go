@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// osmElement is a fully decoded node, way or relation, independent of
+// the block it was stored in.
+type osmElement struct {
+	kind groupKindType // One of kindNodes, kindWays and kindRelations.
+	id   int64
+	info *osmInfo // Nil if the element has no metadata.
+	tags []tag
+
+	lat, lon int64    // In nanodegrees; only for nodes.
+	refs     []int64  // Only for ways.
+	members  []member // Only for relations.
+}
+
+type osmInfo struct {
+	version   int32
+	timestamp int64 // In milliseconds since the epoch.
+	changeset int64
+	uid       int32
+	user      string
+	visible   bool
+}
+
+type tag struct {
+	key, value string
+}
+
+type member struct {
+	kind groupKindType
+	id   int64
+	role string
+}
+
+// name returns a short name like "n123" for the element.
+func (e *osmElement) name() string {
+	return kindLetter(e.kind) + fmt.Sprint(e.id)
+}
+
+func kindLetter(kind groupKindType) string {
+	switch kind {
+	case kindNodes, kindDense:
+		return "n"
+	case kindWays:
+		return "w"
+	case kindRelations:
+		return "r"
+	}
+	return "?"
+}
+
+// decodeElements decodes all nodes, ways and relations of block.
+func decodeElements(block *pbfproto.PrimitiveBlock) ([]*osmElement, error) {
+	if block.Stringtable == nil {
+		return nil, fmt.Errorf("PrimitiveBlock has no string table")
+	}
+	table := block.Stringtable.S
+	var badSID int64 = -1
+	str := func(sid int64) string {
+		if sid < 0 || sid >= int64(len(table)) {
+			badSID = sid
+			return ""
+		}
+		return string(table[sid])
+	}
+	granularity := int64(block.GetGranularity())
+	dateGranularity := int64(block.GetDateGranularity())
+	latOffset, lonOffset := block.GetLatOffset(), block.GetLonOffset()
+	decodeInfo := func(info *pbfproto.Info) *osmInfo {
+		if info == nil {
+			return nil
+		}
+		return &osmInfo{
+			version:   info.GetVersion(),
+			timestamp: info.GetTimestamp() * dateGranularity,
+			changeset: info.GetChangeset(),
+			uid:       info.GetUid(),
+			user:      str(int64(info.GetUserSid())),
+			visible:   info.Visible == nil || *info.Visible,
+		}
+	}
+	decodeTags := func(keys, vals []uint32) []tag {
+		tags := make([]tag, 0, len(keys))
+		for i := range keys {
+			if i < len(vals) {
+				tags = append(tags, tag{str(int64(keys[i])), str(int64(vals[i]))})
+			}
+		}
+		return tags
+	}
+
+	var elements []*osmElement
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			if len(node.Keys) != len(node.Vals) {
+				return nil, fmt.Errorf("node %d has %d keys but %d values", node.GetId(), len(node.Keys), len(node.Vals))
+			}
+			elements = append(elements, &osmElement{
+				kind: kindNodes,
+				id:   node.GetId(),
+				info: decodeInfo(node.Info),
+				tags: decodeTags(node.Keys, node.Vals),
+				lat:  latOffset + granularity*node.GetLat(),
+				lon:  lonOffset + granularity*node.GetLon(),
+			})
+		}
+		if group.Dense != nil {
+			nodes, err := decodeDenseNodes(group.Dense)
+			if err != nil {
+				return nil, err
+			}
+			hasInfo, hasVisible := denseHasInfo(group.Dense)
+			for _, node := range nodes {
+				e := &osmElement{
+					kind: kindNodes,
+					id:   node.id,
+					lat:  latOffset + granularity*node.lat,
+					lon:  lonOffset + granularity*node.lon,
+				}
+				if hasInfo {
+					e.info = &osmInfo{
+						version:   node.version,
+						timestamp: node.timestamp * dateGranularity,
+						changeset: node.changeset,
+						uid:       node.uid,
+						user:      str(int64(node.userSid)),
+						visible:   !hasVisible || node.visible,
+					}
+				}
+				for i := 0; i+1 < len(node.keysVals); i += 2 {
+					e.tags = append(e.tags, tag{str(int64(node.keysVals[i])), str(int64(node.keysVals[i+1]))})
+				}
+				elements = append(elements, e)
+			}
+		}
+		for _, way := range group.Ways {
+			if len(way.Keys) != len(way.Vals) {
+				return nil, fmt.Errorf("way %d has %d keys but %d values", way.GetId(), len(way.Keys), len(way.Vals))
+			}
+			e := &osmElement{
+				kind: kindWays,
+				id:   way.GetId(),
+				info: decodeInfo(way.Info),
+				tags: decodeTags(way.Keys, way.Vals),
+				refs: make([]int64, len(way.Refs)),
+			}
+			var ref int64
+			for i, delta := range way.Refs {
+				ref += delta
+				e.refs[i] = ref
+			}
+			elements = append(elements, e)
+		}
+		for _, relation := range group.Relations {
+			if len(relation.Keys) != len(relation.Vals) {
+				return nil, fmt.Errorf("relation %d has %d keys but %d values", relation.GetId(), len(relation.Keys), len(relation.Vals))
+			}
+			if len(relation.Memids) != len(relation.Types) || len(relation.Memids) != len(relation.RolesSid) {
+				return nil, fmt.Errorf("relation %d has inconsistent member arrays", relation.GetId())
+			}
+			e := &osmElement{
+				kind:    kindRelations,
+				id:      relation.GetId(),
+				info:    decodeInfo(relation.Info),
+				tags:    decodeTags(relation.Keys, relation.Vals),
+				members: make([]member, len(relation.Memids)),
+			}
+			var id int64
+			for i, delta := range relation.Memids {
+				id += delta
+				e.members[i] = member{
+					kind: memberKind(relation.Types[i]),
+					id:   id,
+					role: str(int64(relation.RolesSid[i])),
+				}
+			}
+			elements = append(elements, e)
+		}
+	}
+	if badSID >= 0 {
+		return nil, fmt.Errorf("string ID %d out of range", badSID)
+	}
+	return elements, nil
+}
+
+func memberKind(t pbfproto.Relation_MemberType) groupKindType {
+	switch t {
+	case pbfproto.Relation_NODE:
+		return kindNodes
+	case pbfproto.Relation_WAY:
+		return kindWays
+	case pbfproto.Relation_RELATION:
+		return kindRelations
+	}
+	return kindEmpty
+}
+
+// encodeElements builds a PrimitiveBlock from elements. Consecutive
+// elements of the same kind are stored in one group; nodes are stored
+// as DenseNodes. Coordinates are stored with the default granularity.
+func encodeElements(elements []*osmElement) *pbfproto.PrimitiveBlock {
+	block := &pbfproto.PrimitiveBlock{Stringtable: &pbfproto.StringTable{S: [][]byte{{}}}}
+	stringIDs := make(map[string]int)
+	sid := func(s string) int {
+		if s == "" {
+			return 0
+		}
+		id, ok := stringIDs[s]
+		if !ok {
+			id = len(block.Stringtable.S)
+			block.Stringtable.S = append(block.Stringtable.S, []byte(s))
+			stringIDs[s] = id
+		}
+		return id
+	}
+	const granularity, dateGranularity = 100, 1000
+	withInfo, withVisible := false, false
+	for _, e := range elements {
+		if e.info != nil {
+			withInfo = true
+			withVisible = withVisible || !e.info.visible
+		}
+	}
+	encodeInfo := func(info *osmInfo) *pbfproto.Info {
+		if info == nil {
+			return nil
+		}
+		userSid := uint32(sid(info.user))
+		pinfo := &pbfproto.Info{
+			Version:   &info.version,
+			Timestamp: proto.Int64(info.timestamp / dateGranularity),
+			Changeset: &info.changeset,
+			Uid:       &info.uid,
+			UserSid:   &userSid,
+		}
+		if withVisible {
+			pinfo.Visible = &info.visible
+		}
+		return pinfo
+	}
+	encodeTags := func(tags []tag) (keys, vals []uint32) {
+		for _, t := range tags {
+			keys = append(keys, uint32(sid(t.key)))
+			vals = append(vals, uint32(sid(t.value)))
+		}
+		return keys, vals
+	}
+
+	var group *pbfproto.PrimitiveGroup
+	var dense []denseNode
+	kind := kindEmpty
+	finishGroup := func() {
+		if kind == kindNodes {
+			group.Dense = encodeDenseNodes(dense, withInfo, withVisible)
+			dense = nil
+		}
+		if group != nil {
+			block.Primitivegroup = append(block.Primitivegroup, group)
+		}
+	}
+	for _, e := range elements {
+		if e.kind != kind {
+			finishGroup()
+			group, kind = &pbfproto.PrimitiveGroup{}, e.kind
+		}
+		switch e.kind {
+		case kindNodes:
+			node := denseNode{id: e.id, lat: e.lat / granularity, lon: e.lon / granularity, visible: true}
+			for _, t := range e.tags {
+				node.keysVals = append(node.keysVals, int32(sid(t.key)), int32(sid(t.value)))
+			}
+			if e.info != nil {
+				node.version = e.info.version
+				node.timestamp = e.info.timestamp / dateGranularity
+				node.changeset = e.info.changeset
+				node.uid = e.info.uid
+				node.userSid = int32(sid(e.info.user))
+				node.visible = e.info.visible
+			}
+			dense = append(dense, node)
+		case kindWays:
+			way := &pbfproto.Way{Id: proto.Int64(e.id), Info: encodeInfo(e.info)}
+			way.Keys, way.Vals = encodeTags(e.tags)
+			var prev int64
+			for _, ref := range e.refs {
+				way.Refs = append(way.Refs, ref-prev)
+				prev = ref
+			}
+			group.Ways = append(group.Ways, way)
+		case kindRelations:
+			relation := &pbfproto.Relation{Id: proto.Int64(e.id), Info: encodeInfo(e.info)}
+			relation.Keys, relation.Vals = encodeTags(e.tags)
+			var prev int64
+			for _, m := range e.members {
+				relation.Memids = append(relation.Memids, m.id-prev)
+				relation.Types = append(relation.Types, memberType(m.kind))
+				relation.RolesSid = append(relation.RolesSid, int32(sid(m.role)))
+				prev = m.id
+			}
+			group.Relations = append(group.Relations, relation)
+		}
+	}
+	finishGroup()
+	return block
+}
+
+func memberType(kind groupKindType) pbfproto.Relation_MemberType {
+	switch kind {
+	case kindWays:
+		return pbfproto.Relation_WAY
+	case kindRelations:
+		return pbfproto.Relation_RELATION
+	}
+	return pbfproto.Relation_NODE
+}
+
+// elementReader reads the elements of a PBF file one at a time.
+type elementReader struct {
+	in      io.Reader
+	pending []*osmElement
+}
+
+func newElementReader(in io.Reader) *elementReader {
+	return &elementReader{in: in}
+}
+
+// next returns the next element or io.EOF at the end of the file.
+func (r *elementReader) next() (*osmElement, error) {
+	for len(r.pending) == 0 {
+		header, err := readBlobHeader(r.in)
+		if err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read BlobHeader: %v", err)
+		}
+		blob, err := readBlob(header, r.in)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Blob: %v", err)
+		}
+		if header.GetType() != "OSMData" {
+			continue
+		}
+		rawData, err := pbf.Decompress(blob)
+		if err != nil {
+			return nil, err
+		}
+		block := &pbfproto.PrimitiveBlock{}
+		if err = proto.Unmarshal(rawData, block); err != nil {
+			return nil, fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+		}
+		if r.pending, err = decodeElements(block); err != nil {
+			return nil, err
+		}
+	}
+	e := r.pending[0]
+	r.pending = r.pending[1:]
+	return e, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xmlElement is a node, way or relation in the OSM XML format.
+type xmlElement struct {
+	ID        int64       `xml:"id,attr"`
+	Lat       string      `xml:"lat,attr,omitempty"`
+	Lon       string      `xml:"lon,attr,omitempty"`
+	Version   int32       `xml:"version,attr,omitempty"`
+	Timestamp string      `xml:"timestamp,attr,omitempty"`
+	Changeset int64       `xml:"changeset,attr,omitempty"`
+	UID       int32       `xml:"uid,attr,omitempty"`
+	User      string      `xml:"user,attr,omitempty"`
+	Visible   string      `xml:"visible,attr,omitempty"`
+	Nds       []xmlNd     `xml:"nd"`
+	Members   []xmlMember `xml:"member"`
+	Tags      []xmlTag    `xml:"tag"`
+}
+
+type xmlTag struct {
+	K string `xml:"k,attr"`
+	V string `xml:"v,attr"`
+}
+
+type xmlNd struct {
+	Ref int64 `xml:"ref,attr"`
+}
+
+type xmlMember struct {
+	Type string `xml:"type,attr"`
+	Ref  int64  `xml:"ref,attr"`
+	Role string `xml:"role,attr"`
+}
+
+// xmlKinds maps the XML element names to element kinds.
+var xmlKinds = map[string]groupKindType{
+	"node":     kindNodes,
+	"way":      kindWays,
+	"relation": kindRelations,
+}
+
+// toElement converts x, whose XML element name is given by kind.
+// Metadata is only set, if x has a version.
+func (x *xmlElement) toElement(kind groupKindType) (*osmElement, error) {
+	e := &osmElement{kind: kind, id: x.ID}
+	if x.Version != 0 {
+		e.info = &osmInfo{
+			version:   x.Version,
+			changeset: x.Changeset,
+			uid:       x.UID,
+			user:      x.User,
+			visible:   x.Visible != "false",
+		}
+		if x.Timestamp != "" {
+			t, err := time.Parse(time.RFC3339, x.Timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp of %s: %v", e.name(), err)
+			}
+			e.info.timestamp = t.UnixMilli()
+		}
+	}
+	for _, t := range x.Tags {
+		e.tags = append(e.tags, tag{t.K, t.V})
+	}
+	switch kind {
+	case kindNodes:
+		var err error
+		if x.Lat != "" || x.Lon != "" {
+			if e.lat, err = parseCoordinate(x.Lat); err != nil {
+				return nil, fmt.Errorf("invalid latitude of %s: %v", e.name(), err)
+			}
+			if e.lon, err = parseCoordinate(x.Lon); err != nil {
+				return nil, fmt.Errorf("invalid longitude of %s: %v", e.name(), err)
+			}
+		}
+	case kindWays:
+		for _, nd := range x.Nds {
+			e.refs = append(e.refs, nd.Ref)
+		}
+	case kindRelations:
+		for _, m := range x.Members {
+			kind, ok := xmlKinds[m.Type]
+			if !ok {
+				return nil, fmt.Errorf("invalid member type '%s' in %s", m.Type, e.name())
+			}
+			e.members = append(e.members, member{kind, m.Ref, m.Role})
+		}
+	}
+	return e, nil
+}
+
+// parseCoordinate parses a coordinate in degrees, as used in OSM XML,
+// into nanodegrees, rounded to the 7 decimal places OSM uses.
+func parseCoordinate(s string) (int64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(f*1e7)) * 100, nil
+}
+
+// newXMLElement converts e to the OSM XML format.
+func newXMLElement(e *osmElement) *xmlElement {
+	x := &xmlElement{ID: e.id}
+	if e.info != nil {
+		x.Version = e.info.version
+		x.Timestamp = formatTimestamp(e.info.timestamp)
+		x.Changeset = e.info.changeset
+		x.UID = e.info.uid
+		x.User = e.info.user
+		if !e.info.visible {
+			x.Visible = "false"
+		}
+	}
+	for _, t := range e.tags {
+		x.Tags = append(x.Tags, xmlTag{t.key, t.value})
+	}
+	switch e.kind {
+	case kindNodes:
+		if e.info == nil || e.info.visible {
+			x.Lat, x.Lon = formatCoordinate(e.lat), formatCoordinate(e.lon)
+		}
+	case kindWays:
+		for _, ref := range e.refs {
+			x.Nds = append(x.Nds, xmlNd{ref})
+		}
+	case kindRelations:
+		for _, m := range e.members {
+			x.Members = append(x.Members, xmlMember{xmlKindName(m.kind), m.id, m.role})
+		}
+	}
+	return x
+}
+
+// xmlKindName returns the XML element name of kind.
+func xmlKindName(kind groupKindType) string {
+	for name, k := range xmlKinds {
+		if k == kind {
+			return name
+		}
+	}
+	return ""
+}
+
+// formatCoordinate formats a coordinate in nanodegrees with the 7
+// decimal places OSM uses, without trailing zeros.
+func formatCoordinate(n int64) string {
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	n = (n + 50) / 100
+	s := fmt.Sprintf("%s%d.%07d", sign, n/1e7, n%1e7)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
@@ -0,0 +1,59 @@
+package pbf
+
+import (
+	"fmt"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// DecodeHeaderBlock decompresses and parses the HeaderBlock of an
+// OSMHeader blob.
+func DecodeHeaderBlock(blob *pbfproto.Blob) (*pbfproto.HeaderBlock, error) {
+	data, err := Decompress(blob)
+	if err != nil {
+		return nil, err
+	}
+	header := &pbfproto.HeaderBlock{}
+	if err = proto.Unmarshal(data, header); err != nil {
+		return nil, fmt.Errorf("could not parse HeaderBlock: %v", err)
+	}
+	return header, nil
+}
+
+// DecodePrimitiveBlock decompresses and parses the PrimitiveBlock of an
+// OSMData blob.
+func DecodePrimitiveBlock(blob *pbfproto.Blob) (*pbfproto.PrimitiveBlock, error) {
+	data, err := Decompress(blob)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrimitiveBlock(data)
+}
+
+func parsePrimitiveBlock(data []byte) (*pbfproto.PrimitiveBlock, error) {
+	block := &pbfproto.PrimitiveBlock{}
+	if err := proto.Unmarshal(data, block); err != nil {
+		return nil, fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+	}
+	return block, nil
+}
+
+// Degrees converts the stored latitude and longitude of a node in block
+// to degrees, applying the granularity and offsets of the block.
+func Degrees(block *pbfproto.PrimitiveBlock, lat, lon int64) (latDeg, lonDeg float64) {
+	granularity := int64(block.GetGranularity())
+	latDeg = float64(block.GetLatOffset()+granularity*lat) / 1e9
+	lonDeg = float64(block.GetLonOffset()+granularity*lon) / 1e9
+	return latDeg, lonDeg
+}
+
+// String returns the entry sid of the string table of block, or an
+// empty string, if there is no such entry.
+func String(block *pbfproto.PrimitiveBlock, sid int) string {
+	table := block.GetStringtable().GetS()
+	if sid < 0 || sid >= len(table) {
+		return ""
+	}
+	return string(table[sid])
+}
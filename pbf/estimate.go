@@ -0,0 +1,109 @@
+package pbf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// EstimatedLevels are the zstd levels, that EstimateSavings tries.
+var EstimatedLevels = []zstd.EncoderLevel{
+	zstd.SpeedFastest,
+	zstd.SpeedDefault,
+	zstd.SpeedBetterCompression,
+	zstd.SpeedBestCompression,
+}
+
+// Estimate is the projected result of converting a file with a level.
+type Estimate struct {
+	Level zstd.EncoderLevel
+
+	// Ratio is the size of the sampled blobs after conversion divided
+	// by their size before.
+	Ratio float64
+
+	// InputSize is the size of all blobs of the file and ProjectedSize
+	// their expected size after conversion.
+	InputSize     int64
+	ProjectedSize int64
+
+	// BytesPerSecond is the rate, at which uncompressed data of the
+	// samples was compressed.
+	BytesPerSecond float64
+}
+
+// EstimateSavings reads the PBF file r, compresses a random sample of
+// up to n of its blobs with each of EstimatedLevels and projects the
+// size of the converted file from them. Only the sampled blobs are
+// decompressed and kept in memory. The sample is the same for the same
+// file.
+func EstimateSavings(ctx context.Context, r io.Reader, n int) ([]Estimate, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("the number of samples must be positive")
+	}
+	samples, inputSize, err := sampleBlobs(ctx, r, n)
+	if err != nil {
+		return nil, err
+	}
+	var sampledSize int64
+	raw := make([][]byte, len(samples))
+	var rawSize int64
+	for i, blob := range samples {
+		sampledSize += int64(proto.Size(blob))
+		if raw[i], err = Decompress(blob); err != nil {
+			return nil, err
+		}
+		rawSize += int64(len(raw[i]))
+	}
+	estimates := make([]Estimate, 0, len(EstimatedLevels))
+	for _, level := range EstimatedLevels {
+		w := NewWriter(nil, Options{Level: level})
+		var size int64
+		began := time.Now()
+		for _, data := range raw {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			blob, err := w.compress(data)
+			if err != nil {
+				return nil, err
+			}
+			size += int64(proto.Size(blob))
+		}
+		estimate := Estimate{Level: level, Ratio: 1, InputSize: inputSize, ProjectedSize: inputSize}
+		if sampledSize > 0 {
+			estimate.Ratio = float64(size) / float64(sampledSize)
+			estimate.ProjectedSize = int64(estimate.Ratio * float64(inputSize))
+		}
+		if elapsed := time.Since(began); elapsed > 0 {
+			estimate.BytesPerSecond = float64(rawSize) / elapsed.Seconds()
+		}
+		estimates = append(estimates, estimate)
+	}
+	return estimates, nil
+}
+
+// sampleBlobs picks up to n blobs of r uniformly at random with
+// reservoir sampling and returns them with the total size of all blobs.
+func sampleBlobs(ctx context.Context, r io.Reader, n int) ([]*pbfproto.Blob, int64, error) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var samples []*pbfproto.Blob
+	var total int64
+	it := NewIterator(r)
+	for seen := 0; it.Next(ctx); seen++ {
+		header, blob := it.BlobHeader(), it.Blob()
+		total += int64(header.GetDatasize())
+		if len(samples) < n {
+			samples = append(samples, blob)
+		} else if i := rng.IntN(seen + 1); i < n {
+			samples[i] = blob
+		}
+	}
+	return samples, total, it.Err()
+}
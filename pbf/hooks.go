@@ -0,0 +1,55 @@
+package pbf
+
+import (
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// BlobStats describe a blob, that is being converted.
+type BlobStats struct {
+	Index int    // The position of the blob in the input, starting at zero.
+	Type  string // The type of the BlobHeader, e.g. OSMData.
+	Codec string // The compression of the blob in the input; see Codec.
+
+	ReadSize int // The size of the blob in the input.
+	RawSize  int // The size of the uncompressed data.
+
+	// WrittenSize is the size of the blob in the output, or zero, if a
+	// Transform dropped it. It and Duration are only set, once the blob
+	// has been written.
+	WrittenSize int
+	Duration    time.Duration
+}
+
+// Hooks are called by Convert for every blob, e.g. to show progress.
+// Nil hooks are skipped.
+type Hooks struct {
+	// BlobStarted is called once a blob has been read and decompressed.
+	BlobStarted func(stats BlobStats)
+
+	// BlobFinished is called once a blob has been written.
+	BlobFinished func(stats BlobStats)
+}
+
+// Codec returns the name of the compression used by blob: raw, zlib,
+// lzma, bzip2, lz4, zstd or none.
+func Codec(blob *pbfproto.Blob) string {
+	switch blob.Data.(type) {
+	case *pbfproto.Blob_Raw:
+		return "raw"
+	case *pbfproto.Blob_ZlibData:
+		return "zlib"
+	case *pbfproto.Blob_LzmaData:
+		return "lzma"
+	case *pbfproto.Blob_OBSOLETEBzip2Data:
+		return "bzip2"
+	case *pbfproto.Blob_Lz4Data:
+		return "lz4"
+	case *pbfproto.Blob_ZstdData:
+		return "zstd"
+	case *pbfproto.Blob_BrotliData:
+		return "brotli"
+	}
+	return "none"
+}
@@ -0,0 +1,81 @@
+package pbf
+
+import (
+	"context"
+	"io"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// Iterator steps through the blobs of a PBF file without decompressing
+// them:
+//
+//	it := pbf.NewIterator(r)
+//	for it.Next(ctx) {
+//		header, blob := it.BlobHeader(), it.Blob()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	r      io.Reader
+	header *pbfproto.BlobHeader
+	blob   *pbfproto.Blob
+	index  int
+	err    error
+}
+
+// NewIterator returns an Iterator over the blobs of the PBF file r.
+func NewIterator(r io.Reader) *Iterator {
+	return &Iterator{r: r, index: -1}
+}
+
+// Next reads the next blob and reports whether there is one. It returns
+// false at the end of the file, after an error and once ctx is done.
+// A read, that blocks, is not interrupted by ctx; closing the underlying
+// reader ends it.
+func (it *Iterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	if err := ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+	it.header, it.blob = nil, nil
+	header, blob, err := ReadBlob(it.r)
+	if err != nil {
+		it.err = err // io.EOF at the end of the file.
+		return false
+	}
+	it.header, it.blob = header, blob
+	it.index++
+	return true
+}
+
+// BlobHeader returns the header of the current blob.
+func (it *Iterator) BlobHeader() *pbfproto.BlobHeader {
+	return it.header
+}
+
+// Blob returns the current blob, which may be compressed; see
+// Decompress.
+func (it *Iterator) Blob() *pbfproto.Blob {
+	return it.blob
+}
+
+// Index returns the position of the current blob in the file, starting
+// at zero.
+func (it *Iterator) Index() int {
+	return it.index
+}
+
+// Err returns the error, that ended the iteration, or nil at the end of
+// the file. If ctx was done, it is the error of ctx.
+func (it *Iterator) Err() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
@@ -0,0 +1,420 @@
+// Package pbf reads OSM PBF files and writes them with zstd compressed
+// blobs. It works on plain io.Reader and io.Writer values, so the data
+// may come from files, memory or network streams alike.
+package pbf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxBlobHeaderSize is the largest BlobHeader, that is accepted.
+const MaxBlobHeaderSize = 64 * 1024
+
+// MaxBlockSize is the largest uncompressed data of a blob, that the
+// specification allows.
+const MaxBlockSize = 32 * 1024 * 1024
+
+// MaxOversizedBlockSize is the largest uncompressed data of a blob, that
+// is read. Some writers exceed MaxBlockSize and their blobs can still be
+// read, e.g. to split them, but they are never written.
+const MaxOversizedBlockSize = 256 * 1024 * 1024
+
+// ErrUnsupportedFormat is returned for blobs, whose data is in a format,
+// that can't be decompressed.
+var ErrUnsupportedFormat = errors.New("unsupported blob format")
+
+var marshalOptions = proto.MarshalOptions{Deterministic: true}
+
+// Reader reads the blobs of a PBF file.
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader returns a Reader reading the PBF file r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read returns the header and uncompressed data of the next blob. At the
+// end of the file, the error is io.EOF.
+func (r *Reader) Read() (*pbfproto.BlobHeader, []byte, error) {
+	header, blob, err := ReadBlob(r.r)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := Decompress(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, data, nil
+}
+
+// ReadBlobHeader reads the size prefix and BlobHeader of the next frame
+// from r. At the end of the file, the error is io.EOF.
+func ReadBlobHeader(r io.Reader) (*pbfproto.BlobHeader, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(buf)
+	if size >= MaxBlobHeaderSize {
+		return nil, fmt.Errorf("blobHeader size %d >= 64KiB", size)
+	}
+	rawHeader := make([]byte, size)
+	if _, err := io.ReadFull(r, rawHeader); err != nil {
+		return nil, fmt.Errorf("could not read BlobHeader: %v", noEOF(err))
+	}
+	header := &pbfproto.BlobHeader{}
+	if err := header.UnmarshalVT(rawHeader); err != nil {
+		return nil, fmt.Errorf("could not parse BlobHeader: %v", err)
+	}
+	return header, nil
+}
+
+// ReadRawBlob reads the serialized blob, that follows header, from r.
+func ReadRawBlob(r io.Reader, header *pbfproto.BlobHeader) ([]byte, error) {
+	if err := CheckDatasize(header); err != nil {
+		return nil, err
+	}
+	rawBlob := make([]byte, header.GetDatasize())
+	if _, err := io.ReadFull(r, rawBlob); err != nil {
+		return nil, noEOF(err)
+	}
+	return rawBlob, nil
+}
+
+func readBlob(r io.Reader, header *pbfproto.BlobHeader) (*pbfproto.Blob, error) {
+	rawBlob, err := ReadRawBlob(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("could not read Blob: %v", err)
+	}
+	// rawBlob is not used elsewhere, so the blob can refer to it.
+	blob := &pbfproto.Blob{}
+	if err := blob.UnmarshalVTUnsafe(rawBlob); err != nil {
+		return nil, fmt.Errorf("could not parse Blob: %v", err)
+	}
+	return blob, nil
+}
+
+// CheckDatasize returns an error, if the Datasize of header is negative
+// or so large, that the blob must not be allocated before reading it.
+func CheckDatasize(header *pbfproto.BlobHeader) error {
+	if header.GetDatasize() < 0 || header.GetDatasize() > MaxOversizedBlockSize {
+		return fmt.Errorf("datasize %d of blob is not between 0 and 256MiB", header.GetDatasize())
+	}
+	return nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, since a file must not end
+// within a blob.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Decompress returns the uncompressed data of blob. Uncompressed, zlib
+// and zstd compressed blobs are supported, as well as the nonstandard
+// brotli compressed ones. The data of uncompressed
+// blobs is not copied.
+func Decompress(blob *pbfproto.Blob) ([]byte, error) {
+	if blob != nil {
+		if blobData, ok := blob.Data.(*pbfproto.Blob_Raw); ok {
+			return blobData.Raw, nil
+		}
+	}
+	return AppendDecompressed(nil, blob)
+}
+
+// AppendDecompressed appends the uncompressed data of blob to dst and
+// returns the extended slice. Reusing dst for many blobs saves the
+// allocation of a buffer for each of them.
+func AppendDecompressed(dst []byte, blob *pbfproto.Blob) ([]byte, error) {
+	if blob == nil {
+		return dst, fmt.Errorf("blob is nil")
+	}
+	if _, raw := blob.Data.(*pbfproto.Blob_Raw); !raw && (blob.GetRawSize() < 0 || blob.GetRawSize() > MaxOversizedBlockSize) {
+		return dst, fmt.Errorf("raw size %d of blob is not between 0 and 256MiB", blob.GetRawSize())
+	}
+	switch blobData := blob.Data.(type) {
+	case *pbfproto.Blob_Raw:
+		return append(dst, blobData.Raw...), nil
+	case *pbfproto.Blob_ZlibData:
+		reader, err := getZlibReader(blobData.ZlibData)
+		if err != nil {
+			return dst, fmt.Errorf("could not decompress zlib blob: %v", err)
+		}
+		defer zlibReaders.Put(reader)
+		dst, data := grow(dst, int(blob.GetRawSize()))
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return dst, fmt.Errorf("could not decompress zlib blob: %v", err)
+		}
+		return dst, nil
+	case *pbfproto.Blob_ZstdData:
+		n, rawSize := len(dst), int(blob.GetRawSize())
+		dst, err := zstdDecoder.DecodeAll(blobData.ZstdData, slices.Grow(dst, rawSize))
+		if err != nil {
+			return dst[:n], fmt.Errorf("could not decompress zstd blob: %v", err)
+		}
+		// Without a raw size, the frame alone tells the size of the data.
+		if blob.RawSize != nil && len(dst)-n != rawSize {
+			return dst[:n], fmt.Errorf("could not decompress zstd blob: it has %d bytes instead of the raw size %d", len(dst)-n, rawSize)
+		}
+		return dst, nil
+	case *pbfproto.Blob_BrotliData:
+		reader := brotli.NewReader(bytes.NewReader(blobData.BrotliData))
+		dst, data := grow(dst, int(blob.GetRawSize()))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return dst, fmt.Errorf("could not decompress brotli blob: %v", err)
+		}
+		return dst, nil
+	}
+	return dst, fmt.Errorf("found %w: %T", ErrUnsupportedFormat, blob.Data)
+}
+
+// grow extends dst by n bytes and returns it along with the new bytes.
+func grow(dst []byte, n int) ([]byte, []byte) {
+	dst = slices.Grow(dst, n)[:len(dst)+n]
+	return dst, dst[len(dst)-n:]
+}
+
+// zstdDecoder decompresses all zstd blobs. It is safe for concurrent
+// use and keeps its state between blobs.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0),
+	zstd.WithDecoderMaxMemory(MaxOversizedBlockSize))
+
+// zlibReaders holds zlib readers, that have been used before and can be
+// reset to read another blob, which saves allocating their state.
+var zlibReaders sync.Pool
+
+// getZlibReader returns a reader for the zlib stream data. It should be
+// put into zlibReaders after use.
+func getZlibReader(data []byte) (io.ReadCloser, error) {
+	if reader, ok := zlibReaders.Get().(io.ReadCloser); ok {
+		if err := reader.(zlib.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+			return nil, err
+		}
+		return reader, nil
+	}
+	return zlib.NewReader(bytes.NewReader(data))
+}
+
+// Options control how a Writer transforms and compresses blobs. The
+// zero value uses the default level of zstd.
+type Options struct {
+	// Transform, if not nil, is applied to the data of every blob
+	// before compression; see Chain for applying several.
+	Transform Transform
+
+	// Level is the zstd compression level; zero means
+	// zstd.SpeedDefault.
+	Level zstd.EncoderLevel
+
+	// WindowSize is the size of the zstd window in bytes, a power of
+	// two; zero means the default of the encoder.
+	WindowSize int
+
+	// Concurrency is the number of goroutines compressing each blob;
+	// zero means GOMAXPROCS.
+	Concurrency int
+
+	// NoChecksum omits the content checksum of the zstd frames, which
+	// saves 4 bytes per blob.
+	NoChecksum bool
+
+	// Hooks are called by Convert for every blob.
+	Hooks Hooks
+}
+
+// Writer writes blobs with zstd compressed data.
+type Writer struct {
+	w    io.Writer
+	opts Options
+}
+
+// NewWriter returns a Writer writing a PBF file to w.
+func NewWriter(w io.Writer, opts Options) *Writer {
+	if opts.Level == 0 {
+		opts.Level = zstd.SpeedDefault
+	}
+	return &Writer{w: w, opts: opts}
+}
+
+// Write transforms and compresses data and writes it as a blob with the
+// given header. The Datasize of header is set to the size of the
+// written blob.
+func (w *Writer) Write(header *pbfproto.BlobHeader, data []byte) error {
+	_, err := w.write(context.Background(), header, data)
+	return err
+}
+
+// write is like Write, but returns the number of written bytes and
+// checks ctx between the stages.
+func (w *Writer) write(ctx context.Context, header *pbfproto.BlobHeader, data []byte) (int, error) {
+	if w.opts.Transform != nil {
+		var err error
+		if data, err = w.opts.Transform(header, data); err != nil {
+			return 0, err
+		} else if data == nil {
+			return 0, nil // The blob has been dropped.
+		}
+		if err = ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if len(data) > MaxBlockSize {
+		return 0, fmt.Errorf("blob of %d bytes exceeds 32MiB", len(data))
+	}
+	blob, err := w.compress(data)
+	if err != nil {
+		return 0, err
+	}
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	return WriteBlob(w.w, header, blob)
+}
+
+func (w *Writer) compress(data []byte) (*pbfproto.Blob, error) {
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(w.opts.Level),
+		zstd.WithEncoderCRC(!w.opts.NoChecksum),
+	}
+	if w.opts.Concurrency > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(w.opts.Concurrency))
+	}
+	if w.opts.WindowSize > 0 {
+		opts = append(opts, zstd.WithWindowSize(w.opts.WindowSize))
+	}
+	out := new(bytes.Buffer)
+	enc, err := zstd.NewWriter(out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = enc.Write(data); err != nil {
+		enc.Close()
+		return nil, fmt.Errorf("could not compress Blob: %v", err)
+	}
+	if err = enc.Close(); err != nil {
+		return nil, fmt.Errorf("could not compress Blob: %v", err)
+	}
+	rawSize := int32(len(data))
+	return &pbfproto.Blob{RawSize: &rawSize, Data: &pbfproto.Blob_ZstdData{ZstdData: out.Bytes()}}, nil
+}
+
+// WriteBlob writes a frame of the size prefix, header and blob to w and
+// returns its size. The Datasize of header is set to the size of blob.
+// Unknown fields are dropped, since they may describe the original
+// encoding of the data.
+func WriteBlob(w io.Writer, header *pbfproto.BlobHeader, blob *pbfproto.Blob) (int, error) {
+	blob.ProtoReflect().SetUnknown(nil)
+	rawBlob, err := blob.MarshalVT()
+	if err != nil {
+		return 0, fmt.Errorf("could not serialize Blob: %v", err)
+	}
+	datasize := int32(len(rawBlob))
+	header.Datasize = &datasize
+	n, err := WriteBlobHeader(w, header)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.Write(rawBlob); err != nil {
+		return 0, fmt.Errorf("could not write Blob: %v", err)
+	}
+	return n + len(rawBlob), nil
+}
+
+// WriteBlobHeader writes the size prefix and header to w and returns
+// their size. The serialized blob must follow. Unknown fields of header
+// are dropped.
+func WriteBlobHeader(w io.Writer, header *pbfproto.BlobHeader) (int, error) {
+	header.ProtoReflect().SetUnknown(nil)
+	rawHeader, err := header.MarshalVT()
+	if err != nil {
+		return 0, fmt.Errorf("could not serialize BlobHeader: %v", err)
+	}
+	if len(rawHeader) >= MaxBlobHeaderSize {
+		return 0, fmt.Errorf("blobHeader size %d >= 64KiB", len(rawHeader))
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(rawHeader)), uint32(len(rawHeader)))
+	if _, err = w.Write(append(frame, rawHeader...)); err != nil {
+		return 0, fmt.Errorf("could not write BlobHeader: %v", err)
+	}
+	return len(frame) + len(rawHeader), nil
+}
+
+// ReadBlob reads the next frame from r and returns its header and blob.
+// At the end of the file, the error is io.EOF.
+func ReadBlob(r io.Reader) (*pbfproto.BlobHeader, *pbfproto.Blob, error) {
+	header, err := ReadBlobHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, err := readBlob(r, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, blob, nil
+}
+
+// Convert writes in with all blobs recompressed with zstd to out. Once
+// ctx is done, it stops after the current stage of the current blob and
+// returns the error of ctx; out then ends with an incomplete file.
+func Convert(ctx context.Context, in io.Reader, out io.Writer, opts Options) error {
+	w := NewWriter(out, opts)
+	hooks := opts.Hooks
+	var buf []byte // Reused for the uncompressed data of every blob.
+	for index := 0; ; index++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		began := time.Now()
+		header, blob, err := ReadBlob(in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if buf, err = AppendDecompressed(buf[:0], blob); err != nil {
+			return err
+		}
+		data := buf
+		stats := BlobStats{
+			Index:    index,
+			Type:     header.GetType(),
+			Codec:    Codec(blob),
+			ReadSize: int(header.GetDatasize()),
+			RawSize:  len(data),
+		}
+		if hooks.BlobStarted != nil {
+			hooks.BlobStarted(stats)
+		}
+		if n, err := w.write(ctx, header, data); err != nil {
+			return err
+		} else if n > 0 {
+			stats.WrittenSize = int(header.GetDatasize())
+		}
+		stats.Duration = time.Since(began)
+		if hooks.BlobFinished != nil {
+			hooks.BlobFinished(stats)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package pbf
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+var (
+	transformsMu sync.Mutex
+	transforms   = map[string]Transform{"strip-metadata": StripMetadata}
+)
+
+// RegisterTransform makes t available under name, so that the zstd-pbf
+// command can apply it with -transform. Forks and plugins call it from
+// an init function. It panics, if name is already registered.
+func RegisterTransform(name string, t Transform) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	if t == nil {
+		panic("pbf: RegisterTransform with nil transform " + name)
+	}
+	if _, ok := transforms[name]; ok {
+		panic("pbf: RegisterTransform called twice for " + name)
+	}
+	transforms[name] = t
+}
+
+// LookupTransform returns the Transform registered under name.
+func LookupTransform(name string) (Transform, error) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	if t, ok := transforms[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown transform %q", name)
+}
+
+// Transforms returns the sorted names of the registered transforms.
+func Transforms() []string {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	names := make([]string, 0, len(transforms))
+	for name := range transforms {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
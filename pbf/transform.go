@@ -0,0 +1,71 @@
+package pbf
+
+import (
+	"fmt"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// Transform modifies the uncompressed data of a blob with the given
+// header before it is written. If it returns nil data without an
+// error, the blob is dropped. data may be reused for the next blob, so
+// it must not be retained.
+type Transform func(header *pbfproto.BlobHeader, data []byte) ([]byte, error)
+
+// Chain returns a Transform applying transforms in order. Once one of
+// them drops a blob, the remaining ones are not called.
+func Chain(transforms ...Transform) Transform {
+	return func(header *pbfproto.BlobHeader, data []byte) ([]byte, error) {
+		for _, t := range transforms {
+			var err error
+			if data, err = t(header, data); err != nil || data == nil {
+				return data, err
+			}
+		}
+		return data, nil
+	}
+}
+
+// BlockTransform returns a Transform, that calls f with the
+// PrimitiveBlock of every OSMData blob. Other blobs are left alone.
+func BlockTransform(f func(block *pbfproto.PrimitiveBlock) error) Transform {
+	return func(header *pbfproto.BlobHeader, data []byte) ([]byte, error) {
+		if header.GetType() != "OSMData" {
+			return data, nil
+		}
+		block, err := parsePrimitiveBlock(data)
+		if err != nil {
+			return nil, err
+		}
+		if err = f(block); err != nil {
+			return nil, err
+		}
+		if data, err = marshalOptions.Marshal(block); err != nil {
+			return nil, err
+		}
+		if len(data) > MaxBlockSize {
+			return nil, fmt.Errorf("data block of %d bytes exceeds 32MiB", len(data))
+		}
+		return data, nil
+	}
+}
+
+// StripMetadata is a Transform, that removes the versions, timestamps,
+// changesets and users of all elements.
+var StripMetadata = BlockTransform(func(block *pbfproto.PrimitiveBlock) error {
+	for _, group := range block.Primitivegroup {
+		for _, node := range group.Nodes {
+			node.Info = nil
+		}
+		if group.Dense != nil {
+			group.Dense.Denseinfo = nil
+		}
+		for _, way := range group.Ways {
+			way.Info = nil
+		}
+		for _, relation := range group.Relations {
+			relation.Info = nil
+		}
+	}
+	return nil
+})
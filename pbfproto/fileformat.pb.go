@@ -57,6 +57,7 @@ type Blob struct {
 	//	*Blob_OBSOLETEBzip2Data
 	//	*Blob_Lz4Data
 	//	*Blob_ZstdData
+	//	*Blob_BrotliData
 	Data isBlob_Data `protobuf_oneof:"data"`
 }
 
@@ -149,6 +150,13 @@ func (x *Blob) GetZstdData() []byte {
 	return nil
 }
 
+func (x *Blob) GetBrotliData() []byte {
+	if x, ok := x.GetData().(*Blob_BrotliData); ok {
+		return x.BrotliData
+	}
+	return nil
+}
+
 type isBlob_Data interface {
 	isBlob_Data()
 }
@@ -184,6 +192,13 @@ type Blob_ZstdData struct {
 	ZstdData []byte `protobuf:"bytes,7,opt,name=zstd_data,json=zstdData,oneof"`
 }
 
+type Blob_BrotliData struct {
+	// For Brotli compressed data. Nonstandard and only written by
+	// zstd-pbf with -experimental-brotli; other readers can't read it.
+	// The tag number is far from the standard ones to avoid clashes.
+	BrotliData []byte `protobuf:"bytes,100,opt,name=brotli_data,json=brotliData,oneof"`
+}
+
 func (*Blob_Raw) isBlob_Data() {}
 
 func (*Blob_ZlibData) isBlob_Data() {}
@@ -196,6 +211,8 @@ func (*Blob_Lz4Data) isBlob_Data() {}
 
 func (*Blob_ZstdData) isBlob_Data() {}
 
+func (*Blob_BrotliData) isBlob_Data() {}
+
 type BlobHeader struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -263,7 +280,7 @@ var File_fileformat_proto protoreflect.FileDescriptor
 
 var file_fileformat_proto_rawDesc = []byte{
 	0x0a, 0x10, 0x66, 0x69, 0x6c, 0x65, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x2e, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x12, 0x06, 0x4f, 0x53, 0x4d, 0x50, 0x42, 0x46, 0x22, 0xed, 0x01, 0x0a, 0x04, 0x42,
+	0x74, 0x6f, 0x12, 0x06, 0x4f, 0x53, 0x4d, 0x50, 0x42, 0x46, 0x22, 0x90, 0x02, 0x0a, 0x04, 0x42,
 	0x6c, 0x6f, 0x62, 0x12, 0x19, 0x0a, 0x08, 0x72, 0x61, 0x77, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18,
 	0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x72, 0x61, 0x77, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x12,
 	0x0a, 0x03, 0x72, 0x61, 0x77, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x03, 0x72,
@@ -278,14 +295,16 @@ var file_fileformat_proto_rawDesc = []byte{
 	0x74, 0x61, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x07, 0x6c, 0x7a, 0x34, 0x44,
 	0x61, 0x74, 0x61, 0x12, 0x1d, 0x0a, 0x09, 0x7a, 0x73, 0x74, 0x64, 0x5f, 0x64, 0x61, 0x74, 0x61,
 	0x18, 0x07, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x08, 0x7a, 0x73, 0x74, 0x64, 0x44, 0x61,
-	0x74, 0x61, 0x42, 0x06, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x5a, 0x0a, 0x0a, 0x42, 0x6c,
-	0x6f, 0x62, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65,
-	0x18, 0x01, 0x20, 0x02, 0x28, 0x09, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x1c, 0x0a, 0x09,
-	0x69, 0x6e, 0x64, 0x65, 0x78, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52,
-	0x09, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x64, 0x61, 0x74, 0x61, 0x12, 0x1a, 0x0a, 0x08, 0x64, 0x61,
-	0x74, 0x61, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x02, 0x28, 0x05, 0x52, 0x08, 0x64, 0x61,
-	0x74, 0x61, 0x73, 0x69, 0x7a, 0x65, 0x42, 0x0c, 0x5a, 0x0a, 0x2e, 0x2f, 0x70, 0x62, 0x66, 0x70,
-	0x72, 0x6f, 0x74, 0x6f,
+	0x74, 0x61, 0x12, 0x21, 0x0a, 0x0b, 0x62, 0x72, 0x6f, 0x74, 0x6c, 0x69, 0x5f, 0x64, 0x61, 0x74,
+	0x61, 0x18, 0x64, 0x20, 0x01, 0x28, 0x0c, 0x48, 0x00, 0x52, 0x0a, 0x62, 0x72, 0x6f, 0x74, 0x6c,
+	0x69, 0x44, 0x61, 0x74, 0x61, 0x42, 0x06, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x5a, 0x0a,
+	0x0a, 0x42, 0x6c, 0x6f, 0x62, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x74,
+	0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x02, 0x28, 0x09, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12,
+	0x1c, 0x0a, 0x09, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x09, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x64, 0x61, 0x74, 0x61, 0x12, 0x1a, 0x0a,
+	0x08, 0x64, 0x61, 0x74, 0x61, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x02, 0x28, 0x05, 0x52,
+	0x08, 0x64, 0x61, 0x74, 0x61, 0x73, 0x69, 0x7a, 0x65, 0x42, 0x0c, 0x5a, 0x0a, 0x2e, 0x2f, 0x70,
+	0x62, 0x66, 0x70, 0x72, 0x6f, 0x74, 0x6f,
 }
 
 var (
@@ -351,6 +370,7 @@ func file_fileformat_proto_init() {
 		(*Blob_OBSOLETEBzip2Data)(nil),
 		(*Blob_Lz4Data)(nil),
 		(*Blob_ZstdData)(nil),
+		(*Blob_BrotliData)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -0,0 +1,271 @@
+// Hand-written fast paths for the messages of fileformat.proto, which
+// are serialized for every blob. The methods follow the API generated
+// by vtprotobuf, so they can be replaced by its output, and produce the
+// same bytes as proto.MarshalOptions{Deterministic: true}.
+
+package pbfproto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var errRequiredType = errors.New("proto: required field OSMPBF.BlobHeader.type not set")
+var errRequiredDatasize = errors.New("proto: required field OSMPBF.BlobHeader.datasize not set")
+
+var blobPool = sync.Pool{New: func() any { return new(Blob) }}
+var blobHeaderPool = sync.Pool{New: func() any { return new(BlobHeader) }}
+
+// BlobFromVTPool returns an empty Blob, which may have been used before.
+func BlobFromVTPool() *Blob {
+	return blobPool.Get().(*Blob)
+}
+
+// ReturnToVTPool resets m and makes it available to BlobFromVTPool. The
+// byte slices of m are not reused, so they stay valid.
+func (m *Blob) ReturnToVTPool() {
+	if m != nil {
+		m.ResetVT()
+		blobPool.Put(m)
+	}
+}
+
+// BlobHeaderFromVTPool returns an empty BlobHeader, which may have been
+// used before.
+func BlobHeaderFromVTPool() *BlobHeader {
+	return blobHeaderPool.Get().(*BlobHeader)
+}
+
+// ReturnToVTPool resets m and makes it available to
+// BlobHeaderFromVTPool.
+func (m *BlobHeader) ReturnToVTPool() {
+	if m != nil {
+		m.ResetVT()
+		blobHeaderPool.Put(m)
+	}
+}
+
+// ResetVT clears all fields of m.
+func (m *Blob) ResetVT() {
+	m.RawSize = nil
+	m.Data = nil
+	m.unknownFields = nil
+}
+
+// ResetVT clears all fields of m.
+func (m *BlobHeader) ResetVT() {
+	m.Type = nil
+	m.Indexdata = nil
+	m.Datasize = nil
+	m.unknownFields = nil
+}
+
+// blobData returns the field number and content of the data of m.
+func (m *Blob) blobData() (protowire.Number, []byte, bool) {
+	switch data := m.Data.(type) {
+	case *Blob_Raw:
+		return 1, data.Raw, true
+	case *Blob_ZlibData:
+		return 3, data.ZlibData, true
+	case *Blob_LzmaData:
+		return 4, data.LzmaData, true
+	case *Blob_OBSOLETEBzip2Data:
+		return 5, data.OBSOLETEBzip2Data, true
+	case *Blob_Lz4Data:
+		return 6, data.Lz4Data, true
+	case *Blob_ZstdData:
+		return 7, data.ZstdData, true
+	case *Blob_BrotliData:
+		return 100, data.BrotliData, true
+	}
+	return 0, nil, false
+}
+
+// SizeVT returns the size of m, when serialized.
+func (m *Blob) SizeVT() int {
+	n := len(m.unknownFields)
+	if m.RawSize != nil {
+		n += 1 + protowire.SizeVarint(uint64(*m.RawSize))
+	}
+	if num, data, ok := m.blobData(); ok {
+		n += protowire.SizeTag(num) + protowire.SizeBytes(len(data))
+	}
+	return n
+}
+
+// MarshalVT serializes m. Like proto.Marshal, it writes raw_size before
+// the data, even if the data is raw, which has a lower field number.
+func (m *Blob) MarshalVT() ([]byte, error) {
+	b := make([]byte, 0, m.SizeVT())
+	if m.RawSize != nil {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*m.RawSize))
+	}
+	if num, data, ok := m.blobData(); ok {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	}
+	return append(b, m.unknownFields...), nil
+}
+
+// UnmarshalVT parses b into m, which must be empty. The data is copied.
+func (m *Blob) UnmarshalVT(b []byte) error {
+	return m.unmarshal(b, true)
+}
+
+// UnmarshalVTUnsafe is like UnmarshalVT, but m refers to b instead of
+// copying the data, so b must not be modified afterwards.
+func (m *Blob) UnmarshalVTUnsafe(b []byte) error {
+	return m.unmarshal(b, false)
+}
+
+func (m *Blob) unmarshal(b []byte, copyData bool) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("proto: cannot parse Blob: %v", protowire.ParseError(n))
+		}
+		field := b
+		b = b[n:]
+		switch {
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("proto: cannot parse Blob.raw_size: %v", protowire.ParseError(n))
+			}
+			rawSize := int32(v)
+			m.RawSize = &rawSize
+			b = b[n:]
+		case (num >= 1 && num <= 7 && num != 2 || num == 100) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("proto: cannot parse Blob: %v", protowire.ParseError(n))
+			}
+			if copyData {
+				v = append(make([]byte, 0, len(v)), v...)
+			} else {
+				v = v[:len(v):len(v)]
+			}
+			m.Data = blobDataField(num, v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("proto: cannot parse Blob: %v", protowire.ParseError(n))
+			}
+			m.unknownFields = append(m.unknownFields, field[:len(field)-len(b)+n]...)
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// blobDataField wraps data in the oneof type of field num.
+func blobDataField(num protowire.Number, data []byte) isBlob_Data {
+	switch num {
+	case 1:
+		return &Blob_Raw{Raw: data}
+	case 3:
+		return &Blob_ZlibData{ZlibData: data}
+	case 4:
+		return &Blob_LzmaData{LzmaData: data}
+	case 5:
+		return &Blob_OBSOLETEBzip2Data{OBSOLETEBzip2Data: data}
+	case 6:
+		return &Blob_Lz4Data{Lz4Data: data}
+	case 100:
+		return &Blob_BrotliData{BrotliData: data}
+	}
+	return &Blob_ZstdData{ZstdData: data}
+}
+
+// SizeVT returns the size of m, when serialized.
+func (m *BlobHeader) SizeVT() int {
+	n := len(m.unknownFields)
+	if m.Type != nil {
+		n += 1 + protowire.SizeBytes(len(*m.Type))
+	}
+	if m.Indexdata != nil {
+		n += 1 + protowire.SizeBytes(len(m.Indexdata))
+	}
+	if m.Datasize != nil {
+		n += 1 + protowire.SizeVarint(uint64(*m.Datasize))
+	}
+	return n
+}
+
+// MarshalVT serializes m with its fields ordered by number. Like
+// proto.Marshal, it fails, if a required field is missing.
+func (m *BlobHeader) MarshalVT() ([]byte, error) {
+	if m.Type == nil {
+		return nil, errRequiredType
+	}
+	if m.Datasize == nil {
+		return nil, errRequiredDatasize
+	}
+	b := make([]byte, 0, m.SizeVT())
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, *m.Type)
+	if m.Indexdata != nil {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Indexdata)
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(*m.Datasize))
+	return append(b, m.unknownFields...), nil
+}
+
+// UnmarshalVT parses b into m, which must be empty. Like
+// proto.Unmarshal, it fails, if a required field is missing.
+func (m *BlobHeader) UnmarshalVT(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("proto: cannot parse BlobHeader: %v", protowire.ParseError(n))
+		}
+		field := b
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("proto: cannot parse BlobHeader.type: %v", protowire.ParseError(n))
+			}
+			blobType := string(v)
+			m.Type = &blobType
+			b = b[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("proto: cannot parse BlobHeader.indexdata: %v", protowire.ParseError(n))
+			}
+			m.Indexdata = append(make([]byte, 0, len(v)), v...)
+			b = b[n:]
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("proto: cannot parse BlobHeader.datasize: %v", protowire.ParseError(n))
+			}
+			datasize := int32(v)
+			m.Datasize = &datasize
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("proto: cannot parse BlobHeader: %v", protowire.ParseError(n))
+			}
+			m.unknownFields = append(m.unknownFields, field[:len(field)-len(b)+n]...)
+			b = b[n:]
+		}
+	}
+	if m.Type == nil {
+		return errRequiredType
+	}
+	if m.Datasize == nil {
+		return errRequiredDatasize
+	}
+	return nil
+}
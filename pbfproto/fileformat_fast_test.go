@@ -0,0 +1,309 @@
+package pbfproto
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+var deterministic = proto.MarshalOptions{Deterministic: true}
+
+func int32Ptr(v int32) *int32 {
+	return &v
+}
+
+func stringPtr(v string) *string {
+	return &v
+}
+
+func testBlobs() map[string]*Blob {
+	data := []byte("\x00\x01data\xff")
+	return map[string]*Blob{
+		"empty":            {},
+		"raw_size only":    {RawSize: int32Ptr(42)},
+		"raw":              {Data: &Blob_Raw{Raw: data}},
+		"empty raw":        {Data: &Blob_Raw{Raw: []byte{}}},
+		"negative raw":     {RawSize: int32Ptr(-1), Data: &Blob_Raw{Raw: data}},
+		"zlib":             {RawSize: int32Ptr(1000), Data: &Blob_ZlibData{ZlibData: data}},
+		"lzma":             {RawSize: int32Ptr(1000), Data: &Blob_LzmaData{LzmaData: data}},
+		"bzip2":            {RawSize: int32Ptr(1000), Data: &Blob_OBSOLETEBzip2Data{OBSOLETEBzip2Data: data}},
+		"lz4":              {RawSize: int32Ptr(1000), Data: &Blob_Lz4Data{Lz4Data: data}},
+		"zstd":             {RawSize: int32Ptr(1 << 25), Data: &Blob_ZstdData{ZstdData: data}},
+		"zstd no raw_size": {Data: &Blob_ZstdData{ZstdData: data}},
+		"brotli":           {RawSize: int32Ptr(1000), Data: &Blob_BrotliData{BrotliData: data}},
+		"negative zstd":    {RawSize: int32Ptr(-1 << 31), Data: &Blob_ZstdData{ZstdData: data}},
+	}
+}
+
+func testBlobHeaders() map[string]*BlobHeader {
+	return map[string]*BlobHeader{
+		"without indexdata": {Type: stringPtr("OSMData"), Datasize: int32Ptr(123)},
+		"with indexdata":    {Type: stringPtr("OSMHeader"), Indexdata: []byte("\x00index\xff"), Datasize: int32Ptr(1 << 20)},
+		"empty indexdata":   {Type: stringPtr("OSMData"), Indexdata: []byte{}, Datasize: int32Ptr(0)},
+		"negative datasize": {Type: stringPtr("OSMData"), Datasize: int32Ptr(-5)},
+		"empty type":        {Type: stringPtr(""), Datasize: int32Ptr(7)},
+		"nonstandard type":  {Type: stringPtr("ZstdPbfJoined"), Indexdata: []byte{1, 2, 3}, Datasize: int32Ptr(99)},
+		"large indexdata":   {Type: stringPtr("OSMData"), Indexdata: bytes.Repeat([]byte{7}, 300), Datasize: int32Ptr(300)},
+		"maximal datasize":  {Type: stringPtr("OSMData"), Datasize: int32Ptr(1<<31 - 1)},
+		"minimal datasize":  {Type: stringPtr("OSMData"), Datasize: int32Ptr(-1 << 31)},
+		"multibyte type":    {Type: stringPtr("ÖSMDätä"), Datasize: int32Ptr(1)},
+	}
+}
+
+// unknownFields returns serialized fields, that neither Blob nor
+// BlobHeader know, of every wire type.
+func unknownFields() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 50, protowire.VarintType)
+	b = protowire.AppendVarint(b, 12345)
+	b = protowire.AppendTag(b, 51, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte("unknown"))
+	b = protowire.AppendTag(b, 52, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 7)
+	b = protowire.AppendTag(b, 53, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, 8)
+	b = protowire.AppendTag(b, 54, protowire.StartGroupType)
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, 54, protowire.EndGroupType)
+	return b
+}
+
+func TestBlobMarshalVT(t *testing.T) {
+	for name, blob := range testBlobs() {
+		t.Run(name, func(t *testing.T) {
+			want, err := deterministic.Marshal(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := blob.MarshalVT()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("MarshalVT() = %x, proto.Marshal = %x", got, want)
+			}
+			if blob.SizeVT() != len(want) {
+				t.Errorf("SizeVT() = %d, want %d", blob.SizeVT(), len(want))
+			}
+		})
+	}
+}
+
+func TestBlobUnmarshalVT(t *testing.T) {
+	for name, blob := range testBlobs() {
+		for _, unsafe := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/unsafe=%v", name, unsafe), func(t *testing.T) {
+				b, err := deterministic.Marshal(blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := &Blob{}
+				if unsafe {
+					err = got.UnmarshalVTUnsafe(b)
+				} else {
+					err = got.UnmarshalVT(b)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := &Blob{}
+				if err = proto.Unmarshal(b, want); err != nil {
+					t.Fatal(err)
+				}
+				if !proto.Equal(got, want) {
+					t.Errorf("UnmarshalVT() = %v, proto.Unmarshal = %v", got, want)
+				}
+				if !proto.Equal(got, blob) {
+					t.Errorf("UnmarshalVT() = %v, want %v", got, blob)
+				}
+			})
+		}
+	}
+}
+
+func TestBlobUnmarshalVTCopies(t *testing.T) {
+	b, err := deterministic.Marshal(&Blob{Data: &Blob_ZstdData{ZstdData: []byte("data")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	safe, unsafe := &Blob{}, &Blob{}
+	if err = safe.UnmarshalVT(b); err != nil {
+		t.Fatal(err)
+	}
+	if err = unsafe.UnmarshalVTUnsafe(b); err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] = 'X'
+	if got := string(safe.GetZstdData()); got != "data" {
+		t.Errorf("UnmarshalVT() refers to its input: %q", got)
+	}
+	if got := string(unsafe.GetZstdData()); got != "datX" {
+		t.Errorf("UnmarshalVTUnsafe() copies its input: %q", got)
+	}
+}
+
+func TestBlobUnknownFields(t *testing.T) {
+	for name, blob := range testBlobs() {
+		t.Run(name, func(t *testing.T) {
+			b, err := deterministic.Marshal(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Unknown fields may also precede the known ones.
+			b = append(append(unknownFields(), b...), unknownFields()...)
+			got := &Blob{}
+			if err = got.UnmarshalVT(b); err != nil {
+				t.Fatal(err)
+			}
+			want := &Blob{}
+			if err = proto.Unmarshal(b, want); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("UnmarshalVT() = %v, proto.Unmarshal = %v", got, want)
+			}
+			gotBytes, err := got.MarshalVT()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantBytes, err := deterministic.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotBytes, wantBytes) {
+				t.Errorf("MarshalVT() = %x, proto.Marshal = %x", gotBytes, wantBytes)
+			}
+			if got.SizeVT() != len(wantBytes) {
+				t.Errorf("SizeVT() = %d, want %d", got.SizeVT(), len(wantBytes))
+			}
+		})
+	}
+}
+
+func TestBlobHeaderMarshalVT(t *testing.T) {
+	for name, header := range testBlobHeaders() {
+		t.Run(name, func(t *testing.T) {
+			want, err := deterministic.Marshal(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := header.MarshalVT()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("MarshalVT() = %x, proto.Marshal = %x", got, want)
+			}
+			if header.SizeVT() != len(want) {
+				t.Errorf("SizeVT() = %d, want %d", header.SizeVT(), len(want))
+			}
+		})
+	}
+}
+
+func TestBlobHeaderUnmarshalVT(t *testing.T) {
+	for name, header := range testBlobHeaders() {
+		t.Run(name, func(t *testing.T) {
+			b, err := deterministic.Marshal(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &BlobHeader{}
+			if err = got.UnmarshalVT(b); err != nil {
+				t.Fatal(err)
+			}
+			want := &BlobHeader{}
+			if err = proto.Unmarshal(b, want); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("UnmarshalVT() = %v, proto.Unmarshal = %v", got, want)
+			}
+			if !proto.Equal(got, header) {
+				t.Errorf("UnmarshalVT() = %v, want %v", got, header)
+			}
+		})
+	}
+}
+
+func TestBlobHeaderUnknownFields(t *testing.T) {
+	for name, header := range testBlobHeaders() {
+		t.Run(name, func(t *testing.T) {
+			b, err := deterministic.Marshal(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b = append(append(unknownFields(), b...), unknownFields()...)
+			got := &BlobHeader{}
+			if err = got.UnmarshalVT(b); err != nil {
+				t.Fatal(err)
+			}
+			want := &BlobHeader{}
+			if err = proto.Unmarshal(b, want); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("UnmarshalVT() = %v, proto.Unmarshal = %v", got, want)
+			}
+			gotBytes, err := got.MarshalVT()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantBytes, err := deterministic.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotBytes, wantBytes) {
+				t.Errorf("MarshalVT() = %x, proto.Marshal = %x", gotBytes, wantBytes)
+			}
+		})
+	}
+}
+
+func TestBlobHeaderRequiredFields(t *testing.T) {
+	for name, header := range map[string]*BlobHeader{
+		"without type":     {Indexdata: []byte("index"), Datasize: int32Ptr(1)},
+		"without datasize": {Type: stringPtr("OSMData")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := header.MarshalVT(); err == nil {
+				t.Error("MarshalVT() succeeded without a required field")
+			}
+			if _, err := deterministic.Marshal(header); err == nil {
+				t.Fatal("proto.Marshal succeeded without a required field")
+			}
+			b, err := proto.MarshalOptions{Deterministic: true, AllowPartial: true}.Marshal(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = (&BlobHeader{}).UnmarshalVT(b); err == nil {
+				t.Error("UnmarshalVT() succeeded without a required field")
+			}
+		})
+	}
+}
+
+func TestUnmarshalVTTruncated(t *testing.T) {
+	blob, err := deterministic.Marshal(&Blob{RawSize: int32Ptr(1000), Data: &Blob_ZstdData{ZstdData: []byte("data")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := deterministic.Marshal(&BlobHeader{Type: stringPtr("OSMData"), Indexdata: []byte("index"), Datasize: int32Ptr(1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < len(blob); n++ {
+		if err = (&Blob{}).UnmarshalVT(blob[:n]); (err == nil) != (proto.Unmarshal(blob[:n], &Blob{}) == nil) {
+			t.Errorf("Blob truncated to %d bytes: UnmarshalVT() = %v, unlike proto.Unmarshal", n, err)
+		}
+	}
+	for n := 1; n < len(header); n++ {
+		if err = (&BlobHeader{}).UnmarshalVT(header[:n]); err == nil {
+			t.Errorf("BlobHeader truncated to %d bytes: UnmarshalVT() succeeded", n)
+		}
+	}
+}
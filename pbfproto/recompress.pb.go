@@ -0,0 +1,231 @@
+// The service of the serve-grpc command.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        v4.25.2
+// source: recompress.proto
+
+package pbfproto
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type RecompressRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The type of the blob, as in its BlobHeader, e.g. OSMData.
+	Type *string `protobuf:"bytes,1,req,name=type" json:"type,omitempty"`
+	Blob *Blob   `protobuf:"bytes,2,req,name=blob" json:"blob,omitempty"`
+}
+
+func (x *RecompressRequest) Reset() {
+	*x = RecompressRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_recompress_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RecompressRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RecompressRequest) ProtoMessage() {}
+
+func (x *RecompressRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_recompress_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RecompressRequest.ProtoReflect.Descriptor instead.
+func (*RecompressRequest) Descriptor() ([]byte, []int) {
+	return file_recompress_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RecompressRequest) GetType() string {
+	if x != nil && x.Type != nil {
+		return *x.Type
+	}
+	return ""
+}
+
+func (x *RecompressRequest) GetBlob() *Blob {
+	if x != nil {
+		return x.Blob
+	}
+	return nil
+}
+
+type RecompressResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Blob *Blob `protobuf:"bytes,1,req,name=blob" json:"blob,omitempty"`
+}
+
+func (x *RecompressResponse) Reset() {
+	*x = RecompressResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_recompress_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RecompressResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RecompressResponse) ProtoMessage() {}
+
+func (x *RecompressResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_recompress_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RecompressResponse.ProtoReflect.Descriptor instead.
+func (*RecompressResponse) Descriptor() ([]byte, []int) {
+	return file_recompress_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RecompressResponse) GetBlob() *Blob {
+	if x != nil {
+		return x.Blob
+	}
+	return nil
+}
+
+var File_recompress_proto protoreflect.FileDescriptor
+
+var file_recompress_proto_rawDesc = []byte{
+	0x0a, 0x10, 0x72, 0x65, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x12, 0x07, 0x7a, 0x73, 0x74, 0x64, 0x70, 0x62, 0x66, 0x1a, 0x10, 0x66, 0x69, 0x6c,
+	0x65, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x49, 0x0a,
+	0x11, 0x52, 0x65, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x02, 0x28, 0x09,
+	0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x20, 0x0a, 0x04, 0x62, 0x6c, 0x6f, 0x62, 0x18, 0x02,
+	0x20, 0x02, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x4f, 0x53, 0x4d, 0x50, 0x42, 0x46, 0x2e, 0x42, 0x6c,
+	0x6f, 0x62, 0x52, 0x04, 0x62, 0x6c, 0x6f, 0x62, 0x22, 0x36, 0x0a, 0x12, 0x52, 0x65, 0x63, 0x6f,
+	0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x20,
+	0x0a, 0x04, 0x62, 0x6c, 0x6f, 0x62, 0x18, 0x01, 0x20, 0x02, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x4f,
+	0x53, 0x4d, 0x50, 0x42, 0x46, 0x2e, 0x42, 0x6c, 0x6f, 0x62, 0x52, 0x04, 0x62, 0x6c, 0x6f, 0x62,
+	0x32, 0x59, 0x0a, 0x0c, 0x52, 0x65, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x6f, 0x72,
+	0x12, 0x49, 0x0a, 0x0a, 0x52, 0x65, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x12, 0x1a,
+	0x2e, 0x7a, 0x73, 0x74, 0x64, 0x70, 0x62, 0x66, 0x2e, 0x52, 0x65, 0x63, 0x6f, 0x6d, 0x70, 0x72,
+	0x65, 0x73, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x7a, 0x73, 0x74,
+	0x64, 0x70, 0x62, 0x66, 0x2e, 0x52, 0x65, 0x63, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x28, 0x01, 0x30, 0x01, 0x42, 0x0c, 0x5a, 0x0a, 0x2e,
+	0x2f, 0x70, 0x62, 0x66, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+}
+
+var (
+	file_recompress_proto_rawDescOnce sync.Once
+	file_recompress_proto_rawDescData = file_recompress_proto_rawDesc
+)
+
+func file_recompress_proto_rawDescGZIP() []byte {
+	file_recompress_proto_rawDescOnce.Do(func() {
+		file_recompress_proto_rawDescData = protoimpl.X.CompressGZIP(file_recompress_proto_rawDescData)
+	})
+	return file_recompress_proto_rawDescData
+}
+
+var file_recompress_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_recompress_proto_goTypes = []any{
+	(*RecompressRequest)(nil),  // 0: zstdpbf.RecompressRequest
+	(*RecompressResponse)(nil), // 1: zstdpbf.RecompressResponse
+	(*Blob)(nil),               // 2: OSMPBF.Blob
+}
+var file_recompress_proto_depIdxs = []int32{
+	2, // 0: zstdpbf.RecompressRequest.blob:type_name -> OSMPBF.Blob
+	2, // 1: zstdpbf.RecompressResponse.blob:type_name -> OSMPBF.Blob
+	0, // 2: zstdpbf.Recompressor.Recompress:input_type -> zstdpbf.RecompressRequest
+	1, // 3: zstdpbf.Recompressor.Recompress:output_type -> zstdpbf.RecompressResponse
+	3, // [3:4] is the sub-list for method output_type
+	2, // [2:3] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_recompress_proto_init() }
+func file_recompress_proto_init() {
+	if File_recompress_proto != nil {
+		return
+	}
+	file_fileformat_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_recompress_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*RecompressRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_recompress_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*RecompressResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_recompress_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_recompress_proto_goTypes,
+		DependencyIndexes: file_recompress_proto_depIdxs,
+		MessageInfos:      file_recompress_proto_msgTypes,
+	}.Build()
+	File_recompress_proto = out.File
+	file_recompress_proto_rawDesc = nil
+	file_recompress_proto_goTypes = nil
+	file_recompress_proto_depIdxs = nil
+}
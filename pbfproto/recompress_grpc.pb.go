@@ -0,0 +1,127 @@
+// The service of the serve-grpc command.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v4.25.2
+// source: recompress.proto
+
+package pbfproto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Recompressor_Recompress_FullMethodName = "/zstdpbf.Recompressor/Recompress"
+)
+
+// RecompressorClient is the client API for Recompressor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Recompressor recompresses the blobs of PBF files with the options the
+// server was started with.
+type RecompressorClient interface {
+	// Recompress returns one response for every request, in the same
+	// order. The stream is aborted at the first error.
+	Recompress(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[RecompressRequest, RecompressResponse], error)
+}
+
+type recompressorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRecompressorClient(cc grpc.ClientConnInterface) RecompressorClient {
+	return &recompressorClient{cc}
+}
+
+func (c *recompressorClient) Recompress(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[RecompressRequest, RecompressResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Recompressor_ServiceDesc.Streams[0], Recompressor_Recompress_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[RecompressRequest, RecompressResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Recompressor_RecompressClient = grpc.BidiStreamingClient[RecompressRequest, RecompressResponse]
+
+// RecompressorServer is the server API for Recompressor service.
+// All implementations must embed UnimplementedRecompressorServer
+// for forward compatibility.
+//
+// Recompressor recompresses the blobs of PBF files with the options the
+// server was started with.
+type RecompressorServer interface {
+	// Recompress returns one response for every request, in the same
+	// order. The stream is aborted at the first error.
+	Recompress(grpc.BidiStreamingServer[RecompressRequest, RecompressResponse]) error
+	mustEmbedUnimplementedRecompressorServer()
+}
+
+// UnimplementedRecompressorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRecompressorServer struct{}
+
+func (UnimplementedRecompressorServer) Recompress(grpc.BidiStreamingServer[RecompressRequest, RecompressResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Recompress not implemented")
+}
+func (UnimplementedRecompressorServer) mustEmbedUnimplementedRecompressorServer() {}
+func (UnimplementedRecompressorServer) testEmbeddedByValue()                      {}
+
+// UnsafeRecompressorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RecompressorServer will
+// result in compilation errors.
+type UnsafeRecompressorServer interface {
+	mustEmbedUnimplementedRecompressorServer()
+}
+
+func RegisterRecompressorServer(s grpc.ServiceRegistrar, srv RecompressorServer) {
+	// If the following call pancis, it indicates UnimplementedRecompressorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Recompressor_ServiceDesc, srv)
+}
+
+func _Recompressor_Recompress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RecompressorServer).Recompress(&grpc.GenericServerStream[RecompressRequest, RecompressResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Recompressor_RecompressServer = grpc.BidiStreamingServer[RecompressRequest, RecompressResponse]
+
+// Recompressor_ServiceDesc is the grpc.ServiceDesc for Recompressor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Recompressor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "zstdpbf.Recompressor",
+	HandlerType: (*RecompressorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Recompress",
+			Handler:       _Recompressor_Recompress_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "recompress.proto",
+}
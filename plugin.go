@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+)
+
+// pluginFiles are Go plugins, that are loaded before the transforms are
+// looked up, so that they can register their own ones.
+var pluginFiles []string
+
+// transformNames are the registered transforms, that are applied to the
+// data of every blob in order.
+var transformNames []string
+
+// transform is the chain of requested transforms and the filter or nil.
+var transform pbf.Transform
+
+// setupTransforms loads pluginFiles and builds transform from
+// transformNames, followed by execFilter.
+func setupTransforms() error {
+	for _, path := range pluginFiles {
+		if err := loadPlugin(path); err != nil {
+			return fmt.Errorf("could not load plugin %s: %v", path, err)
+		}
+	}
+	var chain []pbf.Transform
+	for _, name := range transformNames {
+		t, err := pbf.LookupTransform(name)
+		if err != nil {
+			return fmt.Errorf("%v; registered are %s", err, strings.Join(pbf.Transforms(), ", "))
+		}
+		chain = append(chain, t)
+	}
+	if execFilter != "" {
+		t, err := commandTransform(execFilter)
+		if err != nil {
+			return fmt.Errorf("could not run filter: %v", err)
+		}
+		chain = append(chain, t)
+	}
+	if len(chain) > 0 {
+		transform = pbf.Chain(chain...)
+	}
+	return nil
+}
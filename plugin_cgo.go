@@ -0,0 +1,12 @@
+//go:build (linux || darwin || freebsd) && cgo
+
+package main
+
+import "plugin"
+
+// loadPlugin opens the Go plugin at path, which runs its init functions.
+// A plugin registers its transforms there with pbf.RegisterTransform.
+func loadPlugin(path string) error {
+	_, err := plugin.Open(path)
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !((linux || darwin || freebsd) && cgo)
+
+package main
+
+import "fmt"
+
+// loadPlugin opens the Go plugin at path, which runs its init functions.
+func loadPlugin(path string) error {
+	return fmt.Errorf("plugins are not supported by this build")
+}
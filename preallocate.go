@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// preallocateOutput makes the conversion reserve disk space for the
+// estimated output size up front.
+var preallocateOutput bool
+
+// estimateOutputSize returns the expected size of the output of
+// converting a file of inSize bytes: the -target-size, if given, or the
+// input size, since recompressing rarely changes it much.
+func estimateOutputSize(inSize int64) int64 {
+	size := inSize
+	if targetSize > 0 {
+		size = int64(targetSize)
+	} else if targetRatio > 0 {
+		size = int64(targetRatio * float64(inSize))
+	}
+	if shard.count > 0 {
+		size /= int64(shard.count)
+	}
+	return size
+}
+
+// preallocate reserves size bytes of disk space for out, without
+// changing its size. This reduces fragmentation and makes a lack of
+// space an immediate error. File systems, that can't preallocate, are
+// ignored.
+func preallocate(out *os.File, size int64) error {
+	err := allocate(out, size)
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("not enough space for the estimated output size of %d bytes", size)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+)
+
+// readAhead is the number of blobs, that are read ahead of the
+// conversion, or zero to read them only when they are needed.
+var readAhead int
+
+// prefetchedFrame is the BlobHeader and Blob of a frame, as read from
+// the input, and the error, that ended reading it.
+type prefetchedFrame struct {
+	data []byte
+	size int64 // The bytes taken from the memory budget.
+	err  error
+}
+
+// prefetchReader reads the frames of a PBF file in the background and
+// yields their bytes, so that the latency of the storage is hidden
+// behind the processing of the preceding blobs.
+type prefetchReader struct {
+	frames chan prefetchedFrame
+	memory *memoryBudget // Nil means no limit.
+	held   int64         // The bytes of cur taken from memory.
+	cur    []byte
+	err    error
+}
+
+// newPrefetchReader reads up to n frames of r ahead. If memory is not
+// zero, the frames, that have been read ahead, take at most this many
+// bytes, so that reading waits for the conversion to catch up.
+func newPrefetchReader(r io.Reader, n int, memory int64) *prefetchReader {
+	p := &prefetchReader{frames: make(chan prefetchedFrame, n)}
+	if memory > 0 {
+		p.memory = newMemoryBudget(memory)
+	}
+	go p.run(r)
+	return p
+}
+
+func (p *prefetchReader) run(r io.Reader) {
+	for {
+		frame := new(bytes.Buffer)
+		header, err := readBlobHeader(io.TeeReader(r, frame))
+		if err == nil {
+			err = pbf.CheckDatasize(header)
+		}
+		var size int64
+		if err == nil {
+			size = int64(frame.Len()) + int64(header.GetDatasize())
+			if p.memory != nil {
+				p.memory.acquire(size)
+			}
+			frame.Grow(int(header.GetDatasize()))
+			_, err = io.CopyN(frame, r, int64(header.GetDatasize()))
+		}
+		p.frames <- prefetchedFrame{data: frame.Bytes(), size: size, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read yields the frames in order. The error, that ended reading the
+// input, is returned after the bytes, that were read before it.
+func (p *prefetchReader) Read(b []byte) (int, error) {
+	for len(p.cur) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.memory != nil {
+			p.memory.release(p.held)
+		}
+		frame := <-p.frames
+		p.cur, p.err, p.held = frame.data, frame.err, frame.size
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// preserveMetadata makes the conversion give the output the
+// modification time, permissions and, where possible, the owner of the
+// input.
+var preserveMetadata bool
+
+// copyMetadata gives the file at path the metadata of the file
+// described by info. Changing the owner requires privileges, so failing
+// to do so is ignored.
+func copyMetadata(path string, info fs.FileInfo) error {
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Chown(path, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	if err := os.Chmod(path, info.Mode().Perm()); err != nil {
+		return err
+	}
+	// The zero time leaves the access time unchanged.
+	return os.Chtimes(path, time.Time{}, info.ModTime())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+var cpuProfile string
+var memProfile string
+var traceFile string
+
+// startProfiling starts the profiles requested with -cpu-profile,
+// -mem-profile and -trace. The returned function writes them.
+func startProfiling() func() {
+	var stops []func()
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			fatalCode(exitOutput, "Could not open file", "file", cpuProfile, "err", err)
+		}
+		if err = pprof.StartCPUProfile(f); err != nil {
+			fatal("Could not start CPU profile", "err", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			if err := f.Close(); err != nil {
+				fatalCode(exitOutput, "Could not write CPU profile", "err", err)
+			}
+		})
+	}
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			fatalCode(exitOutput, "Could not open file", "file", traceFile, "err", err)
+		}
+		if err = trace.Start(f); err != nil {
+			fatal("Could not start trace", "err", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			if err := f.Close(); err != nil {
+				fatalCode(exitOutput, "Could not write trace", "err", err)
+			}
+		})
+	}
+	if memProfile != "" {
+		stops = append(stops, func() {
+			f, err := os.Create(memProfile)
+			if err != nil {
+				fatalCode(exitOutput, "Could not open file", "file", memProfile, "err", err)
+			}
+			runtime.GC() // Get up-to-date statistics.
+			err = pprof.Lookup("allocs").WriteTo(f, 0)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				fatalCode(exitOutput, "Could not write memory profile", "err", err)
+			}
+		})
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
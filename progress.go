@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressMode chooses how the progress of a conversion is shown: auto,
+// bar, lines or none. auto draws a bar, if stderr is a terminal, and
+// logs lines otherwise.
+var progressMode = "auto"
+
+const (
+	// barInterval is the time between redraws of the progress bar.
+	barInterval = 200 * time.Millisecond
+
+	// lineInterval is the time between the logged lines of progress.
+	lineInterval = 10 * time.Second
+
+	barWidth = 30
+)
+
+// progressCadence is a flag.Value for how often the progress is shown:
+// after a duration, like 30s, or after a number of blobs. The zero value
+// uses the default interval of the mode.
+type progressCadence struct {
+	interval time.Duration
+	blobs    int
+}
+
+var progressEvery progressCadence
+
+func (c *progressCadence) String() string {
+	if c.blobs > 0 {
+		return strconv.Itoa(c.blobs)
+	}
+	if c.interval > 0 {
+		return c.interval.String()
+	}
+	return ""
+}
+
+func (c *progressCadence) Set(value string) error {
+	if n, err := strconv.Atoi(value); err == nil && n > 0 {
+		*c = progressCadence{blobs: n}
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("expected a positive duration, like 30s, or number of blobs")
+	}
+	*c = progressCadence{interval: d}
+	return nil
+}
+
+// progress shows how much of the input has been converted.
+type progress struct {
+	bar      bool
+	total    int64 // The input size, or 0, if it is unknown.
+	began    time.Time
+	interval time.Duration
+	blobs    int       // Shows every that many blobs instead of after interval.
+	last     time.Time // Of the last update, that was shown.
+	lastBlob int       // The number of blobs of the last update, that was shown.
+	drawn    bool      // Whether a bar must be cleared.
+}
+
+// newProgress returns the progress of converting an input of total
+// bytes, or nil, if no progress is shown.
+func newProgress(total int64) (*progress, error) {
+	p := &progress{total: total, began: time.Now()}
+	switch progressMode {
+	case "none":
+		return nil, nil
+	case "auto":
+		if quiet || verbose || veryVerbose {
+			// The bar would be mixed up with the debug messages.
+			return nil, nil
+		}
+		p.bar = isTerminal(os.Stderr)
+	case "bar":
+		p.bar = true
+	case "lines":
+	default:
+		return nil, fmt.Errorf("unknown progress mode '%s'", progressMode)
+	}
+	p.interval = lineInterval
+	if p.bar {
+		p.interval = barInterval
+	}
+	if progressEvery.interval > 0 || progressEvery.blobs > 0 {
+		p.interval, p.blobs = progressEvery.interval, progressEvery.blobs
+	}
+	p.last = p.began
+	if p.bar {
+		drawnBar = p
+	}
+	return p, nil
+}
+
+// drawnBar is the progress bar, that clearProgress clears.
+var drawnBar *progress
+
+// clearProgress clears the progress bar, if one is drawn, so that an
+// error doesn't end up on its line.
+func clearProgress() {
+	if drawnBar != nil {
+		drawnBar.finish()
+	}
+}
+
+// update shows, that done bytes and blobs of the input have been read,
+// if the last update was shown long enough ago or it is the turn of
+// blobs.
+func (p *progress) update(done int64, blobs int) {
+	now := time.Now()
+	if p.blobs > 0 && (blobs == p.lastBlob || blobs%p.blobs != 0) || p.blobs == 0 && now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last, p.lastBlob = now, blobs
+	ratio := compressionRatio(int(bytesWritten), int(done))
+	var fraction float64
+	var eta time.Duration
+	if p.total > 0 && done > 0 {
+		fraction = min(float64(done)/float64(p.total), 1)
+		eta = time.Duration(float64(now.Sub(p.began)) * (1 - fraction) / fraction).Round(time.Second)
+	}
+	if !p.bar {
+		if p.total > 0 {
+			slog.Info("Progress", "percent", int(fraction*100), "read", done, "blobs", blobs, "ratio", ratio, "eta", eta)
+		} else {
+			slog.Info("Progress", "read", done, "blobs", blobs, "ratio", ratio)
+		}
+		return
+	}
+	var line string
+	if p.total > 0 {
+		filled := int(fraction * barWidth)
+		line = fmt.Sprintf("[%s%s] %3d%%  %s/%s  ratio %.3f  ETA %s",
+			strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), int(fraction*100),
+			formatSize(done), formatSize(p.total), ratio, eta)
+	} else {
+		line = fmt.Sprintf("%s  ratio %.3f", formatSize(done), ratio)
+	}
+	fmt.Fprintf(os.Stderr, "\r%s\033[K", line)
+	p.drawn = true
+}
+
+// finish clears the bar, so that the following messages start on an
+// empty line.
+func (p *progress) finish() {
+	if p.drawn {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// formatSize formats size in binary units, like 1.5GiB.
+func formatSize(size int64) string {
+	units := sizeSuffixes[:4]
+	if size < units[0].factor {
+		return fmt.Sprintf("%dB", size)
+	}
+	unit := units[0]
+	for _, u := range units[1:] {
+		if size >= u.factor {
+			unit = u
+		}
+	}
+	return fmt.Sprintf("%.1f%s", float64(size)/float64(unit.factor), unit.suffix)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+)
+
+// rateBurst is the time, for which a rateLimiter lets data pass without
+// waiting, e.g. after the other side has been waiting.
+const rateBurst = time.Second
+
+var maxReadMBps float64
+var maxWriteMBps float64
+
+// readLimit and writeLimit throttle reading the input and writing the
+// output. They are nil without a limit.
+var readLimit *rateLimiter
+var writeLimit *rateLimiter
+
+// addRateLimitFlags adds the flags, that limit the I/O bandwidth, to the
+// flags of a command, that reads and writes files.
+func addRateLimitFlags(flags *flag.FlagSet) {
+	flags.Float64Var(&maxReadMBps, "max-read-mbps", 0, "read the input at most with this `rate` in MiB per second; 0 means no limit")
+	flags.Float64Var(&maxWriteMBps, "max-write-mbps", 0, "write the output at most with this `rate` in MiB per second; 0 means no limit")
+}
+
+// setupRateLimits creates readLimit and writeLimit from the flags.
+func setupRateLimits() error {
+	if maxReadMBps < 0 || maxWriteMBps < 0 {
+		return fmt.Errorf("the rate must not be negative")
+	}
+	if maxReadMBps > 0 {
+		readLimit = newRateLimiter(maxReadMBps * (1 << 20))
+	}
+	if maxWriteMBps > 0 {
+		writeLimit = newRateLimiter(maxWriteMBps * (1 << 20))
+	}
+	return nil
+}
+
+// rateLimiter delays its callers, so that the number of bytes passed
+// to wait stays below a rate.
+type rateLimiter struct {
+	bytesPerSecond float64
+	next           time.Time // When the given bytes have passed at the rate.
+}
+
+func newRateLimiter(bytesPerSecond float64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait accounts for n bytes and sleeps, until they don't exceed the
+// rate. It does nothing, if l is nil.
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSecond * float64(time.Second)))
+	if delay := l.next.Sub(now) - rateBurst; delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// rateLimitedReader reads from r and waits for limit after every read.
+type rateLimitedReader struct {
+	r     io.Reader
+	limit *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.limit.wait(n)
+	return n, err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxBlockSize is the maximum size of an uncompressed data block.
+// See https://wiki.openstreetmap.org/wiki/PBF_Format#File_format
+const maxBlockSize = 32 * 1024 * 1024
+
+// recommendedBlockSize is the size, that the specification recommends
+// uncompressed data blocks to stay below.
+const recommendedBlockSize = 16 * 1024 * 1024
+
+// splitOversized makes the conversion split data blocks, that exceed
+// maxBlockSize, instead of copying them.
+var splitOversized bool
+
+// oversizeSplitter splits data blocks, that exceed maxBlockSize, into
+// blocks of about recommendedBlockSize. Other blocks are passed on
+// unchanged.
+type oversizeSplitter struct{}
+
+func (oversizeSplitter) add(block *pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error) {
+	size := proto.Size(block)
+	if size <= maxBlockSize {
+		return []*pbfproto.PrimitiveBlock{block}, nil
+	}
+	// A reblocker of its own leaves the surrounding blocks alone.
+	r := newReblocker(recommendedBlockSize)
+	blocks, err := r.add(block)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := r.flush()
+	if err != nil {
+		return nil, err
+	}
+	blocks = append(blocks, rest...)
+	slog.Info("Split an oversized data block", "size", size, "blocks", len(blocks))
+	return blocks, nil
+}
+
+func (oversizeSplitter) flush() ([]*pbfproto.PrimitiveBlock, error) {
+	return nil, nil
+}
+
+// reblocker repacks the PrimitiveGroups of consecutive data blocks into
+// new blocks of approximately targetSize bytes. Small blocks are merged
+// and groups that are too large are split.
+type reblocker struct {
+	targetSize int
+
+	block     *pbfproto.PrimitiveBlock // Nil if no groups are pending.
+	stringIDs map[string]int
+	size      int
+
+	// Consecutive dense nodes are collected here and only encoded into
+	// a group, once a different kind of group is added.
+	dense           []denseNode
+	denseHasInfo    bool
+	denseHasVisible bool
+}
+
+func newReblocker(targetSize int) *reblocker {
+	return &reblocker{targetSize: targetSize}
+}
+
+// add adds the groups of block and returns the blocks that have been
+// completed in the process.
+func (r *reblocker) add(block *pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error) {
+	var done []*pbfproto.PrimitiveBlock
+	if r.block != nil && !sameGrid(r.block, block) {
+		done = append(done, r.finishBlock())
+	}
+	if block.Stringtable == nil {
+		return done, fmt.Errorf("PrimitiveBlock has no string table")
+	}
+	for _, group := range block.Primitivegroup {
+		size, err := groupSize(block, group)
+		if err != nil {
+			return done, err
+		}
+		pieces := []*pbfproto.PrimitiveGroup{group}
+		if size > r.targetSize {
+			if pieces, err = splitGroup(group, (size+r.targetSize-1)/r.targetSize); err != nil {
+				return done, err
+			}
+		}
+		for _, piece := range pieces {
+			if len(pieces) > 1 {
+				size, _ = groupSize(block, piece)
+			}
+			if r.block != nil && r.size+size > r.targetSize {
+				done = append(done, r.finishBlock())
+			}
+			if err = r.addGroup(block, piece); err != nil {
+				return done, err
+			}
+			r.size += size
+		}
+	}
+	return done, nil
+}
+
+// flush returns the pending block, if there is one.
+func (r *reblocker) flush() ([]*pbfproto.PrimitiveBlock, error) {
+	if r.block == nil {
+		return nil, nil
+	}
+	return []*pbfproto.PrimitiveBlock{r.finishBlock()}, nil
+}
+
+func (r *reblocker) finishBlock() *pbfproto.PrimitiveBlock {
+	r.flushDense()
+	block := r.block
+	r.block, r.stringIDs, r.size = nil, nil, 0
+	return block
+}
+
+func (r *reblocker) flushDense() {
+	if len(r.dense) == 0 {
+		return
+	}
+	dense := encodeDenseNodes(r.dense, r.denseHasInfo, r.denseHasVisible)
+	r.block.Primitivegroup = append(r.block.Primitivegroup, &pbfproto.PrimitiveGroup{Dense: dense})
+	r.dense = nil
+}
+
+// addGroup moves group from src to the pending block, merging it with
+// the previous group, if it contains the same kind of elements.
+func (r *reblocker) addGroup(src *pbfproto.PrimitiveBlock, group *pbfproto.PrimitiveGroup) error {
+	if r.block == nil {
+		r.block = &pbfproto.PrimitiveBlock{
+			Stringtable:     &pbfproto.StringTable{S: [][]byte{{}}},
+			Granularity:     src.Granularity,
+			LatOffset:       src.LatOffset,
+			LonOffset:       src.LonOffset,
+			DateGranularity: src.DateGranularity,
+		}
+		r.stringIDs = make(map[string]int)
+	}
+	table := src.Stringtable.S
+	err := visitGroupStringIDs(group, func(sid int) (int, error) {
+		if sid == 0 {
+			return 0, nil
+		} else if sid < 0 || sid >= len(table) {
+			return 0, fmt.Errorf("string ID %d out of range", sid)
+		}
+		newSID, ok := r.stringIDs[string(table[sid])]
+		if !ok {
+			newSID = len(r.block.Stringtable.S)
+			r.block.Stringtable.S = append(r.block.Stringtable.S, table[sid])
+			r.stringIDs[string(table[sid])] = newSID
+		}
+		return newSID, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	kind := groupKind(group)
+	switch kind {
+	case kindEmpty:
+		return nil
+	case kindDense:
+		hasInfo, hasVisible := denseHasInfo(group.Dense)
+		if len(r.dense) > 0 && (hasInfo != r.denseHasInfo || hasVisible != r.denseHasVisible) {
+			r.flushDense()
+		}
+		nodes, err := decodeDenseNodes(group.Dense)
+		if err != nil {
+			return err
+		}
+		r.dense = append(r.dense, nodes...)
+		r.denseHasInfo, r.denseHasVisible = hasInfo, hasVisible
+		return nil
+	}
+	r.flushDense()
+	groups := r.block.Primitivegroup
+	if len(groups) > 0 && groupKind(groups[len(groups)-1]) == kind {
+		last := groups[len(groups)-1]
+		switch kind {
+		case kindNodes:
+			last.Nodes = append(last.Nodes, group.Nodes...)
+			return nil
+		case kindWays:
+			last.Ways = append(last.Ways, group.Ways...)
+			return nil
+		case kindRelations:
+			last.Relations = append(last.Relations, group.Relations...)
+			return nil
+		case kindChangesets:
+			last.Changesets = append(last.Changesets, group.Changesets...)
+			return nil
+		}
+	}
+	r.block.Primitivegroup = append(groups, group)
+	return nil
+}
+
+type groupKindType int
+
+const (
+	kindEmpty groupKindType = iota
+	kindNodes
+	kindDense
+	kindWays
+	kindRelations
+	kindChangesets
+	kindMixed // Not allowed by the specification, but handled anyway.
+)
+
+func groupKind(group *pbfproto.PrimitiveGroup) groupKindType {
+	kind := kindEmpty
+	set := func(k groupKindType) {
+		if kind == kindEmpty {
+			kind = k
+		} else {
+			kind = kindMixed
+		}
+	}
+	if len(group.Nodes) > 0 {
+		set(kindNodes)
+	}
+	if group.Dense != nil && len(group.Dense.Id) > 0 {
+		set(kindDense)
+	}
+	if len(group.Ways) > 0 {
+		set(kindWays)
+	}
+	if len(group.Relations) > 0 {
+		set(kindRelations)
+	}
+	if len(group.Changesets) > 0 {
+		set(kindChangesets)
+	}
+	return kind
+}
+
+// splitGroup splits group into n groups of roughly equal element count.
+// Groups of mixed kind are not split.
+func splitGroup(group *pbfproto.PrimitiveGroup, n int) ([]*pbfproto.PrimitiveGroup, error) {
+	var groups []*pbfproto.PrimitiveGroup
+	switch groupKind(group) {
+	case kindNodes:
+		for _, nodes := range chunk(group.Nodes, n) {
+			groups = append(groups, &pbfproto.PrimitiveGroup{Nodes: nodes})
+		}
+	case kindDense:
+		nodes, err := decodeDenseNodes(group.Dense)
+		if err != nil {
+			return nil, err
+		}
+		hasInfo, hasVisible := denseHasInfo(group.Dense)
+		for _, nodes := range chunk(nodes, n) {
+			dense := encodeDenseNodes(nodes, hasInfo, hasVisible)
+			groups = append(groups, &pbfproto.PrimitiveGroup{Dense: dense})
+		}
+	case kindWays:
+		for _, ways := range chunk(group.Ways, n) {
+			groups = append(groups, &pbfproto.PrimitiveGroup{Ways: ways})
+		}
+	case kindRelations:
+		for _, relations := range chunk(group.Relations, n) {
+			groups = append(groups, &pbfproto.PrimitiveGroup{Relations: relations})
+		}
+	case kindChangesets:
+		for _, changesets := range chunk(group.Changesets, n) {
+			groups = append(groups, &pbfproto.PrimitiveGroup{Changesets: changesets})
+		}
+	default:
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// chunk splits s into n slices of roughly equal length.
+func chunk[T any](s []T, n int) [][]T {
+	if n > len(s) {
+		n = len(s)
+	}
+	chunks := make([][]T, 0, n)
+	for i := 0; i < n; i++ {
+		chunks = append(chunks, s[i*len(s)/n:(i+1)*len(s)/n])
+	}
+	return chunks
+}
+
+// groupSize estimates the serialized size of group, including the
+// strings it references from the string table of block.
+func groupSize(block *pbfproto.PrimitiveBlock, group *pbfproto.PrimitiveGroup) (int, error) {
+	size := proto.Size(group)
+	table := block.Stringtable.S
+	seen := make(map[int]bool)
+	err := visitGroupStringIDs(group, func(sid int) (int, error) {
+		if sid < 0 || sid >= len(table) {
+			return 0, fmt.Errorf("string ID %d out of range", sid)
+		}
+		if !seen[sid] {
+			seen[sid] = true
+			size += len(table[sid]) + 2
+		}
+		return sid, nil
+	})
+	return size, err
+}
+
+// sameGrid reports whether the coordinates and timestamps of a and b
+// are stored with the same granularity and offsets.
+func sameGrid(a, b *pbfproto.PrimitiveBlock) bool {
+	return a.GetGranularity() == b.GetGranularity() &&
+		a.GetLatOffset() == b.GetLatOffset() &&
+		a.GetLonOffset() == b.GetLonOffset() &&
+		a.GetDateGranularity() == b.GetDateGranularity()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxReferenceExamples is the number of broken references, that are
+// printed; the others are only counted.
+const maxReferenceExamples = 10
+
+// referenceCheck finds ways, that reference missing nodes, and
+// relations, that reference missing members.
+type referenceCheck struct {
+	nodes, ways, relations idSet
+
+	brokenWays, brokenRelations int
+	missing                     int // References to missing objects.
+	examples                    []string
+}
+
+// collect records the IDs of all objects in block.
+func (c *referenceCheck) collect(block *pbfproto.PrimitiveBlock) error {
+	return visitElements(block, func(e *element) {
+		switch e.kind {
+		case kindNodes:
+			c.nodes.add(e.id)
+		case kindWays:
+			c.ways.add(e.id)
+		case kindRelations:
+			c.relations.add(e.id)
+		}
+	})
+}
+
+// check checks the references of the ways and relations in block.
+func (c *referenceCheck) check(block *pbfproto.PrimitiveBlock) error {
+	if !slices.ContainsFunc(block.Primitivegroup, func(group *pbfproto.PrimitiveGroup) bool {
+		kind := groupKind(group)
+		return kind == kindWays || kind == kindRelations || kind == kindMixed
+	}) {
+		return nil
+	}
+	elements, err := decodeElements(block)
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+		missing := 0
+		var first string
+		note := func(kind string, id int64) {
+			if missing == 0 {
+				first = fmt.Sprintf("%s %d", kind, id)
+			}
+			missing++
+		}
+		switch e.kind {
+		case kindWays:
+			for _, ref := range e.refs {
+				if !c.nodes.has(ref) {
+					note("node", ref)
+				}
+			}
+		case kindRelations:
+			for _, m := range e.members {
+				switch {
+				case m.kind == kindNodes && !c.nodes.has(m.id):
+					note("node", m.id)
+				case m.kind == kindWays && !c.ways.has(m.id):
+					note("way", m.id)
+				case m.kind == kindRelations && !c.relations.has(m.id):
+					note("relation", m.id)
+				}
+			}
+		}
+		if missing == 0 {
+			continue
+		}
+		c.missing += missing
+		kind := "Way"
+		if e.kind == kindWays {
+			c.brokenWays++
+		} else {
+			kind = "Relation"
+			c.brokenRelations++
+		}
+		if len(c.examples) < maxReferenceExamples {
+			c.examples = append(c.examples, fmt.Sprintf("%s %d references %d missing objects, e.g. %s.", kind, e.id, missing, first))
+		}
+	}
+	return nil
+}
+
+// checkReferences reads in twice: first to record the IDs of all objects
+// and then to check the references to them, since relations may
+// reference objects, that come after them.
+func checkReferences(in io.ReadSeeker) (*referenceCheck, error) {
+	c := &referenceCheck{}
+	for _, step := range []func(*pbfproto.PrimitiveBlock) error{c.collect, c.check} {
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		err := readBlobs(in, func(header *pbfproto.BlobHeader, rawData []byte) error {
+			if header.GetType() != "OSMData" {
+				return nil
+			}
+			block := &pbfproto.PrimitiveBlock{}
+			if err := proto.Unmarshal(rawData, block); err != nil {
+				return fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+			}
+			return step(block)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
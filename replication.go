@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// replicationState is the content of an Osmosis state.txt file.
+type replicationState struct {
+	sequence  int64
+	timestamp time.Time
+}
+
+// caughtUp is the replication state of the output, if the input has
+// been brought up to date with -catch-up.
+var caughtUp *replicationState
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// catchUp downloads the diffs, that are needed to bring a file with the
+// given header up to date, into dir. It returns the paths of the diffs
+// and the state they lead to.
+func catchUp(ctx context.Context, header *pbfproto.HeaderBlock, dir string) ([]string, *replicationState, error) {
+	baseURL := strings.TrimSuffix(header.GetOsmosisReplicationBaseUrl(), "/")
+	if baseURL == "" || header.OsmosisReplicationSequenceNumber == nil {
+		return nil, nil, fmt.Errorf("the OSMHeader contains no replication base URL and sequence number")
+	}
+	state, err := fetchState(ctx, baseURL+"/state.txt")
+	if err != nil {
+		return nil, nil, err
+	}
+	var paths []string
+	for seq := header.GetOsmosisReplicationSequenceNumber() + 1; seq <= state.sequence; seq++ {
+		path := filepath.Join(dir, fmt.Sprintf("%09d.osc.gz", seq))
+		url := baseURL + "/" + sequencePath(seq) + ".osc.gz"
+		slog.Info("Downloading", "url", url)
+		if err = download(ctx, url, path); err != nil {
+			return nil, nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, state, nil
+}
+
+// sequencePath returns the path of the files of a sequence number
+// relative to the replication base URL, e.g. "006/123/456".
+func sequencePath(seq int64) string {
+	s := fmt.Sprintf("%09d", seq)
+	return s[0:3] + "/" + s[3:6] + "/" + s[6:9]
+}
+
+func fetchState(ctx context.Context, url string) (*replicationState, error) {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch '%s': %s", url, resp.Status)
+	}
+	state := &replicationState{sequence: -1}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		// The values are escaped like Java properties.
+		value = strings.ReplaceAll(value, `\`, "")
+		switch key {
+		case "sequenceNumber":
+			if state.sequence, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid sequence number in '%s': %v", url, err)
+			}
+		case "timestamp":
+			if state.timestamp, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, fmt.Errorf("invalid timestamp in '%s': %v", url, err)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if state.sequence < 0 || state.timestamp.IsZero() {
+		return nil, fmt.Errorf("'%s' contains no sequence number and timestamp", url)
+	}
+	return state, nil
+}
+
+func download(ctx context.Context, url, path string) error {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch '%s': %s", url, resp.Status)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("could not fetch '%s': %v", url, err)
+	}
+	return f.Close()
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+// readHeaderBlock reads the HeaderBlock from the first blob of in and
+// rewinds it afterwards.
+func readHeaderBlock(in io.ReadSeeker) (*pbfproto.HeaderBlock, error) {
+	blobHeader, err := readBlobHeader(in)
+	if err != nil {
+		return nil, fmt.Errorf("could not read BlobHeader: %v", err)
+	}
+	if blobHeader.GetType() != "OSMHeader" {
+		return nil, fmt.Errorf("the first blob is of type %s instead of OSMHeader", blobHeader.GetType())
+	}
+	blob, err := readBlob(blobHeader, in)
+	if err != nil {
+		return nil, fmt.Errorf("could not read Blob: %v", err)
+	}
+	rawData, err := pbf.Decompress(blob)
+	if err != nil {
+		return nil, err
+	}
+	header := &pbfproto.HeaderBlock{}
+	if err = proto.Unmarshal(rawData, header); err != nil {
+		return nil, fmt.Errorf("could not parse HeaderBlock: %v", err)
+	}
+	_, err = in.Seek(0, io.SeekStart)
+	return header, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// statsFile is the file, to which the report of a conversion is written
+// as JSON.
+var statsFile string
+
+// runReport summarizes a conversion for the metadata stores of data
+// pipelines.
+type runReport struct {
+	Version  string            `json:"version"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	Settings map[string]string `json:"settings"` // The flags, that were given.
+	Level    string            `json:"level"`    // The final zstd level, which -deadline may lower.
+	Input    reportFile        `json:"input"`
+	Outputs  []reportFile      `json:"outputs"`
+	RawSize  int64             `json:"raw_size"` // Of the uncompressed data of the output.
+	Ratio    float64           `json:"ratio"`    // Of the output to the input size.
+	Times    reportTimes       `json:"times"`
+}
+
+type reportFile struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	Blobs  int    `json:"blobs"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// reportTimes are the stageTimes in seconds.
+type reportTimes struct {
+	Read       float64 `json:"read"`
+	Decompress float64 `json:"decompress"`
+	Transform  float64 `json:"transform"`
+	Marshal    float64 `json:"marshal"`
+	Compress   float64 `json:"compress"`
+	Write      float64 `json:"write"`
+	Total      float64 `json:"total"`
+}
+
+// describeOutput adds the size and the hex encoded SHA-256 hash of the
+// output f to r. f is read through the descriptor, that wrote it, since
+// closing another one would release the lock of the process on it.
+func describeOutput(r *reportFile, f *os.File) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hash, err := hashFile(f)
+	r.Size, r.SHA256 = stat.Size(), fmt.Sprintf("%x", hash)
+	return err
+}
+
+// writeRunReport writes the report of the conversion, that began at
+// began and read inputBlobs blobs of inSize bytes, to statsFile. The
+// outputs, of which out is the first, are read back to hash them.
+func writeRunReport(began time.Time, inSize int64, inputBlobs int, out *os.File) error {
+	finished := time.Now()
+	r := runReport{
+		Version:  readBuildVersion().version,
+		Started:  began,
+		Finished: finished,
+		Settings: make(map[string]string),
+		Level:    compressionLevel.String(),
+		Input:    reportFile{File: inFile, Size: inSize, Blobs: inputBlobs},
+		RawSize:  rawBytesWritten,
+		Times: reportTimes{
+			Read:       times.read.Seconds(),
+			Decompress: times.decompress.Seconds(),
+			Transform:  times.transform.Seconds(),
+			Marshal:    times.marshal.Seconds(),
+			Compress:   times.compress.Seconds(),
+			Write:      times.write.Seconds(),
+			Total:      finished.Sub(began).Seconds(),
+		},
+	}
+	flag.Visit(func(f *flag.Flag) { r.Settings[f.Name] = f.Value.String() })
+	outputs := []reportFile{{File: outFile, Blobs: blobsWritten}}
+	files := []*os.File{out}
+	if tee != nil {
+		outputs = append(outputs, reportFile{File: alsoWrite, Blobs: tee.blobs})
+		files = append(files, tee.f)
+	}
+	for i := range outputs {
+		if err := describeOutput(&outputs[i], files[i]); err != nil {
+			return err
+		}
+	}
+	r.Outputs = outputs
+	if inSize > 0 {
+		r.Ratio = float64(outputs[0].Size) / float64(inSize)
+	}
+	f, err := createOutput(statsFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	onFatal(func() { os.Remove(f.Name()) })
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(r); err != nil {
+		return err
+	}
+	return commitOutput(f, statsFile)
+}
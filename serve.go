@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// addCompressionFlags adds the flags, that control how a single blob is
+// compressed, to the flags of a server command.
+func addCompressionFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&speedFastest, "fastest", false, "use the fastest compression level")
+	flags.BoolVar(&speedBetterCompression, "better", false, "use a compression level with better compression than default")
+	flags.BoolVar(&speedBestCompression, "best", false, "use the compression level with the best compression")
+	flags.BoolVar(&zstdChecksum, "checksum", true, "store a content checksum in every zstd frame")
+	flags.Var(&codecs, "codec", "compress blobs of a type with another codec, given as `TYPE=CODEC`, where\nCODEC is zstd, zlib, raw or brotli; can be given multiple times")
+	flags.BoolVar(&experimentalBrotli, "experimental-brotli", false, "allow the codec brotli, which is not part of the PBF specification and can\nonly be read by zstd-pbf")
+	flags.IntVar(&encoderConcurrency, "encoder-concurrency", 0, "compress each blob with up to `N` goroutines; defaults to the number of usable\nCPUs, see -cpus")
+}
+
+func runServeGRPC(args []string) {
+	flags := flag.NewFlagSet("serve-grpc", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:50051", "listen on this `address`")
+	metricsAddr := addMetricsFlag(flags)
+	otlp := addTracingFlag(flags)
+	addCompressionFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf serve-grpc [-listen ADDRESS] [-metrics ADDRESS] [-otlp] [COMPRESSION_OPTIONS]")
+		fmt.Fprintln(os.Stderr, "Serve the zstdpbf.Recompressor gRPC service, defined in recompress.proto,\n"+
+			"which recompresses a stream of blobs.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 0 {
+		fatalCode(exitUsage, "The serve-grpc command takes no arguments")
+	}
+	setCompressionLevel()
+	if err := checkBrotli(); err != nil {
+		fatalCode(exitCodec, "Could not use codec", "err", err)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal("Could not listen", "address", *listen, "err", err)
+	}
+	serveMetrics(*metricsAddr)
+	stopTracing, err := setupTracing(*otlp)
+	if err != nil {
+		fatal("Could not set up tracing", "err", err)
+	}
+	defer stopTracing()
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(2*maxBlockSize), grpc.MaxSendMsgSize(2*maxBlockSize),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	pbfproto.RegisterRecompressorServer(server, recompressServer{})
+	slog.Info("Listening", "address", listener.Addr().String())
+	if err = server.Serve(listener); err != nil {
+		fatal("Could not serve", "err", err)
+	}
+}
+
+type recompressServer struct {
+	pbfproto.UnimplementedRecompressorServer
+}
+
+func (recompressServer) Recompress(stream pbfproto.Recompressor_RecompressServer) error {
+	metricQueueDepth.Inc()
+	defer metricQueueDepth.Dec()
+	err := recompressStream(stream)
+	if err != nil {
+		metricErrors.Inc()
+	}
+	return err
+}
+
+func recompressStream(stream pbfproto.Recompressor_RecompressServer) error {
+	for i := 0; ; i++ {
+		began := time.Now()
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ctx, span := startBlobSpan(stream.Context(), i, began)
+		var rawData []byte
+		var blob *pbfproto.Blob
+		err = traced(ctx, "decompress", func() (err error) {
+			if err = checkUploadedBlob(req.Blob); err != nil {
+				return err
+			}
+			rawData, err = pbf.Decompress(req.Blob)
+			return err
+		})
+		if err != nil {
+			err = status.Errorf(codes.InvalidArgument, "could not decompress blob: %v", err)
+		} else if err = traced(ctx, "compress", func() (err error) {
+			blob, err = compressData(rawData, codecs.get(req.GetType()))
+			return err
+		}); err != nil {
+			err = status.Errorf(codes.Internal, "could not compress blob: %v", err)
+		} else {
+			err = traced(ctx, "write", func() error {
+				return stream.Send(&pbfproto.RecompressResponse{Blob: blob})
+			})
+		}
+		span.End()
+		if err != nil {
+			return err
+		}
+		recordBlob(proto.Size(req.Blob), proto.Size(blob))
+	}
+}
+
+func runServeHTTP(args []string) {
+	flags := flag.NewFlagSet("serve-http", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8080", "listen on this `address`")
+	maxRequests := flags.Int("max-requests", 4, "handle at most `N` requests at once and reject others; 0 means no limit")
+	maxSize := byteSize(defaultMaxRequestSize)
+	flags.Var(&maxSize, "max-request-size", "reject requests larger than this `size`, e.g. 2G; 0 means no limit")
+	metricsAddr := addMetricsFlag(flags)
+	otlp := addTracingFlag(flags)
+	addCompressionFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf serve-http [-listen ADDRESS] [-max-requests N] [-max-request-size SIZE]\n"+
+			"                      [-metrics ADDRESS] [-otlp] [COMPRESSION_OPTIONS]")
+		fmt.Fprintln(os.Stderr, "Serve HTTP, where the response to a POST of a PBF file is the file with\n"+
+			"all blobs recompressed.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 0 {
+		fatalCode(exitUsage, "The serve-http command takes no arguments")
+	}
+	setCompressionLevel()
+	if err := checkBrotli(); err != nil {
+		fatalCode(exitCodec, "Could not use codec", "err", err)
+	}
+	handler := &recompressHandler{maxSize: int64(maxSize)}
+	if *maxRequests > 0 {
+		handler.slots = make(chan struct{}, *maxRequests)
+	}
+	serveMetrics(*metricsAddr)
+	stopTracing, err := setupTracing(*otlp)
+	if err != nil {
+		fatal("Could not set up tracing", "err", err)
+	}
+	defer stopTracing()
+	slog.Info("Listening", "address", *listen)
+	if err = http.ListenAndServe(*listen, otelhttp.NewHandler(handler, "recompress")); err != nil {
+		fatal("Could not serve", "err", err)
+	}
+}
+
+// defaultMaxRequestSize is the default of -max-request-size.
+const defaultMaxRequestSize = 4 << 30
+
+// checkUploadedBlob returns an error, if blob may hold more uncompressed
+// data than the specification allows, so that a crafted upload can't
+// make the server allocate much more than that.
+func checkUploadedBlob(blob *pbfproto.Blob) error {
+	if _, raw := blob.Data.(*pbfproto.Blob_Raw); raw {
+		return nil // Its size is that of the blob.
+	}
+	if blob.RawSize == nil {
+		return fmt.Errorf("compressed blob has no raw_size")
+	}
+	if blob.GetRawSize() > maxBlockSize {
+		return fmt.Errorf("raw size %d of blob exceeds 32MiB", blob.GetRawSize())
+	}
+	return nil
+}
+
+// recompressHandler responds to a POST of a PBF file with the file with
+// all blobs recompressed.
+type recompressHandler struct {
+	maxSize int64         // Zero means no limit.
+	slots   chan struct{} // Nil means no limit.
+}
+
+func (h *recompressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+			defer func() { <-h.slots }()
+		default:
+			http.Error(w, "Too many concurrent requests.", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if h.maxSize > 0 {
+		if r.ContentLength > h.maxSize {
+			http.Error(w, "The request is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxSize)
+	}
+	metricQueueDepth.Inc()
+	defer metricQueueDepth.Dec()
+	// Blobs are written while the request is still being read, which
+	// HTTP/1 servers don't allow by default.
+	http.NewResponseController(w).EnableFullDuplex()
+	started := false
+	for i := 0; ; i++ {
+		err := recompressBlob(r.Context(), i, r.Body, w, &started)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			metricErrors.Inc()
+			if started {
+				// The status has been sent already, so the client can
+				// only learn about the error from the aborted response.
+				slog.Error("Could not recompress blob", "blob", i, "client", r.RemoteAddr, "err", err)
+				panic(http.ErrAbortHandler)
+			}
+			status := http.StatusBadRequest
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("Could not recompress blob %d: %v", i, err), status)
+			return
+		}
+	}
+}
+
+// recompressBlob reads the blob with the given index from in and writes
+// it recompressed to out. started is set, once the first byte has been
+// written.
+func recompressBlob(ctx context.Context, index int, in io.Reader, out http.ResponseWriter, started *bool) error {
+	began := time.Now()
+	header, err := readBlobHeader(in)
+	if err != nil {
+		return err
+	}
+	if header.GetDatasize() > maxBlockSize {
+		return fmt.Errorf("datasize %d of blob exceeds 32MiB", header.GetDatasize())
+	}
+	blob, err := readBlob(header, in)
+	if err != nil {
+		return fmt.Errorf("could not read Blob: %v", err)
+	}
+	if err = checkUploadedBlob(blob); err != nil {
+		return err
+	}
+	ctx, span := startBlobSpan(ctx, index, began)
+	defer span.End()
+	var rawData []byte
+	err = traced(ctx, "decompress", func() (err error) {
+		rawData, err = pbf.Decompress(blob)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	read := int(header.GetDatasize())
+	var rawBlob []byte
+	err = traced(ctx, "compress", func() (err error) {
+		if blob, err = compressData(rawData, codecs.get(header.GetType())); err != nil {
+			return fmt.Errorf("could not compress Blob: %v", err)
+		}
+		rawBlob, err = marshalFraming(blob)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	datasize := int32(len(rawBlob))
+	header.Datasize = &datasize
+	if !*started {
+		out.Header().Set("Content-Type", "application/octet-stream")
+		*started = true
+	}
+	err = traced(ctx, "write", func() error {
+		if err := writeBlobHeader(header, out); err != nil {
+			return err
+		}
+		_, err := out.Write(rawBlob)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	recordBlob(read, len(rawBlob))
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// shardSpec is a flag.Value for -shard, given as "i/n". Shard i of n
+// contains every input blob, whose index modulo n is i.
+type shardSpec struct {
+	index, count int
+}
+
+func (s *shardSpec) String() string {
+	if s == nil || s.count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", s.index, s.count)
+}
+
+func (s *shardSpec) Set(value string) error {
+	var i, n int
+	if _, err := fmt.Sscanf(value, "%d/%d", &i, &n); err != nil || n < 1 || i < 0 || i >= n {
+		return fmt.Errorf("expected i/n with 0 <= i < n")
+	}
+	s.index, s.count = i, n
+	return nil
+}
+
+var shard shardSpec
+var shardWriter *shardManifestWriter
+
+// The assembly manifest of a shard is written next to it, with the name
+// of the shard followed by shardSuffix. It starts with the line
+//
+//	zstd-pbf shard <i>/<n>
+//
+// followed by a line for every blob of the shard in the format
+//
+//	<input blob index> <offset> <length>
+//
+// and ends with the total number of blobs of the input:
+//
+//	total <blobs>
+const shardSuffix = ".shard"
+
+type shardManifestWriter struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	n    int
+}
+
+func newShardManifestWriter(path string) (*shardManifestWriter, error) {
+	f, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	_, err = fmt.Fprintf(w, "zstd-pbf shard %s\n", shard.String())
+	return &shardManifestWriter{path: path, f: f, w: w}, err
+}
+
+// add adds the next blob of the shard, which has been written at offset.
+func (s *shardManifestWriter) add(offset, length int64) error {
+	_, err := fmt.Fprintf(s.w, "%d %d %d\n", shard.index+s.n*shard.count, offset, length)
+	s.n++
+	return err
+}
+
+// close finishes the manifest of a shard of an input with the given
+// number of blobs.
+func (s *shardManifestWriter) close(total int) error {
+	_, err := fmt.Fprintf(s.w, "total %d\n", total)
+	if flushErr := s.w.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return err
+	}
+	return commitOutput(s.f, s.path)
+}
+
+// shardManifest is a parsed assembly manifest.
+type shardManifest struct {
+	spec    shardSpec
+	extents []blobExtent
+	total   int
+}
+
+func readShardManifest(path string) (*shardManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &shardManifest{total: -1}
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("the manifest is empty")
+	}
+	spec, ok := strings.CutPrefix(scanner.Text(), "zstd-pbf shard ")
+	if !ok || m.spec.Set(spec) != nil {
+		return nil, fmt.Errorf("the manifest does not start with a shard specification")
+	}
+	for line := 2; scanner.Scan(); line++ {
+		if m.total >= 0 {
+			return nil, fmt.Errorf("line %d follows the total", line)
+		}
+		if _, err := fmt.Sscanf(scanner.Text(), "total %d", &m.total); err == nil {
+			continue
+		}
+		var index int
+		var extent blobExtent
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &index, &extent.Offset, &extent.Length); err != nil {
+			return nil, fmt.Errorf("malformed line %d", line)
+		}
+		if index != m.spec.index+len(m.extents)*m.spec.count {
+			return nil, fmt.Errorf("line %d does not describe the next blob of the shard", line)
+		}
+		m.extents = append(m.extents, extent)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.total < 0 {
+		return nil, fmt.Errorf("the manifest is incomplete")
+	}
+	if want := (m.total - m.spec.index + m.spec.count - 1) / m.spec.count; len(m.extents) != want {
+		return nil, fmt.Errorf("the shard has %d instead of %d blobs", len(m.extents), want)
+	}
+	return m, nil
+}
+
+func runAssemble(args []string) {
+	flags := flag.NewFlagSet("assemble", flag.ExitOnError)
+	withFooter := flags.Bool("footer", false, "append a blob with the hash of the file, that can be checked with verify -quick")
+	addOverwriteFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf assemble [-footer] [-yes] <OUT_FILE> <SHARD_FILE>...")
+		fmt.Fprintln(os.Stderr, "Stitch the shards written with -shard into OUT_FILE. The assembly\n"+
+			"manifest of every shard must lie next to it, with the suffix .shard.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() < 2 {
+		fatalCode(exitUsage, "Give at least two arguments: The output file and the shards")
+	}
+	outPath, shardPaths := flags.Arg(0), flags.Args()[1:]
+	checkOutput(outPath, shardPaths...)
+	shards, files, err := openShards(shardPaths)
+	if err != nil {
+		fatalCode(inputCode(err), "Could not open shards", "err", err)
+	}
+	for _, f := range files {
+		defer f.Close()
+	}
+	out, err := createOutput(outPath)
+	if err != nil {
+		fatalCode(exitOutput, "Could not open file", "file", outPath, "err", err)
+	}
+	defer out.Close()
+	total := shards[0].total
+	for i := 0; i < total && err == nil; i++ {
+		n := len(shards)
+		extent := shards[i%n].extents[i/n]
+		_, err = io.Copy(out, io.NewSectionReader(files[i%n], extent.Offset, extent.Length))
+	}
+	if err == nil && *withFooter {
+		err = writeFooter(out, total)
+	}
+	if err == nil {
+		err = commitOutput(out, outPath)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		fatalCode(exitOutput, "Could not write", "file", outPath, "err", err)
+	}
+	slog.Info("Assembled shards", "blobs", total, "shards", len(shards))
+}
+
+// openShards reads the manifests of the shards at paths and opens them.
+// The results are ordered by shard index.
+func openShards(paths []string) ([]*shardManifest, []*os.File, error) {
+	shards := make([]*shardManifest, len(paths))
+	files := make([]*os.File, len(paths))
+	for _, path := range paths {
+		m, err := readShardManifest(path + shardSuffix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read manifest of '%s': %v", path, err)
+		}
+		if m.spec.count != len(paths) {
+			return nil, nil, fmt.Errorf("'%s' is shard %s, but %d shards were given", path, m.spec.String(), len(paths))
+		} else if shards[m.spec.index] != nil {
+			return nil, nil, fmt.Errorf("shard %s was given twice", m.spec.String())
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(m.extents) > 0 {
+			last := m.extents[len(m.extents)-1]
+			if last.Offset+last.Length > stat.Size() {
+				return nil, nil, fmt.Errorf("'%s' is shorter than its manifest says", path)
+			}
+		}
+		shards[m.spec.index], files[m.spec.index] = m, f
+	}
+	for _, m := range shards {
+		if m.total != shards[0].total {
+			return nil, nil, fmt.Errorf("the shards belong to different inputs")
+		}
+	}
+	return shards, files, nil
+}
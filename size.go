@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag.Value for sizes like "512K", "16M" or "40G". The
+// suffixes are binary multiples, so "1K" is 1024 bytes.
+type byteSize int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func (s *byteSize) String() string {
+	if s == nil || *s == 0 {
+		return "0"
+	}
+	// The largest unit, that divides the size, is used.
+	for i := 7; i >= 4; i-- {
+		if unit := sizeSuffixes[i]; int64(*s)%unit.factor == 0 {
+			return strconv.FormatInt(int64(*s)/unit.factor, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	factor := int64(1)
+	for _, unit := range sizeSuffixes {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size")
+	}
+	*s = byteSize(n * factor)
+	return nil
+}
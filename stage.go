@@ -0,0 +1,48 @@
+package main
+
+import "github.com/codesoap/zstd-pbf/pbfproto"
+
+// A blockStage transforms the stream of data blocks. Stages may hold
+// back blocks, merge or split them and drop or modify their content.
+type blockStage interface {
+	// add adds block to the stage and returns the blocks that are
+	// ready to be passed on.
+	add(block *pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error)
+
+	// flush returns all blocks held back by the stage.
+	flush() ([]*pbfproto.PrimitiveBlock, error)
+}
+
+// runStages passes blocks through stages in order.
+func runStages(stages []blockStage, blocks []*pbfproto.PrimitiveBlock) ([]*pbfproto.PrimitiveBlock, error) {
+	for _, stage := range stages {
+		var next []*pbfproto.PrimitiveBlock
+		for _, block := range blocks {
+			done, err := stage.add(block)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, done...)
+		}
+		blocks = next
+	}
+	return blocks, nil
+}
+
+// flushStages flushes stages in order, passing the blocks flushed from
+// a stage through the stages that follow it.
+func flushStages(stages []blockStage) ([]*pbfproto.PrimitiveBlock, error) {
+	var blocks []*pbfproto.PrimitiveBlock
+	for i, stage := range stages {
+		var err error
+		if blocks, err = runStages(stages[i:i+1], blocks); err != nil {
+			return nil, err
+		}
+		flushed, err := stage.flush()
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, flushed...)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// elementStats summarizes the elements of one type.
+type elementStats struct {
+	count        int64
+	minID, maxID int64
+}
+
+func (s *elementStats) add(id int64) {
+	if s.count == 0 || id < s.minID {
+		s.minID = id
+	}
+	if s.count == 0 || id > s.maxID {
+		s.maxID = id
+	}
+	s.count++
+}
+
+// sizeStats sums up the sizes of blobs or parts of them.
+type sizeStats struct {
+	count      int64
+	compressed int64
+	raw        int64
+}
+
+func (s *sizeStats) add(compressed, raw int64) {
+	s.count++
+	s.compressed += compressed
+	s.raw += raw
+}
+
+// fileStats summarizes the content of a PBF file.
+type fileStats struct {
+	nodes, ways, relations     elementStats
+	minTimestamp, maxTimestamp int64 // In milliseconds since the epoch.
+	hasTimestamps              bool
+	users, changesets          idSet
+
+	blobTypes map[string]*sizeStats
+
+	// Of all blobs, to help choosing a -target-blob-size.
+	compressedSizes, rawSizes sizeHistogram
+
+	// The compressed size of a group can't be measured, so the
+	// compressed size of a blob is split between its groups by their
+	// uncompressed size.
+	groups map[string]*sizeStats
+}
+
+// addBlob adds the sizes of a blob with the given header and
+// uncompressed data. block must be the parsed rawData of OSMData blobs.
+func (s *fileStats) addBlob(header *pbfproto.BlobHeader, rawData []byte, block *pbfproto.PrimitiveBlock) {
+	if s.blobTypes == nil {
+		s.blobTypes = make(map[string]*sizeStats)
+		s.groups = make(map[string]*sizeStats)
+	}
+	blobType := header.GetType()
+	if s.blobTypes[blobType] == nil {
+		s.blobTypes[blobType] = &sizeStats{}
+	}
+	compressed := int64(header.GetDatasize())
+	s.blobTypes[blobType].add(compressed, int64(len(rawData)))
+	s.compressedSizes.add(compressed)
+	s.rawSizes.add(int64(len(rawData)))
+	if block == nil {
+		return
+	}
+	var total int64
+	sizes := make([]int64, len(block.Primitivegroup))
+	for i, group := range block.Primitivegroup {
+		sizes[i] = int64(proto.Size(group))
+		total += sizes[i]
+	}
+	for i, group := range block.Primitivegroup {
+		name := groupKindName(groupKind(group))
+		if s.groups[name] == nil {
+			s.groups[name] = &sizeStats{}
+		}
+		s.groups[name].add(compressed*sizes[i]/max(total, 1), sizes[i])
+	}
+}
+
+func groupKindName(kind groupKindType) string {
+	switch kind {
+	case kindNodes, kindDense:
+		return "nodes"
+	case kindWays:
+		return "ways"
+	case kindRelations:
+		return "relations"
+	}
+	return "other"
+}
+
+func (s *fileStats) add(e *element) {
+	switch e.kind {
+	case kindNodes:
+		s.nodes.add(e.id)
+	case kindWays:
+		s.ways.add(e.id)
+	case kindRelations:
+		s.relations.add(e.id)
+	}
+	if !e.hasInfo {
+		return
+	}
+	if !s.hasTimestamps || e.timestamp < s.minTimestamp {
+		s.minTimestamp = e.timestamp
+	}
+	if !s.hasTimestamps || e.timestamp > s.maxTimestamp {
+		s.maxTimestamp = e.timestamp
+	}
+	s.hasTimestamps = true
+	s.users.add(int64(e.uid))
+	s.changesets.add(e.changeset)
+}
+
+func (s *fileStats) print(w io.Writer) {
+	printElements := func(name string, es elementStats) {
+		if es.count == 0 {
+			fmt.Fprintf(w, "%-11s 0\n", name+":")
+		} else {
+			fmt.Fprintf(w, "%-11s %d (IDs %d to %d)\n", name+":", es.count, es.minID, es.maxID)
+		}
+	}
+	printElements("Nodes", s.nodes)
+	printElements("Ways", s.ways)
+	printElements("Relations", s.relations)
+	if s.hasTimestamps {
+		fmt.Fprintf(w, "Timestamps: %s to %s\n", formatTimestamp(s.minTimestamp), formatTimestamp(s.maxTimestamp))
+	} else {
+		fmt.Fprintln(w, "Timestamps: none")
+	}
+	fmt.Fprintf(w, "Users:      %d\n", s.users.len())
+	fmt.Fprintf(w, "Changesets: %d\n", s.changesets.len())
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTENT\tCOUNT\tCOMPRESSED\tUNCOMPRESSED\tRATIO")
+	var total sizeStats
+	printSizes := func(name string, sizes *sizeStats) {
+		ratio := float64(sizes.raw) / float64(max(sizes.compressed, 1))
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.2f\n", name, sizes.count, sizes.compressed, sizes.raw, ratio)
+	}
+	for _, blobType := range sortedKeys(s.blobTypes) {
+		sizes := s.blobTypes[blobType]
+		printSizes(blobType, sizes)
+		total.count += sizes.count
+		total.compressed += sizes.compressed
+		total.raw += sizes.raw
+		if blobType != "OSMData" {
+			continue
+		}
+		for _, name := range []string{"nodes", "ways", "relations", "other"} {
+			if sizes := s.groups[name]; sizes != nil {
+				printSizes("  "+name+" groups", sizes)
+			}
+		}
+	}
+	printSizes("total", &total)
+	tw.Flush()
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BLOB SIZE\tCOMPRESSED\tUNCOMPRESSED")
+	first, last := histogramRange(&s.compressedSizes, &s.rawSizes)
+	for i := first; i <= last; i++ {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", bucketLabel(i), s.compressedSizes[i], s.rawSizes[i])
+	}
+	tw.Flush()
+}
+
+// histogramBuckets is the number of buckets of a sizeHistogram. Bucket i
+// holds the sizes below 1KiB<<i, the last one all sizes from 32MiB on.
+const histogramBuckets = 17
+
+// sizeHistogram counts blobs by size in buckets between powers of two.
+type sizeHistogram [histogramBuckets]int64
+
+func (h *sizeHistogram) add(size int64) {
+	i := 0
+	for i < histogramBuckets-1 && size >= 1024<<i {
+		i++
+	}
+	h[i]++
+}
+
+// histogramRange returns the first and last bucket, that is used in any
+// of hs, or 0 and -1, if all are empty.
+func histogramRange(hs ...*sizeHistogram) (first, last int) {
+	first, last = histogramBuckets, -1
+	for _, h := range hs {
+		for i, n := range h {
+			if n > 0 {
+				first, last = min(first, i), max(last, i)
+			}
+		}
+	}
+	if last < 0 {
+		return 0, -1
+	}
+	return first, last
+}
+
+// bucketLabel describes the sizes in bucket i, e.g. "1K-2K".
+func bucketLabel(i int) string {
+	upper := byteSize(1024 << i)
+	if i == 0 {
+		return "<" + upper.String()
+	}
+	lower := byteSize(1024 << (i - 1))
+	if i == histogramBuckets-1 {
+		return ">=" + lower.String()
+	}
+	return lower.String() + "-" + upper.String()
+}
+
+// statsJSON is the JSON form of fileStats.
+type statsJSON struct {
+	Nodes        elementStatsJSON         `json:"nodes"`
+	Ways         elementStatsJSON         `json:"ways"`
+	Relations    elementStatsJSON         `json:"relations"`
+	MinTimestamp string                   `json:"min_timestamp,omitempty"`
+	MaxTimestamp string                   `json:"max_timestamp,omitempty"`
+	Users        int                      `json:"users"`
+	Changesets   int                      `json:"changesets"`
+	BlobTypes    map[string]sizeStatsJSON `json:"blob_types"`
+	Groups       map[string]sizeStatsJSON `json:"groups"`
+	Histogram    []histogramBucketJSON    `json:"blob_size_histogram"`
+}
+
+type elementStatsJSON struct {
+	Count int64 `json:"count"`
+	MinID int64 `json:"min_id"`
+	MaxID int64 `json:"max_id"`
+}
+
+type sizeStatsJSON struct {
+	Count        int64 `json:"count"`
+	Compressed   int64 `json:"compressed"`
+	Uncompressed int64 `json:"uncompressed"`
+}
+
+// histogramBucketJSON counts the blobs, whose size is at least Min and
+// below Max, which is omitted for the last bucket.
+type histogramBucketJSON struct {
+	Min          int64 `json:"min"`
+	Max          int64 `json:"max,omitempty"`
+	Compressed   int64 `json:"compressed"`
+	Uncompressed int64 `json:"uncompressed"`
+}
+
+func (s *fileStats) printJSON(w io.Writer) error {
+	elements := func(es elementStats) elementStatsJSON {
+		return elementStatsJSON{Count: es.count, MinID: es.minID, MaxID: es.maxID}
+	}
+	sizes := func(m map[string]*sizeStats) map[string]sizeStatsJSON {
+		out := make(map[string]sizeStatsJSON, len(m))
+		for key, ss := range m {
+			out[key] = sizeStatsJSON{Count: ss.count, Compressed: ss.compressed, Uncompressed: ss.raw}
+		}
+		return out
+	}
+	out := statsJSON{
+		Nodes:      elements(s.nodes),
+		Ways:       elements(s.ways),
+		Relations:  elements(s.relations),
+		Users:      s.users.len(),
+		Changesets: s.changesets.len(),
+		BlobTypes:  sizes(s.blobTypes),
+		Groups:     sizes(s.groups),
+		Histogram:  []histogramBucketJSON{},
+	}
+	if s.hasTimestamps {
+		out.MinTimestamp = formatTimestamp(s.minTimestamp)
+		out.MaxTimestamp = formatTimestamp(s.maxTimestamp)
+	}
+	first, last := histogramRange(&s.compressedSizes, &s.rawSizes)
+	for i := first; i <= last; i++ {
+		bucket := histogramBucketJSON{Compressed: s.compressedSizes[i], Uncompressed: s.rawSizes[i]}
+		if i > 0 {
+			bucket.Min = 1024 << (i - 1)
+		}
+		if i < histogramBuckets-1 {
+			bucket.Max = 1024 << i
+		}
+		out.Histogram = append(out.Histogram, bucket)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// sortedKeys returns the keys of m in order, but with OSMHeader and
+// OSMData first.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	rank := func(key string) int {
+		switch key {
+		case "OSMHeader":
+			return 0
+		case "OSMData":
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if rank(keys[i]) != rank(keys[j]) {
+			return rank(keys[i]) < rank(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func formatTimestamp(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+// idSet is a set of IDs. Non-negative IDs are stored in a bitmap, since
+// OSM IDs are dense and a map would need far more memory for a planet.
+type idSet struct {
+	bitmap   []uint64
+	n        int
+	negative map[int64]bool
+}
+
+func (s *idSet) add(id int64) {
+	if id < 0 {
+		if s.negative == nil {
+			s.negative = make(map[int64]bool)
+		}
+		if !s.negative[id] {
+			s.negative[id] = true
+			s.n++
+		}
+		return
+	}
+	i := int(id / 64)
+	if i >= len(s.bitmap) {
+		s.bitmap = append(s.bitmap, make([]uint64, i+1-len(s.bitmap)+len(s.bitmap)/4)...)
+	}
+	if bit := uint64(1) << (id % 64); s.bitmap[i]&bit == 0 {
+		s.bitmap[i] |= bit
+		s.n++
+	}
+}
+
+func (s *idSet) has(id int64) bool {
+	if id < 0 {
+		return s.negative[id]
+	}
+	i := int(id / 64)
+	return i < len(s.bitmap) && s.bitmap[i]&(uint64(1)<<(id%64)) != 0
+}
+
+func (s *idSet) len() int {
+	return s.n
+}
+
+func runStats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := flags.String("format", "text", "the output `format`: text or json")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf stats [-format text|json] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Print element counts, ID and timestamp ranges, the number of distinct\n"+
+			"users and changesets, the compressed and uncompressed sizes of the\n"+
+			"blob types and element groups and a histogram of the blob sizes.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	if *format != "text" && *format != "json" {
+		fatalCode(exitUsage, "Unknown format", "format", *format)
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	var stats fileStats
+	err = readBlobs(in, func(header *pbfproto.BlobHeader, rawData []byte) error {
+		if header.GetType() != "OSMData" {
+			stats.addBlob(header, rawData, nil)
+			return nil
+		}
+		block := &pbfproto.PrimitiveBlock{}
+		if err := proto.Unmarshal(rawData, block); err != nil {
+			return fmt.Errorf("could not parse PrimitiveBlock: %v", err)
+		}
+		stats.addBlob(header, rawData, block)
+		return visitElements(block, stats.add)
+	})
+	if err != nil {
+		fatalCode(inputCode(err), "Could not read file", "file", flags.Arg(0), "err", err)
+	}
+	if *format == "json" {
+		if err = stats.printJSON(os.Stdout); err != nil {
+			fatalCode(exitOutput, "Could not write statistics", "err", err)
+		}
+		return
+	}
+	stats.print(os.Stdout)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"google.golang.org/protobuf/proto"
+)
+
+// canonicalizeStringTable rebuilds the string table of block, so that
+// every string is contained only once, unused strings are dropped and
+// the most frequently referenced strings come first. Smaller string IDs
+// need fewer bytes as varints and similar blocks end up with similar
+// string tables, which helps compression.
+//
+// The entry at index 0 is reserved by the PBF format and always stays
+// an empty string.
+func canonicalizeStringTable(block *pbfproto.PrimitiveBlock) error {
+	if block.Stringtable == nil {
+		return fmt.Errorf("PrimitiveBlock has no string table")
+	}
+	table := block.Stringtable.S
+	counts := make([]int, len(table))
+	err := visitStringIDs(block, func(sid int) (int, error) {
+		if sid < 0 || sid >= len(table) {
+			return 0, fmt.Errorf("string ID %d out of range", sid)
+		}
+		counts[sid]++
+		return sid, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Merge the counts of duplicate strings. Index 0 is reserved.
+	uses := make(map[string]int)
+	for sid := 1; sid < len(table); sid++ {
+		if counts[sid] > 0 {
+			uses[string(table[sid])] += counts[sid]
+		}
+	}
+	strs := make([]string, 0, len(uses))
+	for s := range uses {
+		strs = append(strs, s)
+	}
+	sort.Slice(strs, func(i, j int) bool {
+		if uses[strs[i]] != uses[strs[j]] {
+			return uses[strs[i]] > uses[strs[j]]
+		}
+		return strs[i] < strs[j]
+	})
+	newIDs := make(map[string]int, len(strs))
+	newTable := make([][]byte, 1, len(strs)+1)
+	newTable[0] = []byte{}
+	for _, s := range strs {
+		newIDs[s] = len(newTable)
+		newTable = append(newTable, []byte(s))
+	}
+
+	visitStringIDs(block, func(sid int) (int, error) {
+		if sid == 0 {
+			return 0, nil
+		}
+		return newIDs[string(table[sid])], nil
+	})
+	block.Stringtable.S = newTable
+	return nil
+}
+
+// visitStringIDs calls f for every reference into the string table of
+// block and replaces the reference with the returned string ID.
+func visitStringIDs(block *pbfproto.PrimitiveBlock, f func(sid int) (int, error)) error {
+	for _, group := range block.Primitivegroup {
+		if err := visitGroupStringIDs(group, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitGroupStringIDs is like visitStringIDs, but only visits the
+// references within group.
+func visitGroupStringIDs(group *pbfproto.PrimitiveGroup, f func(sid int) (int, error)) error {
+	visitUint32s := func(sids []uint32) error {
+		for i, sid := range sids {
+			newSID, err := f(int(sid))
+			if err != nil {
+				return err
+			}
+			sids[i] = uint32(newSID)
+		}
+		return nil
+	}
+	visitInfo := func(info *pbfproto.Info) error {
+		if info == nil || info.UserSid == nil {
+			return nil
+		}
+		newSID, err := f(int(*info.UserSid))
+		if err != nil {
+			return err
+		}
+		info.UserSid = proto.Uint32(uint32(newSID))
+		return nil
+	}
+	for _, node := range group.Nodes {
+		if err := visitUint32s(node.Keys); err != nil {
+			return err
+		}
+		if err := visitUint32s(node.Vals); err != nil {
+			return err
+		}
+		if err := visitInfo(node.Info); err != nil {
+			return err
+		}
+	}
+	if dense := group.Dense; dense != nil {
+		// A string ID of 0 delimits the tags of consecutive nodes.
+		for i, sid := range dense.KeysVals {
+			if sid == 0 {
+				continue
+			}
+			newSID, err := f(int(sid))
+			if err != nil {
+				return err
+			}
+			dense.KeysVals[i] = int32(newSID)
+		}
+		if dense.Denseinfo != nil {
+			// User string IDs are delta coded.
+			var prev, newPrev int32
+			for i, delta := range dense.Denseinfo.UserSid {
+				sid := prev + delta
+				prev = sid
+				newSID, err := f(int(sid))
+				if err != nil {
+					return err
+				}
+				dense.Denseinfo.UserSid[i] = int32(newSID) - newPrev
+				newPrev = int32(newSID)
+			}
+		}
+	}
+	for _, way := range group.Ways {
+		if err := visitUint32s(way.Keys); err != nil {
+			return err
+		}
+		if err := visitUint32s(way.Vals); err != nil {
+			return err
+		}
+		if err := visitInfo(way.Info); err != nil {
+			return err
+		}
+	}
+	for _, relation := range group.Relations {
+		if err := visitUint32s(relation.Keys); err != nil {
+			return err
+		}
+		if err := visitUint32s(relation.Vals); err != nil {
+			return err
+		}
+		if err := visitInfo(relation.Info); err != nil {
+			return err
+		}
+		for i, sid := range relation.RolesSid {
+			newSID, err := f(int(sid))
+			if err != nil {
+				return err
+			}
+			relation.RolesSid[i] = int32(newSID)
+		}
+	}
+	return nil
+}
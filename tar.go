@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// memberSeparator separates the path of a tar archive from the member,
+// that is read from it, in IN_FILE.
+const memberSeparator = "::"
+
+// isTar reports whether r starts with the header of a POSIX or GNU tar
+// archive. r is rewound afterwards.
+func isTar(r io.ReadSeeker) (bool, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return n == len(buf) && bytes.HasPrefix(buf[257:], []byte("ustar")), nil
+}
+
+// tarMember reads a member of the tar archive in archive. Like a
+// wrappedFile, it can only be rewound, which searches the member again,
+// and report the position in the archive.
+type tarMember struct {
+	archive io.ReadSeeker
+	name    string
+	tr      *tar.Reader
+}
+
+// openTarMember opens the regular file name in archive. If name is
+// empty, the archive must contain a single PBF file or a single file.
+func openTarMember(archive io.ReadSeeker, name string) (*tarMember, error) {
+	if name == "" {
+		var err error
+		if name, err = soleTarMember(archive); err != nil {
+			return nil, err
+		}
+	}
+	m := &tarMember{archive: archive, name: path.Clean(name)}
+	if _, err := m.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// soleTarMember returns the name of the only PBF file in archive or of
+// its only file, if it contains no PBF file.
+func soleTarMember(archive io.ReadSeeker) (string, error) {
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	var files, pbfs []string
+	tr := newTarReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if header.Typeflag == tar.TypeReg {
+			files = append(files, header.Name)
+			if strings.HasSuffix(header.Name, ".pbf") {
+				pbfs = append(pbfs, header.Name)
+			}
+		}
+	}
+	switch {
+	case len(pbfs) == 1:
+		return pbfs[0], nil
+	case len(pbfs) == 0 && len(files) == 1:
+		return files[0], nil
+	case len(files) == 0:
+		return "", fmt.Errorf("the archive contains no files")
+	}
+	return "", fmt.Errorf("the archive contains %d files; select one with ARCHIVE%sMEMBER", len(files), memberSeparator)
+}
+
+// newTarReader returns a tar.Reader for archive. It only lets the reader
+// seek over members in plain files, since decompressing readers can't
+// seek.
+func newTarReader(archive io.Reader) *tar.Reader {
+	if f, ok := archive.(*os.File); ok {
+		return tar.NewReader(f)
+	}
+	return tar.NewReader(struct{ io.Reader }{archive})
+}
+
+func (m *tarMember) Read(p []byte) (int, error) {
+	return m.tr.Read(p)
+}
+
+func (m *tarMember) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || (whence != io.SeekStart && whence != io.SeekCurrent) {
+		return 0, fmt.Errorf("a member of an archive can only be rewound")
+	}
+	if whence == io.SeekCurrent {
+		return m.archive.Seek(0, io.SeekCurrent)
+	}
+	if _, err := m.archive.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	m.tr = newTarReader(m.archive)
+	for {
+		header, err := m.tr.Next()
+		if err == io.EOF {
+			return 0, fmt.Errorf("%s is not in the archive", m.name)
+		} else if err != nil {
+			return 0, err
+		}
+		if path.Clean(header.Name) == m.name {
+			if header.Typeflag != tar.TypeReg {
+				return 0, fmt.Errorf("%s is not a regular file", m.name)
+			}
+			return 0, nil
+		}
+	}
+}
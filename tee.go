@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/codesoap/zstd-pbf/pbf"
+	"github.com/codesoap/zstd-pbf/pbfproto"
+)
+
+// alsoWrite is a second output, that receives the same blobs as the
+// main output, compressed with alsoCodec.
+var alsoWrite string
+var alsoCodec = codecZlib
+
+// tee writes the blobs of the conversion to alsoWrite, if it is given.
+var tee *teeWriter
+
+type teeWriter struct {
+	f     *os.File
+	codec string
+	blobs int
+}
+
+// write compresses rawData with the codec of t and writes it as a blob
+// of blobType.
+func (t *teeWriter) write(blobType string, rawData []byte) error {
+	began := time.Now()
+	blob, err := compressData(rawData, t.codec)
+	if err != nil {
+		return fmt.Errorf("could not compress Blob: %v", err)
+	}
+	times.compress += time.Since(began)
+	rawBlob, err := marshalFraming(blob)
+	if err != nil {
+		return fmt.Errorf("could not serialize Blob: %v", err)
+	}
+	return t.writeRaw(blobType, rawBlob)
+}
+
+// writeOriginal writes rawBlob, the serialized blob as read from the
+// input. It is only recompressed, if it doesn't use the codec of t.
+func (t *teeWriter) writeOriginal(blobType string, rawBlob []byte, blob *pbfproto.Blob) error {
+	if pbf.Codec(blob) == t.codec {
+		return t.writeRaw(blobType, rawBlob)
+	}
+	rawData, err := pbf.Decompress(blob)
+	if err != nil {
+		return fmt.Errorf("could not decompress Blob: %v", err)
+	}
+	return t.write(blobType, rawData)
+}
+
+func (t *teeWriter) writeRaw(blobType string, rawBlob []byte) error {
+	began := time.Now()
+	datasize := int32(len(rawBlob))
+	header := &pbfproto.BlobHeader{Type: &blobType, Datasize: &datasize}
+	if err := writeBlobHeader(header, t.f); err != nil {
+		return fmt.Errorf("could not write BlobHeader: %v", err)
+	}
+	if _, err := t.f.Write(rawBlob); err != nil {
+		return fmt.Errorf("could not write Blob: %v", err)
+	}
+	times.write += time.Since(began)
+	writeLimit.wait(4 + header.SizeVT() + len(rawBlob))
+	t.blobs++
+	return nil
+}
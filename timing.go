@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// stageTimes is the time spent in the stages of a conversion.
+type stageTimes struct {
+	read       time.Duration
+	decompress time.Duration
+	transform  time.Duration
+	marshal    time.Duration
+	compress   time.Duration
+	write      time.Duration
+}
+
+var times stageTimes
+
+// since returns the time since began and advances began to now, so that
+// consecutive stages can be timed with a single variable.
+func since(began *time.Time) time.Duration {
+	now := time.Now()
+	d := now.Sub(*began)
+	*began = now
+	return d
+}
+
+// log reports the stage times of a conversion, that took total, which
+// shows whether it was bound by I/O, decoding or encoding.
+func (t *stageTimes) log(total time.Duration) {
+	other := total - t.read - t.decompress - t.transform - t.marshal - t.compress - t.write
+	slog.Info("Time spent", "read", t.read, "decompress", t.decompress, "transform", t.transform,
+		"marshal", t.marshal, "compress", t.compress, "write", t.write, "other", other, "total", total)
+}
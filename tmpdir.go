@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// tmpDir is the directory for temporary files. If it is empty, the
+// directory of the system is used, which can be changed with TMPDIR.
+var tmpDir string
+
+// minTempSpace is the free space, that the directory for temporary files
+// must have at least, so that a nearly full disk is noticed before the
+// work starts instead of midway.
+const minTempSpace = 256 << 20
+
+// makeTempDir creates a new directory for temporary files in tmpDir,
+// after checking, that it has at least need bytes of free space.
+func makeTempDir(prefix string, need int64) (string, error) {
+	parent := tmpDir
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	free, ok, err := freeSpace(parent)
+	if err != nil {
+		return "", fmt.Errorf("could not check the free space of %s: %v", parent, err)
+	}
+	if ok {
+		slog.Debug("Checked space for temporary files", "dir", parent, "free_bytes", free, "needed_bytes", need)
+		if free < need {
+			return "", fmt.Errorf("only %d bytes are free in %s, but %d are needed; choose another directory with -tmpdir", free, parent, need)
+		}
+	}
+	return os.MkdirTemp(parent, prefix)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the server commands. Until setupTracing
+// has been called, they are discarded.
+var tracer = otel.Tracer("github.com/codesoap/zstd-pbf")
+
+// addTracingFlag adds the flag, that enables the export of spans, to the
+// flags of a server command.
+func addTracingFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("otlp", false, "export OpenTelemetry spans via OTLP over gRPC, configured by the standard\nOTEL_EXPORTER_OTLP_* environment variables")
+}
+
+// setupTracing exports spans via OTLP, if enabled is true. The returned
+// function flushes the remaining spans.
+func setupTracing(enabled bool) (func(), error) {
+	if !enabled {
+		return func() {}, nil
+	}
+	ctx := context.Background()
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("zstd-pbf"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() { provider.Shutdown(ctx) }, nil
+}
+
+// startBlobSpan starts the span of recompressing blob index, which began
+// at the given time with reading the blob.
+func startBlobSpan(ctx context.Context, index int, began time.Time) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "recompress blob",
+		trace.WithTimestamp(began), trace.WithAttributes(attribute.Int("blob.index", index)))
+	_, read := tracer.Start(ctx, "read", trace.WithTimestamp(began))
+	read.End()
+	return ctx, span
+}
+
+// traced runs f in a child span of ctx, which records the error of f.
+func traced(ctx context.Context, name string, f func() error) error {
+	_, span := tracer.Start(ctx, name)
+	defer span.End()
+	err := f()
+	if err != nil && err != io.EOF {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/codesoap/zstd-pbf/pbfproto"
+	"github.com/klauspost/compress/zstd"
+)
+
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	manifestPath := flags.String("manifest", "", "compare the uncompressed data of every blob to the hashes in this `file`")
+	quick := flags.Bool("quick", false, "only check the footer, without decompressing the blobs")
+	references := flags.Bool("references", false, "check, that all way nodes and relation members are in the file, which reads\nit twice")
+	deep := flags.Bool("deep", false, "check the structure of every DenseNodes group: the lengths of its arrays,\nthe termination of keys_vals, the string IDs, DenseInfo and, if the OSMHeader\nclaims it, the order of the IDs")
+	duplicates := flags.Bool("duplicates", false, "report objects, whose type, ID and version appear more than once, which\nreads the file twice")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf verify [-quick] [-manifest FILE] [-references] [-duplicates] [-deep] <IN_FILE>")
+		fmt.Fprintln(os.Stderr, "Decompress every blob of IN_FILE and check the footer, if there is\n"+
+			"one, to check the integrity of the file.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 1 {
+		fatalCode(exitUsage, "Give exactly one argument: The input PBF file")
+	}
+	var entries []manifestEntry
+	if *manifestPath != "" {
+		var err error
+		if entries, err = readManifest(*manifestPath); err != nil {
+			fatalCode(inputCode(err), "Could not read manifest", "file", *manifestPath, "err", err)
+		}
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalCode(exitInput, "Could not open file", "file", flags.Arg(0), "err", err)
+	}
+	defer in.Close()
+	found, blobs, err := checkFooter(in)
+	if err != nil {
+		fmt.Printf("Footer check failed: %v.\n", err)
+		fatalCode(exitMismatch, "Verification failed")
+	} else if found {
+		fmt.Printf("Footer matches %d blobs.\n", blobs)
+	} else if *quick {
+		fmt.Println("The file has no footer.")
+		fatalCode(exitMismatch, "Verification failed")
+	}
+	if *quick {
+		return
+	}
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		fatalCode(inputCode(err), "Could not read file", "file", flags.Arg(0), "err", err)
+	}
+	blobs, mismatches := 0, 0
+	// The content checksums of zstd frames are checked while decompressing.
+	zstdBlobs, checksums := 0, 0
+	var structure *structureCheck
+	if *deep {
+		structure = &structureCheck{}
+	}
+	err = forEachBlob(in, func(header *pbfproto.BlobHeader, blob *pbfproto.Blob, rawData []byte) error {
+		if header.GetType() == footerBlobType {
+			return nil
+		}
+		if data, ok := blob.Data.(*pbfproto.Blob_ZstdData); ok {
+			var frame zstd.Header
+			if frame.Decode(data.ZstdData) == nil && frame.HasCheckSum {
+				checksums++
+			}
+			zstdBlobs++
+		}
+		index := blobs
+		blobs++
+		if structure != nil {
+			var err error
+			switch header.GetType() {
+			case "OSMHeader":
+				err = structure.header(rawData)
+			case "OSMData":
+				err = structure.check(index, rawData)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if entries == nil {
+			return nil
+		}
+		if index >= len(entries) {
+			fmt.Printf("Blob %d: not in the manifest.\n", index)
+			mismatches++
+			return nil
+		}
+		entry := entries[index]
+		if header.GetType() != entry.blobType {
+			fmt.Printf("Blob %d: type is %s, but %s in the manifest.\n", index, header.GetType(), entry.blobType)
+			mismatches++
+		} else if fmt.Sprintf("%x", sha256.Sum256(rawData)) != entry.hash {
+			fmt.Printf("Blob %d: hash does not match the manifest.\n", index)
+			mismatches++
+		}
+		return nil
+	})
+	if err != nil {
+		fatalCode(inputCode(err), "Could not read file", "file", flags.Arg(0), "err", err)
+	}
+	if entries != nil && blobs < len(entries) {
+		fmt.Printf("The file has %d blobs, but the manifest lists %d.\n", blobs, len(entries))
+		mismatches++
+	}
+	if structure != nil {
+		for _, example := range structure.examples {
+			fmt.Println(example)
+		}
+		if structure.problems > 0 {
+			fmt.Printf("The DenseNodes have %d structural problems.\n", structure.problems)
+			mismatches++
+		} else {
+			fmt.Println("The DenseNodes are well-formed.")
+		}
+	}
+	if *references {
+		c, err := checkReferences(in)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read file", "file", flags.Arg(0), "err", err)
+		}
+		for _, example := range c.examples {
+			fmt.Println(example)
+		}
+		if c.missing > 0 {
+			fmt.Printf("%d ways and %d relations reference %d missing objects.\n", c.brokenWays, c.brokenRelations, c.missing)
+			mismatches++
+		} else {
+			fmt.Println("All references are in the file.")
+		}
+	}
+	if *duplicates {
+		c, err := checkDuplicates(in)
+		if err != nil {
+			fatalCode(inputCode(err), "Could not read file", "file", flags.Arg(0), "err", err)
+		}
+		for _, example := range c.examples {
+			fmt.Println(example)
+		}
+		if c.duplicates > 0 {
+			fmt.Printf("%d object versions appear more than once; drop the copies with -dedupe.\n", c.duplicates)
+			mismatches++
+		} else {
+			fmt.Println("No object version appears more than once.")
+		}
+	}
+	if mismatches > 0 {
+		fatalCode(exitMismatch, "Verification failed", "problems", mismatches)
+	}
+	if zstdBlobs > 0 {
+		fmt.Printf("%d of %d zstd blobs have a content checksum.\n", checksums, zstdBlobs)
+	}
+	fmt.Printf("Verified %d blobs.\n", blobs)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// showVersion makes the conversion print the version instead.
+var showVersion bool
+
+// zstdModule is the module, whose zstd encoder and decoder are used.
+const zstdModule = "github.com/klauspost/compress"
+
+// buildVersion describes the build of the running binary.
+type buildVersion struct {
+	version   string // Of the module, or "(devel)" for local builds.
+	commit    string
+	time      string // Of the commit.
+	modified  bool   // Whether the working tree had uncommitted changes.
+	goVersion string
+	zstd      string // The version of zstdModule.
+}
+
+func readBuildVersion() buildVersion {
+	v := buildVersion{version: "unknown", goVersion: runtime.Version(), zstd: "unknown"}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.version = info.Main.Version
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.commit = s.Value
+		case "vcs.time":
+			v.time = s.Value
+		case "vcs.modified":
+			v.modified = s.Value == "true"
+		}
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != zstdModule {
+			continue
+		}
+		v.zstd = dep.Version
+		if dep.Replace != nil {
+			v.zstd = fmt.Sprintf("%s => %s %s", dep.Version, dep.Replace.Path, dep.Replace.Version)
+		}
+	}
+	return v
+}
+
+func writeVersion(w io.Writer) {
+	v := readBuildVersion()
+	fmt.Fprintln(w, "zstd-pbf", v.version)
+	switch {
+	case v.commit == "":
+		fmt.Fprintln(w, "commit:  unknown")
+	case v.modified:
+		fmt.Fprintf(w, "commit:  %s (%s, modified)\n", v.commit, v.time)
+	default:
+		fmt.Fprintf(w, "commit:  %s (%s)\n", v.commit, v.time)
+	}
+	fmt.Fprintf(w, "go:      %s %s/%s\n", v.goVersion, runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(w, "zstd:    %s %s\n", zstdModule, v.zstd)
+}
+
+func runVersion(args []string) {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:\n  zstd-pbf version")
+		fmt.Fprintln(os.Stderr, "Print the version and commit of zstd-pbf, the Go version it was built\n"+
+			"with and the version of the zstd library, for bug reports.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+	if flags.NArg() != 0 {
+		fatalCode(exitUsage, "The version command takes no arguments")
+	}
+	writeVersion(os.Stdout)
+}
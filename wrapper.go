@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Whole-file compressions, that some mirrors wrap PBF and OSM XML files
+// in, and age encryption. A PBF file starts with the big-endian size of the first
+// BlobHeader, so its first byte is zero and can't be mistaken for their
+// magic bytes.
+const (
+	wrapperGzip  = "gzip"
+	wrapperZstd  = "zstd"
+	wrapperBzip2 = "bzip2"
+	wrapperAge   = "age"
+)
+
+var wrapperMagic = map[string][][]byte{
+	wrapperGzip:  {{0x1f, 0x8b}},
+	wrapperZstd:  {{0x28, 0xb5, 0x2f, 0xfd}},
+	wrapperBzip2: {[]byte("BZh")},
+	wrapperAge:   {[]byte("age-encryption.org/v1\n"), []byte("-----BEGIN AGE ENCRYPTED FILE-----")},
+}
+
+// sniffWrapper returns the wrapper of f or "", if f is a plain PBF
+// file. f is rewound afterwards.
+func sniffWrapper(f io.ReadSeeker) (string, error) {
+	buf := make([]byte, 64)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	for wrapper, magics := range wrapperMagic {
+		for _, magic := range magics {
+			if bytes.HasPrefix(buf[:n], magic) {
+				return wrapper, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// wrappedFile reads the PBF file, that is wrapped in the compressed or
+// encrypted file f. It can only seek to the start, which restarts the
+// decompression or decryption, and report the position in f, so that
+// progress relates to the size of f.
+type wrappedFile struct {
+	f     *os.File
+	gz    *gzip.Reader
+	zstd  *zstd.Decoder
+	bzip2 io.Reader
+	age   *ageDecrypter
+}
+
+func newWrappedFile(f *os.File, wrapper string) (*wrappedFile, error) {
+	w := &wrappedFile{f: f}
+	var err error
+	switch wrapper {
+	case wrapperGzip:
+		w.gz, err = gzip.NewReader(f)
+	case wrapperZstd:
+		w.zstd, err = zstd.NewReader(f)
+	case wrapperBzip2:
+		w.bzip2 = bzip2.NewReader(f)
+	case wrapperAge:
+		w.age, err = startDecryption(f)
+	default:
+		err = fmt.Errorf("unknown wrapper '%s'", wrapper)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wrappedFile) Read(p []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Read(p)
+	case w.bzip2 != nil:
+		return w.bzip2.Read(p)
+	case w.age != nil:
+		return w.age.Read(p)
+	}
+	return w.zstd.Read(p)
+}
+
+func (w *wrappedFile) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || (whence != io.SeekStart && whence != io.SeekCurrent) {
+		return 0, fmt.Errorf("a compressed input can only be rewound")
+	}
+	if whence == io.SeekCurrent {
+		return w.f.Seek(0, io.SeekCurrent)
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	switch {
+	case w.gz != nil:
+		return 0, w.gz.Reset(w.f)
+	case w.bzip2 != nil:
+		w.bzip2 = bzip2.NewReader(w.f)
+		return 0, nil
+	case w.age != nil:
+		w.age.Close()
+		var err error
+		w.age, err = startDecryption(w.f)
+		return 0, err
+	}
+	return 0, w.zstd.Reset(w.f)
+}
+
+// Close releases the decompressor or stops age, but leaves f open.
+func (w *wrappedFile) Close() error {
+	switch {
+	case w.gz != nil:
+		return w.gz.Close()
+	case w.bzip2 != nil:
+		return nil
+	case w.age != nil:
+		return w.age.Close()
+	}
+	w.zstd.Close()
+	return nil
+}